@@ -75,6 +75,19 @@ func main() {
 
 	// 4. Подготовка каналов и генератора метрик
 	metricsGen := runtimemetrics.NewRuntimeUpdater(svc, cfg.RateLimit, pubKey)
+	metricsGen.SetAuthToken(cfg.Token)
+	metricsGen.SetTenant(cfg.Tenant)
+	if host, err := os.Hostname(); err == nil {
+		metricsGen.SetAgentID(host)
+	}
+
+	// Объявляем на сервере единицы и описания собираемых метрик (не блокируя сбор)
+	baseURL := fmt.Sprintf("http://%v%v", cfg.GetHost(), cfg.GetPort())
+	go func() {
+		if err := metricsGen.SendMetadata(ctx, baseURL, cfg.Key, runtimemetrics.RuntimeMetadata); err != nil {
+			log.Printf("WARN: send metrics metadata: %v", err)
+		}
+	}()
 
 	// Каналы для сигналов от тикеров
 	pollCh1 := make(chan struct{})
@@ -10,6 +10,7 @@ import (
 	_ "net/http/pprof" // Import pprof for profiling
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -17,16 +18,26 @@ import (
 	httpSwagger "github.com/swaggo/http-swagger"
 
 	"gometrics/configs"
+	"gometrics/internal/alerting"
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/audit"
+	"gometrics/internal/auth"
 	myCompress "gometrics/internal/compress"
 	"gometrics/internal/db"
 	"gometrics/internal/handlers"
+	"gometrics/internal/idempotency"
 	"gometrics/internal/logger"
+	"gometrics/internal/metadata"
+	"gometrics/internal/metricname"
 	"gometrics/internal/persist"
+	"gometrics/internal/ratelimit"
 	"gometrics/internal/retry"
 	"gometrics/internal/serverconfig"
 	"gometrics/internal/service"
 	"gometrics/internal/signature"
+	"gometrics/internal/staleness"
 	"gometrics/internal/storage"
+	"gometrics/internal/tenant"
 	_ "gometrics/swagger"
 
 	"github.com/go-chi/chi/v5"
@@ -53,6 +64,14 @@ const shutdownTimeout = 10 * time.Second
 
 func main() {
 	fmt.Println(configs.BuildVerPrint())
+	// "gometrics-server migrate ..." manages the database schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	// 1. Initialize configuration
 	f := serverconfig.InitialFlags()
 	f.ParseFlags()
@@ -72,8 +91,13 @@ func main() {
 		newLogger.Warnf("retry attempt %d failed: %v; next retry in %v", attempt, err, delay)
 	}
 
-	// 4. Initialize In-Memory Storage (Primary Storage)
-	newStorage := storage.NewMemStorage()
+	// 4. Initialize In-Memory Storage (Primary Storage), sharded if configured
+	// Metric names are normalised by one policy in memory, in the service and in persistence
+	names, err := metricname.ParsePolicy(f.MetricNamePolicy)
+	if err != nil {
+		panic(err)
+	}
+	newStorage := storage.New(f.StorageShards, names)
 
 	var (
 		pstore  *persist.PersistStorage
@@ -101,10 +125,30 @@ func main() {
 			// but logic here implies "don't use file flush loop")
 			if dbStore != nil {
 				f.StoreInter = 0
+				if err := dbStore.SetNamePolicy(ctx, names); err != nil {
+					panic(fmt.Errorf("migrate metric names: %w", err))
+				}
 			}
 		}
 	}
 
+	// Snapshot encryption keys: SNAPSHOT_KEY takes precedence over the key file
+	var snapshotKeys []signature.AESKey
+	switch {
+	case f.SnapshotKey != "":
+		keys, err := signature.ParseAESKeys(f.SnapshotKey)
+		if err != nil {
+			panic(fmt.Errorf("SNAPSHOT_KEY: %w", err))
+		}
+		snapshotKeys = keys
+	case f.SnapshotKeyFile != "":
+		keys, err := signature.GetAESKeys(f.SnapshotKeyFile)
+		if err != nil {
+			panic(fmt.Errorf("load snapshot keys: %w", err))
+		}
+		snapshotKeys = keys
+	}
+
 	// Fallback to File Storage if DB is not available
 	if dbStore == nil {
 		persistResult, persistErr := retryCfg.Retry(ctx, func(args ...any) (any, error) {
@@ -118,6 +162,14 @@ func main() {
 		}
 
 		pstore = persistResult.(*persist.PersistStorage)
+		pstore.SetNamePolicy(names)
+		pstore.SetGenerations(f.SnapshotGenerations)
+		if err := pstore.SetFormat(f.SnapshotFormat, f.SnapshotCompression); err != nil {
+			panic(fmt.Errorf("init persist storage: %w", err))
+		}
+		if err := pstore.SetEncryption(snapshotKeys); err != nil {
+			panic(fmt.Errorf("init persist storage: %w", err))
+		}
 	}
 
 	// 6. Initialize Business Logic Service
@@ -127,6 +179,136 @@ func main() {
 	} else {
 		newService = service.NewService(newStorage, pstore)
 	}
+	newService.SetNamePolicy(names)
+
+	// 6a. Series TTL (expired series are evicted by the janitor) and timestamp skew
+	ttlPolicy := service.TTLPolicy{Default: time.Duration(f.MetricTTL) * time.Second}
+	for pattern, secs := range f.MetricTTLPatterns {
+		if ttlPolicy.Patterns == nil {
+			ttlPolicy.Patterns = make(map[string]time.Duration)
+		}
+		ttlPolicy.Patterns[pattern] = time.Duration(secs) * time.Second
+	}
+	newService.SetTTLPolicy(ttlPolicy)
+	newService.SetMaxFutureSkew(time.Duration(f.MaxFutureSkew) * time.Second)
+
+	// 6a. Persistence mode: in async mode a background writer per service
+	// persists the dirty series; it is stopped (with a final write) on shutdown.
+	var (
+		writers                 sync.WaitGroup
+		writerCtx, writerCancel = context.WithCancel(ctx)
+		startWriter             func(svc *service.Service)
+	)
+	defer writerCancel()
+	switch f.PersistMode {
+	case service.PersistSync:
+		startWriter = func(*service.Service) {}
+	case service.PersistAsync:
+		flushPolicy := service.FlushPolicy{
+			MaxDelay:   time.Duration(f.FlushDelayMs) * time.Millisecond,
+			BatchSize:  f.FlushBatch,
+			MaxPending: f.FlushMaxPending,
+		}
+		startWriter = func(svc *service.Service) {
+			svc.EnableAsyncFlush(flushPolicy)
+			writers.Add(1)
+			go func() {
+				defer writers.Done()
+				svc.RunWriter(writerCtx)
+			}()
+		}
+	default:
+		panic(fmt.Errorf("unknown PERSIST_MODE %q: want %q or %q", f.PersistMode, service.PersistSync, service.PersistAsync))
+	}
+
+	// 6a. Counter mode: in database mode counter increments are added in the DB
+	// and totals read back through a short cache, so replicas sharing it converge.
+	var shareCounters func(svc *service.Service) error
+	switch f.CounterMode {
+	case service.CountersLocal:
+		shareCounters = func(*service.Service) error { return nil }
+	case service.CountersDatabase:
+		if dbStore == nil {
+			panic(fmt.Errorf("COUNTER_MODE %q needs a database (-d or DATABASE_DSN)", f.CounterMode))
+		}
+		shareCounters = func(svc *service.Service) error {
+			return svc.EnableSharedCounters(time.Duration(f.CounterCacheMs) * time.Millisecond)
+		}
+	default:
+		panic(fmt.Errorf("unknown COUNTER_MODE %q: want %q or %q", f.CounterMode, service.CountersLocal, service.CountersDatabase))
+	}
+	if err := shareCounters(newService); err != nil {
+		panic(fmt.Errorf("init counters: %w", err))
+	}
+	startWriter(newService)
+
+	// 6b. Staleness tracking; restored series turn stale unless updated again
+	var tracker *staleness.Tracker
+	if f.StaleWindow > 0 {
+		tracker = staleness.NewTracker(time.Duration(f.StaleWindow) * time.Second)
+		tracker.SetNamePolicy(names)
+	}
+	seedStale := func(ctx context.Context, name string, svc *service.Service) {
+		if tracker == nil {
+			return
+		}
+		gauges, counters, _ := svc.GetAllMetrics(ctx)
+		tracker.Seed(name, metricsdto.MetricTypeGauge, gauges)
+		tracker.Seed(name, metricsdto.MetricTypeCounter, counters)
+	}
+
+	// 6c. Tenant registry: the default tenant is served by newService,
+	// others get their own storage (DB schema or file sub-directory) on first use.
+	var tenantFactory tenant.Factory
+	if f.MultiTenant {
+		tenantFactory = func(ctx context.Context, name string) (*service.Service, error) {
+			var svc *service.Service
+			if dbStore != nil {
+				tenantDB, err := dbStore.ForTenant(ctx, name)
+				if err != nil {
+					return nil, err
+				}
+				if err := tenantDB.SetNamePolicy(ctx, names); err != nil {
+					return nil, err
+				}
+				svc = service.NewService(storage.New(f.StorageShards, names), tenantDB)
+			} else {
+				tenantFile, err := persist.NewPersistStorage(filepath.Join(f.FilePath, "tenants", name), f.StoreInter)
+				if err != nil {
+					return nil, err
+				}
+				tenantFile.SetNamePolicy(names)
+				tenantFile.SetGenerations(f.SnapshotGenerations)
+				if err := tenantFile.SetFormat(f.SnapshotFormat, f.SnapshotCompression); err != nil {
+					return nil, err
+				}
+				if err := tenantFile.SetEncryption(snapshotKeys); err != nil {
+					return nil, err
+				}
+				svc = service.NewService(storage.New(f.StorageShards, names), tenantFile)
+			}
+			svc.SetNamePolicy(names)
+			svc.SetTTLPolicy(ttlPolicy)
+			svc.SetMaxFutureSkew(time.Duration(f.MaxFutureSkew) * time.Second)
+			if err := shareCounters(svc); err != nil {
+				return nil, err
+			}
+			startWriter(svc)
+			if f.Restore {
+				if err := svc.PersistRestore(ctx); err != nil {
+					newLogger.Warnln("restore tenant", name, "metrics:", err)
+				}
+				seedStale(ctx, name, svc)
+			}
+			return svc, nil
+		}
+	}
+	tenants := tenant.NewRegistry(newService, tenantFactory, tenant.Limits{
+		MaxTenants: f.MaxTenants,
+		MaxSeries:  f.MaxSeries,
+		Series:     f.TenantMaxSeries,
+	})
+	tenants.SetContext(ctx)
 
 	// 7. Setup HTTP Router & Middleware
 	newMux := chi.NewMux()
@@ -141,19 +323,129 @@ func main() {
 
 	newMux.Use(myCompress.GzipHandleReader) // Request decompression
 
-	newMux.Mount("/swagger", httpSwagger.WrapHandler)
-
-	// Mount profiler for debugging
-	newMux.Mount("/debug", middleware.Profiler())
-
 	// 8. Initialize Handlers
 	newHandler := handlers.NewHandlerService(newService, newMux)
+	newHandler.SetNamePolicy(names)
+
+	// API docs and the profiler need an admin token when authentication is enabled
+	newHandler.MountAdmin("/swagger", httpSwagger.WrapHandler)
+	newHandler.MountAdmin("/debug", middleware.Profiler())
+
+	// 8a. Token authentication (file has priority over DB)
+	var authStore auth.Store
+	switch {
+	case f.AuthFile != "":
+		authStore, err = auth.NewFileStore(f.AuthFile)
+	case f.AuthDB && dbStore != nil:
+		authStore = auth.NewDBStore(dbStore.DB)
+	case f.AuthDB:
+		err = errors.New("auth-db requires a database connection")
+	}
+	if err != nil {
+		panic(fmt.Errorf("init auth store: %w", err))
+	}
+	if authStore != nil {
+		newHandler.SetAuthenticator(auth.NewAuthenticator(authStore))
+	}
+	// 8b. Ingestion limits and Idempotency-Key deduplication on the update routes
+	if f.RateLimitRPS > 0 {
+		keyFunc, err := ratelimit.KeyFuncFor(f.RateLimitKey)
+		if err != nil {
+			panic(fmt.Errorf("init rate limiter: %w", err))
+		}
+		newHandler.SetRateLimiter(ratelimit.NewLimiter(f.RateLimitRPS, f.RateLimitBurst, keyFunc))
+	}
+	newHandler.SetMaxBodySize(f.MaxBodySize)
+	if f.IdempotencyTTL > 0 {
+		ttl := time.Duration(f.IdempotencyTTL) * time.Second
+		var idemStore idempotency.Store = idempotency.NewMemoryStore(ttl, f.IdempotencyMaxKeys)
+		if f.IdempotencyDB && dbStore != nil {
+			idemStore = idempotency.NewDBStore(dbStore.DB, ttl)
+		}
+		newHandler.SetIdempotency(idempotency.NewGuard(idemStore))
+	}
+
+	// 8c. Audit of metric updates
+	var auditObservers []audit.Observer
+	if f.AuditFile != "" {
+		fileObserver, err := audit.NewFileObserver(f.AuditFile)
+		if err != nil {
+			panic(fmt.Errorf("init audit file: %w", err))
+		}
+		auditObservers = append(auditObservers, fileObserver)
+	}
+	if f.AuditURL != "" {
+		auditObservers = append(auditObservers, audit.NewHTTPObserver(f.AuditURL))
+	}
+	var auditor *audit.Publisher
+	if len(auditObservers) > 0 {
+		auditor = audit.NewPublisher(0, auditObservers...)
+		newHandler.SetAuditor(auditor)
+	}
+
+	// 8d. Alerting rules, evaluated against the default tenant
+	if f.AlertRules != "" {
+		rulesFile, err := alerting.Load(f.AlertRules)
+		if err != nil {
+			panic(fmt.Errorf("init alerting: %w", err))
+		}
+		if f.AlertInterval <= 0 {
+			panic(fmt.Errorf("please, set ALERT_INTERVAL > 0"))
+		}
+		dispatcher, err := rulesFile.Notify.Dispatcher()
+		if err != nil {
+			panic(fmt.Errorf("init alert notifiers: %w", err))
+		}
+		var source alerting.Source = newService
+		if tracker != nil {
+			source = tracker.WithSelfMetrics(tenant.Default, newService)
+		}
+		engine := alerting.NewEngine(source, rulesFile.Rules)
+		if dispatcher != nil {
+			engine.SetDispatcher(dispatcher)
+		}
+		go engine.Run(ctx, time.Duration(f.AlertInterval)*time.Second)
+		newHandler.SetAlertEngine(engine)
+	}
+
+	// 8e. Metric metadata, shared by all tenants and kept by the default storage
+	var metaStore metadata.Store = pstore
+	if dbStore != nil {
+		metaStore = dbStore
+	}
+	metaRegistry := metadata.NewRegistry(metaStore)
+	metaRegistry.SetNamePolicy(names)
+	if err := metaRegistry.Load(ctx); err != nil {
+		newLogger.Warnln("load metrics metadata:", err)
+	}
+	newHandler.SetMetadata(metaRegistry)
+
+	if f.MultiTenant {
+		newHandler.SetTenantResolver(func(ctx context.Context, name string) (handlers.Service, error) {
+			return tenants.Get(ctx, name)
+		})
+	}
 
 	// 9. Restore Metrics from persistent storage if enabled
 	if f.Restore {
 		if err := newService.PersistRestore(ctx); err != nil {
 			newLogger.Warnln("restore persisted metrics: ", err)
 		}
+		seedStale(ctx, tenant.Default, newService)
+	}
+	if tracker != nil {
+		newHandler.SetStaleness(tracker, f.HideStale)
+	}
+	if (f.MetricTTL > 0 || len(f.MetricTTLPatterns) > 0) && f.JanitorInterval > 0 {
+		var onEvict tenant.EvictFunc
+		if tracker != nil {
+			onEvict = func(name string, evicted []metricsdto.Metrics) {
+				for _, m := range evicted {
+					tracker.Forget(name, m.MType, m.ID)
+				}
+			}
+		}
+		go tenants.LoopEvict(ctx, time.Duration(f.JanitorInterval)*time.Second, onEvict)
 	}
 
 	// 10. Setup signal handling for graceful shutdown
@@ -172,7 +464,7 @@ func main() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := newService.LoopFlushWithContext(flushCtx); err != nil {
+			if err := tenants.LoopFlush(flushCtx, time.Duration(f.StoreInter)*time.Second); err != nil {
 				// Игнорируем ошибку отмены контекста
 				if !errors.Is(err, context.Canceled) {
 					newLogger.Errorln("flush loop error:", err)
@@ -213,17 +505,30 @@ func main() {
 			newLogger.Errorln("server shutdown error:", err)
 		}
 
+		// Доставляем оставшиеся события аудита
+		if auditor != nil {
+			if err := auditor.Close(shutdownCtx); err != nil {
+				newLogger.Errorln("audit close error:", err)
+			}
+		}
+
 		// Ждём завершения всех горутин
 		wg.Wait()
 
+		// Останавливаем фоновых писателей (они дописывают изменённые серии)
+		writerCancel()
+		writers.Wait()
+
 		// Финальный flush данных перед закрытием
 		newLogger.Infoln("Flushing remaining data...")
-		if err := newService.PersistFlush(context.Background()); err != nil {
+		if err := tenants.Flush(context.Background()); err != nil {
 			newLogger.Errorln("final flush error:", err)
 		}
 
 		// Закрываем хранилище
-		newService.StorageCloser()
+		if err := tenants.Close(); err != nil {
+			newLogger.Errorln("storage close error:", err)
+		}
 		newLogger.Sync()
 		newLogger.Infoln("Server stopped gracefully")
 
@@ -257,14 +562,27 @@ func main() {
 			newLogger.Errorln("server shutdown error:", err)
 		}
 
+		// Доставляем оставшиеся события аудита
+		if auditor != nil {
+			if err := auditor.Close(shutdownCtx); err != nil {
+				newLogger.Errorln("audit close error:", err)
+			}
+		}
+
+		// Останавливаем фоновых писателей (они дописывают изменённые серии)
+		writerCancel()
+		writers.Wait()
+
 		// Финальный flush данных (для DB режима - сохраняем всё что в памяти)
 		newLogger.Infoln("Flushing remaining data...")
-		if err := newService.PersistFlush(context.Background()); err != nil {
+		if err := tenants.Flush(context.Background()); err != nil {
 			newLogger.Errorln("final flush error:", err)
 		}
 
 		// Закрываем хранилище
-		newService.StorageCloser()
+		if err := tenants.Close(); err != nil {
+			newLogger.Errorln("storage close error:", err)
+		}
 		newLogger.Sync()
 		newLogger.Infoln("Server stopped gracefully")
 
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"gometrics/internal/db"
+	"gometrics/internal/serverconfig"
+)
+
+// migrateUsage describes the migrate subcommand.
+const migrateUsage = `usage: gometrics-server migrate [server flags] [up | down [N] | status]
+  up      apply all pending migrations (default)
+  down N  revert the last N applied migrations (default 1)
+  status  list the migrations and whether they are applied`
+
+// runMigrate implements "gometrics-server migrate": it applies or reverts the
+// schema migrations of the database given by -d / DATABASE_DSN / the JSON config.
+func runMigrate(ctx context.Context, args []string, out io.Writer) error {
+	f := serverconfig.InitialFlags()
+	rest, err := f.ParseCommandArgs("migrate", args)
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, migrateUsage)
+	}
+	if f.DatabaseDSN == "" {
+		return errors.New("migrate: database DSN is not set (-d or DATABASE_DSN)")
+	}
+
+	action := "up"
+	if len(rest) > 0 {
+		action, rest = rest[0], rest[1:]
+	}
+	steps := 1
+	switch {
+	case action == "down" && len(rest) == 1:
+		if steps, err = strconv.Atoi(rest[0]); err != nil || steps < 1 {
+			return fmt.Errorf("migrate down: bad step count %q\n%s", rest[0], migrateUsage)
+		}
+	case len(rest) > 0:
+		return fmt.Errorf("migrate %s: unexpected arguments %q\n%s", action, rest, migrateUsage)
+	}
+
+	sqlDB, err := sql.Open("postgres", f.DatabaseDSN)
+	if err != nil {
+		return fmt.Errorf("open connection: %w", err)
+	}
+	defer sqlDB.Close()
+	migrator, err := db.NewMigrator(sqlDB)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		versions, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "applied %d migration(s) %v\n", len(versions), versions)
+	case "down":
+		versions, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "reverted %d migration(s) %v\n", len(versions), versions)
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05Z07:00")
+			}
+			fmt.Fprintf(out, "%04d %-30s %s\n", s.Version, s.Name, state)
+		}
+	default:
+		return fmt.Errorf("migrate: unknown action %q\n%s", action, migrateUsage)
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ require (
 	github.com/mailru/easyjson v0.9.0
 	github.com/stretchr/testify v1.11.1
 	go.uber.org/zap v1.27.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -56,5 +57,4 @@ require (
 	github.com/swaggo/http-swagger v1.3.4
 	github.com/swaggo/swag v1.16.6
 	golang.org/x/crypto v0.46.0
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,193 @@
+// Package alerting evaluates threshold rules against the metrics held by the
+// server and tracks the resulting alerts through the pending, firing and
+// resolved states.
+package alerting
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State of an alert.
+type State string
+
+// Alert states.
+const (
+	StatePending  State = "pending"  // condition holds for less than Rule.For
+	StateFiring   State = "firing"   // condition has held for Rule.For
+	StateResolved State = "resolved" // condition stopped holding after firing
+)
+
+// resolvedRetention is how long resolved alerts stay visible.
+const resolvedRetention = 15 * time.Minute
+
+// Source provides metric values; *service.Service implements it.
+type Source interface {
+	GetGauge(ctx context.Context, key string) (float64, error)
+	GetCounter(ctx context.Context, key string) (int, error)
+}
+
+// Alert is the state of one rule that is not inactive.
+type Alert struct {
+	Name       string            `json:"name"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	State      State             `json:"state"`
+	Value      float64           `json:"value"`
+	Threshold  float64           `json:"threshold"`
+	ActiveAt   time.Time         `json:"activeAt"`
+	FiredAt    time.Time         `json:"firedAt,omitzero"`
+	ResolvedAt time.Time         `json:"resolvedAt,omitzero"`
+}
+
+// ruleState is the evaluation state of one rule.
+type ruleState struct {
+	rule  Rule
+	alert *Alert // nil while inactive
+
+	// previous raw sample, for increase() and rate()
+	prev     float64
+	prevAt   time.Time
+	havePrev bool
+}
+
+// Engine evaluates rules periodically. It is safe for concurrent use.
+type Engine struct {
+	mu         sync.RWMutex
+	source     Source
+	rules      []*ruleState
+	dispatcher *Dispatcher
+}
+
+// NewEngine creates an engine evaluating rules against source.
+func NewEngine(source Source, rules []Rule) *Engine {
+	e := &Engine{source: source}
+	for _, r := range rules {
+		e.rules = append(e.rules, &ruleState{rule: r})
+	}
+	return e
+}
+
+// SetDispatcher makes Run send the alerts to d after every evaluation.
+// It must be called before Run.
+func (e *Engine) SetDispatcher(d *Dispatcher) {
+	e.dispatcher = d
+}
+
+// sample reads the current raw value of a metric, gauges first.
+func (e *Engine) sample(ctx context.Context, name string) (float64, bool) {
+	if v, err := e.source.GetGauge(ctx, name); err == nil {
+		return v, true
+	}
+	if v, err := e.source.GetCounter(ctx, name); err == nil {
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// value computes the rule expression at now. ok is false when there is no data.
+func (e *Engine) value(ctx context.Context, rs *ruleState, now time.Time) (float64, bool) {
+	raw, ok := e.sample(ctx, rs.rule.metric)
+	if !ok {
+		rs.havePrev = false
+		return 0, false
+	}
+	if rs.rule.fn == "" {
+		return raw, true
+	}
+
+	prev, prevAt, havePrev := rs.prev, rs.prevAt, rs.havePrev
+	rs.prev, rs.prevAt, rs.havePrev = raw, now, true
+	if !havePrev {
+		return 0, false
+	}
+	delta := raw - prev
+	if rs.rule.fn == "rate" {
+		secs := now.Sub(prevAt).Seconds()
+		if secs <= 0 {
+			return 0, false
+		}
+		return delta / secs, true
+	}
+	return delta, true
+}
+
+// Eval evaluates every rule at now and updates the alert states.
+func (e *Engine) Eval(ctx context.Context, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, rs := range e.rules {
+		v, ok := e.value(ctx, rs, now)
+		active := ok && ops[rs.rule.Op](v, rs.rule.Threshold)
+		a := rs.alert
+
+		switch {
+		case active && (a == nil || a.State == StateResolved):
+			rs.alert = &Alert{
+				Name:      rs.rule.Name,
+				Labels:    rs.rule.Labels,
+				State:     StatePending,
+				Value:     v,
+				Threshold: rs.rule.Threshold,
+				ActiveAt:  now,
+			}
+			if rs.rule.For == 0 {
+				rs.alert.State, rs.alert.FiredAt = StateFiring, now
+			}
+		case active:
+			a.Value = v
+			if a.State == StatePending && now.Sub(a.ActiveAt) >= time.Duration(rs.rule.For) {
+				a.State, a.FiredAt = StateFiring, now
+			}
+		case a == nil:
+		case a.State == StatePending:
+			rs.alert = nil
+		case a.State == StateFiring:
+			a.State, a.ResolvedAt = StateResolved, now
+			if ok {
+				a.Value = v
+			}
+		case a.State == StateResolved && now.Sub(a.ResolvedAt) >= resolvedRetention:
+			rs.alert = nil
+		}
+	}
+}
+
+// Alerts returns the pending, firing and recently resolved alerts ordered by name.
+func (e *Engine) Alerts() []Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	out := make([]Alert, 0, len(e.rules))
+	for _, rs := range e.rules {
+		if rs.alert != nil {
+			out = append(out, *rs.alert)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Run evaluates the rules every interval until ctx is cancelled. The alerts
+// are sent by the dispatcher from its own goroutine.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	if e.dispatcher != nil {
+		go e.dispatcher.Run(ctx)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.Eval(ctx, now)
+			if e.dispatcher != nil {
+				e.dispatcher.Submit(e.Alerts(), now)
+			}
+		}
+	}
+}
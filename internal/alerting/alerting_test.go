@@ -0,0 +1,125 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mapSource serves metric values from maps.
+type mapSource struct {
+	gauges   map[string]float64
+	counters map[string]int
+}
+
+func (s *mapSource) GetGauge(_ context.Context, key string) (float64, error) {
+	if v, ok := s.gauges[key]; ok {
+		return v, nil
+	}
+	return 0, errors.New("not found")
+}
+
+func (s *mapSource) GetCounter(_ context.Context, key string) (int, error) {
+	if v, ok := s.counters[key]; ok {
+		return v, nil
+	}
+	return 0, errors.New("not found")
+}
+
+func mustRules(t *testing.T, data string) []Rule {
+	t.Helper()
+	rules, err := ParseRules([]byte(data), false)
+	require.NoError(t, err)
+	return rules
+}
+
+func TestEngine_Threshold(t *testing.T) {
+	ctx := context.Background()
+	src := &mapSource{gauges: map[string]float64{"HeapAlloc": 10}}
+	e := NewEngine(src, mustRules(t, `rules: [{name: HighHeap, expr: HeapAlloc, threshold: 100, for: 2m, labels: {severity: page}}]`))
+	start := time.Unix(1000, 0)
+
+	e.Eval(ctx, start)
+	assert.Empty(t, e.Alerts(), "below threshold")
+
+	src.gauges["HeapAlloc"] = 200
+	e.Eval(ctx, start.Add(time.Minute))
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StatePending, alerts[0].State)
+	assert.Equal(t, map[string]string{"severity": "page"}, alerts[0].Labels)
+
+	// A pending alert that recovers is dropped without firing.
+	src.gauges["HeapAlloc"] = 50
+	e.Eval(ctx, start.Add(2*time.Minute))
+	assert.Empty(t, e.Alerts())
+
+	src.gauges["HeapAlloc"] = 300
+	e.Eval(ctx, start.Add(3*time.Minute))
+	e.Eval(ctx, start.Add(5*time.Minute))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	assert.Equal(t, 300.0, alerts[0].Value)
+	assert.Equal(t, start.Add(3*time.Minute), alerts[0].ActiveAt)
+	assert.Equal(t, start.Add(5*time.Minute), alerts[0].FiredAt)
+
+	src.gauges["HeapAlloc"] = 1
+	e.Eval(ctx, start.Add(6*time.Minute))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+	assert.Equal(t, start.Add(6*time.Minute), alerts[0].ResolvedAt)
+
+	e.Eval(ctx, start.Add(6*time.Minute+resolvedRetention))
+	assert.Empty(t, e.Alerts(), "resolved alerts expire")
+}
+
+func TestEngine_Increase(t *testing.T) {
+	ctx := context.Background()
+	src := &mapSource{counters: map[string]int{"PollCount": 1}}
+	e := NewEngine(src, mustRules(t, `rules: [{name: Stalled, expr: increase(PollCount), op: "<=", threshold: 0}]`))
+	start := time.Unix(1000, 0)
+
+	e.Eval(ctx, start)
+	assert.Empty(t, e.Alerts(), "no previous sample")
+
+	src.counters["PollCount"] = 5
+	e.Eval(ctx, start.Add(time.Minute))
+	assert.Empty(t, e.Alerts())
+
+	// Counter stopped increasing; for: 0 fires immediately.
+	e.Eval(ctx, start.Add(2*time.Minute))
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	assert.Equal(t, 0.0, alerts[0].Value)
+
+	src.counters["PollCount"] = 6
+	e.Eval(ctx, start.Add(3*time.Minute))
+	assert.Equal(t, StateResolved, e.Alerts()[0].State)
+}
+
+func TestEngine_RateAndMissing(t *testing.T) {
+	ctx := context.Background()
+	src := &mapSource{counters: map[string]int{"NumGC": 0}}
+	e := NewEngine(src, mustRules(t, `
+rules:
+  - {name: FastGC, expr: rate(NumGC), op: ">=", threshold: 1}
+  - {name: Missing, expr: NoSuchMetric, threshold: 0}
+`))
+	start := time.Unix(1000, 0)
+
+	e.Eval(ctx, start)
+	src.counters["NumGC"] = 20
+	e.Eval(ctx, start.Add(10*time.Second))
+
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1, "rules without data stay inactive")
+	assert.Equal(t, "FastGC", alerts[0].Name)
+	assert.Equal(t, 2.0, alerts[0].Value)
+}
@@ -0,0 +1,221 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookTimeout bounds a single webhook request.
+const webhookTimeout = 10 * time.Second
+
+// smtpTimeout bounds a whole SMTP session, from dialing to QUIT.
+const smtpTimeout = 30 * time.Second
+
+// WebhookNotifier POSTs each group as JSON to a URL.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier posting to url.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Notify posts the group. Any non-2xx response is an error.
+func (n *WebhookNotifier) Notify(ctx context.Context, g Group) error {
+	body, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("marshal alert group: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded %s", n.URL, resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier e-mails each group as a plain-text message.
+type SMTPNotifier struct {
+	Addr string    // host:port of the SMTP server
+	From string    // envelope and header sender
+	To   []string  // recipients
+	Auth smtp.Auth // optional, e.g. smtp.PlainAuth
+}
+
+// NewSMTPNotifier creates a notifier sending through the server at addr.
+// With a non-empty username it authenticates with PLAIN auth.
+func NewSMTPNotifier(addr, from string, to []string, username, password string) *SMTPNotifier {
+	n := &SMTPNotifier{Addr: addr, From: from, To: to}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		n.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n
+}
+
+// Notify sends the group as one message. The session is bounded by
+// smtpTimeout and aborted when ctx is cancelled.
+func (n *SMTPNotifier) Notify(ctx context.Context, g Group) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	if err := n.send(ctx, n.message(g)); err != nil {
+		// The connection deadline is the deadline of ctx.
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = context.DeadlineExceeded
+		} else if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("send mail via %s: %w", n.Addr, err)
+	}
+	return nil
+}
+
+// send delivers msg like smtp.SendMail, over a connection closed when ctx is done.
+func (n *SMTPNotifier) send(ctx context.Context, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	host, _, err := net.SplitHostPort(n.Addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("server does not support AUTH")
+		}
+		if err := c.Auth(n.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, rcpt := range n.To {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message renders the RFC 5322 message for a group.
+func (n *SMTPNotifier) message(g Group) []byte {
+	firing := 0
+	for _, a := range g.Alerts {
+		if a.State == StateFiring {
+			firing++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&b, "Subject: [%s:%d] %s\r\n", strings.ToUpper(string(g.Status)), firing, g.Key)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, a := range g.Alerts {
+		fmt.Fprintf(&b, "%s is %s: value %g, threshold %g, active since %s\r\n",
+			a.Name, a.State, a.Value, a.Threshold, a.ActiveAt.Format(time.RFC3339))
+		names := make([]string, 0, len(a.Labels))
+		for k := range a.Labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			fmt.Fprintf(&b, "  %s=%s\r\n", k, a.Labels[k])
+		}
+	}
+	return []byte(b.String())
+}
+
+// FileNotifier appends each group to a file as one JSON line.
+type FileNotifier struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileNotifier opens (or creates) the file at path in append-only mode.
+func NewFileNotifier(path string) (*FileNotifier, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open alerts file: %w", err)
+	}
+	return &FileNotifier{file: file}, nil
+}
+
+// Notify appends the group.
+func (n *FileNotifier) Notify(_ context.Context, g Group) error {
+	line, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("marshal alert group: %w", err)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write alert group: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (n *FileNotifier) Close() error {
+	return n.file.Close()
+}
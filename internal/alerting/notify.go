@@ -0,0 +1,208 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gometrics/internal/retry"
+)
+
+// Group is a set of alerts sharing the values of the grouping labels,
+// delivered to notifiers as one notification.
+type Group struct {
+	Key    string            `json:"groupKey"`
+	Labels map[string]string `json:"groupLabels"`
+	Status State             `json:"status"` // firing if any alert fires, resolved otherwise
+	Alerts []Alert           `json:"alerts"`
+}
+
+// Notifier delivers notifications about alert groups.
+type Notifier interface {
+	Notify(ctx context.Context, g Group) error
+}
+
+// defaultRepeatInterval is used when Dispatcher.RepeatInterval is not set.
+const defaultRepeatInterval = 4 * time.Hour
+
+// sentKey identifies the notifications of a group to one notifier.
+type sentKey struct {
+	notifier int
+	group    string
+}
+
+// sent records the last notification of a group to one notifier.
+type sent struct {
+	at          time.Time
+	fingerprint string
+}
+
+// dispatch is one set of alerts handed to the dispatcher goroutine.
+type dispatch struct {
+	alerts []Alert
+	now    time.Time
+}
+
+// Dispatcher groups alerts and sends them to notifiers.
+//
+// A group is sent when its content changes (an alert starts firing or
+// resolves) and, while it keeps firing, again every RepeatInterval.
+// Failed deliveries are retried with Retry and, if still failing,
+// on the next Dispatch.
+//
+// Engine.Run hands the alerts over with Submit to the goroutine started by
+// Run, so slow notifiers never delay the evaluation of rules.
+type Dispatcher struct {
+	GroupBy        []string
+	RepeatInterval time.Duration
+	Retry          retry.RetryConfig
+
+	mu        sync.Mutex
+	notifiers []Notifier
+	sent      map[sentKey]sent
+
+	submitMu sync.Mutex
+	pending  chan dispatch // latest undelivered Submit, capacity 1
+}
+
+// NewDispatcher creates a dispatcher sending to notifiers.
+func NewDispatcher(groupBy []string, repeat time.Duration, notifiers ...Notifier) *Dispatcher {
+	if repeat <= 0 {
+		repeat = defaultRepeatInterval
+	}
+	return &Dispatcher{
+		GroupBy:        groupBy,
+		RepeatInterval: repeat,
+		Retry: retry.RetryConfig{
+			Attempts:    3,
+			Delays:      []time.Duration{time.Second, 5 * time.Second},
+			ShouldRetry: shouldRetryNotification,
+		},
+		notifiers: notifiers,
+		sent:      make(map[sentKey]sent),
+		pending:   make(chan dispatch, 1),
+	}
+}
+
+// Submit queues the alerts for the Run goroutine without blocking. Alerts
+// submitted before and not yet dispatched are replaced: every submission
+// carries the full state.
+func (d *Dispatcher) Submit(alerts []Alert, now time.Time) {
+	d.submitMu.Lock()
+	defer d.submitMu.Unlock()
+	select {
+	case <-d.pending:
+	default:
+	}
+	d.pending <- dispatch{alerts: alerts, now: now}
+}
+
+// Run dispatches the submitted alerts until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-d.pending:
+			d.Dispatch(ctx, job.alerts, job.now)
+		}
+	}
+}
+
+// shouldRetryNotification retries every delivery error except cancellation.
+func shouldRetryNotification(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// groups splits the firing and resolved alerts by the GroupBy labels.
+func (d *Dispatcher) groups(alerts []Alert) []Group {
+	byKey := make(map[string]*Group)
+	var keys []string
+	for _, a := range alerts {
+		if a.State == StatePending {
+			continue
+		}
+		labels := make(map[string]string, len(d.GroupBy))
+		parts := make([]string, 0, len(d.GroupBy))
+		for _, name := range d.GroupBy {
+			labels[name] = a.Labels[name]
+			parts = append(parts, name+"="+a.Labels[name])
+		}
+		key := "{" + strings.Join(parts, ",") + "}"
+		g, ok := byKey[key]
+		if !ok {
+			g = &Group{Key: key, Labels: labels, Status: StateResolved}
+			byKey[key] = g
+			keys = append(keys, key)
+		}
+		g.Alerts = append(g.Alerts, a)
+		if a.State == StateFiring {
+			g.Status = StateFiring
+		}
+	}
+
+	sort.Strings(keys)
+	out := make([]Group, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, *byKey[k])
+	}
+	return out
+}
+
+// fingerprint identifies the content of a group that is worth a new notification.
+func fingerprint(g Group) string {
+	var b strings.Builder
+	for _, a := range g.Alerts {
+		fmt.Fprintf(&b, "%s:%s;", a.Name, a.State)
+	}
+	return b.String()
+}
+
+// Dispatch sends the groups of alerts that are due at now and forgets the
+// groups that no longer exist.
+func (d *Dispatcher) Dispatch(ctx context.Context, alerts []Alert, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	groups := d.groups(alerts)
+	current := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		current[g.Key] = true
+	}
+	for key := range d.sent {
+		if !current[key.group] {
+			delete(d.sent, key)
+		}
+	}
+
+	for _, g := range groups {
+		fp := fingerprint(g)
+		for i, n := range d.notifiers {
+			key := sentKey{notifier: i, group: g.Key}
+			last, ok := d.sent[key]
+			changed := !ok || last.fingerprint != fp
+			repeat := g.Status == StateFiring && now.Sub(last.at) >= d.RepeatInterval
+			if !changed && !repeat {
+				continue
+			}
+			// A group that resolved before it was ever sent is not worth a notification.
+			if !ok && g.Status == StateResolved {
+				continue
+			}
+
+			_, err := d.Retry.Retry(ctx, func(...any) (any, error) {
+				return nil, n.Notify(ctx, g)
+			})
+			if err != nil {
+				log.Printf("WARN: notify %T about %s: %v", n, g.Key, err)
+				continue
+			}
+			d.sent[key] = sent{at: now, fingerprint: fp}
+		}
+	}
+}
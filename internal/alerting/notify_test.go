@@ -0,0 +1,364 @@
+package alerting
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gometrics/internal/retry"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingNotifier keeps the received groups and fails the first failures calls.
+type recordingNotifier struct {
+	failures int
+	calls    int
+	groups   []Group
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, g Group) error {
+	n.calls++
+	if n.calls <= n.failures {
+		return errors.New("temporary failure")
+	}
+	n.groups = append(n.groups, g)
+	return nil
+}
+
+func TestDispatcher_GroupingAndRepeat(t *testing.T) {
+	n := &recordingNotifier{}
+	d := NewDispatcher([]string{"severity"}, time.Hour, n)
+	start := time.Unix(1000, 0)
+
+	page := map[string]string{"severity": "page"}
+	alerts := []Alert{
+		{Name: "HighHeap", State: StateFiring, Labels: page},
+		{Name: "Stalled", State: StateFiring, Labels: page},
+		{Name: "Slow", State: StateFiring, Labels: map[string]string{"severity": "ticket"}},
+		{Name: "Soon", State: StatePending, Labels: page},
+	}
+	d.Dispatch(context.Background(), alerts, start)
+	require.Len(t, n.groups, 2)
+	assert.Equal(t, "{severity=page}", n.groups[0].Key)
+	assert.Len(t, n.groups[0].Alerts, 2, "pending alerts are not sent")
+	assert.Equal(t, "{severity=ticket}", n.groups[1].Key)
+
+	// Nothing changed: no notification until the repeat interval.
+	d.Dispatch(context.Background(), alerts, start.Add(time.Minute))
+	assert.Len(t, n.groups, 2)
+	d.Dispatch(context.Background(), alerts, start.Add(time.Hour))
+	assert.Len(t, n.groups, 4)
+
+	// A resolution is sent once.
+	alerts[2].State = StateResolved
+	d.Dispatch(context.Background(), alerts[2:3], start.Add(time.Hour+time.Minute))
+	d.Dispatch(context.Background(), alerts[2:3], start.Add(3*time.Hour))
+	require.Len(t, n.groups, 5)
+	assert.Equal(t, StateResolved, n.groups[4].Status)
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	n := &recordingNotifier{failures: 2}
+	d := NewDispatcher(nil, time.Hour, n)
+	d.Retry = retry.RetryConfig{Attempts: 3, Delays: []time.Duration{time.Millisecond}, ShouldRetry: shouldRetryNotification}
+
+	d.Dispatch(context.Background(), []Alert{{Name: "HighHeap", State: StateFiring}}, time.Unix(0, 0))
+	assert.Equal(t, 3, n.calls)
+	require.Len(t, n.groups, 1)
+	assert.Equal(t, "{}", n.groups[0].Key)
+
+	// A delivery that keeps failing is attempted again on the next Dispatch.
+	failing := &recordingNotifier{failures: 100}
+	d = NewDispatcher(nil, time.Hour, failing)
+	d.Retry = retry.RetryConfig{Attempts: 2, Delays: []time.Duration{time.Millisecond}, ShouldRetry: shouldRetryNotification}
+	d.Dispatch(context.Background(), []Alert{{Name: "HighHeap", State: StateFiring}}, time.Unix(0, 0))
+	d.Dispatch(context.Background(), []Alert{{Name: "HighHeap", State: StateFiring}}, time.Unix(1, 0))
+	assert.Equal(t, 4, failing.calls)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Group
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		if got.Key == "bad" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+
+	n := NewWebhookNotifier(ts.URL)
+	g := Group{Key: "{}", Status: StateFiring, Alerts: []Alert{{Name: "HighHeap", State: StateFiring, Value: 2}}}
+	require.NoError(t, n.Notify(context.Background(), g))
+	assert.Equal(t, "HighHeap", got.Alerts[0].Name)
+	assert.Equal(t, StateFiring, got.Status)
+
+	assert.Error(t, n.Notify(context.Background(), Group{Key: "bad"}))
+}
+
+func TestFileNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.log")
+	n, err := NewFileNotifier(path)
+	require.NoError(t, err)
+	require.NoError(t, n.Notify(context.Background(), Group{Key: "a", Status: StateFiring}))
+	require.NoError(t, n.Notify(context.Background(), Group{Key: "a", Status: StateResolved}))
+	require.NoError(t, n.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"status":"resolved"`)
+}
+
+// fakeSMTP is a minimal SMTP server accepting one message per session.
+type fakeSMTP struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	from     string
+	rcpt     []string
+	messages []string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeSMTP{ln: ln}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *fakeSMTP) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.mu.Lock()
+			s.from = strings.Trim(strings.TrimSpace(line)[len("MAIL FROM:"):], "<>")
+			s.mu.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.mu.Lock()
+			s.rcpt = append(s.rcpt, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 end with .")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	srv := newFakeSMTP(t)
+	n := NewSMTPNotifier(srv.ln.Addr().String(), "gometrics@local", []string{"ops@local", "dev@local"}, "", "")
+
+	g := Group{Key: "{severity=page}", Status: StateFiring, Alerts: []Alert{
+		{Name: "HighHeap", State: StateFiring, Value: 2e9, Threshold: 1e9, Labels: map[string]string{"severity": "page"}},
+	}}
+	require.NoError(t, n.Notify(context.Background(), g))
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	assert.Equal(t, "gometrics@local", srv.from)
+	assert.Equal(t, []string{"ops@local", "dev@local"}, srv.rcpt)
+	require.Len(t, srv.messages, 1)
+	assert.Contains(t, srv.messages[0], "Subject: [FIRING:1] {severity=page}")
+	assert.Contains(t, srv.messages[0], "HighHeap is firing: value 2e+09, threshold 1e+09")
+	assert.Contains(t, srv.messages[0], "severity=page")
+}
+
+func TestSMTPNotifier_Unresponsive(t *testing.T) {
+	// A server that accepts connections but never greets.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	n := NewSMTPNotifier(ln.Addr().String(), "gometrics@local", []string{"ops@local"}, "", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = n.Notify(ctx, Group{Key: "{}", Status: StateFiring})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, shouldRetryNotification(err))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// blockingNotifier blocks every delivery until its context is cancelled.
+type blockingNotifier struct {
+	started chan struct{}
+}
+
+func (n *blockingNotifier) Notify(ctx context.Context, _ Group) error {
+	select {
+	case n.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// countingSource counts the evaluations of a firing rule.
+type countingSource struct {
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *countingSource) GetGauge(context.Context, string) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	return 1, nil
+}
+
+func (s *countingSource) GetCounter(context.Context, string) (int, error) {
+	return 0, errors.New("not found")
+}
+
+func (s *countingSource) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+func TestEngine_RunWithBlockedNotifier(t *testing.T) {
+	src := &countingSource{}
+	rules, err := ParseRules([]byte(`rules: [{name: Up, expr: up, threshold: 0}]`), false)
+	require.NoError(t, err)
+	e := NewEngine(src, rules)
+	n := &blockingNotifier{started: make(chan struct{}, 1)}
+	e.SetDispatcher(NewDispatcher(nil, time.Hour, n))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx, time.Millisecond)
+
+	<-n.started
+	reads := src.count()
+	assert.Eventually(t, func() bool { return src.count() >= reads+5 }, 5*time.Second, time.Millisecond,
+		"rules are evaluated while a notifier hangs")
+}
+
+func TestDispatcher_ForgetsGoneGroups(t *testing.T) {
+	n := &recordingNotifier{}
+	d := NewDispatcher([]string{"severity"}, time.Hour, n)
+	page := Alert{Name: "HighHeap", State: StateFiring, Labels: map[string]string{"severity": "page"}}
+	ticket := Alert{Name: "Slow", State: StateFiring, Labels: map[string]string{"severity": "ticket"}}
+
+	d.Dispatch(context.Background(), []Alert{page, ticket}, time.Unix(0, 0))
+	assert.Len(t, d.sent, 2)
+	d.Dispatch(context.Background(), []Alert{page}, time.Unix(1, 0))
+	assert.Equal(t, map[sentKey]sent{{0, "{severity=page}"}: {at: time.Unix(0, 0), fingerprint: "HighHeap:firing;"}}, d.sent)
+}
+
+func TestDispatcher_Submit(t *testing.T) {
+	n := &recordingNotifier{}
+	d := NewDispatcher(nil, time.Hour, n)
+	d.Submit([]Alert{{Name: "Old", State: StateFiring}}, time.Unix(0, 0))
+	d.Submit([]Alert{{Name: "New", State: StateFiring}}, time.Unix(1, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(n.groups) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, "New", n.groups[0].Alerts[0].Name, "only the latest submission is dispatched")
+}
+
+func TestNotifyConfig_Dispatcher(t *testing.T) {
+	file, err := Parse([]byte(`
+rules: []
+notify:
+  group_by: [severity]
+  repeat_interval: 30m
+  webhook: {url: "http://localhost/hook"}
+  smtp: {addr: "localhost:25", from: a@local, to: [b@local]}
+  file: {path: `+filepath.Join(t.TempDir(), "alerts.log")+`}
+`), false)
+	require.NoError(t, err)
+
+	d, err := file.Notify.Dispatcher()
+	require.NoError(t, err)
+	require.NotNil(t, d)
+	assert.Len(t, d.notifiers, 3)
+	assert.Equal(t, 30*time.Minute, d.RepeatInterval)
+	assert.Equal(t, []string{"severity"}, d.GroupBy)
+
+	d, err = NotifyConfig{}.Dispatcher()
+	require.NoError(t, err)
+	assert.Nil(t, d)
+
+	_, err = NotifyConfig{SMTP: &SMTPConfig{Addr: "localhost:25"}}.Dispatcher()
+	assert.Error(t, err)
+}
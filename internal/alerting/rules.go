@@ -0,0 +1,230 @@
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration read from strings such as "30s" or "5m".
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration string.
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.parse(node.Value)
+}
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	return d.parse(s)
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Comparison operators accepted in Rule.Op.
+var ops = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// Rule describes one alert.
+//
+// Expr selects the value to compare: a metric name ("HeapAlloc"), or the change
+// of a metric since the previous evaluation ("increase(PollCount)") or its
+// per-second rate ("rate(PollCount)"). The alert is pending while
+// "value Op Threshold" holds, and firing once it has held for For.
+type Rule struct {
+	Name      string            `yaml:"name" json:"name"`
+	Expr      string            `yaml:"expr" json:"expr"`
+	Op        string            `yaml:"op" json:"op"` // defaults to ">"
+	Threshold float64           `yaml:"threshold" json:"threshold"`
+	For       Duration          `yaml:"for" json:"for"`
+	Labels    map[string]string `yaml:"labels" json:"labels"`
+
+	fn     string // "", "increase" or "rate"
+	metric string
+}
+
+// RuleFile is the layout of a rules file:
+//
+//	rules:
+//	  - name: HighHeap
+//	    expr: HeapAlloc
+//	    op: ">"
+//	    threshold: 1e9
+//	    for: 5m
+//	    labels: {severity: page}
+//	notify:
+//	  group_by: [severity]
+//	  repeat_interval: 4h
+//	  webhook: {url: "http://hooks.local/alerts"}
+//	  smtp: {addr: "mail.local:25", from: "gometrics@local", to: ["ops@local"]}
+//	  file: {path: "alerts.log"}
+type RuleFile struct {
+	Rules  []Rule       `yaml:"rules" json:"rules"`
+	Notify NotifyConfig `yaml:"notify" json:"notify"`
+}
+
+// NotifyConfig configures where and how often alerts are sent.
+type NotifyConfig struct {
+	GroupBy        []string       `yaml:"group_by" json:"group_by"`
+	RepeatInterval Duration       `yaml:"repeat_interval" json:"repeat_interval"`
+	Webhook        *WebhookConfig `yaml:"webhook" json:"webhook"`
+	SMTP           *SMTPConfig    `yaml:"smtp" json:"smtp"`
+	File           *FileConfig    `yaml:"file" json:"file"`
+}
+
+// WebhookConfig configures WebhookNotifier.
+type WebhookConfig struct {
+	URL string `yaml:"url" json:"url"`
+}
+
+// SMTPConfig configures SMTPNotifier.
+type SMTPConfig struct {
+	Addr     string   `yaml:"addr" json:"addr"`
+	From     string   `yaml:"from" json:"from"`
+	To       []string `yaml:"to" json:"to"`
+	Username string   `yaml:"username" json:"username"`
+	Password string   `yaml:"password" json:"password"`
+}
+
+// FileConfig configures FileNotifier.
+type FileConfig struct {
+	Path string `yaml:"path" json:"path"`
+}
+
+// Dispatcher builds the dispatcher of the configured notifiers,
+// or returns nil if none is configured.
+func (c NotifyConfig) Dispatcher() (*Dispatcher, error) {
+	var notifiers []Notifier
+	if c.Webhook != nil {
+		if c.Webhook.URL == "" {
+			return nil, errors.New("webhook notifier without url")
+		}
+		notifiers = append(notifiers, NewWebhookNotifier(c.Webhook.URL))
+	}
+	if c.SMTP != nil {
+		if c.SMTP.Addr == "" || c.SMTP.From == "" || len(c.SMTP.To) == 0 {
+			return nil, errors.New("smtp notifier requires addr, from and to")
+		}
+		notifiers = append(notifiers, NewSMTPNotifier(c.SMTP.Addr, c.SMTP.From, c.SMTP.To, c.SMTP.Username, c.SMTP.Password))
+	}
+	if c.File != nil {
+		n, err := NewFileNotifier(c.File.Path)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	if len(notifiers) == 0 {
+		return nil, nil
+	}
+	return NewDispatcher(c.GroupBy, time.Duration(c.RepeatInterval), notifiers...), nil
+}
+
+var exprPattern = regexp.MustCompile(`^\s*(?:(increase|rate)\(\s*([^()\s]+)\s*\)|([^()\s]+))\s*$`)
+
+// compile validates the rule and parses its expression.
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return errors.New("rule without name")
+	}
+	m := exprPattern.FindStringSubmatch(r.Expr)
+	if m == nil {
+		return fmt.Errorf("rule %s: invalid expr %q", r.Name, r.Expr)
+	}
+	r.fn, r.metric = m[1], m[2]
+	if r.fn == "" {
+		r.metric = m[3]
+	}
+	if r.Op == "" {
+		r.Op = ">"
+	}
+	if _, ok := ops[r.Op]; !ok {
+		return fmt.Errorf("rule %s: unknown op %q", r.Name, r.Op)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("rule %s: negative for", r.Name)
+	}
+	return nil
+}
+
+// ParseRules decodes rules from YAML, or from JSON when isJSON is set, and validates them.
+func ParseRules(data []byte, isJSON bool) ([]Rule, error) {
+	file, err := Parse(data, isJSON)
+	if err != nil {
+		return nil, err
+	}
+	return file.Rules, nil
+}
+
+// Parse decodes a rules file from YAML, or from JSON when isJSON is set, and validates the rules.
+func Parse(data []byte, isJSON bool) (*RuleFile, error) {
+	var file RuleFile
+	var err error
+	if isJSON {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode rules: %w", err)
+	}
+
+	seen := make(map[string]bool, len(file.Rules))
+	for i := range file.Rules {
+		if err := file.Rules[i].compile(); err != nil {
+			return nil, err
+		}
+		if seen[file.Rules[i].Name] {
+			return nil, fmt.Errorf("duplicate rule %s", file.Rules[i].Name)
+		}
+		seen[file.Rules[i].Name] = true
+	}
+	return &file, nil
+}
+
+// Load reads a rules file in YAML, or in JSON if its extension is ".json".
+func Load(path string) (*RuleFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rules file: %w", err)
+	}
+	return Parse(data, strings.EqualFold(filepath.Ext(path), ".json"))
+}
+
+// LoadRules reads the rules of a rules file, see Load.
+func LoadRules(path string) ([]Rule, error) {
+	file, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return file.Rules, nil
+}
@@ -0,0 +1,76 @@
+package alerting
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const yamlRules = `
+rules:
+  - name: HighHeap
+    expr: HeapAlloc
+    threshold: 1e9
+    for: 5m
+    labels:
+      severity: page
+  - name: PollCountStalled
+    expr: increase(PollCount)
+    op: "<="
+    threshold: 0
+    for: 1m
+`
+
+const jsonRules = `{"rules": [{"name": "FastGC", "expr": "rate(NumGC)", "op": ">=", "threshold": 10, "for": "30s"}]}`
+
+func TestLoadRules(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "rules.yaml")
+	jsonPath := filepath.Join(dir, "rules.json")
+	require.NoError(t, os.WriteFile(yamlPath, []byte(yamlRules), 0o644))
+	require.NoError(t, os.WriteFile(jsonPath, []byte(jsonRules), 0o644))
+
+	rules, err := LoadRules(yamlPath)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, ">", rules[0].Op, "op defaults to >")
+	assert.Equal(t, 1e9, rules[0].Threshold)
+	assert.Equal(t, Duration(5*time.Minute), rules[0].For)
+	assert.Equal(t, map[string]string{"severity": "page"}, rules[0].Labels)
+	assert.Equal(t, "increase", rules[1].fn)
+	assert.Equal(t, "PollCount", rules[1].metric)
+
+	rules, err = LoadRules(jsonPath)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, "rate", rules[0].fn)
+	assert.Equal(t, "NumGC", rules[0].metric)
+	assert.Equal(t, Duration(30*time.Second), rules[0].For)
+
+	_, err = LoadRules(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "no name", data: `rules: [{expr: HeapAlloc}]`},
+		{name: "bad expr", data: `rules: [{name: a, expr: "sum(HeapAlloc)"}]`},
+		{name: "empty expr", data: `rules: [{name: a, expr: ""}]`},
+		{name: "bad op", data: `rules: [{name: a, expr: HeapAlloc, op: "=>"}]`},
+		{name: "bad duration", data: `rules: [{name: a, expr: HeapAlloc, for: soon}]`},
+		{name: "duplicate", data: `rules: [{name: a, expr: HeapAlloc}, {name: a, expr: Sys}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRules([]byte(tt.data), false)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -13,7 +13,40 @@ type Metrics struct {
 	MType string   `json:"type"`            // "gauge" | "counter"
 	Delta *int64   `json:"delta,omitempty"` // для counter
 	Value *float64 `json:"value,omitempty"` // для gauge и ответов
+	TTL   *int64   `json:"ttl,omitempty"`   // время жизни серии в секундах, необязательно
+
+	Timestamp *int64 `json:"timestamp,omitempty"` // время измерения, Unix-миллисекунды; необязательно
 }
 
 //easyjson:json
 type MetricsArray []Metrics
+
+// Статусы элементов BatchResult.
+const (
+	ItemAccepted     = "accepted"     // метрика применена
+	ItemRejected     = "rejected"     // метрика отклонена, причина в Error
+	ItemDeduplicated = "deduplicated" // образец gauge старше уже сохранённого и пропущен
+)
+
+// ItemResult - итог обработки одной метрики пакета.
+//
+//easyjson:json
+type ItemResult struct {
+	Index  int      `json:"index"` // позиция метрики в пакете
+	ID     string   `json:"id"`
+	MType  string   `json:"type"`
+	Status string   `json:"status"`          // accepted | rejected | deduplicated
+	Error  string   `json:"error,omitempty"` // причина отказа
+	Delta  *int64   `json:"delta,omitempty"` // сохранённое значение counter после пакета
+	Value  *float64 `json:"value,omitempty"` // сохранённое значение gauge после пакета
+}
+
+// BatchResult - ответ на пакетное обновление /updates/.
+//
+//easyjson:json
+type BatchResult struct {
+	Accepted     int          `json:"accepted"`
+	Rejected     int          `json:"rejected"`
+	Deduplicated int          `json:"deduplicated"`
+	Items        []ItemResult `json:"items"`
+}
@@ -126,6 +126,26 @@ func easyjson6d884236DecodeGometricsInternalApiMetricsdto1(in *jlexer.Lexer, out
 				}
 				*out.Value = float64(in.Float64())
 			}
+		case "ttl":
+			if in.IsNull() {
+				in.Skip()
+				out.TTL = nil
+			} else {
+				if out.TTL == nil {
+					out.TTL = new(int64)
+				}
+				*out.TTL = int64(in.Int64())
+			}
+		case "timestamp":
+			if in.IsNull() {
+				in.Skip()
+				out.Timestamp = nil
+			} else {
+				if out.Timestamp == nil {
+					out.Timestamp = new(int64)
+				}
+				*out.Timestamp = int64(in.Int64())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -160,6 +180,16 @@ func easyjson6d884236EncodeGometricsInternalApiMetricsdto1(out *jwriter.Writer,
 		out.RawString(prefix)
 		out.Float64(float64(*in.Value))
 	}
+	if in.TTL != nil {
+		const prefix string = ",\"ttl\":"
+		out.RawString(prefix)
+		out.Int64(int64(*in.TTL))
+	}
+	if in.Timestamp != nil {
+		const prefix string = ",\"timestamp\":"
+		out.RawString(prefix)
+		out.Int64(int64(*in.Timestamp))
+	}
 	out.RawByte('}')
 }
 
@@ -186,3 +216,246 @@ func (v *Metrics) UnmarshalJSON(data []byte) error {
 func (v *Metrics) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjson6d884236DecodeGometricsInternalApiMetricsdto1(l, v)
 }
+func easyjson6d884236DecodeGometricsInternalApiMetricsdto2(in *jlexer.Lexer, out *ItemResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "index":
+			out.Index = int(in.Int())
+		case "id":
+			out.ID = string(in.String())
+		case "type":
+			out.MType = string(in.String())
+		case "status":
+			out.Status = string(in.String())
+		case "error":
+			out.Error = string(in.String())
+		case "delta":
+			if in.IsNull() {
+				in.Skip()
+				out.Delta = nil
+			} else {
+				if out.Delta == nil {
+					out.Delta = new(int64)
+				}
+				*out.Delta = int64(in.Int64())
+			}
+		case "value":
+			if in.IsNull() {
+				in.Skip()
+				out.Value = nil
+			} else {
+				if out.Value == nil {
+					out.Value = new(float64)
+				}
+				*out.Value = float64(in.Float64())
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson6d884236EncodeGometricsInternalApiMetricsdto2(out *jwriter.Writer, in ItemResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"index\":"
+		out.RawString(prefix[1:])
+		out.Int(int(in.Index))
+	}
+	{
+		const prefix string = ",\"id\":"
+		out.RawString(prefix)
+		out.String(string(in.ID))
+	}
+	{
+		const prefix string = ",\"type\":"
+		out.RawString(prefix)
+		out.String(string(in.MType))
+	}
+	{
+		const prefix string = ",\"status\":"
+		out.RawString(prefix)
+		out.String(string(in.Status))
+	}
+	if in.Error != "" {
+		const prefix string = ",\"error\":"
+		out.RawString(prefix)
+		out.String(string(in.Error))
+	}
+	if in.Delta != nil {
+		const prefix string = ",\"delta\":"
+		out.RawString(prefix)
+		out.Int64(int64(*in.Delta))
+	}
+	if in.Value != nil {
+		const prefix string = ",\"value\":"
+		out.RawString(prefix)
+		out.Float64(float64(*in.Value))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v ItemResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson6d884236EncodeGometricsInternalApiMetricsdto2(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v ItemResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson6d884236EncodeGometricsInternalApiMetricsdto2(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *ItemResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson6d884236DecodeGometricsInternalApiMetricsdto2(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *ItemResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson6d884236DecodeGometricsInternalApiMetricsdto2(l, v)
+}
+func easyjson6d884236DecodeGometricsInternalApiMetricsdto3(in *jlexer.Lexer, out *BatchResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "accepted":
+			out.Accepted = int(in.Int())
+		case "rejected":
+			out.Rejected = int(in.Int())
+		case "deduplicated":
+			out.Deduplicated = int(in.Int())
+		case "items":
+			if in.IsNull() {
+				in.Skip()
+				out.Items = nil
+			} else {
+				in.Delim('[')
+				if out.Items == nil {
+					if !in.IsDelim(']') {
+						out.Items = make([]ItemResult, 0, 0)
+					} else {
+						out.Items = []ItemResult{}
+					}
+				} else {
+					out.Items = (out.Items)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v4 ItemResult
+					(v4).UnmarshalEasyJSON(in)
+					out.Items = append(out.Items, v4)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson6d884236EncodeGometricsInternalApiMetricsdto3(out *jwriter.Writer, in BatchResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"accepted\":"
+		out.RawString(prefix[1:])
+		out.Int(int(in.Accepted))
+	}
+	{
+		const prefix string = ",\"rejected\":"
+		out.RawString(prefix)
+		out.Int(int(in.Rejected))
+	}
+	{
+		const prefix string = ",\"deduplicated\":"
+		out.RawString(prefix)
+		out.Int(int(in.Deduplicated))
+	}
+	{
+		const prefix string = ",\"items\":"
+		out.RawString(prefix)
+		if in.Items == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v5, v6 := range in.Items {
+				if v5 > 0 {
+					out.RawByte(',')
+				}
+				(v6).MarshalEasyJSON(out)
+			}
+			out.RawByte(']')
+		}
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v BatchResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson6d884236EncodeGometricsInternalApiMetricsdto3(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v BatchResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson6d884236EncodeGometricsInternalApiMetricsdto3(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *BatchResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson6d884236DecodeGometricsInternalApiMetricsdto3(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *BatchResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson6d884236DecodeGometricsInternalApiMetricsdto3(l, v)
+}
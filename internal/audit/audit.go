@@ -0,0 +1,166 @@
+// Package audit records who changed which metrics and when.
+//
+// Handlers publish an Event after every successful update; a Publisher
+// delivers events asynchronously to the registered observers (a JSON-lines
+// file, a remote HTTP endpoint, ...), so the request path is not slowed down
+// by slow sinks.
+package audit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event describes one successful update request.
+type Event struct {
+	TS        int64    `json:"ts"`               // unix time of the update, seconds
+	Metrics   []string `json:"metrics"`          // IDs of the updated metrics
+	IPAddress string   `json:"ip_address"`       // client address
+	Token     string   `json:"token,omitempty"`  // name of the API token, if any
+	Tenant    string   `json:"tenant,omitempty"` // tenant of the metrics, if any
+}
+
+// Observer receives audit events.
+type Observer interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// ClientIP returns the IP address of the request client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// NewEvent creates an event for the request updating metrics, stamped with the current time.
+func NewEvent(r *http.Request, metrics []string) Event {
+	return Event{
+		TS:        time.Now().Unix(),
+		Metrics:   metrics,
+		IPAddress: ClientIP(r),
+	}
+}
+
+// defaultBuffer is the queue size used when NewPublisher gets a non-positive buffer.
+const defaultBuffer = 1024
+
+// Publisher fans events out to observers. Every observer has its own queue and
+// goroutine, so a slow observer delays only itself. Events are dropped (and
+// logged) for an observer whose queue is full.
+type Publisher struct {
+	mu     sync.RWMutex
+	closed bool
+	queues []queue
+	wg     sync.WaitGroup
+	ctx    context.Context // cancelled when Close gives up waiting
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// queue holds the pending events of one observer.
+type queue struct {
+	observer Observer
+	events   chan Event
+}
+
+// NewPublisher starts a publisher delivering to observers with a queue of
+// buffer events per observer.
+func NewPublisher(buffer int, observers ...Observer) *Publisher {
+	if buffer <= 0 {
+		buffer = defaultBuffer
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Publisher{
+		queues: make([]queue, len(observers)),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	for i, o := range observers {
+		p.queues[i] = queue{observer: o, events: make(chan Event, buffer)}
+		p.wg.Add(1)
+		go p.run(p.queues[i])
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.done)
+	}()
+	return p
+}
+
+// Publish queues the event for every observer without blocking. It returns
+// false if the event was dropped for any of them.
+func (p *Publisher) Publish(e Event) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	queued := true
+	for _, q := range p.queues {
+		select {
+		case q.events <- e:
+		default:
+			log.Printf("WARN: audit queue of %T is full, event for %v dropped", q.observer, e.Metrics)
+			queued = false
+		}
+	}
+	return queued
+}
+
+// run delivers the events of q until its queue is closed and drained or the
+// publisher gives up waiting.
+func (p *Publisher) run(q queue) {
+	defer p.wg.Done()
+	for e := range q.events {
+		if p.ctx.Err() != nil {
+			return
+		}
+		if err := q.observer.Notify(p.ctx, e); err != nil {
+			log.Printf("WARN: audit observer %T: %v", q.observer, err)
+		}
+	}
+}
+
+// Close stops accepting events, delivers the queued ones and closes the observers
+// implementing io.Closer. It waits for delivery until ctx is done; then the
+// deliveries in progress are cancelled through their context and, once they
+// return, the remaining events are dropped and ctx.Err() is returned. The
+// observers are closed in either case.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, q := range p.queues {
+			close(q.events)
+		}
+	}
+	p.mu.Unlock()
+
+	var errs []error
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+		p.cancel()
+		<-p.done
+	}
+	p.cancel()
+
+	for _, q := range p.queues {
+		if c, ok := q.observer.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gometrics/internal/retry"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is an Observer keeping the received events.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+	closed bool
+}
+
+func (r *recorder) Notify(_ context.Context, e Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *recorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestPublisher(t *testing.T) {
+	rec := &recorder{}
+	p := NewPublisher(10, rec)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, p.Publish(Event{TS: int64(i), Metrics: []string{"cpu"}}))
+	}
+	require.NoError(t, p.Close(context.Background()))
+
+	assert.Len(t, rec.events, 3, "queued events are delivered before Close returns")
+	assert.True(t, rec.closed)
+	assert.False(t, p.Publish(Event{}), "closed publisher drops events")
+}
+
+// blockingObserver blocks every delivery until its context is cancelled.
+type blockingObserver struct {
+	recorder
+	started chan struct{}
+}
+
+func (b *blockingObserver) Notify(ctx context.Context, e Event) error {
+	b.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPublisher_SlowObserver(t *testing.T) {
+	rec := &recorder{}
+	slow := &blockingObserver{started: make(chan struct{}, 10)}
+	p := NewPublisher(10, slow, rec)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, p.Publish(Event{TS: int64(i)}))
+	}
+	<-slow.started
+	require.Eventually(t, func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return len(rec.events) == 3
+	}, time.Second, time.Millisecond, "a slow observer does not delay the others")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Close(ctx), context.DeadlineExceeded)
+	assert.True(t, slow.closed, "observers are closed when Close times out")
+	assert.True(t, rec.closed)
+	assert.Len(t, slow.started, 0, "queued events are dropped after the timeout")
+}
+
+func TestNewEvent(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	req.RemoteAddr = "192.168.1.10:40000"
+
+	e := NewEvent(req, []string{"Alloc", "PollCount"})
+	assert.Equal(t, "192.168.1.10", e.IPAddress)
+	assert.Equal(t, []string{"Alloc", "PollCount"}, e.Metrics)
+	assert.InDelta(t, time.Now().Unix(), e.TS, 1)
+}
+
+func TestFileObserver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, os.WriteFile(path, []byte(`{"ts":1,"metrics":["old"],"ip_address":"a"}`+"\n"), 0o644))
+
+	o, err := NewFileObserver(path)
+	require.NoError(t, err)
+	require.NoError(t, o.Notify(context.Background(), Event{TS: 2, Metrics: []string{"cpu"}, IPAddress: "b", Tenant: "teama"}))
+	require.NoError(t, o.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var got []Event
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &e))
+		got = append(got, e)
+	}
+	require.Len(t, got, 2, "file is appended to, not truncated")
+	assert.Equal(t, Event{TS: 2, Metrics: []string{"cpu"}, IPAddress: "b", Tenant: "teama"}, got[1])
+}
+
+func TestHTTPObserver(t *testing.T) {
+	var got Event
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	o := NewHTTPObserver(ts.URL)
+	o.Retry = retry.RetryConfig{Attempts: 1}
+
+	e := Event{TS: 10, Metrics: []string{"cpu"}, IPAddress: "127.0.0.1"}
+	require.NoError(t, o.Notify(context.Background(), e))
+	assert.Equal(t, e, got)
+
+	status = http.StatusInternalServerError
+	assert.Error(t, o.Notify(context.Background(), e))
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gometrics/internal/retry"
+)
+
+// FileObserver appends events to a file, one JSON object per line.
+type FileObserver struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileObserver opens (or creates) the file at path in append-only mode.
+func NewFileObserver(path string) (*FileObserver, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open audit file: %w", err)
+	}
+	return &FileObserver{file: file}, nil
+}
+
+// Notify writes the event as a single line.
+func (o *FileObserver) Notify(_ context.Context, e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal audit event: %w", err)
+	}
+	line = append(line, '\n')
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err := o.file.Write(line); err != nil {
+		return fmt.Errorf("write audit event: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (o *FileObserver) Close() error {
+	return o.file.Close()
+}
+
+// httpTimeout bounds a single delivery attempt of HTTPObserver.
+const httpTimeout = 5 * time.Second
+
+// HTTPObserver POSTs each event as JSON to a remote URL.
+// Network failures are retried according to Retry.
+type HTTPObserver struct {
+	URL    string
+	Client *http.Client
+	Retry  retry.RetryConfig
+}
+
+// NewHTTPObserver creates an observer posting to url with retry.DefaultConfig.
+func NewHTTPObserver(url string) *HTTPObserver {
+	return &HTTPObserver{
+		URL:    url,
+		Client: &http.Client{Timeout: httpTimeout},
+		Retry:  retry.DefaultConfig(),
+	}
+}
+
+// Notify posts the event. Any non-2xx response is an error.
+func (o *HTTPObserver) Notify(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal audit event: %w", err)
+	}
+	_, err = o.Retry.Retry(ctx, func(...any) (any, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := o.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("audit endpoint responded %s", resp.Status)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("post audit event to %s: %w", o.URL, err)
+	}
+	return nil
+}
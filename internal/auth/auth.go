@@ -0,0 +1,153 @@
+// Package auth implements bearer-token and API-key authentication for the metrics server.
+// Every token carries a set of scopes (read, write, admin) and an optional
+// metric-name prefix that limits which series the token may read or update.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"gometrics/internal/metricname"
+	"gometrics/internal/problem"
+)
+
+// Scope is a permission granted to a token.
+type Scope string
+
+const (
+	// ScopeRead allows reading metric values and listings.
+	ScopeRead Scope = "read"
+	// ScopeWrite allows updating metrics.
+	ScopeWrite Scope = "write"
+	// ScopeAdmin implies every other scope.
+	ScopeAdmin Scope = "admin"
+)
+
+// ErrUnknownToken is returned by a Store when the presented credential is not registered.
+var ErrUnknownToken = errors.New("unknown token")
+
+// Token describes a credential and the permissions attached to it.
+type Token struct {
+	Token  string  `json:"token"`            // secret value presented by the client
+	Name   string  `json:"name"`             // human readable owner (team, service)
+	Scopes []Scope `json:"scopes"`           // granted scopes
+	Prefix string  `json:"prefix,omitempty"` // optional metric-name prefix restriction
+	Tenant string  `json:"tenant,omitempty"` // tenant the token is bound to, empty for none
+}
+
+// HasScope reports whether the token grants the scope. Admin implies all scopes.
+func (t Token) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsMetric reports whether the token may access the metric with the given name.
+// Name and prefix are compared as storage keys of the name policy, so the
+// prefix matches exactly the series stored under it.
+func (t Token) AllowsMetric(names metricname.Policy, name string) bool {
+	if t.Prefix == "" {
+		return true
+	}
+	return strings.HasPrefix(names.Key(name), names.Key(t.Prefix))
+}
+
+// Store looks up tokens by their secret value.
+type Store interface {
+	Lookup(ctx context.Context, token string) (Token, error)
+}
+
+// HashToken returns the hex-encoded SHA-256 of a token, as stored in the database.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type ctxKey struct{}
+
+// WithToken returns a copy of ctx carrying the authenticated token.
+func WithToken(ctx context.Context, t Token) context.Context {
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+// FromContext returns the authenticated token, if any.
+func FromContext(ctx context.Context) (Token, bool) {
+	t, ok := ctx.Value(ctxKey{}).(Token)
+	return t, ok
+}
+
+// AllowMetric reports whether the request context may access the metric.
+// Requests without an authenticated token (authentication disabled) are always allowed.
+func AllowMetric(ctx context.Context, names metricname.Policy, name string) bool {
+	t, ok := FromContext(ctx)
+	if !ok {
+		return true
+	}
+	return t.AllowsMetric(names, name)
+}
+
+// Authenticator is an HTTP middleware that resolves credentials through a Store.
+type Authenticator struct {
+	store Store
+}
+
+// NewAuthenticator creates an Authenticator backed by the given store.
+func NewAuthenticator(store Store) *Authenticator {
+	return &Authenticator{store: store}
+}
+
+// credential extracts a token from "Authorization: Bearer <token>" or "X-API-Key: <token>".
+func credential(r *http.Request) string {
+	if h := strings.TrimSpace(r.Header.Get("Authorization")); h != "" {
+		scheme, value, found := strings.Cut(h, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// Authenticate rejects requests without a known credential with 401 and stores
+// the resolved token in the request context.
+func (a *Authenticator) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := credential(r)
+		if secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gometrics"`)
+			problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "missing credentials")
+			return
+		}
+		token, err := a.store.Lookup(r.Context(), secret)
+		if errors.Is(err, ErrUnknownToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gometrics", error="invalid_token"`)
+			problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "invalid credentials")
+			return
+		}
+		if err != nil {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "cannot verify credentials")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithToken(r.Context(), token)))
+	})
+}
+
+// Require returns a middleware that rejects requests whose token lacks the scope with 403.
+// Requests without a token pass through, so routes stay open when authentication is disabled.
+func Require(scope Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t, ok := FromContext(r.Context()); ok && !t.HasScope(scope) {
+				problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "insufficient scope: "+string(scope)+" required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gometrics/internal/metricname"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapStore is an in-memory Store for tests.
+type mapStore map[string]Token
+
+func (m mapStore) Lookup(_ context.Context, token string) (Token, error) {
+	t, ok := m[token]
+	if !ok {
+		return Token{}, ErrUnknownToken
+	}
+	return t, nil
+}
+
+func TestToken_HasScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []Scope
+		check  Scope
+		want   bool
+	}{
+		{name: "read grants read", scopes: []Scope{ScopeRead}, check: ScopeRead, want: true},
+		{name: "read does not grant write", scopes: []Scope{ScopeRead}, check: ScopeWrite, want: false},
+		{name: "admin grants write", scopes: []Scope{ScopeAdmin}, check: ScopeWrite, want: true},
+		{name: "no scopes", scopes: nil, check: ScopeRead, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Token{Scopes: tt.scopes}.HasScope(tt.check))
+		})
+	}
+}
+
+func TestToken_AllowsMetric(t *testing.T) {
+	tok := Token{Prefix: "teamA_"}
+	assert.True(t, tok.AllowsMetric(metricname.CaseInsensitive, "teamA_requests"))
+	assert.True(t, tok.AllowsMetric(metricname.CaseInsensitive, "teama_requests"), "prefix match is case-insensitive")
+	assert.False(t, tok.AllowsMetric(metricname.CaseInsensitive, "teamB_requests"))
+	assert.True(t, Token{}.AllowsMetric(metricname.CaseInsensitive, "anything"))
+
+	// Under case-sensitive policies the prefix covers only the series stored under it.
+	assert.False(t, tok.AllowsMetric(metricname.CaseSensitive, "teama_requests"))
+	assert.False(t, Token{Prefix: "app_"}.AllowsMetric(metricname.Prometheus, "APP_secret"))
+	assert.True(t, Token{Prefix: "app."}.AllowsMetric(metricname.Prometheus, "app.requests"))
+}
+
+func TestAuthenticator(t *testing.T) {
+	store := mapStore{
+		"reader": {Name: "reader", Scopes: []Scope{ScopeRead}},
+		"writer": {Name: "writer", Scopes: []Scope{ScopeRead, ScopeWrite}},
+	}
+	handler := NewAuthenticator(store).Authenticate(
+		Require(ScopeWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tok, ok := FromContext(r.Context())
+			assert.True(t, ok)
+			w.Write([]byte(tok.Name))
+		})),
+	)
+
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		wantCode int
+	}{
+		{name: "no credentials", wantCode: http.StatusUnauthorized},
+		{name: "unknown bearer", header: "Authorization", value: "Bearer nope", wantCode: http.StatusUnauthorized},
+		{name: "insufficient scope", header: "Authorization", value: "Bearer reader", wantCode: http.StatusForbidden},
+		{name: "bearer token", header: "Authorization", value: "Bearer writer", wantCode: http.StatusOK},
+		{name: "api key", header: "X-API-Key", value: "writer", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/update/", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.wantCode, rec.Code)
+		})
+	}
+}
+
+func TestRequire_WithoutToken(t *testing.T) {
+	// Authentication disabled: no token in context, the route stays open.
+	h := Require(ScopeAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, AllowMetric(context.Background(), metricname.CaseInsensitive, "any"))
+}
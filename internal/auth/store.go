@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FileStore is a read-only token store loaded from a JSON file.
+//
+// The file holds an array of tokens:
+//
+//	[{"token": "s3cr3t", "name": "team-a", "scopes": ["read", "write"], "prefix": "teama_", "tenant": "teama"}]
+type FileStore struct {
+	tokens map[string]Token
+}
+
+// NewFileStore loads tokens from the JSON file at path.
+func NewFileStore(path string) (*FileStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read tokens file: %w", err)
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("parse tokens file: %w", err)
+	}
+	store := &FileStore{tokens: make(map[string]Token, len(tokens))}
+	for _, t := range tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("token %q has empty secret", t.Name)
+		}
+		if err := validateScopes(t.Scopes); err != nil {
+			return nil, fmt.Errorf("token %q: %w", t.Name, err)
+		}
+		store.tokens[t.Token] = t
+	}
+	return store, nil
+}
+
+// Lookup returns the token registered under the secret.
+func (s *FileStore) Lookup(_ context.Context, token string) (Token, error) {
+	t, ok := s.tokens[token]
+	if !ok {
+		return Token{}, ErrUnknownToken
+	}
+	return t, nil
+}
+
+// DBStore is a token store backed by the auth_tokens table in PostgreSQL.
+type DBStore struct {
+	db *sql.DB
+}
+
+// NewDBStore returns a store using the auth_tokens table, created by the db
+// migrations. Tokens are stored as SHA-256 hashes, scopes as a comma-separated
+// list (e.g. "read,write").
+func NewDBStore(db *sql.DB) *DBStore {
+	return &DBStore{db: db}
+}
+
+// Lookup returns the token whose SHA-256 hash matches the secret.
+func (s *DBStore) Lookup(ctx context.Context, token string) (Token, error) {
+	var (
+		t      = Token{Token: token}
+		scopes string
+	)
+	err := s.db.QueryRowContext(ctx,
+		"SELECT Name, Scopes, Prefix, Tenant FROM auth_tokens WHERE TokenHash = $1", HashToken(token),
+	).Scan(&t.Name, &scopes, &t.Prefix, &t.Tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, ErrUnknownToken
+	}
+	if err != nil {
+		return Token{}, fmt.Errorf("lookup token: %w", err)
+	}
+	t.Scopes = parseScopes(scopes)
+	return t, nil
+}
+
+// parseScopes splits a comma-separated scope list.
+func parseScopes(raw string) []Scope {
+	var scopes []Scope
+	for _, s := range strings.Split(raw, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopes = append(scopes, Scope(strings.ToLower(s)))
+		}
+	}
+	return scopes
+}
+
+// validateScopes rejects unknown scope names.
+func validateScopes(scopes []Scope) error {
+	for _, s := range scopes {
+		switch s {
+		case ScopeRead, ScopeWrite, ScopeAdmin:
+		default:
+			return fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFileStore(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("valid file", func(t *testing.T) {
+		path := filepath.Join(dir, "tokens.json")
+		require.NoError(t, os.WriteFile(path, []byte(`[
+			{"token": "s3cr3t", "name": "team-a", "scopes": ["read", "write"], "prefix": "teama_"}
+		]`), 0600))
+
+		store, err := NewFileStore(path)
+		require.NoError(t, err)
+
+		tok, err := store.Lookup(context.Background(), "s3cr3t")
+		require.NoError(t, err)
+		assert.Equal(t, "team-a", tok.Name)
+		assert.Equal(t, "teama_", tok.Prefix)
+		assert.True(t, tok.HasScope(ScopeWrite))
+
+		_, err = store.Lookup(context.Background(), "other")
+		assert.ErrorIs(t, err, ErrUnknownToken)
+	})
+
+	t.Run("unknown scope", func(t *testing.T) {
+		path := filepath.Join(dir, "bad.json")
+		require.NoError(t, os.WriteFile(path, []byte(`[{"token": "x", "scopes": ["root"]}]`), 0600))
+		_, err := NewFileStore(path)
+		assert.Error(t, err)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := NewFileStore(filepath.Join(dir, "absent.json"))
+		assert.Error(t, err)
+	})
+}
+
+func TestDBStore_Lookup(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	store := NewDBStore(sqlDB)
+
+	mock.ExpectQuery("SELECT Name, Scopes, Prefix, Tenant FROM auth_tokens").
+		WithArgs(HashToken("s3cr3t")).
+		WillReturnRows(sqlmock.NewRows([]string{"Name", "Scopes", "Prefix", "Tenant"}).AddRow("team-a", "read, admin", "", "teama"))
+	tok, err := store.Lookup(context.Background(), "s3cr3t")
+	require.NoError(t, err)
+	assert.Equal(t, []Scope{ScopeRead, ScopeAdmin}, tok.Scopes)
+	assert.Equal(t, "teama", tok.Tenant)
+
+	mock.ExpectQuery("SELECT Name, Scopes, Prefix, Tenant FROM auth_tokens").
+		WithArgs(HashToken("missing")).
+		WillReturnRows(sqlmock.NewRows([]string{"Name", "Scopes", "Prefix", "Tenant"}))
+	_, err = store.Lookup(context.Background(), "missing")
+	assert.ErrorIs(t, err, ErrUnknownToken)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
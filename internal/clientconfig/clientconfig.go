@@ -22,6 +22,8 @@ type JSONConfig struct {
 	ReportInterval string `json:"report_interval"` // аналог переменной окружения REPORT_INTERVAL или флага -r
 	PollInterval   string `json:"poll_interval"`   // аналог переменной окружения POLL_INTERVAL или флага -p
 	CryptoKey      string `json:"crypto_key"`      // аналог переменной окружения CRYPTO_KEY или флага -crypto-key
+	Token          string `json:"token"`           // аналог переменной окружения TOKEN или флага -token
+	Tenant         string `json:"tenant"`          // аналог переменной окружения TENANT или флага -tenant
 }
 
 // ClientConfig holds all configuration settings for the client.
@@ -50,6 +52,12 @@ type ClientConfig struct {
 
 	// ConfigPath is the path to JSON configuration file.
 	ConfigPath string `env:"CONFIG" envDefault:""`
+
+	// Token is the API token sent as "Authorization: Bearer <token>".
+	Token string `env:"TOKEN" envDefault:""`
+
+	// Tenant is sent in the X-Tenant-ID header to select the server-side tenant.
+	Tenant string `env:"TENANT" envDefault:""`
 }
 
 // GetPort returns the port string formatted with a colon (e.g., ":8080").
@@ -149,14 +157,7 @@ func (o *ClientConfig) ParseFlags() {
 	// This allows flags to override env vars generally.
 	// Since flag.Parse uses the global flag set, this should ideally be called once.
 	if flag.Lookup("r") == nil { // Prevent re-definition in tests if running multiple times in same process
-		flag.IntVar(&o.ReportInterval, "r", o.ReportInterval, "Send to server interval")
-		flag.IntVar(&o.PollInterval, "p", o.PollInterval, "Refresh metrics interval")
-		flag.IntVar(&o.RateLimit, "l", o.RateLimit, "sender counter")
-		flag.Var(&o.Addr, "a", "Host and port for connect/create")
-		flag.StringVar(&o.Compress, "c", o.Compress, "Send metrics with compression")
-		flag.StringVar(&o.Key, "k", o.Key, "Cipher key")
-		flag.StringVar(&o.CryptoKey, "crypto-key", o.CryptoKey, "Public key for payload encryption")
-		flag.StringVar(&o.ConfigPath, "config", o.ConfigPath, "Path to JSON config file")
+		o.defineFlags(flag.CommandLine)
 	}
 
 	// 3. Parse Flags
@@ -186,51 +187,43 @@ func (o *ClientConfig) ParseFlags() {
 	}
 }
 
+// defineFlags registers the command-line flags in the given FlagSet,
+// using the current field values (env or defaults) as flag defaults.
+func (o *ClientConfig) defineFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.ReportInterval, "r", o.ReportInterval, "Send to server interval")
+	fs.IntVar(&o.PollInterval, "p", o.PollInterval, "Refresh metrics interval")
+	fs.IntVar(&o.RateLimit, "l", o.RateLimit, "sender counter")
+	fs.Var(&o.Addr, "a", "Host and port for connect/create")
+	fs.StringVar(&o.Compress, "c", o.Compress, "Send metrics with compression")
+	fs.StringVar(&o.Key, "k", o.Key, "Cipher key")
+	fs.StringVar(&o.CryptoKey, "crypto-key", o.CryptoKey, "Public key for payload encryption")
+	fs.StringVar(&o.ConfigPath, "config", o.ConfigPath, "Path to JSON config file")
+	fs.StringVar(&o.Token, "token", o.Token, "API token for server authentication")
+	fs.StringVar(&o.Tenant, "tenant", o.Tenant, "Tenant to report metrics to")
+}
+
 // applyJSONConfig применяет значения из JSON конфига с учётом приоритетов
 // JSON имеет самый низкий приоритет, поэтому применяется только если значение не задано через флаги/env
 func (o *ClientConfig) applyJSONConfig(cfg *JSONConfig) {
-	// Address
-	if cfg.Address != "" && !isFlagPassed("a") && os.Getenv("ADDRESS") == "" {
-		if err := o.Addr.Set(cfg.Address); err != nil {
-			fmt.Printf("Warning: invalid address in config: %v\n", err)
-		}
-	}
-
-	// ReportInterval
-	if cfg.ReportInterval != "" && !isFlagPassed("r") && os.Getenv("REPORT_INTERVAL") == "" {
-		if interval, err := parseInterval(cfg.ReportInterval); err == nil {
-			o.ReportInterval = interval
-		} else {
-			fmt.Printf("Warning: invalid report_interval in config: %v\n", err)
-		}
-	}
-
-	// PollInterval
-	if cfg.PollInterval != "" && !isFlagPassed("p") && os.Getenv("POLL_INTERVAL") == "" {
-		if interval, err := parseInterval(cfg.PollInterval); err == nil {
-			o.PollInterval = interval
-		} else {
-			fmt.Printf("Warning: invalid poll_interval in config: %v\n", err)
-		}
-	}
-
-	// CryptoKey
-	if cfg.CryptoKey != "" && !isFlagPassed("crypto-key") && os.Getenv("CRYPTO_KEY") == "" {
-		o.CryptoKey = cfg.CryptoKey
-	}
+	o.applyJSONConfigWith(cfg, isFlagPassed)
 }
 
 // applyJSONConfigFromSet применяет значения из JSON конфига для FlagSet (используется в тестах)
 func (o *ClientConfig) applyJSONConfigFromSet(cfg *JSONConfig, fs *flag.FlagSet) {
+	o.applyJSONConfigWith(cfg, func(name string) bool { return isFlagPassedInSet(fs, name) })
+}
+
+// applyJSONConfigWith применяет значения из JSON конфига; passed сообщает, был ли флаг передан явно
+func (o *ClientConfig) applyJSONConfigWith(cfg *JSONConfig, passed func(name string) bool) {
 	// Address
-	if cfg.Address != "" && !isFlagPassedInSet(fs, "a") && os.Getenv("ADDRESS") == "" {
+	if cfg.Address != "" && !passed("a") && os.Getenv("ADDRESS") == "" {
 		if err := o.Addr.Set(cfg.Address); err != nil {
 			fmt.Printf("Warning: invalid address in config: %v\n", err)
 		}
 	}
 
 	// ReportInterval
-	if cfg.ReportInterval != "" && !isFlagPassedInSet(fs, "r") && os.Getenv("REPORT_INTERVAL") == "" {
+	if cfg.ReportInterval != "" && !passed("r") && os.Getenv("REPORT_INTERVAL") == "" {
 		if interval, err := parseInterval(cfg.ReportInterval); err == nil {
 			o.ReportInterval = interval
 		} else {
@@ -239,7 +232,7 @@ func (o *ClientConfig) applyJSONConfigFromSet(cfg *JSONConfig, fs *flag.FlagSet)
 	}
 
 	// PollInterval
-	if cfg.PollInterval != "" && !isFlagPassedInSet(fs, "p") && os.Getenv("POLL_INTERVAL") == "" {
+	if cfg.PollInterval != "" && !passed("p") && os.Getenv("POLL_INTERVAL") == "" {
 		if interval, err := parseInterval(cfg.PollInterval); err == nil {
 			o.PollInterval = interval
 		} else {
@@ -248,9 +241,19 @@ func (o *ClientConfig) applyJSONConfigFromSet(cfg *JSONConfig, fs *flag.FlagSet)
 	}
 
 	// CryptoKey
-	if cfg.CryptoKey != "" && !isFlagPassedInSet(fs, "crypto-key") && os.Getenv("CRYPTO_KEY") == "" {
+	if cfg.CryptoKey != "" && !passed("crypto-key") && os.Getenv("CRYPTO_KEY") == "" {
 		o.CryptoKey = cfg.CryptoKey
 	}
+
+	// Token
+	if cfg.Token != "" && !passed("token") && os.Getenv("TOKEN") == "" {
+		o.Token = cfg.Token
+	}
+
+	// Tenant
+	if cfg.Tenant != "" && !passed("tenant") && os.Getenv("TENANT") == "" {
+		o.Tenant = cfg.Tenant
+	}
 }
 
 // ParseFlagsFromArgs is a helper for testing that allows passing custom arguments.
@@ -264,14 +267,7 @@ func (o *ClientConfig) ParseFlagsFromArgs(args []string) error {
 	envConfigPath := o.ConfigPath
 
 	fs := flag.NewFlagSet("test-client", flag.ContinueOnError)
-	fs.IntVar(&o.ReportInterval, "r", o.ReportInterval, "Send to server interval")
-	fs.IntVar(&o.PollInterval, "p", o.PollInterval, "Refresh metrics interval")
-	fs.IntVar(&o.RateLimit, "l", o.RateLimit, "sender counter")
-	fs.Var(&o.Addr, "a", "Host and port for connect/create")
-	fs.StringVar(&o.Compress, "c", o.Compress, "Send metrics with compression")
-	fs.StringVar(&o.Key, "k", o.Key, "Cipher key")
-	fs.StringVar(&o.CryptoKey, "crypto-key", o.CryptoKey, "Public key for payload encryption")
-	fs.StringVar(&o.ConfigPath, "config", o.ConfigPath, "Path to JSON config file")
+	o.defineFlags(fs)
 
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -276,6 +276,38 @@ func TestClientConfig_ParseFlagsFromArgs(t *testing.T) {
 				Addr:           addr.Addr{Host: "config-host", Port: 9999},
 			},
 		},
+		{
+			name:    "Token: flag > JSON config",
+			args:    []string{"-token", "flag-token"},
+			envVars: map[string]string{},
+			jsonConfig: &JSONConfig{
+				Token: "json-token",
+			},
+			want: ClientConfig{
+				ReportInterval: 10,
+				PollInterval:   2,
+				Compress:       "gzip",
+				RateLimit:      5,
+				Token:          "flag-token",
+				Addr:           addr.Addr{Host: "localhost", Port: 8080},
+			},
+		},
+		{
+			name:    "Token from JSON config",
+			args:    []string{},
+			envVars: map[string]string{},
+			jsonConfig: &JSONConfig{
+				Token: "json-token",
+			},
+			want: ClientConfig{
+				ReportInterval: 10,
+				PollInterval:   2,
+				Compress:       "gzip",
+				RateLimit:      5,
+				Token:          "json-token",
+				Addr:           addr.Addr{Host: "localhost", Port: 8080},
+			},
+		},
 		{
 			name:    "JSON config with complex duration",
 			args:    []string{},
@@ -342,6 +374,9 @@ func TestClientConfig_ParseFlagsFromArgs(t *testing.T) {
 			if cfg.CryptoKey != tt.want.CryptoKey {
 				t.Errorf("CryptoKey = %s, want %s", cfg.CryptoKey, tt.want.CryptoKey)
 			}
+			if cfg.Token != tt.want.Token {
+				t.Errorf("Token = %s, want %s", cfg.Token, tt.want.Token)
+			}
 
 			// Сравнение структуры Addr
 			if cfg.Addr.Host != tt.want.Addr.Host || cfg.Addr.Port != tt.want.Addr.Port {
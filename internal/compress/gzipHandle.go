@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+
+	"gometrics/internal/problem"
 )
 
 // gzipWriter wraps http.ResponseWriter to transparently compress response data using gzip.
@@ -63,7 +65,7 @@ func GzipHandleReader(next http.Handler) http.Handler {
 
 		// Reset the reader with the new request body
 		if err := gz.Reset(r.Body); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeBadRequest, "invalid gzip body: "+err.Error())
 			return
 		}
 
@@ -1,36 +1,155 @@
 // Package db provides persistent storage implementation using a PostgreSQL database.
 // It handles database connection, schema migration, and bulk operations for metrics.
+//
+// The schema evolves through the versioned SQL files in migrations/, embedded
+// in the binary and applied by Migrator on connection or by the
+// "gometrics-server migrate" command.
 package db
 
 import (
 	"context"
 	"database/sql"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
 
 	"gometrics/internal/api/metricsdto"
+	"gometrics/internal/metadata"
+	"gometrics/internal/metricname"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-// initDDL contains the SQL statement to create the initial schema for metrics.
-const initDDL = `
-CREATE TABLE IF NOT EXISTS metrics (
-    ID      TEXT PRIMARY KEY,
-    MType   TEXT NOT NULL,
-    Delta   BIGINT,
-    Value   DOUBLE PRECISION,
-    UpdateAt TIMESTAMPTZ DEFAULT now()
-);
+// tenantDDL creates a tenant schema with a metrics table shaped like public.metrics.
+// Secondary indexes are not copied: they follow the name policy of the tenant storage.
+// Existing tenant tables are kept up to date by the tenant migrations.
+const tenantDDL = `
+CREATE SCHEMA IF NOT EXISTS %[1]s;
+CREATE TABLE IF NOT EXISTS %[1]s.metrics (LIKE public.metrics INCLUDING ALL EXCLUDING INDEXES, PRIMARY KEY (ID));
 `
 
+// foldedIDIndex is the unique index on lower(ID) that makes names differing
+// only in case one row under the case-insensitive name policy.
+const foldedIDIndex = "metrics_id_lower_key"
+
+// dedupeDML deletes the rows whose normalised name (%[2]s for row a, %[3]s
+// for row b) is shared with a more recently updated row, keeping one row per name.
+const dedupeDML = `
+DELETE FROM %[1]s a USING %[1]s b
+WHERE %[2]s = %[3]s AND a.ID <> b.ID
+  AND (COALESCE(a.UpdateAt, '-infinity') < COALESCE(b.UpdateAt, '-infinity')
+    OR COALESCE(a.UpdateAt, '-infinity') = COALESCE(b.UpdateAt, '-infinity') AND a.ID < b.ID);
+`
+
+// prometheusName is the SQL counterpart of metricname.Sanitize for the column col.
+func prometheusName(col string) string {
+	return fmt.Sprintf(`regexp_replace(regexp_replace(%s, '[^a-zA-Z0-9_:]', '_', 'g'), '^([0-9])', '_\1')`, col)
+}
+
 // DBStorage represents a storage implementation backed by a SQL database.
 // It embeds *sql.DB to provide direct access to database operations if needed.
 type DBStorage struct {
 	*sql.DB
 	storeInter int
+	table      string // qualified metrics table, "metrics" when empty
+	shared     bool   // the connection pool belongs to another DBStorage
+	foldCase   bool   // IDs are unique regardless of case (foldedIDIndex exists)
+}
+
+// tableName returns the metrics table used by this storage.
+func (db *DBStorage) tableName() string {
+	if db.table == "" {
+		return "metrics"
+	}
+	return db.table
+}
+
+// ForTenant returns a storage for the tenant's own schema ("tenant_<name>"),
+// creating the schema and its metrics table if needed. The returned storage
+// shares the connection pool; closing it does not close the pool.
+func (db *DBStorage) ForTenant(ctx context.Context, tenant string) (*DBStorage, error) {
+	schema := pq.QuoteIdentifier("tenant_" + tenant)
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(tenantDDL, schema)); err != nil {
+		return nil, fmt.Errorf("create tenant schema: %w", err)
+	}
+	return &DBStorage{
+		DB:         db.DB,
+		storeInter: db.storeInter,
+		table:      schema + ".metrics",
+		shared:     true,
+	}, nil
+}
+
+// SetNamePolicy migrates the metrics table to the name policy p and makes
+// subsequent writes follow it, in one transaction:
+//   - case-insensitive: rows whose IDs differ only in case are merged, keeping
+//     the most recently updated one, and a unique index on lower(ID) is created;
+//     upserts then match rows regardless of case and keep the case of the latest write;
+//   - case-sensitive: the index on lower(ID) is dropped;
+//   - prometheus: the index on lower(ID) is dropped and IDs are rewritten like
+//     metricname.Sanitize, merging rows that now share an ID.
+func (db *DBStorage) SetNamePolicy(ctx context.Context, p metricname.Policy) (err error) {
+	table := db.tableName()
+	schema := strings.TrimSuffix(table, "metrics") // `"tenant_x".` or empty
+	var stmts []string
+	switch p {
+	case metricname.CaseSensitive:
+		stmts = []string{"DROP INDEX IF EXISTS " + schema + foldedIDIndex}
+	case metricname.Prometheus:
+		stmts = []string{
+			"DROP INDEX IF EXISTS " + schema + foldedIDIndex,
+			fmt.Sprintf(dedupeDML, table, prometheusName("a.ID"), prometheusName("b.ID")),
+			fmt.Sprintf("UPDATE %s SET ID = %s WHERE ID <> %[2]s", table, prometheusName("ID")),
+		}
+	default:
+		stmts = []string{
+			fmt.Sprintf(dedupeDML, table, "lower(a.ID)", "lower(b.ID)"),
+			fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (lower(ID))", foldedIDIndex, table),
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				err = fmt.Errorf("rollback failed: %v (original err: %w)", rbErr, err)
+			}
+		}
+	}()
+	for _, stmt := range stmts {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migrate metric names to %s: %w", p, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	db.foldCase = p.FoldsCase()
+	return nil
 }
 
-// CreateConnection establishes a connection to the database and applies initial migrations.
+// conflictTarget returns the ON CONFLICT target of the metric upserts.
+func (db *DBStorage) conflictTarget() string {
+	if db.foldCase {
+		return "((lower(ID)))"
+	}
+	return "(ID)"
+}
+
+// Close closes the connection pool unless it is shared with another storage.
+func (db *DBStorage) Close() error {
+	if db.shared {
+		return nil
+	}
+	return db.DB.Close()
+}
+
+// CreateConnection establishes a connection to the database and applies pending migrations.
 // It returns a new *DBStorage instance or an error if connection or migration fails.
 //
 // The 'connectionString' parameter typically follows the PostgreSQL DSN format.
@@ -45,24 +164,17 @@ func CreateConnection(ctx context.Context, dbType, connectionString string) (*DB
 		return nil, fmt.Errorf("ping database: %w", err)
 	}
 
-	tx, err := db.BeginTx(ctx, nil)
+	migrator, err := NewMigrator(db)
 	if err != nil {
-		return nil, err
+		db.Close()
+		return nil, fmt.Errorf("load migrations: %w", err)
 	}
-	defer func() {
-		if err != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				err = fmt.Errorf("rollback failed: %v (original err: %w)", rbErr, err)
-			}
-		}
-	}()
-
-	if _, err := db.ExecContext(ctx, initDDL); err != nil {
+	if _, err := migrator.Up(ctx); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("apply migrations: %w", err)
 	}
 
-	return &DBStorage{db, 0}, tx.Commit()
+	return &DBStorage{DB: db}, nil
 }
 
 // Ping checks the connection to the database.
@@ -76,7 +188,7 @@ func (db *DBStorage) Ping(ctx context.Context) error {
 func (db *DBStorage) ImportLogs(ctx context.Context) ([]metricsdto.Metrics, error) {
 	metrics := make([]metricsdto.Metrics, 0)
 
-	rows, err := db.QueryContext(ctx, "SELECT ID, MType, Delta, Value from metrics")
+	rows, err := db.QueryContext(ctx, "SELECT ID, MType, Delta, Value, UpdateAt, TTL from "+db.tableName())
 	if err != nil {
 		return nil, err
 	}
@@ -84,13 +196,15 @@ func (db *DBStorage) ImportLogs(ctx context.Context) ([]metricsdto.Metrics, erro
 	defer rows.Close()
 
 	var (
-		delta sql.NullInt64
-		value sql.NullFloat64
+		delta    sql.NullInt64
+		value    sql.NullFloat64
+		updateAt sql.NullTime
+		ttl      sql.NullInt64
 	)
 
 	for rows.Next() {
 		var v metricsdto.Metrics
-		err = rows.Scan(&v.ID, &v.MType, &delta, &value)
+		err = rows.Scan(&v.ID, &v.MType, &delta, &value, &updateAt, &ttl)
 		if err != nil {
 			return nil, err
 		}
@@ -103,6 +217,14 @@ func (db *DBStorage) ImportLogs(ctx context.Context) ([]metricsdto.Metrics, erro
 			val := value.Float64
 			v.Value = &val
 		}
+		if updateAt.Valid {
+			ts := updateAt.Time.UnixMilli()
+			v.Timestamp = &ts
+		}
+		if ttl.Valid {
+			seconds := ttl.Int64
+			v.TTL = &seconds
+		}
 
 		metrics = append(metrics, v)
 	}
@@ -113,6 +235,38 @@ func (db *DBStorage) ImportLogs(ctx context.Context) ([]metricsdto.Metrics, erro
 	return metrics, nil
 }
 
+// gaugeUpsert upserts the gauges passed as parallel arrays of IDs, values,
+// sample times (NULL = now()) and TTLs in seconds (NULL = none) in one statement.
+const gaugeUpsert = `
+INSERT INTO %s (ID, MType, Delta, Value, UpdateAt, TTL)
+SELECT u.id, 'gauge', NULL, u.value, COALESCE(u.at, now()), u.ttl
+FROM unnest($1::text[], $2::float8[], $3::timestamptz[], $4::int8[]) AS u(id, value, at, ttl)
+ON CONFLICT %s DO UPDATE
+SET ID = EXCLUDED.ID, value = EXCLUDED.value, delta = NULL, UpdateAt = EXCLUDED.UpdateAt, TTL = EXCLUDED.TTL;
+`
+
+// counterUpsert is gaugeUpsert for counter totals.
+const counterUpsert = `
+INSERT INTO %s (ID, MType, Delta, Value, UpdateAt, TTL)
+SELECT u.id, 'counter', u.delta, NULL, COALESCE(u.at, now()), u.ttl
+FROM unnest($1::text[], $2::int8[], $3::timestamptz[], $4::int8[]) AS u(id, delta, at, ttl)
+ON CONFLICT %s DO UPDATE
+SET ID = EXCLUDED.ID, delta = EXCLUDED.delta, value = NULL, UpdateAt = EXCLUDED.UpdateAt, TTL = EXCLUDED.TTL;
+`
+
+// counterAdd is counterUpsert for counter increments: they are added to the
+// stored totals, so servers sharing the table do not overwrite each other.
+// The sample time only moves forward. It returns the new totals.
+const counterAdd = `
+INSERT INTO %s AS m (ID, MType, Delta, Value, UpdateAt, TTL)
+SELECT u.id, 'counter', u.delta, NULL, COALESCE(u.at, now()), u.ttl
+FROM unnest($1::text[], $2::int8[], $3::timestamptz[], $4::int8[]) AS u(id, delta, at, ttl)
+ON CONFLICT %s DO UPDATE
+SET ID = EXCLUDED.ID, delta = COALESCE(m.delta, 0) + EXCLUDED.delta, value = NULL,
+    UpdateAt = GREATEST(m.UpdateAt, EXCLUDED.UpdateAt), TTL = EXCLUDED.TTL
+RETURNING ID, delta;
+`
+
 // FormattingLogs bulk inserts or updates the provided gauge and counter metrics.
 // It uses a transaction to ensure atomicity.
 //
@@ -120,9 +274,95 @@ func (db *DBStorage) ImportLogs(ctx context.Context) ([]metricsdto.Metrics, erro
 // - If the metric ID exists, it updates the value/delta and sets UpdateAt to now().
 // - If it does not exist, it inserts a new row.
 func (db *DBStorage) FormattingLogs(ctx context.Context, gauge map[string]float64, counter map[string]int) error {
+	return db.FormattingLogsAt(ctx, gauge, counter, nil, nil)
+}
+
+// FormattingLogsAt works like FormattingLogs but sets UpdateAt to the sample time
+// returned by at. A nil at or a zero time falls back to now(). The TTL column
+// is set to the explicit TTL returned by ttl; a nil ttl or a zero one stores none.
+//
+// The series are sent as arrays and upserted set-based, one statement per
+// metric type, so a flush takes the same few round trips whatever the number
+// of series. IDs are sorted, so that concurrent flushes lock rows in the same order.
+func (db *DBStorage) FormattingLogsAt(ctx context.Context, gauge map[string]float64, counter map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration) error {
+	_, err := db.upsert(ctx, gauge, counter, at, ttl, false)
+	return err
+}
+
+// AddCounters upserts the gauges like WriteSeries but adds the counter
+// increments to the stored totals instead of replacing them, in one
+// transaction. It returns the new totals of the counters. Several servers
+// sharing the database keep consistent counters this way.
+func (db *DBStorage) AddCounters(ctx context.Context, gauge map[string]float64, deltas map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration) (map[string]int, error) {
+	return db.upsert(ctx, gauge, deltas, at, ttl, true)
+}
+
+// LoadCounters returns the stored totals of all counters.
+func (db *DBStorage) LoadCounters(ctx context.Context) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT ID, Delta FROM %s WHERE MType = 'counter' AND Delta IS NOT NULL", db.tableName()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load counters: %w", err)
+	}
+	defer rows.Close()
+	return scanCounters(rows)
+}
+
+// scanCounters reads (ID, Delta) rows into a map.
+func scanCounters(rows *sql.Rows) (map[string]int, error) {
+	totals := make(map[string]int)
+	for rows.Next() {
+		var (
+			id    string
+			total int64
+		)
+		if err := rows.Scan(&id, &total); err != nil {
+			return nil, err
+		}
+		totals[id] = int(total)
+	}
+	return totals, rows.Err()
+}
+
+// upsert writes the gauges and counters in one transaction. With add set the
+// counters are increments and their new totals are returned.
+func (db *DBStorage) upsert(ctx context.Context, gauge map[string]float64, counter map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration, add bool) (totals map[string]int, err error) {
+	sampleTime := func(mtype, name string) sql.NullTime {
+		if at == nil {
+			return sql.NullTime{}
+		}
+		t := at(mtype, name)
+		return sql.NullTime{Time: t, Valid: !t.IsZero()}
+	}
+	seconds := func(mtype, name string) sql.NullInt64 {
+		if ttl == nil {
+			return sql.NullInt64{}
+		}
+		d := ttl(mtype, name)
+		return sql.NullInt64{Int64: int64(d / time.Second), Valid: d > 0}
+	}
+
+	gaugeIDs := slices.Sorted(maps.Keys(gauge))
+	gaugeValues := make([]float64, len(gaugeIDs))
+	gaugeTimes := make([]sql.NullTime, len(gaugeIDs))
+	gaugeTTLs := make([]sql.NullInt64, len(gaugeIDs))
+	for i, id := range gaugeIDs {
+		gaugeValues[i] = gauge[id]
+		gaugeTimes[i] = sampleTime(metricsdto.MetricTypeGauge, id)
+		gaugeTTLs[i] = seconds(metricsdto.MetricTypeGauge, id)
+	}
+	counterIDs := slices.Sorted(maps.Keys(counter))
+	counterDeltas := make([]int64, len(counterIDs))
+	counterTimes := make([]sql.NullTime, len(counterIDs))
+	counterTTLs := make([]sql.NullInt64, len(counterIDs))
+	for i, id := range counterIDs {
+		counterDeltas[i] = int64(counter[id])
+		counterTimes[i] = sampleTime(metricsdto.MetricTypeCounter, id)
+		counterTTLs[i] = seconds(metricsdto.MetricTypeCounter, id)
+	}
+
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
 		if err != nil {
@@ -132,44 +372,128 @@ func (db *DBStorage) FormattingLogs(ctx context.Context, gauge map[string]float6
 		}
 	}()
 
-	gaugeStmt, err := tx.PrepareContext(ctx, `
-        INSERT INTO metrics (ID, MType, Delta, Value)
-        VALUES ($1, 'gauge', NULL, $2)
-        ON CONFLICT (id) DO UPDATE
-        SET value = EXCLUDED.value, delta = NULL, UpdateAt = now();
-    `)
+	if len(gaugeIDs) > 0 {
+		query := fmt.Sprintf(gaugeUpsert, db.tableName(), db.conflictTarget())
+		if _, err = tx.ExecContext(ctx, query, pq.Array(gaugeIDs), pq.Array(gaugeValues), pq.Array(gaugeTimes), pq.Array(gaugeTTLs)); err != nil {
+			return nil, fmt.Errorf("cannot upsert gauges: %w", err)
+		}
+	}
+	switch {
+	case len(counterIDs) == 0:
+	case add:
+		if totals, err = db.addCounters(ctx, tx, counterIDs, counterDeltas, counterTimes, counterTTLs); err != nil {
+			return nil, fmt.Errorf("cannot add counters: %w", err)
+		}
+	default:
+		query := fmt.Sprintf(counterUpsert, db.tableName(), db.conflictTarget())
+		if _, err = tx.ExecContext(ctx, query, pq.Array(counterIDs), pq.Array(counterDeltas), pq.Array(counterTimes), pq.Array(counterTTLs)); err != nil {
+			return nil, fmt.Errorf("cannot upsert counters: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+// addCounters runs counterAdd in tx and returns the new totals.
+func (db *DBStorage) addCounters(ctx context.Context, tx *sql.Tx, ids []string, deltas []int64, times []sql.NullTime, ttls []sql.NullInt64) (map[string]int, error) {
+	query := fmt.Sprintf(counterAdd, db.tableName(), db.conflictTarget())
+	rows, err := tx.QueryContext(ctx, query, pq.Array(ids), pq.Array(deltas), pq.Array(times), pq.Array(ttls))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+	return scanCounters(rows)
+}
+
+// WriteSeries upserts only the given series in one transaction; rows of other
+// series are left untouched. It is used to persist the series changed since the last write.
+func (db *DBStorage) WriteSeries(ctx context.Context, gauge map[string]float64, counter map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration) error {
+	return db.FormattingLogsAt(ctx, gauge, counter, at, ttl)
+}
+
+// DeleteMetrics removes the given series, matched by ID and type, in one transaction.
+func (db *DBStorage) DeleteMetrics(ctx context.Context, metrics []metricsdto.Metrics) error {
+	ids := make(map[string][]string)
+	for _, m := range metrics {
+		id := m.ID
+		if db.foldCase {
+			id = strings.ToLower(id)
+		}
+		ids[m.MType] = append(ids[m.MType], id)
 	}
-	defer gaugeStmt.Close()
 
-	counterStmt, err := tx.PrepareContext(ctx, `
-        INSERT INTO metrics (ID, MType, Delta, Value)
-        VALUES ($1, 'counter', $2, NULL)
-        ON CONFLICT (id) DO UPDATE
-        SET delta = EXCLUDED.delta, value = NULL, UpdateAt = now();
-    `)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer counterStmt.Close()
-
-	for gkey, gvalue := range gauge {
-		_, err := gaugeStmt.ExecContext(ctx, gkey, gvalue)
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("cannot insert gauge: %v", err)
+			if rbErr := tx.Rollback(); rbErr != nil {
+				err = fmt.Errorf("rollback failed: %v (original err: %w)", rbErr, err)
+			}
 		}
+	}()
+
+	column := "ID"
+	if db.foldCase {
+		column = "lower(ID)"
 	}
-	for ckey, cvalue := range counter {
-		_, err := counterStmt.ExecContext(ctx, ckey, int64(cvalue))
-		if err != nil {
-			return fmt.Errorf("cannot insert counter: %v", err)
+	query := fmt.Sprintf("DELETE FROM %s WHERE MType = $1 AND %s = ANY($2)", db.tableName(), column)
+	for _, mtype := range []string{metricsdto.MetricTypeGauge, metricsdto.MetricTypeCounter} {
+		if len(ids[mtype]) == 0 {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, query, mtype, pq.Array(ids[mtype])); err != nil {
+			return fmt.Errorf("cannot delete %s metrics: %w", mtype, err)
 		}
 	}
 
 	return tx.Commit()
 }
 
+// LoadMetadata retrieves the metadata of all metrics. Metadata is shared by all
+// tenants and always kept in the public metric_metadata table.
+func (db *DBStorage) LoadMetadata(ctx context.Context) ([]metadata.Metadata, error) {
+	rows, err := db.QueryContext(ctx, "SELECT Name, MType, Unit, Help FROM metric_metadata")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []metadata.Metadata
+	for rows.Next() {
+		var m metadata.Metadata
+		if err := rows.Scan(&m.Name, &m.Type, &m.Unit, &m.Help); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// SaveMetadata inserts or replaces the metadata of m.Name. Under the
+// case-insensitive name policy it also replaces the metadata of names
+// differing from m.Name only in case.
+func (db *DBStorage) SaveMetadata(ctx context.Context, m metadata.Metadata) error {
+	replaced := ""
+	if db.foldCase {
+		replaced = "WITH replaced AS (DELETE FROM metric_metadata WHERE lower(Name) = lower($1) AND Name <> $1)"
+	}
+	_, err := db.ExecContext(ctx, replaced+`
+        INSERT INTO metric_metadata (Name, MType, Unit, Help)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (Name) DO UPDATE
+        SET MType = EXCLUDED.MType, Unit = EXCLUDED.Unit, Help = EXCLUDED.Help;
+    `, m.Name, m.Type, m.Unit, m.Help)
+	if err != nil {
+		return fmt.Errorf("cannot save metadata: %w", err)
+	}
+	return nil
+}
+
 // GetLoopTime returns the configured storage interval (currently always 0 for DB).
 func (db *DBStorage) GetLoopTime() int {
 	return db.storeInter
@@ -2,15 +2,22 @@ package db
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"regexp"
 	"testing"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+	"gometrics/internal/metadata"
+	"gometrics/internal/metricname"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 )
 
-// TestCreateConnection verifies the initialization sequence: Open -> Ping -> Begin -> Exec DDL -> Commit.
+// TestCreateConnection verifies the initialization sequence: Open -> Ping -> apply pending migrations.
 func TestCreateConnection(t *testing.T) {
 	const dsn = "sqlmock_create_conn"
 
@@ -22,10 +29,36 @@ func TestCreateConnection(t *testing.T) {
 
 	mock.ExpectPing()
 
+	expectMigrationLock(mock, sqlmock.NewRows([]string{"Version", "AppliedAt"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS metrics").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(int64(1), "create_metrics").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("ALTER TABLE metrics ADD COLUMN IF NOT EXISTS TTL").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(int64(2), "add_metrics_ttl").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT nspname FROM pg_namespace").
+		WillReturnRows(sqlmock.NewRows([]string{"nspname"}).AddRow("tenant_teama"))
+	mock.ExpectExec(regexp.QuoteMeta(`SET LOCAL search_path TO "tenant_teama"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE metrics ADD COLUMN IF NOT EXISTS TTL").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(int64(3), "create_auth_tokens").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 	mock.ExpectBegin()
-	// Используем QuoteMeta, так как DDL содержит спецсимволы
-	mock.ExpectExec(regexp.QuoteMeta(initDDL)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(int64(4), "create_idempotency_keys").
+		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
+	expectMigrationUnlock(mock)
 
 	conn, err := CreateConnection(context.Background(), "sqlmock", dsn)
 
@@ -59,11 +92,12 @@ func TestDBStorage_ImportLogs(t *testing.T) {
 	storage := &DBStorage{DB: sqlDB}
 
 	// Mocking rows
-	rows := sqlmock.NewRows([]string{"ID", "MType", "Delta", "Value"}).
-		AddRow("test_gauge", "gauge", nil, 123.456).
-		AddRow("test_counter", "counter", 10, nil)
+	updated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"ID", "MType", "Delta", "Value", "UpdateAt", "TTL"}).
+		AddRow("test_gauge", "gauge", nil, 123.456, updated, 60).
+		AddRow("test_counter", "counter", 10, nil, nil, nil)
 
-	mock.ExpectQuery("SELECT ID, MType, Delta, Value from metrics").
+	mock.ExpectQuery("SELECT ID, MType, Delta, Value, UpdateAt, TTL from metrics").
 		WillReturnRows(rows)
 
 	metrics, err := storage.ImportLogs(context.Background())
@@ -76,6 +110,10 @@ func TestDBStorage_ImportLogs(t *testing.T) {
 	require.Nil(t, metrics[0].Delta)
 	require.NotNil(t, metrics[0].Value)
 	require.Equal(t, 123.456, *metrics[0].Value)
+	require.NotNil(t, metrics[0].Timestamp)
+	require.Equal(t, updated.UnixMilli(), *metrics[0].Timestamp)
+	require.NotNil(t, metrics[0].TTL)
+	require.Equal(t, int64(60), *metrics[0].TTL)
 
 	// Verify Counter
 	require.Equal(t, "test_counter", metrics[1].ID)
@@ -83,6 +121,8 @@ func TestDBStorage_ImportLogs(t *testing.T) {
 	require.NotNil(t, metrics[1].Delta)
 	require.Equal(t, int64(10), *metrics[1].Delta)
 	require.Nil(t, metrics[1].Value)
+	require.Nil(t, metrics[1].Timestamp)
+	require.Nil(t, metrics[1].TTL)
 
 	require.NoError(t, mock.ExpectationsWereMet())
 }
@@ -95,37 +135,163 @@ func TestDBStorage_FormattingLogs(t *testing.T) {
 
 	storage := &DBStorage{DB: sqlDB}
 
-	gauges := map[string]float64{"g1": 1.1}
+	gauges := map[string]float64{"g2": 2.2, "g1": 1.1}
 	counters := map[string]int{"c1": 100}
 
 	mock.ExpectBegin()
 
-	// Ожидаем подготовку выражения для gauge
-	mock.ExpectPrepare("INSERT INTO metrics .* 'gauge'")
-	// Ожидаем подготовку выражения для counter
-	mock.ExpectPrepare("INSERT INTO metrics .* 'counter'")
+	// Все gauge одним выражением: массивы ID, значений и времён, ID отсортированы
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO metrics (ID, MType, Delta, Value, UpdateAt, TTL) SELECT u.id, 'gauge'")).
+		WithArgs(pq.Array([]string{"g1", "g2"}), pq.Array([]float64{1.1, 2.2}), pq.Array([]sql.NullTime{{}, {}}), pq.Array([]sql.NullInt64{{}, {}})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
 
-	// Ожидаем выполнение (порядок важен, в коде gauge идет первым)
-	mock.ExpectExec("INSERT INTO metrics").
-		WithArgs("g1", 1.1).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Затем все counter (порядок важен, в коде gauge идет первым)
+	mock.ExpectExec(regexp.QuoteMeta("FROM unnest($1::text[], $2::int8[], $3::timestamptz[], $4::int8[])")).
+		WithArgs(pq.Array([]string{"c1"}), pq.Array([]int64{100}), pq.Array([]sql.NullTime{{}}), pq.Array([]sql.NullInt64{{}})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectCommit()
+
+	err = storage.FormattingLogs(context.Background(), gauges, counters)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestDBStorage_FormattingLogsAt verifies that sample times are written to
+// UpdateAt and explicit TTLs to TTL.
+func TestDBStorage_FormattingLogsAt(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	storage := &DBStorage{DB: sqlDB}
+	sampled := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(mtype, name string) time.Time {
+		if name == "g1" {
+			return sampled
+		}
+		return time.Time{}
+	}
+	ttl := func(mtype, name string) time.Duration {
+		if name == "c1" {
+			return time.Minute
+		}
+		return 0
+	}
 
-	mock.ExpectExec("INSERT INTO metrics").
-		WithArgs("c1", int64(100)).
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO metrics .* 'gauge'").
+		WithArgs(pq.Array([]string{"g1"}), pq.Array([]float64{1.1}), pq.Array([]sql.NullTime{{Time: sampled, Valid: true}}), pq.Array([]sql.NullInt64{{}})).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO metrics .* 'counter'").
+		WithArgs(pq.Array([]string{"c1"}), pq.Array([]int64{100}), pq.Array([]sql.NullTime{{}}), pq.Array([]sql.NullInt64{{Int64: 60, Valid: true}})).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	// Ожидаем закрытие prepared statements (defer Close())
-	// sqlmock может требовать явного ожидания закрытия, если strict mode.
-	// Обычно это не обязательно, но полезно знать.
-	// Тут мы просто проверяем Commit.
+	err = storage.FormattingLogsAt(context.Background(), map[string]float64{"g1": 1.1}, map[string]int{"c1": 100}, at, ttl)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestDBStorage_FormattingLogsOnlyGauges verifies that a type without series
+// costs no statement.
+func TestDBStorage_FormattingLogsOnlyGauges(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	storage := &DBStorage{DB: sqlDB}
 
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO metrics .* 'gauge'").
+		WithArgs(pq.Array([]string{"g1"}), pq.Array([]float64{1.1}), pq.Array([]sql.NullTime{{}}), pq.Array([]sql.NullInt64{{}})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
-	err = storage.FormattingLogs(context.Background(), gauges, counters)
+	err = storage.FormattingLogs(context.Background(), map[string]float64{"g1": 1.1}, map[string]int{})
 	require.NoError(t, err)
 	require.NoError(t, mock.ExpectationsWereMet())
 }
 
+// TestDBStorage_AddCounters verifies that counter increments are added to the
+// stored totals and the new totals are returned.
+func TestDBStorage_AddCounters(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	storage := &DBStorage{DB: sqlDB}
+
+	t.Run("adds increments", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO metrics .* 'gauge'").
+			WithArgs(pq.Array([]string{"g1"}), pq.Array([]float64{1.1}), pq.Array([]sql.NullTime{{}}), pq.Array([]sql.NullInt64{{}})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO metrics AS m")+".*"+
+			regexp.QuoteMeta("delta = COALESCE(m.delta, 0) + EXCLUDED.delta")+".*RETURNING ID, delta").
+			WithArgs(pq.Array([]string{"c1", "c2"}), pq.Array([]int64{2, 5}), pq.Array([]sql.NullTime{{}, {}}), pq.Array([]sql.NullInt64{{}, {}})).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "delta"}).AddRow("c1", 12).AddRow("c2", 5))
+		mock.ExpectCommit()
+
+		totals, err := storage.AddCounters(context.Background(), map[string]float64{"g1": 1.1}, map[string]int{"c2": 5, "c1": 2}, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, map[string]int{"c1": 12, "c2": 5}, totals)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rolls back on error", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("INSERT INTO metrics AS m").WillReturnError(fmt.Errorf("conflict"))
+		mock.ExpectRollback()
+
+		_, err := storage.AddCounters(context.Background(), nil, map[string]int{"c1": 1}, nil, nil)
+		require.ErrorContains(t, err, "cannot add counters")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("loads totals", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT ID, Delta FROM metrics WHERE MType = 'counter'")).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "delta"}).AddRow("c1", 12))
+
+		totals, err := storage.LoadCounters(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, map[string]int{"c1": 12}, totals)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// BenchmarkDBStorage_FormattingLogs measures a flush of 10k series: the whole
+// batch is two statements in one transaction whatever the number of series.
+func BenchmarkDBStorage_FormattingLogs(b *testing.B) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(b, err)
+	defer sqlDB.Close()
+
+	storage := &DBStorage{DB: sqlDB}
+	gauges := make(map[string]float64, 5000)
+	counters := make(map[string]int, 5000)
+	for i := range 5000 {
+		gauges[fmt.Sprintf("gauge_%d", i)] = float64(i) / 3
+		counters[fmt.Sprintf("counter_%d", i)] = i
+	}
+	ctx := context.Background()
+
+	for b.Loop() {
+		b.StopTimer()
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO metrics .* 'gauge'").WillReturnResult(sqlmock.NewResult(0, 5000))
+		mock.ExpectExec("INSERT INTO metrics .* 'counter'").WillReturnResult(sqlmock.NewResult(0, 5000))
+		mock.ExpectCommit()
+		b.StartTimer()
+
+		if err := storage.FormattingLogs(ctx, gauges, counters); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	require.NoError(b, mock.ExpectationsWereMet())
+}
+
 // ExampleCreateConnection demonstrates how to initialize the DB storage.
 // Note: This example uses a hypothetical "postgres" driver and connection string.
 func ExampleCreateConnection() {
@@ -142,3 +308,150 @@ func ExampleCreateConnection() {
 	// Output:
 	// DB Connection initialized (example)
 }
+
+// TestDBStorage_ForTenant verifies that a tenant storage creates its schema and
+// writes to its own table without closing the shared pool.
+func TestDBStorage_DeleteMetrics(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM metrics WHERE MType = $1 AND ID = ANY($2)")).
+		WithArgs("gauge", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM metrics WHERE MType = $1 AND ID = ANY($2)")).
+		WithArgs("counter", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	storage := &DBStorage{DB: sqlDB}
+	err = storage.DeleteMetrics(context.Background(), []metricsdto.Metrics{
+		{ID: "Alloc", MType: "gauge"},
+		{ID: "Frees", MType: "gauge"},
+		{ID: "PollCount", MType: "counter"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDBStorage_Metadata(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	mock.ExpectExec("INSERT INTO metric_metadata").
+		WithArgs("Alloc", "gauge", "bytes", "Allocated heap objects").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT Name, MType, Unit, Help FROM metric_metadata")).
+		WillReturnRows(sqlmock.NewRows([]string{"Name", "MType", "Unit", "Help"}).
+			AddRow("Alloc", "gauge", "bytes", "Allocated heap objects"))
+
+	storage := &DBStorage{DB: sqlDB}
+	m := metadata.Metadata{Name: "Alloc", Type: "gauge", Unit: "bytes", Help: "Allocated heap objects"}
+	require.NoError(t, storage.SaveMetadata(context.Background(), m))
+
+	got, err := storage.LoadMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []metadata.Metadata{m}, got)
+
+	// Under the case-insensitive policy the metadata of "alloc" is replaced too.
+	mock.ExpectExec(regexp.QuoteMeta("WITH replaced AS (DELETE FROM metric_metadata WHERE lower(Name) = lower($1) AND Name <> $1)")).
+		WithArgs("Alloc", "gauge", "bytes", "Allocated heap objects").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	storage.foldCase = true
+	require.NoError(t, storage.SaveMetadata(context.Background(), m))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDBStorage_ForTenant(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE SCHEMA IF NOT EXISTS "tenant_teama"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`from "tenant_teama".metrics`)).
+		WillReturnRows(sqlmock.NewRows([]string{"ID", "MType", "Delta", "Value"}))
+
+	base := &DBStorage{DB: sqlDB}
+	tenantDB, err := base.ForTenant(context.Background(), "teama")
+	require.NoError(t, err)
+
+	_, err = tenantDB.ImportLogs(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, tenantDB.Close())
+	require.NoError(t, sqlDB.Ping(), "closing a tenant storage must not close the pool")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestDBStorage_SetNamePolicy verifies the migration statements of every name
+// policy and that case-insensitive upserts and deletes match IDs regardless of case.
+func TestDBStorage_SetNamePolicy(t *testing.T) {
+	tests := []struct {
+		policy metricname.Policy
+		table  string
+		stmts  []string
+	}{
+		{
+			policy: metricname.CaseInsensitive,
+			stmts: []string{
+				"DELETE FROM metrics a USING metrics b WHERE lower(a.ID) = lower(b.ID)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS metrics_id_lower_key ON metrics (lower(ID))",
+			},
+		},
+		{
+			policy: metricname.CaseSensitive,
+			table:  `"tenant_teama".metrics`,
+			stmts:  []string{`DROP INDEX IF EXISTS "tenant_teama".metrics_id_lower_key`},
+		},
+		{
+			policy: metricname.Prometheus,
+			stmts: []string{
+				"DROP INDEX IF EXISTS metrics_id_lower_key",
+				"DELETE FROM metrics a USING metrics b WHERE regexp_replace(regexp_replace(a.ID,",
+				"UPDATE metrics SET ID = regexp_replace(",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			sqlDB, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer sqlDB.Close()
+
+			mock.ExpectBegin()
+			for _, stmt := range tt.stmts {
+				mock.ExpectExec(regexp.QuoteMeta(stmt)).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			mock.ExpectCommit()
+
+			storage := &DBStorage{DB: sqlDB, table: tt.table}
+			require.NoError(t, storage.SetNamePolicy(context.Background(), tt.policy))
+			require.Equal(t, tt.policy == metricname.CaseInsensitive, storage.foldCase)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("case-insensitive writes", func(t *testing.T) {
+		sqlDB, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer sqlDB.Close()
+		storage := &DBStorage{DB: sqlDB, foldCase: true}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("ON CONFLICT ((lower(ID))) DO UPDATE SET ID = EXCLUDED.ID, value")).
+			WithArgs(pq.Array([]string{"Alloc"}), pq.Array([]float64{1.5}), pq.Array([]sql.NullTime{{}}), pq.Array([]sql.NullInt64{{}})).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		require.NoError(t, storage.FormattingLogs(context.Background(), map[string]float64{"Alloc": 1.5}, nil))
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM metrics WHERE MType = $1 AND lower(ID) = ANY($2)")).
+			WithArgs("gauge", pq.Array([]string{"alloc"})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		require.NoError(t, storage.DeleteMetrics(context.Background(), []metricsdto.Metrics{{ID: "Alloc", MType: "gauge"}}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// migrationFiles holds the schema migrations: "NNNN_name.up.sql" and
+// "NNNN_name.down.sql", applied in version order, and optionally
+// "NNNN_name.tenant.up.sql" and "NNNN_name.tenant.down.sql", applied in every
+// tenant schema.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsDDL creates the table recording the applied migrations.
+const migrationsDDL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    Version   BIGINT PRIMARY KEY,
+    Name      TEXT NOT NULL,
+    AppliedAt TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// migrationLockID is the key of the session-level advisory lock held while
+// migrating, so that servers starting together do not migrate concurrently.
+const migrationLockID int64 = 7_318_412_205_000_001
+
+// ErrNoDownMigration is returned when rolling back a version without a down migration.
+var ErrNoDownMigration = errors.New("no down migration")
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(tenant\.)?(up|down)\.sql$`)
+
+// tenantSchemas lists the schemas created by DBStorage.ForTenant.
+const tenantSchemas = `SELECT nspname FROM pg_namespace WHERE nspname LIKE 'tenant\_%' ORDER BY nspname`
+
+// Migration is one schema change with the SQL to apply and to revert it.
+// TenantUp and TenantDown run in every tenant schema (with search_path set to
+// it) after Up and Down, in the same transaction; tenant schemas created later
+// copy public.metrics and need no migrations.
+type Migration struct {
+	Version    int64
+	Name       string
+	Up         string
+	Down       string // empty if the migration cannot be reverted
+	TenantUp   string
+	TenantDown string
+}
+
+// MigrationStatus reports whether a migration is applied.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// LoadMigrations reads the migrations in the root of fsys, sorted by version.
+// Every version needs an up migration; down migrations are optional.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, name := range names {
+		match := migrationName.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: name is not NNNN_name[.tenant].(up|down).sql", name)
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: bad version", name)
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %s: version %d is already used by %s", name, version, m.Name)
+		}
+		switch match[3] + match[4] {
+		case "up":
+			m.Up = string(data)
+		case "down":
+			m.Down = string(data)
+		case "tenant.up":
+			m.TenantUp = string(data)
+		default:
+			m.TenantDown = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s: missing up migration", m.Version, m.Name)
+		}
+		if m.Down != "" && m.TenantUp != "" && m.TenantDown == "" {
+			return nil, fmt.Errorf("migration %d_%s: missing tenant down migration", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts schema migrations, recording them in the
+// schema_migrations table. Every migration runs in its own transaction; the
+// whole run holds a PostgreSQL advisory lock.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator returns a migrator for the migrations embedded in the binary.
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := LoadMigrations(sub)
+	if err != nil {
+		return nil, err
+	}
+	return NewMigratorWith(db, migrations), nil
+}
+
+// NewMigratorWith returns a migrator for the given migrations, sorted by version.
+func NewMigratorWith(db *sql.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// Up applies all pending migrations in version order, in the public schema
+// and then in every tenant schema, and returns their versions.
+func (m *Migrator) Up(ctx context.Context) ([]int64, error) {
+	var done []int64
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (Version, Name) VALUES ($1, $2)", mig.Version, mig.Name); err != nil {
+					return err
+				}
+				return inTenants(ctx, tx, mig.TenantUp)
+			})
+			if err != nil {
+				return fmt.Errorf("apply migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns
+// their versions.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]int64, error) {
+	var done []int64
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		known := make(map[int64]Migration, len(m.migrations))
+		for _, mig := range m.migrations {
+			known[mig.Version] = mig
+		}
+		versions := make([]int64, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+		for _, v := range versions[:min(max(steps, 0), len(versions))] {
+			mig, ok := known[v]
+			if !ok || mig.Down == "" {
+				return fmt.Errorf("revert migration %d: %w", v, ErrNoDownMigration)
+			}
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE Version = $1", v); err != nil {
+					return err
+				}
+				return inTenants(ctx, tx, mig.TenantDown)
+			})
+			if err != nil {
+				return fmt.Errorf("revert migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, v)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists the known migrations and whether each one is applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var status []MigrationStatus
+	err := m.locked(ctx, func(_ *sql.Conn, applied map[int64]time.Time) error {
+		for _, mig := range m.migrations {
+			at, ok := applied[mig.Version]
+			status = append(status, MigrationStatus{Migration: mig, Applied: ok, AppliedAt: at})
+		}
+		return nil
+	})
+	return status, err
+}
+
+// locked runs fn on a dedicated connection holding the migration advisory
+// lock, passing the applied versions and their times.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, applied map[int64]time.Time) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("migrate: acquire lock: %w", err)
+	}
+	defer func() {
+		// The lock is released with the session anyway if this fails.
+		_, _ = conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}()
+
+	if _, err := conn.ExecContext(ctx, migrationsDDL); err != nil {
+		return fmt.Errorf("migrate: create schema_migrations: %w", err)
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	return fn(conn, applied)
+}
+
+// appliedMigrations returns the versions recorded in schema_migrations.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT Version, AppliedAt FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var (
+			version int64
+			at      time.Time
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// inTenants runs query in every tenant schema within tx. It must be the last
+// statement of the migration: search_path stays set to the last tenant schema
+// until the transaction ends.
+func inTenants(ctx context.Context, tx *sql.Tx, query string) error {
+	if query == "" {
+		return nil
+	}
+	rows, err := tx.QueryContext(ctx, tenantSchemas)
+	if err != nil {
+		return fmt.Errorf("list tenant schemas: %w", err)
+	}
+	var schemas []string
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			rows.Close()
+			return err
+		}
+		schemas = append(schemas, schema)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, schema := range schemas {
+		if _, err := tx.ExecContext(ctx, "SET LOCAL search_path TO "+pq.QuoteIdentifier(schema)); err != nil {
+			return fmt.Errorf("%s: %w", schema, err)
+		}
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("%s: %w", schema, err)
+		}
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction on conn, committing if it succeeds.
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				err = fmt.Errorf("rollback failed: %v (original err: %w)", rbErr, err)
+			}
+		}
+	}()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectMigrationLock expects the advisory lock and the read of the applied versions.
+func expectMigrationLock(mock sqlmock.Sqlmock, applied *sqlmock.Rows) {
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).
+		WithArgs(migrationLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT Version, AppliedAt FROM schema_migrations").
+		WillReturnRows(applied)
+}
+
+// expectMigrationUnlock expects the release of the advisory lock.
+func expectMigrationUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).
+		WithArgs(migrationLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(fstest.MapFS{
+		"0002_add_unit.up.sql":          {Data: []byte("ALTER TABLE t ADD COLUMN u TEXT;")},
+		"0002_add_unit.down.sql":        {Data: []byte("ALTER TABLE t DROP COLUMN u;")},
+		"0002_add_unit.tenant.up.sql":   {Data: []byte("ALTER TABLE m ADD COLUMN u TEXT;")},
+		"0002_add_unit.tenant.down.sql": {Data: []byte("ALTER TABLE m DROP COLUMN u;")},
+		"0001_create_t.up.sql":          {Data: []byte("CREATE TABLE t (id TEXT);")},
+		"0010_backfill_t.up.sql":        {Data: []byte("UPDATE t SET u = '';")},
+		"README.md":                     {Data: []byte("not a migration")},
+	})
+	require.NoError(t, err)
+	require.Len(t, migrations, 3)
+	assert.Equal(t, []int64{1, 2, 10}, []int64{migrations[0].Version, migrations[1].Version, migrations[2].Version})
+	assert.Equal(t, "add_unit", migrations[1].Name)
+	assert.Equal(t, "ALTER TABLE t DROP COLUMN u;", migrations[1].Down)
+	assert.Equal(t, "ALTER TABLE m ADD COLUMN u TEXT;", migrations[1].TenantUp)
+	assert.Equal(t, "ALTER TABLE m DROP COLUMN u;", migrations[1].TenantDown)
+	assert.Empty(t, migrations[2].Down)
+	assert.Empty(t, migrations[2].TenantUp)
+
+	for name, files := range map[string]fstest.MapFS{
+		"bad name":       {"create.up.sql": {}},
+		"missing up":     {"0001_a.down.sql": {Data: []byte("x")}},
+		"version reused": {"0001_a.up.sql": {Data: []byte("x")}, "0001_b.up.sql": {Data: []byte("y")}},
+		"zero version":   {"0000_a.up.sql": {Data: []byte("x")}},
+		"missing tenant down": {
+			"0001_a.up.sql": {Data: []byte("x")}, "0001_a.down.sql": {Data: []byte("y")},
+			"0001_a.tenant.up.sql": {Data: []byte("z")},
+		},
+	} {
+		_, err := LoadMigrations(files)
+		assert.Error(t, err, name)
+	}
+
+	embedded, err := NewMigrator(nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, embedded.migrations)
+	assert.Equal(t, int64(1), embedded.migrations[0].Version)
+	assert.Empty(t, embedded.migrations[0].Down, "the initial schema cannot be reverted")
+	for _, m := range embedded.migrations[1:] {
+		assert.NotEmpty(t, m.Down, "embedded migration %d has no down migration", m.Version)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	migrations := []Migration{
+		{Version: 1, Name: "create_t", Up: "CREATE TABLE t (id TEXT)", Down: "DROP TABLE t"},
+		{Version: 2, Name: "add_u", Up: "ALTER TABLE t ADD COLUMN u TEXT", Down: "ALTER TABLE t DROP COLUMN u"},
+		{Version: 3, Name: "backfill_u", Up: "UPDATE t SET u = ''"},
+	}
+	appliedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("up applies pending migrations in order", func(t *testing.T) {
+		sqlDB, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer sqlDB.Close()
+
+		expectMigrationLock(mock, sqlmock.NewRows([]string{"Version", "AppliedAt"}).AddRow(1, appliedAt))
+		for _, m := range migrations[1:] {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta(m.Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("INSERT INTO schema_migrations").
+				WithArgs(m.Version, m.Name).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+		expectMigrationUnlock(mock)
+
+		done, err := NewMigratorWith(sqlDB, migrations).Up(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{2, 3}, done)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("tenant migrations run in every tenant schema", func(t *testing.T) {
+		sqlDB, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer sqlDB.Close()
+
+		tenantMigrations := []Migration{{
+			Version: 1, Name: "add_u",
+			Up: "ALTER TABLE t ADD COLUMN u TEXT", Down: "ALTER TABLE t DROP COLUMN u",
+			TenantUp: "ALTER TABLE m ADD COLUMN u TEXT", TenantDown: "ALTER TABLE m DROP COLUMN u",
+		}}
+		expectTenants := func(query string) {
+			mock.ExpectQuery("SELECT nspname FROM pg_namespace").
+				WillReturnRows(sqlmock.NewRows([]string{"nspname"}).AddRow("tenant_a").AddRow("tenant_b"))
+			for _, schema := range []string{"tenant_a", "tenant_b"} {
+				mock.ExpectExec(regexp.QuoteMeta(`SET LOCAL search_path TO "` + schema + `"`)).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta(query)).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+		}
+
+		expectMigrationLock(mock, sqlmock.NewRows([]string{"Version", "AppliedAt"}))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(tenantMigrations[0].Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO schema_migrations").WillReturnResult(sqlmock.NewResult(0, 1))
+		expectTenants(tenantMigrations[0].TenantUp)
+		mock.ExpectCommit()
+		expectMigrationUnlock(mock)
+
+		expectMigrationLock(mock, sqlmock.NewRows([]string{"Version", "AppliedAt"}).AddRow(1, appliedAt))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(tenantMigrations[0].Down)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM schema_migrations").WillReturnResult(sqlmock.NewResult(0, 1))
+		expectTenants(tenantMigrations[0].TenantDown)
+		mock.ExpectCommit()
+		expectMigrationUnlock(mock)
+
+		migrator := NewMigratorWith(sqlDB, tenantMigrations)
+		_, err = migrator.Up(ctx)
+		require.NoError(t, err)
+		_, err = migrator.Down(ctx, 1)
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("failed migration is rolled back and stops the run", func(t *testing.T) {
+		sqlDB, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer sqlDB.Close()
+
+		expectMigrationLock(mock, sqlmock.NewRows([]string{"Version", "AppliedAt"}).AddRow(1, appliedAt))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(migrations[1].Up)).WillReturnError(assert.AnError)
+		mock.ExpectRollback()
+		expectMigrationUnlock(mock)
+
+		done, err := NewMigratorWith(sqlDB, migrations).Up(ctx)
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.ErrorContains(t, err, "2_add_u")
+		assert.Empty(t, done)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("down reverts the newest migrations", func(t *testing.T) {
+		sqlDB, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer sqlDB.Close()
+
+		expectMigrationLock(mock, sqlmock.NewRows([]string{"Version", "AppliedAt"}).AddRow(1, appliedAt).AddRow(2, appliedAt))
+		for _, m := range []Migration{migrations[1], migrations[0]} {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta(m.Down)).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`DELETE FROM schema_migrations WHERE Version = \$1`).
+				WithArgs(m.Version).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+		expectMigrationUnlock(mock)
+
+		done, err := NewMigratorWith(sqlDB, migrations).Down(ctx, 5)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{2, 1}, done)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("down without a down migration", func(t *testing.T) {
+		sqlDB, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer sqlDB.Close()
+
+		expectMigrationLock(mock, sqlmock.NewRows([]string{"Version", "AppliedAt"}).AddRow(1, appliedAt).AddRow(3, appliedAt))
+		expectMigrationUnlock(mock)
+
+		_, err = NewMigratorWith(sqlDB, migrations).Down(ctx, 1)
+		assert.ErrorIs(t, err, ErrNoDownMigration)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("status", func(t *testing.T) {
+		sqlDB, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer sqlDB.Close()
+
+		expectMigrationLock(mock, sqlmock.NewRows([]string{"Version", "AppliedAt"}).AddRow(1, appliedAt))
+		expectMigrationUnlock(mock)
+
+		status, err := NewMigratorWith(sqlDB, migrations).Status(ctx)
+		require.NoError(t, err)
+		require.Len(t, status, 3)
+		assert.True(t, status[0].Applied)
+		assert.Equal(t, appliedAt, status[0].AppliedAt)
+		assert.False(t, status[1].Applied)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,15 @@
+-- Initial schema. IF NOT EXISTS keeps it valid for databases created before
+-- schema_migrations existed.
+CREATE TABLE IF NOT EXISTS metrics (
+    ID      TEXT PRIMARY KEY,
+    MType   TEXT NOT NULL,
+    Delta   BIGINT,
+    Value   DOUBLE PRECISION,
+    UpdateAt TIMESTAMPTZ DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS metric_metadata (
+    Name    TEXT PRIMARY KEY,
+    MType   TEXT NOT NULL DEFAULT '',
+    Unit    TEXT NOT NULL DEFAULT '',
+    Help    TEXT NOT NULL DEFAULT ''
+);
@@ -0,0 +1,2 @@
+-- Explicit TTL of a series in seconds, NULL when the TTL policy applies.
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS TTL BIGINT;
@@ -0,0 +1,11 @@
+-- Tokens used by auth.DBStore: SHA-256 hashes of the secrets, scopes as a
+-- comma-separated list (e.g. "read,write"). Tables created before Tenant
+-- existed get it added.
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    TokenHash TEXT PRIMARY KEY,
+    Name      TEXT NOT NULL,
+    Scopes    TEXT NOT NULL,
+    Prefix    TEXT NOT NULL DEFAULT '',
+    Tenant    TEXT NOT NULL DEFAULT ''
+);
+ALTER TABLE auth_tokens ADD COLUMN IF NOT EXISTS Tenant TEXT NOT NULL DEFAULT '';
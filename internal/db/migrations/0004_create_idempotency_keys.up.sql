@@ -0,0 +1,9 @@
+-- Responses remembered by idempotency.DBStore; Status 0 marks a claimed key
+-- whose request is still being served.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    Key         TEXT PRIMARY KEY,
+    Status      INTEGER NOT NULL,
+    ContentType TEXT NOT NULL DEFAULT '',
+    Body        BYTEA,
+    CreatedAt   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
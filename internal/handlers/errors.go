@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"gometrics/internal/metadata"
+	"gometrics/internal/problem"
+	"gometrics/internal/ratelimit"
+	"gometrics/internal/service"
+	"gometrics/internal/tenant"
+)
+
+// writeError maps err to a problem response with a stable code; msg prefixes
+// the detail. Domain errors are recognised with errors.Is, anything else is
+// reported as 500 internal. Server failures are logged and answered with a
+// generic detail, since their causes may reveal storage internals.
+func writeError(res http.ResponseWriter, req *http.Request, err error, msg string) {
+	detail := err.Error()
+	if msg != "" {
+		detail = msg + ": " + detail
+	}
+	var (
+		batchErr *service.BatchError
+		tooLarge *http.MaxBytesError
+		p        problem.Problem
+	)
+	switch {
+	case errors.Is(err, service.ErrSeriesLimit):
+		ratelimit.SetRetryAfter(res, seriesLimitRetryAfter)
+		p = problem.New(http.StatusTooManyRequests, problem.CodeSeriesLimit, detail)
+	case errors.Is(err, service.ErrBacklogFull):
+		res.Header().Set("Retry-After", "1")
+		p = problem.New(http.StatusServiceUnavailable, problem.CodeUnavailable, detail)
+	case errors.As(err, &batchErr) && batchErr.Size > 1:
+		p = problem.New(http.StatusBadRequest, problem.CodeInvalidBatch, detail)
+		p.Result = batchErr.Result
+	case errors.As(err, &tooLarge):
+		ratelimit.SetRetryAfter(res, ratelimit.BodyLimitRetryAfter)
+		p = problem.New(http.StatusTooManyRequests, problem.CodeBodyTooLarge, detail)
+	case errors.Is(err, service.ErrFutureTimestamp):
+		p = problem.New(http.StatusBadRequest, problem.CodeFutureTimestamp, detail)
+	case errors.Is(err, service.ErrInvalidType):
+		p = problem.New(http.StatusBadRequest, problem.CodeInvalidType, detail)
+	case errors.Is(err, service.ErrInvalidMetric):
+		p = problem.New(http.StatusBadRequest, problem.CodeInvalidMetric, detail)
+	case errors.Is(err, service.ErrParse):
+		p = problem.New(http.StatusBadRequest, problem.CodeParse, detail)
+	case errors.Is(err, service.ErrNotFound):
+		p = problem.New(http.StatusNotFound, problem.CodeNotFound, detail)
+	case errors.Is(err, metadata.ErrInvalid):
+		p = problem.New(http.StatusBadRequest, problem.CodeInvalidMetadata, detail)
+	case errors.Is(err, metadata.ErrTypeMismatch):
+		p = problem.New(http.StatusBadRequest, problem.CodeTypeMismatch, detail)
+	case errors.Is(err, tenant.ErrInvalidName):
+		p = problem.New(http.StatusBadRequest, problem.CodeInvalidTenant, detail)
+	case errors.Is(err, tenant.ErrTooManyTenants):
+		p = problem.New(http.StatusForbidden, problem.CodeTenantLimit, detail)
+	case errors.Is(err, service.ErrPersistence):
+		logServerError(req, detail)
+		p = problem.New(http.StatusInternalServerError, problem.CodePersistence, genericDetail(msg, "metrics could not be persisted"))
+	default:
+		logServerError(req, detail)
+		p = problem.New(http.StatusInternalServerError, problem.CodeInternal, genericDetail(msg, "internal server error"))
+	}
+	problem.Write(res, req, p)
+}
+
+// logServerError logs the cause of a 5xx response.
+func logServerError(req *http.Request, detail string) {
+	if req == nil {
+		log.Printf("ERROR: %s", detail)
+		return
+	}
+	log.Printf("ERROR: %s %s: %s", req.Method, req.URL.Path, detail)
+}
+
+// genericDetail returns msg, a fixed text of the caller, or fallback if msg is empty.
+func genericDetail(msg, fallback string) string {
+	if msg != "" {
+		return msg
+	}
+	return fallback
+}
+
+// parseError wraps a body decoding failure, keeping *http.MaxBytesError
+// recognisable so that oversized bodies are reported as body_too_large.
+func parseError(err error) error {
+	return fmt.Errorf("%w: %w", service.ErrParse, err)
+}
+
+// forbidden writes 403 for a metric the request token may not access.
+func forbidden(res http.ResponseWriter, req *http.Request, name string) {
+	problem.Error(res, req, http.StatusForbidden, problem.CodeForbidden,
+		fmt.Sprintf("access to metric %s is forbidden", name))
+}
@@ -6,13 +6,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"gometrics/internal/alerting"
 	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/audit"
+	"gometrics/internal/auth"
+	"gometrics/internal/idempotency"
+	"gometrics/internal/metadata"
+	"gometrics/internal/metricname"
+	"gometrics/internal/problem"
+	"gometrics/internal/ratelimit"
+	"gometrics/internal/service"
+	"gometrics/internal/staleness"
+	"gometrics/internal/tenant"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -21,8 +33,32 @@ import (
 type HandlerService struct {
 	service Service
 	router  *chi.Mux
+	auth    *auth.Authenticator
+	tenants TenantResolver
+	limiter *ratelimit.Limiter
+	maxBody int64
+	auditor *audit.Publisher
+	alerts  *alerting.Engine
+	stale   *staleness.Tracker
+	hide    bool // hide stale series from read endpoints
+	meta    *metadata.Registry
+	idem    *idempotency.Guard
+	names   metricname.Policy // normalisation of metric names, case-insensitive by default
+	admin   []adminRoute
 }
 
+// adminRoute is a handler mounted for tokens with the admin scope.
+type adminRoute struct {
+	pattern string
+	handler http.Handler
+}
+
+// seriesLimitRetryAfter is the Retry-After sent when a tenant hits its series quota.
+const seriesLimitRetryAfter = time.Minute
+
+// TenantResolver returns the service holding the metrics of the named tenant.
+type TenantResolver func(ctx context.Context, tenant string) (Service, error)
+
 // Service defines the business logic interface for metrics manipulation.
 type Service interface {
 	GaugeInsert(ctx context.Context, key string, value float64) error
@@ -30,8 +66,11 @@ type Service interface {
 	GetGauge(ctx context.Context, key string) (float64, error)
 	GetCounter(ctx context.Context, key string) (int, error)
 	GetAllMetrics(ctx context.Context) ([]string, []string, map[string]string)
+	GetAllGauges(ctx context.Context) map[string]float64
+	GetAllCounters(ctx context.Context) map[string]int
 	Ping(ctx context.Context) error
 	FromStructToStoreBatch(ctx context.Context, metrics []metricsdto.Metrics) error
+	ApplyBatch(ctx context.Context, metrics []metricsdto.Metrics, partial bool) (metricsdto.BatchResult, error)
 }
 
 // NewHandlerService creates a new HandlerService instance.
@@ -47,30 +86,219 @@ func (h *HandlerService) GetRouter() *chi.Mux {
 	return h.router
 }
 
+// SetAuthenticator enables token authentication for all routes registered by CreateHandlers.
+// It must be called before CreateHandlers.
+func (h *HandlerService) SetAuthenticator(a *auth.Authenticator) {
+	h.auth = a
+}
+
+// SetNamePolicy sets how metric names are matched against token prefixes.
+// It must match the policy of the services.
+func (h *HandlerService) SetNamePolicy(p metricname.Policy) {
+	h.names = p
+}
+
+// MountAdmin mounts handler under pattern behind authentication, for tokens
+// with the admin scope (e.g. the profiler or the API docs). It must be called
+// before CreateHandlers.
+func (h *HandlerService) MountAdmin(pattern string, handler http.Handler) {
+	h.admin = append(h.admin, adminRoute{pattern: pattern, handler: handler})
+}
+
+// SetTenantResolver enables multi-tenancy: every request is served by the service
+// of its tenant (see tenant.Middleware). It must be called before CreateHandlers.
+func (h *HandlerService) SetTenantResolver(r TenantResolver) {
+	h.tenants = r
+}
+
+// SetRateLimiter enables per-client rate limiting of the update routes.
+// It must be called before CreateHandlers.
+func (h *HandlerService) SetRateLimiter(l *ratelimit.Limiter) {
+	h.limiter = l
+}
+
+// SetIdempotency makes the update routes honour the Idempotency-Key header.
+// It must be called before CreateHandlers.
+func (h *HandlerService) SetIdempotency(g *idempotency.Guard) {
+	h.idem = g
+}
+
+// SetMaxBodySize limits the (decompressed) body of update requests to n bytes.
+// It must be called before CreateHandlers.
+func (h *HandlerService) SetMaxBodySize(n int64) {
+	h.maxBody = n
+}
+
+// SetAuditor enables publishing an audit event after every successful update.
+func (h *HandlerService) SetAuditor(p *audit.Publisher) {
+	h.auditor = p
+}
+
+// SetAlertEngine exposes the alerts of the engine on GET /api/v1/alerts to
+// admin tokens: rules see the default tenant and any metric name.
+// It must be called before CreateHandlers.
+func (h *HandlerService) SetAlertEngine(e *alerting.Engine) {
+	h.alerts = e
+}
+
+// SetStaleness enables tracking of update times. Stale series are marked with the
+// X-Metric-Stale header (or "(stale)" in the listing), or hidden if hide is set,
+// and sources are listed on GET /api/v1/sources. It must be called before CreateHandlers.
+func (h *HandlerService) SetStaleness(t *staleness.Tracker, hide bool) {
+	h.stale = t
+	h.hide = hide
+}
+
+// isStale reports whether the series of the request tenant is stale.
+func (h *HandlerService) isStale(req *http.Request, mtype, name string) bool {
+	return h.stale != nil && h.stale.Stale(tenant.FromContext(req.Context()), mtype, name)
+}
+
+// markStale sets the X-Metric-Stale header for a stale series. When stale series
+// are hidden it writes 404 instead and returns false.
+func (h *HandlerService) markStale(res http.ResponseWriter, req *http.Request, mtype, name string) bool {
+	if !h.isStale(req, mtype, name) {
+		return true
+	}
+	if h.hide {
+		problem.Error(res, req, http.StatusNotFound, problem.CodeStale, fmt.Sprintf("%s metric %s is stale", mtype, name))
+		return false
+	}
+	res.Header().Set(staleness.StaleHeader, "true")
+	return true
+}
+
+// afterUpdate records a successful update of the metrics: it refreshes their
+// update times and publishes the audit event.
+func (h *HandlerService) afterUpdate(req *http.Request, metrics ...metricsdto.Metrics) {
+	if h.stale != nil {
+		h.stale.Touch(tenant.FromContext(req.Context()), staleness.SourceID(req), metrics)
+	}
+	if h.auditor == nil {
+		return
+	}
+	ids := make([]string, len(metrics))
+	for i, m := range metrics {
+		ids[i] = m.ID
+	}
+	e := audit.NewEvent(req, ids)
+	if tok, ok := auth.FromContext(req.Context()); ok {
+		e.Token = tok.Name
+	}
+	e.Tenant = tenant.FromContext(req.Context())
+	h.auditor.Publish(e)
+}
+
+// applyBatch stores a batch, honouring the partial query parameter, and runs
+// afterUpdate for the accepted entries. Failures, including a batch rejected as
+// a whole, are written with writeError and reported by ok == false.
+func (h *HandlerService) applyBatch(res http.ResponseWriter, req *http.Request, svc Service, metrics []metricsdto.Metrics) (result metricsdto.BatchResult, ok bool) {
+	partial, _ := strconv.ParseBool(req.URL.Query().Get("partial"))
+	result, err := svc.ApplyBatch(req.Context(), metrics, partial)
+	if err != nil {
+		writeError(res, req, err, "failed to write request body")
+		return result, false
+	}
+
+	accepted := make([]metricsdto.Metrics, 0, len(metrics))
+	for _, item := range result.Items {
+		if item.Status == metricsdto.ItemAccepted {
+			accepted = append(accepted, metrics[item.Index])
+		}
+	}
+	h.afterUpdate(req, accepted...)
+	return result, true
+}
+
+// serviceFor returns the service of the request tenant.
+// On failure it writes the error response and returns false.
+func (h *HandlerService) serviceFor(res http.ResponseWriter, req *http.Request) (Service, bool) {
+	if h.tenants == nil {
+		return h.service, true
+	}
+	svc, err := h.tenants(req.Context(), tenant.FromContext(req.Context()))
+	if err != nil {
+		writeError(res, req, err, "cannot resolve tenant")
+		return nil, false
+	}
+	return svc, true
+}
+
 // CreateHandlers registers all API routes for the service.
+// When an authenticator is set, every route requires a token with the matching scope.
 func (h *HandlerService) CreateHandlers() {
 	h.router.Group(func(r chi.Router) {
-		r.Get("/", h.showAllMetrics)
-		r.Get("/value/{type}/{name}", h.GetMetrics)
-		r.Get("/ping", h.Ping)
-		r.Post("/update/", h.PostJSON)
-		r.Post("/updates/", h.PostMetrics)
-		r.Post("/value/", h.GetJSON)
-		r.Post("/update/{type}/{name}/{value}", h.UpdateMetrics)
+		if h.auth != nil {
+			r.Use(h.auth.Authenticate)
+		}
+		if h.tenants != nil {
+			r.Use(tenant.Middleware)
+		}
+		read := r.With(auth.Require(auth.ScopeRead))
+		writeMW := []func(http.Handler) http.Handler{auth.Require(auth.ScopeWrite)}
+		if h.limiter != nil {
+			writeMW = append(writeMW, h.limiter.Middleware)
+		}
+		if h.idem != nil {
+			writeMW = append(writeMW, h.idem.Middleware)
+		}
+		writeMW = append(writeMW, ratelimit.MaxBodySize(h.maxBody))
+		write := r.With(writeMW...)
+
+		read.Get("/", h.showAllMetrics)
+		read.Get("/value/{type}/{name}", h.GetMetrics)
+		read.Get("/ping", h.Ping)
+		read.Get("/metrics", h.PrometheusMetrics)
+		write.Post("/update/", h.PostJSON)
+		write.Post("/updates/", h.PostMetrics)
+		read.Post("/value/", h.GetJSON)
+		write.Post("/update/{type}/{name}/{value}", h.UpdateMetrics)
+		admin := r.With(auth.Require(auth.ScopeAdmin))
+		for _, route := range h.admin {
+			admin.Mount(route.pattern, route.handler)
+		}
+		if h.alerts != nil {
+			admin.Get("/api/v1/alerts", h.GetAlerts)
+		}
+		if h.stale != nil {
+			read.Get("/api/v1/sources", h.GetSources)
+		}
+		if h.meta != nil {
+			read.Get("/api/v1/metadata", h.ListMetadata)
+			read.Get("/api/v1/metadata/{name}", h.GetMetadata)
+			// Writers may describe the metrics their token prefix allows them to write.
+			write.Put("/api/v1/metadata/{name}", h.PutMetadata)
+		}
 	})
 }
 
+// forbidMetrics writes 403 and returns true if the request token may not access any of the metrics.
+func (h *HandlerService) forbidMetrics(res http.ResponseWriter, req *http.Request, metrics []metricsdto.Metrics) bool {
+	for _, m := range metrics {
+		if !auth.AllowMetric(req.Context(), h.names, m.ID) {
+			forbidden(res, req, m.ID)
+			return true
+		}
+	}
+	return false
+}
+
 // PostMetrics handles bulk updates of metrics.
 // It supports both JSON array and Gob formats based on Content-Type header.
 //
 // @Summary Update multiple metrics
-// @Description Updates metrics in batch. Supports application/json and application/x-gob.
+// @Description Updates metrics in batch atomically: either every metric is applied or none.
+// @Description With partial=true invalid metrics are rejected individually and the rest is applied.
+// @Description The response lists the status and stored value of every metric.
+// @Description Supports application/json and application/x-gob.
 // @Tags update
 // @Accept json, application/x-gob
 // @Produce json, application/x-gob
 // @Param metrics body []metricsdto.Metrics true "List of metrics to update"
-// @Success 200 {array} metricsdto.Metrics
-// @Failure 500 {string} string "Internal Server Error"
+// @Param partial query bool false "Apply the valid metrics of a batch with invalid ones"
+// @Success 200 {object} metricsdto.BatchResult
+// @Failure 400 {object} metricsdto.BatchResult "Batch rejected, nothing applied"
+// @Failure 500 {object} problem.Problem "Internal Server Error"
 // @Router /updates/ [post]
 func (h *HandlerService) PostMetrics(res http.ResponseWriter, req *http.Request) {
 	if strings.Contains(req.Header.Get("Content-Type"), "application/json") {
@@ -84,6 +312,10 @@ func (h *HandlerService) PostMetrics(res http.ResponseWriter, req *http.Request)
 
 // PostMetricsArray handles batch updates in Gob format.
 func (h *HandlerService) PostMetricsArray(res http.ResponseWriter, req *http.Request) {
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
 	var metrics []metricsdto.Metrics
 	var returnBuf bytes.Buffer
 
@@ -92,23 +324,27 @@ func (h *HandlerService) PostMetricsArray(res http.ResponseWriter, req *http.Req
 	decoder := gob.NewDecoder(req.Body)
 	err := decoder.Decode(&metrics)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("failed to read request body with gob: %v", err), http.StatusInternalServerError)
+		writeError(res, req, parseError(err), "failed to read request body with gob")
+		return
+	}
+	if h.forbidMetrics(res, req, metrics) || h.rejectTypes(res, req, metrics) {
 		return
 	}
 
-	buf := gob.NewEncoder(&returnBuf)
-	err = buf.Encode(metrics)
-	if err != nil {
-		http.Error(res, fmt.Sprintf("failed to write request body with gob: %v", err), http.StatusInternalServerError)
+	// Store before answering, so that a failed batch (e.g. over quota) gets an error status.
+	result, ok := h.applyBatch(res, req, svc, metrics)
+	if !ok {
 		return
 	}
-	res.Write(returnBuf.Bytes())
-	err = h.service.FromStructToStoreBatch(req.Context(), metrics)
+
+	buf := gob.NewEncoder(&returnBuf)
+	err = buf.Encode(result)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("failed to write request body: %v", err), http.StatusInternalServerError)
+		writeError(res, req, err, "failed to write response with gob")
 		return
 	}
 	res.WriteHeader(http.StatusOK)
+	res.Write(returnBuf.Bytes())
 }
 
 // Ping checks the database connection status.
@@ -117,13 +353,16 @@ func (h *HandlerService) PostMetricsArray(res http.ResponseWriter, req *http.Req
 // @Description Checks if the database is accessible.
 // @Tags info
 // @Success 200 {string} string "OK"
-// @Failure 500 {string} string "Database connection error"
+// @Failure 500 {object} problem.Problem "Database connection error"
 // @Router /ping [get]
 func (h *HandlerService) Ping(res http.ResponseWriter, req *http.Request) {
-	err := h.service.Ping(req.Context())
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
+	err := svc.Ping(req.Context())
 	if err != nil {
-		log.Printf("cannot ping db: %v", err)
-		http.Error(res, fmt.Sprintf("cannot ping db: %v", err), http.StatusInternalServerError)
+		writeError(res, req, fmt.Errorf("%w: %w", service.ErrPersistence, err), "cannot ping db")
 		return
 	}
 	res.WriteHeader(http.StatusOK)
@@ -136,17 +375,39 @@ func (h *HandlerService) Ping(res http.ResponseWriter, req *http.Request) {
 // @Tags info
 // @Produce html
 // @Success 200 {string} string "HTML content"
-// @Failure 400 {string} string "Bad Request"
+// @Failure 400 {object} problem.Problem "Bad Request"
 // @Router / [get]
 func (h *HandlerService) showAllMetrics(res http.ResponseWriter, req *http.Request) {
-	keysGauge, keysCounter, metrics := h.service.GetAllMetrics(req.Context())
-	keys := append(keysGauge, keysCounter...)
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
+	keysGauge, keysCounter, metrics := svc.GetAllMetrics(req.Context())
 	res.Header().Set("Content-Type", "text/html; charset=utf-8")
-	format := "%s: %s<br>"
-	for _, key := range keys {
-		if _, err := fmt.Fprintf(res, format, key, metrics[key]); err != nil {
-			http.Error(res, fmt.Sprintf("cannot render metric: %v", err), http.StatusBadRequest)
-			return
+	format := "%s: %s%s%s<br>"
+	for _, group := range []struct {
+		mtype string
+		keys  []string
+	}{{metricsdto.MetricTypeGauge, keysGauge}, {metricsdto.MetricTypeCounter, keysCounter}} {
+		for _, key := range group.keys {
+			if !auth.AllowMetric(req.Context(), h.names, key) {
+				continue
+			}
+			mark := ""
+			if h.isStale(req, group.mtype, key) {
+				if h.hide {
+					continue
+				}
+				mark = " (stale)"
+			}
+			unit := h.unit(key)
+			if unit != "" {
+				unit = " " + unit
+			}
+			if _, err := fmt.Fprintf(res, format, key, metrics[key], unit, mark); err != nil {
+				writeError(res, req, err, "cannot render metric")
+				return
+			}
 		}
 	}
 	res.WriteHeader(http.StatusOK)
@@ -161,40 +422,42 @@ func (h *HandlerService) showAllMetrics(res http.ResponseWriter, req *http.Reque
 // @Param name path string true "Metric name"
 // @Produce text/plain
 // @Success 200 {string} string "Metric value"
-// @Failure 404 {string} string "Metric not found"
-// @Failure 400 {string} string "Invalid metric type"
+// @Failure 404 {object} problem.Problem "Metric not found"
+// @Failure 400 {object} problem.Problem "Invalid metric type"
 // @Router /value/{type}/{name} [get]
 func (h *HandlerService) GetMetrics(res http.ResponseWriter, req *http.Request) {
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
 	typeMetric := chi.URLParam(req, "type")
 	nameMetric := chi.URLParam(req, "name")
 	format := "%v"
-	switch typeMetric {
-	case metricsdto.MetricTypeGauge:
-		value, err := h.service.GetGauge(req.Context(), nameMetric)
-		if err != nil {
-			http.Error(res, fmt.Sprintf("gauge metric not found: %v", err), http.StatusNotFound)
-			return
-		}
-		if _, err = fmt.Fprintf(res, format, value); err != nil {
-			http.Error(res, fmt.Sprintf("cannot render metric: %v", err), http.StatusBadRequest)
-			return
-		}
-		res.WriteHeader(http.StatusOK)
-	case metricsdto.MetricTypeCounter:
-		value, err := h.service.GetCounter(req.Context(), nameMetric)
-		if err != nil {
-			http.Error(res, fmt.Sprintf("counter metric not found: %v", err), http.StatusNotFound)
-			return
-		}
-		if _, err = fmt.Fprintf(res, format, value); err != nil {
-			http.Error(res, fmt.Sprintf("cannot render metric: %v", err), http.StatusBadRequest)
-			return
-		}
-		res.WriteHeader(http.StatusOK)
-	default:
-		http.Error(res, "invalid metric type", http.StatusBadRequest)
+	if !auth.AllowMetric(req.Context(), h.names, nameMetric) {
+		forbidden(res, req, nameMetric)
 		return
 	}
+	if err := service.CheckType(typeMetric); err != nil {
+		writeError(res, req, err, "")
+		return
+	}
+	if !h.markStale(res, req, typeMetric, nameMetric) {
+		return
+	}
+	var value any
+	var err error
+	if typeMetric == metricsdto.MetricTypeGauge {
+		value, err = svc.GetGauge(req.Context(), nameMetric)
+	} else {
+		value, err = svc.GetCounter(req.Context(), nameMetric)
+	}
+	if err != nil {
+		writeError(res, req, err, typeMetric+" metric not found")
+		return
+	}
+	if _, err = fmt.Fprintf(res, format, value); err != nil {
+		writeError(res, req, err, "cannot render metric")
+	}
 }
 
 // UpdateMetrics updates a single metric via URL path parameters.
@@ -206,39 +469,111 @@ func (h *HandlerService) GetMetrics(res http.ResponseWriter, req *http.Request)
 // @Param name path string true "Metric name"
 // @Param value path string true "Metric value"
 // @Success 200 {string} string "OK"
-// @Failure 400 {string} string "Bad Request or Parse Error"
+// @Failure 400 {object} problem.Problem "Bad Request or Parse Error"
 // @Router /update/{type}/{name}/{value} [post]
 func (h *HandlerService) UpdateMetrics(res http.ResponseWriter, req *http.Request) {
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
 	typeMetric := chi.URLParam(req, "type")
 	nameMetric := chi.URLParam(req, "name")
 	valueMetric := chi.URLParam(req, "value")
+	if !auth.AllowMetric(req.Context(), h.names, nameMetric) {
+		forbidden(res, req, nameMetric)
+		return
+	}
+	if h.rejectTypes(res, req, []metricsdto.Metrics{{ID: nameMetric, MType: typeMetric}}) {
+		return
+	}
 	switch typeMetric {
 	case metricsdto.MetricTypeGauge:
-		value, err := strconv.ParseFloat(valueMetric, 64)
-		if err != nil {
-			http.Error(res, fmt.Sprintf("could not parse gauge metric: %v", err), http.StatusBadRequest)
-			return
+		value, err := service.ParseGauge(valueMetric)
+		if err == nil {
+			err = svc.GaugeInsert(req.Context(), nameMetric, value)
 		}
-		err = h.service.GaugeInsert(req.Context(), nameMetric, value)
 		if err != nil {
-			http.Error(res, fmt.Sprintf("could not insert gauge metric: %v", err), http.StatusBadRequest)
+			writeError(res, req, err, "could not insert gauge metric")
 			return
 		}
-		res.WriteHeader(http.StatusOK)
 	case metricsdto.MetricTypeCounter:
-		value, err := strconv.Atoi(valueMetric)
-		if err != nil {
-			http.Error(res, fmt.Sprintf("could not parse counter metric: %v", err), http.StatusBadRequest)
-			return
+		value, err := service.ParseCounter(valueMetric)
+		if err == nil {
+			err = svc.CounterInsert(req.Context(), nameMetric, value)
 		}
-		err = h.service.CounterInsert(req.Context(), nameMetric, value)
 		if err != nil {
-			http.Error(res, fmt.Sprintf("could not insert counter metric: %v", err), http.StatusBadRequest)
+			writeError(res, req, err, "could not insert counter metric")
 			return
 		}
-		res.WriteHeader(http.StatusOK)
 	default:
-		http.Error(res, "invalid action type", http.StatusBadRequest)
+		writeError(res, req, service.CheckType(typeMetric), "")
 		return
 	}
+	h.afterUpdate(req, metricsdto.Metrics{ID: nameMetric, MType: typeMetric})
+	res.WriteHeader(http.StatusOK)
+}
+
+// alertsResponse is the body of GET /api/v1/alerts.
+type alertsResponse struct {
+	Alerts []alerting.Alert `json:"alerts"`
+}
+
+// GetAlerts lists the pending, firing and recently resolved alerts.
+//
+// @Summary List alerts
+// @Description Returns the alerts produced by the alerting rules. Requires the admin scope.
+// @Tags alerts
+// @Produce json
+// @Success 200 {object} alertsResponse
+// @Failure 403 {object} problem.Problem "Forbidden"
+// @Router /api/v1/alerts [get]
+func (h *HandlerService) GetAlerts(res http.ResponseWriter, req *http.Request) {
+	out, err := json.Marshal(alertsResponse{Alerts: h.alerts.Alerts()})
+	if err != nil {
+		writeError(res, req, err, "cannot marshal alerts")
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
+}
+
+// sourcesResponse is the body of GET /api/v1/sources.
+type sourcesResponse struct {
+	Window       string             `json:"window"`
+	StaleSeries  int                `json:"staleSeries"`
+	StaleSources int                `json:"staleSources"`
+	Sources      []staleness.Source `json:"sources"`
+}
+
+// GetSources lists the agents reporting to the request tenant with their last-seen times.
+//
+// @Summary List sources
+// @Description Returns the reporting sources with their last-seen times and the number of stale series.
+// @Tags info
+// @Produce json
+// @Success 200 {object} sourcesResponse
+// @Router /api/v1/sources [get]
+func (h *HandlerService) GetSources(res http.ResponseWriter, req *http.Request) {
+	name := tenant.FromContext(req.Context())
+	sources := h.stale.Sources(name)
+	staleSources := 0
+	for _, s := range sources {
+		if s.Stale {
+			staleSources++
+		}
+	}
+	out, err := json.Marshal(sourcesResponse{
+		Window:       h.stale.Window().String(),
+		StaleSeries:  h.stale.StaleSeries(name),
+		StaleSources: staleSources,
+		Sources:      sources,
+	})
+	if err != nil {
+		writeError(res, req, err, "cannot marshal sources")
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
 }
@@ -3,15 +3,28 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"gometrics/internal/alerting"
 	dto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/audit"
+	"gometrics/internal/auth"
+	"gometrics/internal/idempotency"
+	"gometrics/internal/metadata"
+	"gometrics/internal/problem"
+	"gometrics/internal/ratelimit"
 	"gometrics/internal/service"
+	"gometrics/internal/staleness"
 	"gometrics/internal/storage"
+	"gometrics/internal/tenant"
 
 	"github.com/go-chi/chi/v5"
 	easyjson "github.com/mailru/easyjson"
@@ -32,6 +45,16 @@ func (s *stubPersistStorage) Close() error               { return nil }
 func (s *stubPersistStorage) Flush() error               { return nil }
 func (s *stubPersistStorage) Ping(context.Context) error { return nil }
 
+// stubTokenStore resolves tokens from a map.
+type stubTokenStore map[string]auth.Token
+
+func (s stubTokenStore) Lookup(_ context.Context, token string) (auth.Token, error) {
+	if t, ok := s[token]; ok {
+		return t, nil
+	}
+	return auth.Token{}, auth.ErrUnknownToken
+}
+
 func testRequest(t *testing.T, ts *httptest.Server, method, path string) (*http.Response, string) {
 	req, err := http.NewRequest(method, ts.URL+path, nil)
 	require.NoError(t, err)
@@ -114,6 +137,577 @@ func Test_HandlerService_CreateHandlers(t *testing.T) {
 	}
 }
 
+func Test_HandlerService_Auth(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	require.NoError(t, svc.GaugeInsert(context.Background(), "teama_cpu", 1))
+	require.NoError(t, svc.GaugeInsert(context.Background(), "teamb_cpu", 2))
+
+	h := NewHandlerService(svc, chi.NewMux())
+	h.SetAuthenticator(auth.NewAuthenticator(stubTokenStore{
+		"reader": {Name: "reader", Scopes: []auth.Scope{auth.ScopeRead}},
+		"teama":  {Name: "teama", Scopes: []auth.Scope{auth.ScopeRead, auth.ScopeWrite}, Prefix: "teama_"},
+		"agent":  {Name: "agent", Scopes: []auth.Scope{auth.ScopeWrite}},
+		"admin":  {Name: "admin", Scopes: []auth.Scope{auth.ScopeAdmin}},
+	}))
+	h.MountAdmin("/debug", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("profile"))
+	}))
+	h.SetMetadata(metadata.NewRegistry(nil))
+	h.SetAlertEngine(alerting.NewEngine(svc, nil))
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		token    string
+		wantCode int
+		wantBody string
+	}{
+		{name: "anonymous read", method: http.MethodGet, url: "/value/gauge/teama_cpu", wantCode: http.StatusUnauthorized},
+		{name: "reader read", method: http.MethodGet, url: "/value/gauge/teamb_cpu", token: "reader", wantCode: http.StatusOK, wantBody: "2"},
+		{name: "reader write", method: http.MethodPost, url: "/update/gauge/teama_cpu/3", token: "reader", wantCode: http.StatusForbidden},
+		{name: "prefixed write", method: http.MethodPost, url: "/update/gauge/teama_cpu/3", token: "teama", wantCode: http.StatusOK},
+		{name: "foreign prefix write", method: http.MethodPost, url: "/update/gauge/teamb_cpu/3", token: "teama", wantCode: http.StatusForbidden},
+		{name: "foreign prefix read", method: http.MethodGet, url: "/value/gauge/teamb_cpu", token: "teama", wantCode: http.StatusForbidden},
+		{name: "listing is filtered", method: http.MethodGet, url: "/", token: "teama", wantCode: http.StatusOK, wantBody: "teama_cpu: 3<br>"},
+		{name: "anonymous debug", method: http.MethodGet, url: "/debug/pprof/", wantCode: http.StatusUnauthorized},
+		{name: "reader debug", method: http.MethodGet, url: "/debug/pprof/", token: "reader", wantCode: http.StatusForbidden},
+		{name: "admin debug", method: http.MethodGet, url: "/debug/pprof/", token: "admin", wantCode: http.StatusOK, wantBody: "profile"},
+		{name: "reader metadata", method: http.MethodPut, url: "/api/v1/metadata/teama_cpu", body: `{"unit":"percent"}`, token: "reader", wantCode: http.StatusForbidden},
+		{name: "agent metadata", method: http.MethodPut, url: "/api/v1/metadata/Alloc", body: `{"unit":"bytes"}`, token: "agent", wantCode: http.StatusOK},
+		{name: "prefixed metadata", method: http.MethodPut, url: "/api/v1/metadata/teama_cpu", body: `{"unit":"percent"}`, token: "teama", wantCode: http.StatusOK},
+		{name: "foreign prefix metadata", method: http.MethodPut, url: "/api/v1/metadata/teamb_cpu", body: `{"unit":"percent"}`, token: "teama", wantCode: http.StatusForbidden},
+		{name: "admin metadata", method: http.MethodPut, url: "/api/v1/metadata/teama_cpu", body: `{"unit":"percent"}`, token: "admin", wantCode: http.StatusOK},
+		{name: "prefixed alerts", method: http.MethodGet, url: "/api/v1/alerts", token: "teama", wantCode: http.StatusForbidden},
+		{name: "admin alerts", method: http.MethodGet, url: "/api/v1/alerts", token: "admin", wantCode: http.StatusOK, wantBody: `{"alerts":[]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.url, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func Test_HandlerService_Tenants(t *testing.T) {
+	newSvc := func() *service.Service {
+		return service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	}
+	registry := tenant.NewRegistry(newSvc(), func(context.Context, string) (*service.Service, error) {
+		return newSvc(), nil
+	}, tenant.Limits{MaxTenants: 2})
+
+	h := NewHandlerService(registry.Default(), chi.NewMux())
+	h.SetTenantResolver(func(ctx context.Context, name string) (Service, error) {
+		return registry.Get(ctx, name)
+	})
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	do := func(method, url, tenantID string, body []byte) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+url, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(tenant.Header, tenantID)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(respBody)
+	}
+
+	code, _ := do(http.MethodPost, "/update/gauge/cpu/1", "teama", nil)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(http.MethodPost, "/updates/", "teamb", []byte(`[{"id":"cpu","type":"gauge","value":2}]`))
+	require.Equal(t, http.StatusOK, code)
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		tenant   string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{name: "teama value", method: http.MethodGet, url: "/value/gauge/cpu", tenant: "teama", wantCode: http.StatusOK, wantBody: "1"},
+		{name: "teamb value", method: http.MethodGet, url: "/value/gauge/cpu", tenant: "teamb", wantCode: http.StatusOK, wantBody: "2"},
+		{name: "default tenant is isolated", method: http.MethodGet, url: "/value/gauge/cpu", wantCode: http.StatusNotFound},
+		{name: "teamb listing", method: http.MethodGet, url: "/", tenant: "teamb", wantCode: http.StatusOK, wantBody: "cpu: 2<br>"},
+		{name: "json value", method: http.MethodPost, url: "/value/", tenant: "teama", body: `{"id":"cpu","type":"gauge"}`, wantCode: http.StatusOK, wantBody: `{"id":"cpu","type":"gauge","value":1}`},
+		{name: "invalid tenant", method: http.MethodGet, url: "/", tenant: "team a", wantCode: http.StatusBadRequest},
+		{name: "tenant quota", method: http.MethodGet, url: "/", tenant: "teamc", wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := do(tt.method, tt.url, tt.tenant, []byte(tt.body))
+			assert.Equal(t, tt.wantCode, code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, body)
+			}
+		})
+	}
+}
+
+func Test_HandlerService_Limits(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	svc.SetMaxSeries(1)
+
+	h := NewHandlerService(svc, chi.NewMux())
+	h.SetRateLimiter(ratelimit.NewLimiter(0.001, 3, ratelimit.ByIP))
+	h.SetMaxBodySize(64)
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	tests := []struct {
+		name           string
+		url            string
+		body           string
+		wantCode       int
+		wantRetryAfter string
+	}{
+		{name: "first series", url: "/update/gauge/cpu/1", wantCode: http.StatusOK},
+		{name: "series quota", url: "/update/gauge/mem/1", wantCode: http.StatusTooManyRequests, wantRetryAfter: "60"},
+		{name: "body too large", url: "/updates/", body: `[{"id":"cpu","type":"gauge","value":1},{"id":"cpu","type":"gauge","value":2}]`, wantCode: http.StatusTooManyRequests, wantRetryAfter: "60"},
+		{name: "rate limit", url: "/update/gauge/cpu/2", wantCode: http.StatusTooManyRequests, wantRetryAfter: "1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+tt.url, bytes.NewReader([]byte(tt.body)))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			assert.Equal(t, tt.wantRetryAfter, resp.Header.Get("Retry-After"))
+		})
+	}
+
+	// Reads are not rate limited.
+	resp, body := testRequest(t, ts, http.MethodGet, "/value/gauge/cpu")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", body)
+}
+
+// auditRecorder is an audit.Observer keeping the received events.
+type auditRecorder struct {
+	events []audit.Event
+}
+
+func (r *auditRecorder) Notify(_ context.Context, e audit.Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func Test_HandlerService_Audit(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	rec := &auditRecorder{}
+	publisher := audit.NewPublisher(10, rec)
+
+	h := NewHandlerService(svc, chi.NewMux())
+	h.SetAuditor(publisher)
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, http.MethodPost, "/update/counter/hits/1")
+	resp.Body.Close()
+	resp, _ = testRequestJSON(t, ts, http.MethodPost, "/update/", []byte(`{"id":"cpu","type":"gauge","value":1}`))
+	resp.Body.Close()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader([]byte(`[{"id":"a","type":"gauge","value":1},{"id":"b","type":"counter","delta":1}]`)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = ts.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	// Failed updates are not audited.
+	resp, _ = testRequest(t, ts, http.MethodPost, "/update/gauge/bad/value")
+	resp.Body.Close()
+
+	require.NoError(t, publisher.Close(context.Background()))
+	require.Len(t, rec.events, 3)
+	assert.Equal(t, []string{"hits"}, rec.events[0].Metrics)
+	assert.Equal(t, []string{"cpu"}, rec.events[1].Metrics)
+	assert.Equal(t, []string{"a", "b"}, rec.events[2].Metrics)
+	assert.Equal(t, "127.0.0.1", rec.events[0].IPAddress)
+}
+
+func Test_HandlerService_Alerts(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	require.NoError(t, svc.GaugeInsert(context.Background(), "HeapAlloc", 500))
+
+	rules, err := alerting.ParseRules([]byte(`rules: [{name: HighHeap, expr: HeapAlloc, threshold: 100, labels: {severity: page}}]`), false)
+	require.NoError(t, err)
+	engine := alerting.NewEngine(svc, rules)
+	engine.Eval(context.Background(), time.Now())
+
+	h := NewHandlerService(svc, chi.NewMux())
+	h.SetAlertEngine(engine)
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/api/v1/alerts")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var got struct {
+		Alerts []alerting.Alert `json:"alerts"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &got))
+	require.Len(t, got.Alerts, 1)
+	assert.Equal(t, "HighHeap", got.Alerts[0].Name)
+	assert.Equal(t, alerting.StateFiring, got.Alerts[0].State)
+	assert.Equal(t, 500.0, got.Alerts[0].Value)
+	assert.Equal(t, "page", got.Alerts[0].Labels["severity"])
+}
+
+func Test_HandlerService_Staleness(t *testing.T) {
+	for _, hide := range []bool{false, true} {
+		t.Run(fmt.Sprintf("hide=%v", hide), func(t *testing.T) {
+			svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+			h := NewHandlerService(svc, chi.NewMux())
+			h.SetStaleness(staleness.NewTracker(50*time.Millisecond), hide)
+			h.CreateHandlers()
+			ts := httptest.NewServer(h.GetRouter())
+			defer ts.Close()
+
+			update := func(url, agent string) {
+				req, err := http.NewRequest(http.MethodPost, ts.URL+url, nil)
+				require.NoError(t, err)
+				req.Header.Set(staleness.AgentHeader, agent)
+				resp, err := ts.Client().Do(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+			update("/update/gauge/mem/2", "dead-agent")
+			time.Sleep(80 * time.Millisecond)
+			update("/update/gauge/cpu/1", "live-agent")
+
+			resp, body := testRequest(t, ts, http.MethodGet, "/value/gauge/cpu")
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get(staleness.StaleHeader))
+
+			resp, body = testRequest(t, ts, http.MethodGet, "/value/gauge/mem")
+			resp.Body.Close()
+			if hide {
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			} else {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, "true", resp.Header.Get(staleness.StaleHeader))
+				assert.Equal(t, "2", body)
+			}
+
+			resp, body = testRequest(t, ts, http.MethodGet, "/")
+			resp.Body.Close()
+			if hide {
+				assert.Equal(t, "cpu: 1<br>", body)
+			} else {
+				assert.Equal(t, "cpu: 1<br>mem: 2 (stale)<br>", body)
+			}
+
+			resp, body = testRequest(t, ts, http.MethodGet, "/api/v1/sources")
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var got struct {
+				StaleSeries  int                `json:"staleSeries"`
+				StaleSources int                `json:"staleSources"`
+				Sources      []staleness.Source `json:"sources"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(body), &got))
+			assert.Equal(t, 1, got.StaleSeries)
+			assert.Equal(t, 1, got.StaleSources)
+			require.Len(t, got.Sources, 2)
+			assert.Equal(t, "dead-agent", got.Sources[0].ID)
+			assert.True(t, got.Sources[0].Stale)
+			assert.Equal(t, "live-agent", got.Sources[1].ID)
+			assert.False(t, got.Sources[1].Stale)
+
+			// The counts are exposed as self-metrics without becoming series.
+			resp, body = testRequest(t, ts, http.MethodGet, "/metrics")
+			resp.Body.Close()
+			assert.Contains(t, body, "# TYPE StaleSeries gauge\nStaleSeries 1\n")
+			assert.Contains(t, body, "# TYPE StaleSources gauge\nStaleSources 1\n")
+			assert.Len(t, svc.GetAllGauges(context.Background()), 2)
+		})
+	}
+}
+
+func Test_HandlerService_Metadata(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	h := NewHandlerService(svc, chi.NewMux())
+	h.SetMetadata(metadata.NewRegistry(nil))
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	put := func(name, body string) int {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/metadata/"+name, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, put("Alloc", `{"type":"gauge","unit":"bytes","help":"Bytes of allocated heap objects."}`))
+	assert.Equal(t, http.StatusBadRequest, put("Alloc", `{"type":"histogram"}`))
+
+	resp, body := testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/1024")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = testRequest(t, ts, http.MethodPost, "/update/counter/Alloc/1")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "declared type is enforced")
+
+	resp, body = testRequest(t, ts, http.MethodGet, "/api/v1/metadata")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"metadata":[{"name":"Alloc","type":"gauge","unit":"bytes","help":"Bytes of allocated heap objects."}]}`, body)
+
+	resp, _ = testRequest(t, ts, http.MethodGet, "/api/v1/metadata/Sys")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = testRequest(t, ts, http.MethodGet, "/")
+	resp.Body.Close()
+	assert.Equal(t, "Alloc: 1024 bytes<br>", body)
+
+	resp, body = testRequest(t, ts, http.MethodGet, "/metrics")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "# HELP Alloc Bytes of allocated heap objects.\n# UNIT Alloc bytes\n# TYPE Alloc gauge\nAlloc 1024\n", body)
+
+	// A gauge and a counter with the same name are one family.
+	require.NoError(t, svc.GaugeInsert(context.Background(), "hits", 1.5))
+	require.NoError(t, svc.CounterInsert(context.Background(), "hits", 7))
+	resp, body = testRequest(t, ts, http.MethodGet, "/metrics")
+	resp.Body.Close()
+	assert.Equal(t, "# HELP Alloc Bytes of allocated heap objects.\n# UNIT Alloc bytes\n# TYPE Alloc gauge\nAlloc 1024\n"+
+		"# TYPE hits gauge\nhits 1.5\n", body)
+
+	// Exposed names follow metricname.Sanitize.
+	require.NoError(t, svc.GaugeInsert(context.Background(), "5xx.rate", 2))
+	require.NoError(t, svc.GaugeInsert(context.Background(), "ёмкость", 3))
+	resp, body = testRequest(t, ts, http.MethodGet, "/metrics")
+	resp.Body.Close()
+	assert.Contains(t, body, "# TYPE _5xx_rate gauge\n_5xx_rate 2\n")
+	assert.Contains(t, body, "# TYPE _______ gauge\n_______ 3\n", "one '_' per rune, not per byte")
+}
+
+func Test_HandlerService_Timestamps(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	svc.SetMaxFutureSkew(time.Minute)
+	h := NewHandlerService(svc, chi.NewMux())
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	post := func(value float64, at time.Time) int {
+		body := fmt.Sprintf(`{"id":"temp","type":"gauge","value":%v,"timestamp":%d}`, value, at.UnixMilli())
+		resp, _ := testRequestJSON(t, ts, http.MethodPost, "/update/", []byte(body))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	now := time.Now()
+	assert.Equal(t, http.StatusOK, post(2, now))
+	assert.Equal(t, http.StatusOK, post(1, now.Add(-time.Minute)))
+	assert.Equal(t, http.StatusBadRequest, post(3, now.Add(time.Hour)))
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/value/gauge/temp")
+	resp.Body.Close()
+	assert.Equal(t, "2", body, "older and future samples do not overwrite the value")
+}
+
+func Test_HandlerService_Idempotency(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	h := NewHandlerService(svc, chi.NewMux())
+	h.SetIdempotency(idempotency.NewGuard(idempotency.NewMemoryStore(time.Minute, 10)))
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	post := func(key string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/",
+			strings.NewReader(`[{"id":"hits","type":"counter","delta":5}]`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotency.Header, key)
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	first := post("batch-1")
+	assert.Equal(t, http.StatusOK, first.StatusCode)
+	assert.Empty(t, first.Header.Get(idempotency.ReplayedHeader))
+
+	retry := post("batch-1")
+	assert.Equal(t, http.StatusOK, retry.StatusCode)
+	assert.Equal(t, "true", retry.Header.Get(idempotency.ReplayedHeader))
+	assert.Equal(t, http.StatusOK, post("batch-2").StatusCode)
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/value/counter/hits")
+	resp.Body.Close()
+	assert.Equal(t, "10", body, "a retried batch is applied once")
+}
+
+func Test_HandlerService_AtomicBatch(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	h := NewHandlerService(svc, chi.NewMux())
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	body := `[{"id":"hits","type":"counter","delta":5},{"id":"","type":"gauge","value":1},{"id":"temp","type":"gauge","value":2}]`
+	resp, err := ts.Client().Post(ts.URL+"/updates/", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, problem.ContentType, resp.Header.Get("Content-Type"))
+
+	var out struct {
+		Code   string          `json:"code"`
+		Result dto.BatchResult `json:"result"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, problem.CodeInvalidBatch, out.Code)
+	assert.Equal(t, 3, out.Result.Rejected)
+	require.Len(t, out.Result.Items, 3)
+	assert.Equal(t, dto.ItemRejected, out.Result.Items[1].Status)
+	assert.Contains(t, out.Result.Items[1].Error, "empty id")
+
+	assert.Empty(t, svc.GetAllCounters(context.Background()), "valid entries of a rejected batch are not applied")
+	assert.Empty(t, svc.GetAllGauges(context.Background()))
+}
+
+func Test_HandlerService_BatchResults(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	h := NewHandlerService(svc, chi.NewMux())
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+	require.NoError(t, svc.CounterInsert(context.Background(), "hits", 1))
+
+	now := time.Now().UnixMilli()
+	body := fmt.Sprintf(`[{"id":"hits","type":"counter","delta":5},{"id":"temp","type":"gauge","value":2,"timestamp":%d},`+
+		`{"id":"temp","type":"gauge","value":1,"timestamp":%d},{"id":"x","type":"histogram"}]`, now, now-1000)
+	resp, err := ts.Client().Post(ts.URL+"/updates/?partial=true", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var out dto.BatchResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, 2, out.Accepted)
+	assert.Equal(t, 1, out.Deduplicated)
+	assert.Equal(t, 1, out.Rejected)
+	require.Len(t, out.Items, 4)
+
+	assert.Equal(t, dto.ItemAccepted, out.Items[0].Status)
+	require.NotNil(t, out.Items[0].Delta)
+	assert.Equal(t, int64(6), *out.Items[0].Delta, "stored counter value")
+	assert.Equal(t, dto.ItemDeduplicated, out.Items[2].Status)
+	require.NotNil(t, out.Items[2].Value)
+	assert.Equal(t, 2.0, *out.Items[2].Value, "stored value of a superseded sample")
+	assert.Equal(t, dto.ItemRejected, out.Items[3].Status)
+	assert.NotEmpty(t, out.Items[3].Error)
+}
+
+func Test_HandlerService_Problems(t *testing.T) {
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	svc.SetMaxFutureSkew(time.Minute)
+	h := NewHandlerService(svc, chi.NewMux())
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+	future := time.Now().Add(time.Hour).UnixMilli()
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "unknown type in path", method: http.MethodGet, url: "/value/histogram/cpu", wantStatus: http.StatusBadRequest, wantCode: problem.CodeInvalidType},
+		{name: "unknown type in JSON", method: http.MethodPost, url: "/value/", body: `{"id":"cpu","type":"histogram"}`, wantStatus: http.StatusBadRequest, wantCode: problem.CodeInvalidType},
+		{name: "missing series in path", method: http.MethodGet, url: "/value/gauge/cpu", wantStatus: http.StatusNotFound, wantCode: problem.CodeNotFound},
+		{name: "missing series in JSON", method: http.MethodPost, url: "/value/", body: `{"id":"cpu","type":"counter"}`, wantStatus: http.StatusNotFound, wantCode: problem.CodeNotFound},
+		{name: "unparsable value", method: http.MethodPost, url: "/update/gauge/cpu/abc", wantStatus: http.StatusBadRequest, wantCode: problem.CodeParse},
+		{name: "malformed JSON", method: http.MethodPost, url: "/update/", body: `{"id":`, wantStatus: http.StatusBadRequest, wantCode: problem.CodeParse},
+		{name: "missing value", method: http.MethodPost, url: "/update/", body: `{"id":"cpu","type":"gauge"}`, wantStatus: http.StatusBadRequest, wantCode: problem.CodeInvalidMetric},
+		{name: "future timestamp", method: http.MethodPost, url: "/update/", body: fmt.Sprintf(`{"id":"cpu","type":"gauge","value":1,"timestamp":%d}`, future), wantStatus: http.StatusBadRequest, wantCode: problem.CodeFutureTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.url, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, problem.ContentType, resp.Header.Get("Content-Type"))
+			var p problem.Problem
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+			assert.Equal(t, tt.wantCode, p.Code)
+			assert.Equal(t, tt.wantStatus, p.Status)
+			assert.Equal(t, tt.url, p.Instance)
+		})
+	}
+}
+
+// failingPersistStorage fails every write with an error revealing storage details.
+type failingPersistStorage struct{ stubPersistStorage }
+
+func (s *failingPersistStorage) FormattingLogs(context.Context, map[string]float64, map[string]int) error {
+	return errors.New(`pq: password authentication failed for user "metrics"`)
+}
+
+func Test_HandlerService_ServerErrorDetail(t *testing.T) {
+	h := NewHandlerService(service.NewService(storage.NewMemStorage(), &failingPersistStorage{}), chi.NewMux())
+	h.CreateHandlers()
+	ts := httptest.NewServer(h.GetRouter())
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, http.MethodPost, "/update/gauge/cpu/1")
+	resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	var p problem.Problem
+	require.NoError(t, json.Unmarshal([]byte(body), &p))
+	assert.Equal(t, problem.CodePersistence, p.Code)
+	assert.Equal(t, "could not insert gauge metric", p.Detail)
+	assert.NotContains(t, body, "password", "causes of server errors are only logged")
+}
+
 // ... helper testRequestJSON and other tests (same logic, updated type names) ...
 
 func testRequestJSON(t *testing.T, ts *httptest.Server, method, path string, body []byte) (*http.Response, dto.Metrics) {
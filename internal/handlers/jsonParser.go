@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/service"
 
 	easyjson "github.com/mailru/easyjson"
 )
@@ -19,52 +20,51 @@ import (
 // @Produce json
 // @Param metric body metricsdto.Metrics true "Metric object"
 // @Success 200 {object} metricsdto.Metrics
-// @Failure 400 {string} string "Bad Request"
-// @Failure 500 {string} string "Internal Server Error"
+// @Failure 400 {object} problem.Problem "Bad Request"
+// @Failure 500 {object} problem.Problem "Internal Server Error"
 // @Router /update/ [post]
 func (h *HandlerService) PostJSON(res http.ResponseWriter, req *http.Request) {
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
 	var metric metricsdto.Metrics
 	var buf bytes.Buffer
 
 	res.Header().Set("Content-Type", "application/json")
 	_, err := buf.ReadFrom(req.Body)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		writeError(res, req, parseError(err), "failed to read request body")
 		return
 	}
 
 	if err = easyjson.Unmarshal(buf.Bytes(), &metric); err != nil {
-		http.Error(res, fmt.Sprintf("failed to decode metric: %v", err), http.StatusBadRequest)
+		writeError(res, req, parseError(err), "failed to decode metric")
 		return
 	}
-	switch metric.MType {
-	case metricsdto.MetricTypeGauge:
-		if metric.Value == nil {
-			http.Error(res, "field Value is required for counter", http.StatusBadRequest)
-			return
-		}
-		if err = h.service.GaugeInsert(req.Context(), metric.ID, *metric.Value); err != nil {
-			http.Error(res, fmt.Sprintf("could not store gauge metric: %v", err), http.StatusInternalServerError)
-			return
-		}
-		res.WriteHeader(http.StatusOK)
-	case metricsdto.MetricTypeCounter:
-		if metric.Delta == nil {
-			http.Error(res, "delta is required for counter", http.StatusBadRequest)
-			return
-		}
-		if err = h.service.CounterInsert(req.Context(), metric.ID, int(*metric.Delta)); err != nil {
-			http.Error(res, fmt.Sprintf("could not store counter metric: %v", err), http.StatusInternalServerError)
-			return
-		}
-		res.WriteHeader(http.StatusOK)
+	if h.forbidMetrics(res, req, []metricsdto.Metrics{metric}) || h.rejectTypes(res, req, []metricsdto.Metrics{metric}) {
+		return
+	}
+	switch {
+	case metric.MType == metricsdto.MetricTypeGauge && metric.Value == nil:
+		err = fmt.Errorf("%w: value is required for gauge", service.ErrInvalidMetric)
+	case metric.MType == metricsdto.MetricTypeCounter && metric.Delta == nil:
+		err = fmt.Errorf("%w: delta is required for counter", service.ErrInvalidMetric)
 	default:
-		http.Error(res, "invalid action type", http.StatusBadRequest)
+		err = service.CheckType(metric.MType)
+	}
+	if err == nil {
+		err = svc.FromStructToStoreBatch(req.Context(), []metricsdto.Metrics{metric})
+	}
+	if err != nil {
+		writeError(res, req, err, "could not store "+metric.MType+" metric")
 		return
 	}
+	h.afterUpdate(req, metric)
+
 	out, err := easyjson.Marshal(metric)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("cannot marshal metric: %v", err), http.StatusInternalServerError)
+		writeError(res, req, err, "cannot marshal metric")
 		return
 	}
 	res.WriteHeader(http.StatusOK)
@@ -80,47 +80,57 @@ func (h *HandlerService) PostJSON(res http.ResponseWriter, req *http.Request) {
 // @Produce json
 // @Param metric body metricsdto.Metrics true "Metric request object (ID, MType)"
 // @Success 200 {object} metricsdto.Metrics
-// @Failure 404 {string} string "Metric not found"
-// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {object} problem.Problem "Metric not found"
+// @Failure 400 {object} problem.Problem "Bad Request"
 // @Router /value/ [post]
 func (h *HandlerService) GetJSON(res http.ResponseWriter, req *http.Request) {
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
 	res.Header().Set("Content-Type", "application/json")
 	var metric metricsdto.Metrics
 	var buf bytes.Buffer
 
 	_, err := buf.ReadFrom(req.Body)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		writeError(res, req, parseError(err), "failed to read request body")
 		return
 	}
 
 	if err = easyjson.Unmarshal(buf.Bytes(), &metric); err != nil {
-		http.Error(res, fmt.Sprintf("failed to decode metric: %v", err), http.StatusBadRequest)
+		writeError(res, req, parseError(err), "failed to decode metric")
 		return
 	}
-	switch metric.MType {
-	case metricsdto.MetricTypeGauge:
-		lVar, err := h.service.GetGauge(req.Context(), metric.ID)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusNotFound)
-			return
+	if h.forbidMetrics(res, req, []metricsdto.Metrics{metric}) {
+		return
+	}
+	if err = service.CheckType(metric.MType); err != nil {
+		writeError(res, req, err, "")
+		return
+	}
+	if !h.markStale(res, req, metric.MType, metric.ID) {
+		return
+	}
+	if metric.MType == metricsdto.MetricTypeGauge {
+		var lVar float64
+		if lVar, err = svc.GetGauge(req.Context(), metric.ID); err == nil {
+			metric.Value = &lVar
 		}
-		metric.Value = &lVar
-	case metricsdto.MetricTypeCounter:
-		lVar, err := h.service.GetCounter(req.Context(), metric.ID)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusNotFound)
-			return
+	} else {
+		var lVar int
+		if lVar, err = svc.GetCounter(req.Context(), metric.ID); err == nil {
+			lVar64 := int64(lVar)
+			metric.Delta = &lVar64
 		}
-		lVar64 := int64(lVar)
-		metric.Delta = &lVar64
-	default:
-		http.Error(res, "invalid action type", http.StatusNotFound)
+	}
+	if err != nil {
+		writeError(res, req, err, "")
 		return
 	}
 	out, err := easyjson.Marshal(metric)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("cannot marshal metric: %v", err), http.StatusInternalServerError)
+		writeError(res, req, err, "cannot marshal metric")
 		return
 	}
 	res.WriteHeader(http.StatusOK)
@@ -130,36 +140,36 @@ func (h *HandlerService) GetJSON(res http.ResponseWriter, req *http.Request) {
 // PostArrayJSON is a helper handler for processing bulk JSON updates.
 // It is used internally by PostMetrics when Content-Type is application/json.
 func (h *HandlerService) PostArrayJSON(res http.ResponseWriter, req *http.Request) {
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
 	var metrics metricsdto.MetricsArray
 	var returnBuf bytes.Buffer
 
 	res.Header().Set("Content-Type", "application/json")
 	_, err := returnBuf.ReadFrom(req.Body)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		writeError(res, req, parseError(err), "failed to read request body")
 		return
 	}
 
 	if err = easyjson.Unmarshal(returnBuf.Bytes(), &metrics); err != nil {
-		http.Error(res, fmt.Sprintf("failed to decode metric: %v", err), http.StatusBadRequest)
+		writeError(res, req, parseError(err), "failed to decode metrics")
 		return
 	}
-	// Note: Logic here writes input back to response before processing?
-	// The original code did `res.Write(returnBuf.Bytes())` which might be intentional echo
-	// but usually we want to return updated metrics or just OK.
-	// Preserving original logic structure but ensuring valid HTTP flow.
-	// Actually, original code writes body twice? (res.Write(returnBuf) then res.Write(out))
-	// I'll keep it functionally similar but fix potential HTTP header issues if needed.
-
-	err = h.service.FromStructToStoreBatch(req.Context(), metrics)
-	if err != nil {
-		http.Error(res, fmt.Sprintf("failed to write request body: %v", err), http.StatusInternalServerError)
+	if h.forbidMetrics(res, req, metrics) || h.rejectTypes(res, req, metrics) {
+		return
+	}
+	// Answer with the status of every metric instead of echoing the input.
+	result, ok := h.applyBatch(res, req, svc, metrics)
+	if !ok {
 		return
 	}
 
-	out, err := easyjson.Marshal(metrics)
+	out, err := easyjson.Marshal(result)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("cannot marshal metric: %v", err), http.StatusInternalServerError)
+		writeError(res, req, err, "cannot marshal batch result")
 		return
 	}
 	res.WriteHeader(http.StatusOK)
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/auth"
+	"gometrics/internal/metadata"
+	"gometrics/internal/metricname"
+	"gometrics/internal/problem"
+	"gometrics/internal/tenant"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// SetMetadata enables the metadata API on /api/v1/metadata, declared type checks
+// on updates and # HELP lines on GET /metrics. It must be called before CreateHandlers.
+func (h *HandlerService) SetMetadata(r *metadata.Registry) {
+	h.meta = r
+}
+
+// rejectTypes writes 400 and returns true if any metric is updated with a type
+// other than the one declared in its metadata.
+func (h *HandlerService) rejectTypes(res http.ResponseWriter, req *http.Request, metrics []metricsdto.Metrics) bool {
+	if h.meta == nil {
+		return false
+	}
+	for _, m := range metrics {
+		if err := h.meta.Check(m.ID, m.MType); err != nil {
+			writeError(res, req, err, "")
+			return true
+		}
+	}
+	return false
+}
+
+// unit returns the unit of the named metric, if its metadata is known.
+func (h *HandlerService) unit(name string) string {
+	if h.meta == nil {
+		return ""
+	}
+	m, _ := h.meta.Get(name)
+	return m.Unit
+}
+
+// metadataResponse is the body of GET /api/v1/metadata.
+type metadataResponse struct {
+	Metadata []metadata.Metadata `json:"metadata"`
+}
+
+// PutMetadata sets the unit, help text and declared type of a metric.
+// Metadata is shared by all tenants: a token needs the write scope and may only
+// describe the metrics its prefix allows, like their updates.
+//
+// @Summary Set metric metadata
+// @Description Adds or replaces the metadata of a metric. The name is taken from the path.
+// @Description Metadata is shared by all tenants and requires a write token allowed to update the metric.
+// @Tags metadata
+// @Accept json
+// @Produce json
+// @Param name path string true "Metric name"
+// @Param metadata body metadata.Metadata true "Metadata (type, unit, help)"
+// @Success 200 {object} metadata.Metadata
+// @Failure 400 {object} problem.Problem "Bad Request"
+// @Failure 403 {object} problem.Problem "Forbidden"
+// @Router /api/v1/metadata/{name} [put]
+func (h *HandlerService) PutMetadata(res http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if !auth.AllowMetric(req.Context(), h.names, name) {
+		forbidden(res, req, name)
+		return
+	}
+	var m metadata.Metadata
+	if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+		writeError(res, req, parseError(err), "failed to decode metadata")
+		return
+	}
+	m.Name = name
+	if err := h.meta.Set(req.Context(), m); err != nil {
+		writeError(res, req, err, "cannot set metadata")
+		return
+	}
+	writeJSON(res, req, m)
+}
+
+// GetMetadata returns the metadata of a metric.
+//
+// @Summary Get metric metadata
+// @Tags metadata
+// @Produce json
+// @Param name path string true "Metric name"
+// @Success 200 {object} metadata.Metadata
+// @Failure 404 {object} problem.Problem "Metadata not found"
+// @Router /api/v1/metadata/{name} [get]
+func (h *HandlerService) GetMetadata(res http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if !auth.AllowMetric(req.Context(), h.names, name) {
+		forbidden(res, req, name)
+		return
+	}
+	m, ok := h.meta.Get(name)
+	if !ok {
+		problem.Error(res, req, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("no metadata for metric %s", name))
+		return
+	}
+	writeJSON(res, req, m)
+}
+
+// ListMetadata lists the metadata of all metrics visible to the request token.
+//
+// @Summary List metric metadata
+// @Tags metadata
+// @Produce json
+// @Success 200 {object} metadataResponse
+// @Router /api/v1/metadata [get]
+func (h *HandlerService) ListMetadata(res http.ResponseWriter, req *http.Request) {
+	out := metadataResponse{Metadata: []metadata.Metadata{}}
+	for _, m := range h.meta.All() {
+		if auth.AllowMetric(req.Context(), h.names, m.Name) {
+			out.Metadata = append(out.Metadata, m)
+		}
+	}
+	writeJSON(res, req, out)
+}
+
+// PrometheusMetrics renders the metrics of the request tenant in the Prometheus
+// text exposition format, with # HELP and # UNIT lines taken from the metadata.
+// Every family is exposed once: a series whose exposed name is taken by a
+// series already written (e.g. a counter named like a gauge) is skipped.
+//
+// @Summary Prometheus exposition
+// @Description Returns all metrics in the Prometheus text format.
+// @Tags info
+// @Produce text/plain
+// @Success 200 {string} string "Metrics"
+// @Router /metrics [get]
+func (h *HandlerService) PrometheusMetrics(res http.ResponseWriter, req *http.Request) {
+	svc, ok := h.serviceFor(res, req)
+	if !ok {
+		return
+	}
+	values := map[string]map[string]string{
+		metricsdto.MetricTypeGauge:   {},
+		metricsdto.MetricTypeCounter: {},
+	}
+	for key, v := range svc.GetAllGauges(req.Context()) {
+		values[metricsdto.MetricTypeGauge][key] = fmt.Sprintf("%v", v)
+	}
+	for key, v := range svc.GetAllCounters(req.Context()) {
+		values[metricsdto.MetricTypeCounter][key] = fmt.Sprintf("%v", v)
+	}
+	if h.stale != nil {
+		// The self-metrics of the tenant shadow stored series of the same name.
+		for name, v := range h.stale.SelfMetrics(tenant.FromContext(req.Context())) {
+			for _, byKey := range values {
+				for key := range byKey {
+					if h.names.Key(key) == h.names.Key(name) {
+						delete(byKey, key)
+					}
+				}
+			}
+			values[metricsdto.MetricTypeGauge][name] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	var b strings.Builder
+	exposed := make(map[string]bool)
+	for _, mtype := range []string{metricsdto.MetricTypeGauge, metricsdto.MetricTypeCounter} {
+		for _, key := range slices.Sorted(maps.Keys(values[mtype])) {
+			if !auth.AllowMetric(req.Context(), h.names, key) || (h.hide && h.isStale(req, mtype, key)) {
+				continue
+			}
+			name := metricname.Sanitize(key)
+			if exposed[name] {
+				continue
+			}
+			exposed[name] = true
+			if h.meta != nil {
+				if m, ok := h.meta.Get(key); ok {
+					if m.Help != "" {
+						fmt.Fprintf(&b, "# HELP %s %s\n", name, promEscape(m.Help))
+					}
+					if m.Unit != "" {
+						fmt.Fprintf(&b, "# UNIT %s %s\n", name, metricname.Sanitize(m.Unit))
+					}
+				}
+			}
+			fmt.Fprintf(&b, "# TYPE %s %s\n%s %s\n", name, mtype, name, values[mtype][key])
+		}
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	res.WriteHeader(http.StatusOK)
+	res.Write([]byte(b.String()))
+}
+
+// promEscape escapes a # HELP text as the exposition format requires.
+func promEscape(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// writeJSON writes v as a 200 application/json response.
+func writeJSON(res http.ResponseWriter, req *http.Request, v any) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		writeError(res, req, err, "cannot marshal response")
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
+}
@@ -0,0 +1,241 @@
+// Package idempotency makes retried update requests safe. A client sends the
+// same Idempotency-Key header with every attempt of a request; the server
+// applies the request once and answers the repeats with the stored response.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gometrics/internal/auth"
+	"gometrics/internal/problem"
+	"gometrics/internal/tenant"
+)
+
+const (
+	// Header carries the client-generated key of a request.
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set to "true" on responses replayed from the store.
+	ReplayedHeader = "Idempotent-Replayed"
+	// maxKeyLen bounds the accepted key length.
+	maxKeyLen = 255
+	// pollInterval is how often a request waits for the key claimed by another
+	// server to get its response.
+	pollInterval = 50 * time.Millisecond
+)
+
+// Response is the stored outcome of a request.
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Store remembers the responses of processed keys for a limited time.
+type Store interface {
+	// Get returns the response stored under key, if it has not expired.
+	// Keys claimed by requests still in flight are not returned.
+	Get(ctx context.Context, key string) (Response, bool, error)
+	// Claim marks key as being processed. It reports false if the key is
+	// already claimed or has a response, so only one request applies it.
+	Claim(ctx context.Context, key string) (bool, error)
+	// Put stores the response of a claimed key.
+	Put(ctx context.Context, key string, resp Response) error
+	// Release drops the claim of key without a response, so a retry is
+	// processed again.
+	Release(ctx context.Context, key string) error
+}
+
+// Guard deduplicates requests by their Idempotency-Key. Concurrent requests
+// with the same key are serialized, so a repeat arriving while the original is
+// still running waits for its response instead of applying the update twice.
+// Requests on other servers sharing the store wait for the claim of the key.
+type Guard struct {
+	store    Store
+	poll     time.Duration
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+// NewGuard creates a guard keeping responses in store.
+func NewGuard(store Store) *Guard {
+	return &Guard{
+		store:    store,
+		poll:     pollInterval,
+		inflight: make(map[string]chan struct{}),
+	}
+}
+
+// scopedKey binds a client key to the tenant, the token and the route of the
+// request, so different clients cannot replay each other's responses.
+func scopedKey(r *http.Request, key string) string {
+	var token string
+	if tok, ok := auth.FromContext(r.Context()); ok {
+		token = tok.Name
+	}
+	sum := sha256.Sum256([]byte(tenant.FromContext(r.Context()) + "\x00" + token + "\x00" +
+		r.Method + " " + r.URL.Path + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// acquire waits until no other request with the key is in flight and marks it
+// as running. It returns nil if ctx is done first.
+func (g *Guard) acquire(ctx context.Context, key string) (release func()) {
+	for {
+		g.mu.Lock()
+		running, busy := g.inflight[key]
+		if !busy {
+			done := make(chan struct{})
+			g.inflight[key] = done
+			g.mu.Unlock()
+			return func() {
+				g.mu.Lock()
+				delete(g.inflight, key)
+				g.mu.Unlock()
+				close(done)
+			}
+		}
+		g.mu.Unlock()
+
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// cacheable reports whether a response is final. Throttling and server errors
+// are not stored, so the client's retry is processed again.
+func cacheable(status int) bool {
+	return status < http.StatusInternalServerError && status != http.StatusTooManyRequests
+}
+
+// Middleware replays the stored response for a repeated Idempotency-Key and
+// stores the response of the first request. Requests without the header pass through.
+// The key is claimed before the request is processed; while another server
+// holds the claim the request waits for its response. If the store fails the
+// request is answered with 503 rather than risk applying it twice.
+func (g *Guard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKeyLen {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidIdempotency, "Idempotency-Key is too long")
+			return
+		}
+
+		id := scopedKey(r, key)
+		release := g.acquire(r.Context(), id)
+		if release == nil {
+			problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "request cancelled")
+			return
+		}
+		defer release()
+
+		for {
+			stored, ok, err := g.store.Get(r.Context(), id)
+			if err != nil {
+				log.Printf("WARN: idempotency lookup: %v", err)
+				problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "idempotency store unavailable")
+				return
+			}
+			if ok {
+				replay(w, stored)
+				return
+			}
+			claimed, err := g.store.Claim(r.Context(), id)
+			if err != nil {
+				log.Printf("WARN: idempotency claim: %v", err)
+				problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "idempotency store unavailable")
+				return
+			}
+			if claimed {
+				g.serve(next, w, r, id)
+				return
+			}
+
+			// Another server is processing the key: wait for its response.
+			select {
+			case <-time.After(g.poll):
+			case <-r.Context().Done():
+				problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "request cancelled")
+				return
+			}
+		}
+	})
+}
+
+// serve processes the request of a claimed key and stores its response, or
+// drops the claim if the response is not final or the handler panics.
+func (g *Guard) serve(next http.Handler, w http.ResponseWriter, r *http.Request, id string) {
+	// The claim is settled even if the client goes away meanwhile.
+	ctx := context.WithoutCancel(r.Context())
+	stored := false
+	defer func() {
+		if stored {
+			return
+		}
+		if err := g.store.Release(ctx, id); err != nil {
+			log.Printf("WARN: idempotency release: %v", err)
+		}
+	}()
+
+	rec := &recorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !cacheable(rec.status) {
+		return
+	}
+	resp := Response{Status: rec.status, ContentType: rec.contentType, Body: rec.body.Bytes()}
+	if err := g.store.Put(ctx, id, resp); err != nil {
+		log.Printf("WARN: idempotency store: %v", err)
+		return
+	}
+	stored = true
+}
+
+// replay writes a stored response.
+func replay(w http.ResponseWriter, stored Response) {
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+// recorder passes a response through while keeping a copy of it.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	contentType string
+	body        bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.contentType = r.Header().Get("Content-Type")
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
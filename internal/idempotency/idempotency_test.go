@@ -0,0 +1,160 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gometrics/internal/tenant"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuard_Middleware(t *testing.T) {
+	var applied atomic.Int32
+	status := http.StatusOK
+	handler := NewGuard(NewMemoryStore(time.Minute, 0)).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := applied.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		w.Write([]byte(strconv.Itoa(int(n))))
+	}))
+
+	do := func(key, tenantID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		if key != "" {
+			req.Header.Set(Header, key)
+		}
+		if tenantID != "" {
+			req = req.WithContext(tenant.WithTenant(req.Context(), tenantID))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := do("batch-1", "")
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "1", first.Body.String())
+
+	repeat := do("batch-1", "")
+	assert.Equal(t, http.StatusOK, repeat.Code)
+	assert.Equal(t, "1", repeat.Body.String(), "the original response is replayed")
+	assert.Equal(t, "text/plain", repeat.Header().Get("Content-Type"))
+	assert.Equal(t, "true", repeat.Header().Get(ReplayedHeader))
+	assert.Equal(t, int32(1), applied.Load(), "the update is applied once")
+
+	assert.Equal(t, "2", do("batch-1", "teama").Body.String(), "keys are scoped by tenant")
+	assert.Equal(t, "3", do("", "").Body.String(), "requests without a key pass through")
+	assert.Equal(t, "4", do("", "").Body.String())
+
+	status = http.StatusServiceUnavailable
+	do("batch-2", "")
+	status = http.StatusOK
+	assert.Equal(t, "6", do("batch-2", "").Body.String(), "server errors are not stored")
+
+	tooLong := make([]byte, maxKeyLen+1)
+	for i := range tooLong {
+		tooLong[i] = 'k'
+	}
+	assert.Equal(t, http.StatusBadRequest, do(string(tooLong), "").Code)
+}
+
+func TestGuard_ConcurrentRepeats(t *testing.T) {
+	var applied atomic.Int32
+	handler := NewGuard(NewMemoryStore(time.Minute, 0)).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		applied.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+			req.Header.Set(Header, "same")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, "done", rec.Body.String())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), applied.Load())
+}
+
+func TestGuard_Replicas(t *testing.T) {
+	// Two servers share the store, each with its own guard.
+	store := NewMemoryStore(time.Minute, 0)
+	var applied atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		applied.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	replicas := []http.Handler{NewGuard(store).Middleware(next), NewGuard(store).Middleware(next)}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+			req.Header.Set(Header, "same")
+			rec := httptest.NewRecorder()
+			replicas[i%2].ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "done", rec.Body.String())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), applied.Load(), "the claim lets one server apply the request")
+}
+
+// failingStore fails every lookup.
+type failingStore struct {
+	MemoryStore
+}
+
+func (s *failingStore) Get(context.Context, string) (Response, bool, error) {
+	return Response{}, false, errors.New("connection refused")
+}
+
+func TestGuard_StoreFailure(t *testing.T) {
+	var applied atomic.Int32
+	handler := NewGuard(&failingStore{}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		applied.Add(1)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	req.Header.Set(Header, "k")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Zero(t, applied.Load(), "the request is not applied without the store")
+}
+
+func TestGuard_StoreFullOfClaims(t *testing.T) {
+	store := NewMemoryStore(time.Minute, 1)
+	claimed, err := store.Claim(context.Background(), "in-progress")
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	var applied atomic.Int32
+	handler := NewGuard(store).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		applied.Add(1)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	req.Header.Set(Header, "k")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Zero(t, applied.Load())
+}
@@ -0,0 +1,252 @@
+package idempotency
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// claimTimeout is how long a claim without a response holds its key. Older
+// claims are considered abandoned by a crashed server and can be taken over.
+const claimTimeout = time.Minute
+
+// ErrTooManyClaims is returned by MemoryStore.Claim when every key it may hold
+// is claimed by a request in progress.
+var ErrTooManyClaims = errors.New("too many requests in progress")
+
+// MemoryStore keeps responses in memory for ttl, holding at most max keys;
+// the oldest responses are dropped first. Claims of requests in progress are
+// never dropped to make room. It is safe for concurrent use.
+type MemoryStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	now     func() time.Time
+	entries map[string]*list.Element
+	order   *list.List // of *memEntry, oldest first
+}
+
+type memEntry struct {
+	key     string
+	resp    Response
+	claimed time.Time // zero once the response is stored
+	expires time.Time
+}
+
+// NewMemoryStore creates a store remembering keys for ttl. A non-positive max
+// leaves the number of keys bounded only by the ttl.
+func NewMemoryStore(ttl time.Duration, max int) *MemoryStore {
+	return &MemoryStore{
+		ttl:     ttl,
+		max:     max,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the response stored under key, if it has not expired.
+func (s *MemoryStore) Get(_ context.Context, key string) (Response, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return Response{}, false, nil
+	}
+	e := elem.Value.(*memEntry)
+	if !s.now().Before(e.expires) {
+		s.remove(elem)
+		return Response{}, false, nil
+	}
+	if !e.claimed.IsZero() {
+		return Response{}, false, nil
+	}
+	return e.resp, true, nil
+}
+
+// Claim marks key as being processed unless it has a response or a claim
+// younger than claimTimeout. It returns ErrTooManyClaims if the store is full
+// of claims younger than claimTimeout.
+func (s *MemoryStore) Claim(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if elem, ok := s.entries[key]; ok {
+		e := elem.Value.(*memEntry)
+		if now.Before(e.expires) && (e.claimed.IsZero() || now.Sub(e.claimed) < claimTimeout) {
+			return false, nil
+		}
+	}
+	if err := s.insert(&memEntry{key: key, claimed: now, expires: now.Add(s.ttl)}, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Put stores the response of key, dropping expired keys and, over the limit,
+// the oldest responses.
+func (s *MemoryStore) Put(_ context.Context, key string, resp Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	return s.insert(&memEntry{key: key, resp: resp, expires: now.Add(s.ttl)}, now)
+}
+
+// Release drops the claim of key.
+func (s *MemoryStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok && !elem.Value.(*memEntry).claimed.IsZero() {
+		s.remove(elem)
+	}
+	return nil
+}
+
+// insert replaces the entry of e.key, dropping expired keys and, to stay
+// within the limit, the oldest responses and abandoned claims. A claim that
+// finds only claims in progress is refused with ErrTooManyClaims; a response
+// is stored over the limit, as it replaces the claim of its request.
+func (s *MemoryStore) insert(e *memEntry, now time.Time) error {
+	if elem, ok := s.entries[e.key]; ok {
+		s.remove(elem)
+	}
+	s.makeRoom(now)
+	if !e.claimed.IsZero() && s.max > 0 && s.order.Len() >= s.max {
+		return ErrTooManyClaims
+	}
+	s.entries[e.key] = s.order.PushBack(e)
+	return nil
+}
+
+// makeRoom drops expired keys and, while there is no room for one more key,
+// the oldest entries other than claims younger than claimTimeout. Entries are
+// ordered by expiry, since all of them live for ttl.
+func (s *MemoryStore) makeRoom(now time.Time) {
+	for elem := s.order.Front(); elem != nil; {
+		next := elem.Next()
+		e := elem.Value.(*memEntry)
+		switch {
+		case !now.Before(e.expires):
+			s.remove(elem)
+		case s.max <= 0 || s.order.Len() < s.max:
+			return
+		case e.claimed.IsZero() || now.Sub(e.claimed) >= claimTimeout:
+			s.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// Len returns the number of stored keys, including expired ones not yet dropped.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+func (s *MemoryStore) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(*memEntry).key)
+}
+
+// purgeEvery is how many Put calls pass between deletions of expired keys.
+const purgeEvery = 256
+
+// DBStore keeps responses in the idempotency_keys table in PostgreSQL, so that
+// repeats are recognized by every server instance sharing the database.
+type DBStore struct {
+	db   *sql.DB
+	ttl  time.Duration
+	now  func() time.Time
+	mu   sync.Mutex
+	puts int
+}
+
+// NewDBStore returns a store remembering keys for ttl in the idempotency_keys
+// table, created by the db migrations.
+func NewDBStore(db *sql.DB, ttl time.Duration) *DBStore {
+	return &DBStore{db: db, ttl: ttl, now: time.Now}
+}
+
+// Get returns the response stored under key, if it has not expired. Claims
+// are stored with a zero Status and are not returned.
+func (s *DBStore) Get(ctx context.Context, key string) (Response, bool, error) {
+	var resp Response
+	err := s.db.QueryRowContext(ctx,
+		"SELECT Status, ContentType, Body FROM idempotency_keys WHERE Key = $1 AND Status <> 0 AND CreatedAt > $2",
+		key, s.now().Add(-s.ttl),
+	).Scan(&resp.Status, &resp.ContentType, &resp.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Response{}, false, nil
+	}
+	if err != nil {
+		return Response{}, false, fmt.Errorf("lookup idempotency key: %w", err)
+	}
+	return resp, true, nil
+}
+
+// Claim inserts a row with a zero Status for key. An existing row is taken
+// over only if it has expired or is a claim older than claimTimeout, so of
+// the servers racing for a key exactly one affects a row.
+func (s *DBStore) Claim(ctx context.Context, key string) (bool, error) {
+	now := s.now()
+	res, err := s.db.ExecContext(ctx, `
+        INSERT INTO idempotency_keys (Key, Status, CreatedAt)
+        VALUES ($1, 0, $2)
+        ON CONFLICT (Key) DO UPDATE
+        SET Status = 0, ContentType = '', Body = NULL, CreatedAt = EXCLUDED.CreatedAt
+        WHERE idempotency_keys.CreatedAt <= $3
+           OR (idempotency_keys.Status = 0 AND idempotency_keys.CreatedAt <= $4);
+    `, key, now, now.Add(-s.ttl), now.Add(-claimTimeout))
+	if err != nil {
+		return false, fmt.Errorf("claim idempotency key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("claim idempotency key: %w", err)
+	}
+	return n == 1, nil
+}
+
+// Release deletes the claim of key.
+func (s *DBStore) Release(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE Key = $1 AND Status = 0", key); err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Put stores the response of key. Every purgeEvery calls it also deletes expired keys.
+func (s *DBStore) Put(ctx context.Context, key string, resp Response) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO idempotency_keys (Key, Status, ContentType, Body, CreatedAt)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (Key) DO UPDATE
+        SET Status = EXCLUDED.Status, ContentType = EXCLUDED.ContentType,
+            Body = EXCLUDED.Body, CreatedAt = EXCLUDED.CreatedAt;
+    `, key, resp.Status, resp.ContentType, resp.Body, s.now())
+	if err != nil {
+		return fmt.Errorf("store idempotency key: %w", err)
+	}
+
+	s.mu.Lock()
+	s.puts++
+	purge := s.puts%purgeEvery == 0
+	s.mu.Unlock()
+	if purge {
+		return s.Purge(ctx)
+	}
+	return nil
+}
+
+// Purge deletes the expired keys.
+func (s *DBStore) Purge(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE CreatedAt <= $1", s.now().Add(-s.ttl)); err != nil {
+		return fmt.Errorf("purge idempotency keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package idempotency
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := NewMemoryStore(time.Minute, 2)
+	s.now = func() time.Time { return now }
+
+	ok := Response{Status: 200, Body: []byte("ok")}
+	require.NoError(t, s.Put(ctx, "a", ok))
+	got, found, err := s.Get(ctx, "a")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, ok, got)
+
+	// Over the limit the oldest key is dropped.
+	require.NoError(t, s.Put(ctx, "b", ok))
+	require.NoError(t, s.Put(ctx, "c", ok))
+	assert.Equal(t, 2, s.Len())
+	_, found, _ = s.Get(ctx, "a")
+	assert.False(t, found)
+
+	// Keys expire after the ttl.
+	now = now.Add(time.Minute)
+	_, found, _ = s.Get(ctx, "b")
+	assert.False(t, found)
+	require.NoError(t, s.Put(ctx, "d", ok))
+	assert.Equal(t, 1, s.Len(), "expired keys are dropped on Put")
+
+	// A claim holds the key until the response is stored or the claim is released.
+	claimed, err := s.Claim(ctx, "e")
+	require.NoError(t, err)
+	require.True(t, claimed)
+	claimed, _ = s.Claim(ctx, "e")
+	assert.False(t, claimed)
+	_, found, _ = s.Get(ctx, "e")
+	assert.False(t, found, "claims have no response")
+	require.NoError(t, s.Release(ctx, "e"))
+	claimed, _ = s.Claim(ctx, "e")
+	assert.True(t, claimed)
+	claimed, _ = s.Claim(ctx, "d")
+	assert.False(t, claimed, "keys with a response cannot be claimed")
+
+	// Abandoned claims are taken over.
+	now = now.Add(claimTimeout)
+	claimed, _ = s.Claim(ctx, "e")
+	assert.True(t, claimed)
+}
+
+func TestMemoryStore_KeepsClaims(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := NewMemoryStore(time.Hour, 2)
+	s.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b"} {
+		claimed, err := s.Claim(ctx, key)
+		require.NoError(t, err)
+		require.True(t, claimed)
+	}
+	_, err := s.Claim(ctx, "c")
+	assert.ErrorIs(t, err, ErrTooManyClaims, "claims in progress are not dropped")
+
+	// Stored responses make room for new claims.
+	require.NoError(t, s.Put(ctx, "a", Response{Status: 200}))
+	claimed, err := s.Claim(ctx, "c")
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	_, found, _ := s.Get(ctx, "a")
+	assert.False(t, found)
+	claimed, _ = s.Claim(ctx, "b")
+	assert.False(t, claimed, "the claim of b is kept")
+
+	// Abandoned claims make room too.
+	now = now.Add(claimTimeout)
+	claimed, err = s.Claim(ctx, "d")
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, 2, s.Len())
+}
+
+func TestDBStore(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	store := NewDBStore(sqlDB, time.Minute)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	mock.ExpectExec("INSERT INTO idempotency_keys").
+		WithArgs("k1", now, now.Add(-time.Minute), now.Add(-claimTimeout)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	claimed, err := store.Claim(context.Background(), "k1")
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	mock.ExpectExec("INSERT INTO idempotency_keys").
+		WithArgs("k1", now, now.Add(-time.Minute), now.Add(-claimTimeout)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	claimed, err = store.Claim(context.Background(), "k1")
+	require.NoError(t, err)
+	assert.False(t, claimed, "the key is claimed by another server")
+
+	mock.ExpectExec("INSERT INTO idempotency_keys").
+		WithArgs("k1", 200, "application/json", []byte("[]"), now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, store.Put(context.Background(), "k1", Response{Status: 200, ContentType: "application/json", Body: []byte("[]")}))
+
+	mock.ExpectQuery("SELECT Status, ContentType, Body FROM idempotency_keys").
+		WithArgs("k1", now.Add(-time.Minute)).
+		WillReturnRows(sqlmock.NewRows([]string{"Status", "ContentType", "Body"}).AddRow(200, "application/json", []byte("[]")))
+	resp, found, err := store.Get(context.Background(), "k1")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, []byte("[]"), resp.Body)
+
+	mock.ExpectQuery("SELECT Status, ContentType, Body FROM idempotency_keys").
+		WithArgs("k2", now.Add(-time.Minute)).
+		WillReturnRows(sqlmock.NewRows([]string{"Status", "ContentType", "Body"}))
+	_, found, err = store.Get(context.Background(), "k2")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM idempotency_keys WHERE Key = $1 AND Status = 0")).
+		WithArgs("k2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, store.Release(context.Background(), "k2"))
+
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE CreatedAt").
+		WithArgs(now.Add(-time.Minute)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	require.NoError(t, store.Purge(context.Background()))
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,144 @@
+// Package metadata keeps descriptive metadata of metrics: the unit, the help
+// text and the type a metric is expected to have, keyed by metric name.
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/metricname"
+)
+
+var (
+	// ErrInvalid is returned for metadata with an empty name or an unknown type.
+	ErrInvalid = errors.New("invalid metadata")
+	// ErrTypeMismatch is returned by Check when a metric is updated with a type
+	// other than the declared one.
+	ErrTypeMismatch = errors.New("metric type does not match its metadata")
+)
+
+// Metadata describes one metric.
+type Metadata struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"` // gauge или counter, пусто - любой тип
+	Unit string `json:"unit,omitempty"` // например bytes, seconds, percent
+	Help string `json:"help,omitempty"` // описание для людей и # HELP
+}
+
+// Validate checks the name and the declared type.
+func (m Metadata) Validate() error {
+	if strings.TrimSpace(m.Name) == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalid)
+	}
+	switch m.Type {
+	case "", metricsdto.MetricTypeGauge, metricsdto.MetricTypeCounter:
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalid, m.Type)
+	}
+}
+
+// Store persists metadata. Both db.DBStorage and persist.PersistStorage implement it.
+type Store interface {
+	LoadMetadata(ctx context.Context) ([]Metadata, error)
+	SaveMetadata(ctx context.Context, m Metadata) error
+}
+
+// Registry holds the metadata of all metrics. Names are matched by the same
+// metricname.Policy as metric names in storage, case-insensitive by default.
+// It is safe for concurrent use.
+type Registry struct {
+	mu    sync.RWMutex
+	items map[string]Metadata // by names.Key(Name)
+	store Store
+	names metricname.Policy
+}
+
+// NewRegistry creates an empty registry saving changes to store; store may be nil.
+func NewRegistry(store Store) *Registry {
+	return &Registry{
+		items: make(map[string]Metadata),
+		store: store,
+	}
+}
+
+// SetNamePolicy sets how metric names are matched and stored; it should be
+// set before Load, with the policy given to the storages.
+func (r *Registry) SetNamePolicy(p metricname.Policy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = p
+}
+
+// Load replaces the registry contents with the metadata kept in the store.
+func (r *Registry) Load(ctx context.Context) error {
+	if r.store == nil {
+		return nil
+	}
+	items, err := r.store.LoadMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("load metadata: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = make(map[string]Metadata, len(items))
+	for _, m := range items {
+		m.Name = r.names.Name(m.Name)
+		r.items[r.names.Key(m.Name)] = m
+	}
+	return nil
+}
+
+// Set validates m, saves it to the store and replaces the metadata of m.Name.
+func (r *Registry) Set(ctx context.Context, m Metadata) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	r.mu.RLock()
+	names := r.names
+	r.mu.RUnlock()
+	m.Name = names.Name(m.Name)
+	if r.store != nil {
+		if err := r.store.SaveMetadata(ctx, m); err != nil {
+			return fmt.Errorf("save metadata %s: %w", m.Name, err)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items[r.names.Key(m.Name)] = m
+	return nil
+}
+
+// Get returns the metadata of the named metric.
+func (r *Registry) Get(name string) (Metadata, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.items[r.names.Key(name)]
+	return m, ok
+}
+
+// All returns the metadata of all metrics sorted by name.
+func (r *Registry) All() []Metadata {
+	r.mu.RLock()
+	out := make([]Metadata, 0, len(r.items))
+	for _, m := range r.items {
+		out = append(out, m)
+	}
+	r.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Check returns ErrTypeMismatch if the metric declares a type other than mtype.
+func (r *Registry) Check(name, mtype string) error {
+	m, ok := r.Get(name)
+	if !ok || m.Type == "" || m.Type == mtype {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is declared as %s, got %s", ErrTypeMismatch, name, m.Type, mtype)
+}
@@ -0,0 +1,112 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gometrics/internal/metricname"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memStore keeps saved metadata in memory.
+type memStore struct {
+	saved []Metadata
+	err   error
+}
+
+func (s *memStore) LoadMetadata(context.Context) ([]Metadata, error) { return s.saved, s.err }
+func (s *memStore) SaveMetadata(_ context.Context, m Metadata) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.saved = append(s.saved, m)
+	return nil
+}
+
+func TestMetadata_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       Metadata
+		wantErr bool
+	}{
+		{"gauge", Metadata{Name: "Alloc", Type: "gauge", Unit: "bytes"}, false},
+		{"any type", Metadata{Name: "Alloc", Help: "heap"}, false},
+		{"empty name", Metadata{Name: " ", Type: "gauge"}, true},
+		{"unknown type", Metadata{Name: "Alloc", Type: "histogram"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.m.Validate()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalid)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	store := &memStore{}
+	r := NewRegistry(store)
+
+	require.NoError(t, r.Set(ctx, Metadata{Name: "Alloc", Type: "gauge", Unit: "bytes"}))
+	require.NoError(t, r.Set(ctx, Metadata{Name: "PollCount", Type: "counter"}))
+	assert.ErrorIs(t, r.Set(ctx, Metadata{Name: "Bad", Type: "summary"}), ErrInvalid)
+	assert.Len(t, store.saved, 2)
+
+	m, ok := r.Get("alloc")
+	require.True(t, ok, "names are case-insensitive")
+	assert.Equal(t, "bytes", m.Unit)
+	assert.Equal(t, []string{"Alloc", "PollCount"}, []string{r.All()[0].Name, r.All()[1].Name})
+
+	assert.NoError(t, r.Check("Alloc", "gauge"))
+	assert.ErrorIs(t, r.Check("Alloc", "counter"), ErrTypeMismatch)
+	assert.NoError(t, r.Check("Unknown", "counter"))
+
+	// A fresh registry restores the saved metadata.
+	restored := NewRegistry(store)
+	require.NoError(t, restored.Load(ctx))
+	assert.Equal(t, r.All(), restored.All())
+
+	store.err = errors.New("disk full")
+	assert.Error(t, r.Set(ctx, Metadata{Name: "Sys", Type: "gauge"}))
+	_, ok = r.Get("Sys")
+	assert.False(t, ok, "failed saves do not change the registry")
+}
+
+func TestRegistry_NamePolicy(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		policy metricname.Policy
+		set    string
+		get    string
+		wantOK bool
+		stored string
+	}{
+		{metricname.CaseInsensitive, "Alloc", "alloc", true, "Alloc"},
+		{metricname.CaseSensitive, "Alloc", "alloc", false, "Alloc"},
+		{metricname.CaseSensitive, "Alloc", "Alloc", true, "Alloc"},
+		{metricname.Prometheus, "http.requests", "http_requests", true, "http_requests"},
+		{metricname.Prometheus, "Alloc", "alloc", false, "Alloc"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+"/"+tt.get, func(t *testing.T) {
+			store := &memStore{}
+			r := NewRegistry(store)
+			r.SetNamePolicy(tt.policy)
+			require.NoError(t, r.Set(ctx, Metadata{Name: tt.set, Type: "gauge"}))
+			assert.Equal(t, tt.stored, store.saved[0].Name)
+
+			m, ok := r.Get(tt.get)
+			require.Equal(t, tt.wantOK, ok)
+			if ok {
+				assert.Equal(t, tt.stored, m.Name)
+			}
+		})
+	}
+}
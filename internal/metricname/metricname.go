@@ -0,0 +1,104 @@
+// Package metricname defines how metric names are normalised. A single policy
+// is shared by the in-memory storage, the service and the persistent storages,
+// so that a name identifies the same series everywhere.
+package metricname
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Policy selects how metric names are compared and stored.
+type Policy string
+
+const (
+	// CaseInsensitive matches names regardless of case; a series keeps the
+	// case of its latest write for display. It is the zero value.
+	CaseInsensitive Policy = "case-insensitive"
+	// CaseSensitive keeps "Alloc" and "alloc" apart.
+	CaseSensitive Policy = "case-sensitive"
+	// Prometheus rewrites names to the Prometheus metric name syntax
+	// ([a-zA-Z_:][a-zA-Z0-9_:]*) and compares them case-sensitively.
+	Prometheus Policy = "prometheus"
+)
+
+// ErrUnknownPolicy is returned by ParsePolicy for an unsupported policy.
+var ErrUnknownPolicy = errors.New("unknown metric name policy")
+
+// ParsePolicy returns the policy named s; the empty string is CaseInsensitive.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "", CaseInsensitive:
+		return CaseInsensitive, nil
+	case CaseSensitive, Prometheus:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownPolicy, s)
+}
+
+// FoldsCase reports whether names differing only in case are the same series.
+func (p Policy) FoldsCase() bool {
+	return p != CaseSensitive && p != Prometheus
+}
+
+// Name returns the form of name that is stored and displayed.
+func (p Policy) Name(name string) string {
+	if p == Prometheus {
+		return Sanitize(name)
+	}
+	return name
+}
+
+// Key returns the identity of name: two names are the same series if and only
+// if their keys are equal. Key(Name(n)) == Key(n) for every policy.
+func (p Policy) Key(name string) string {
+	name = p.Name(name)
+	if p.FoldsCase() {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// Sanitize rewrites name to the Prometheus metric name syntax: every
+// character outside [a-zA-Z0-9_:] becomes '_' and a leading digit gets a '_'
+// prefix. Valid names are returned unchanged.
+func Sanitize(name string) string {
+	valid := true
+	for i, r := range name {
+		if !validRune(r, i == 0) {
+			valid = false
+			break
+		}
+	}
+	if valid {
+		return name
+	}
+
+	var b strings.Builder
+	b.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case i == 0 && r >= '0' && r <= '9':
+			b.WriteByte('_')
+			b.WriteRune(r)
+		case validRune(r, false):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// validRune reports whether r may appear in a Prometheus metric name, at the
+// start of it if first is set.
+func validRune(r rune, first bool) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+		return true
+	case r >= '0' && r <= '9':
+		return !first
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package metricname
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Policy
+	}{
+		{"", CaseInsensitive},
+		{"case-insensitive", CaseInsensitive},
+		{" Case-Sensitive ", CaseSensitive},
+		{"prometheus", Prometheus},
+	} {
+		p, err := ParsePolicy(tt.in)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, p, tt.in)
+	}
+	_, err := ParsePolicy("lower")
+	assert.ErrorIs(t, err, ErrUnknownPolicy)
+}
+
+func TestPolicy_NameKey(t *testing.T) {
+	tests := []struct {
+		policy   Policy
+		in       string
+		wantName string
+		wantKey  string
+	}{
+		{CaseInsensitive, "Alloc", "Alloc", "alloc"},
+		{"", "Alloc", "Alloc", "alloc"},
+		{CaseSensitive, "Alloc", "Alloc", "Alloc"},
+		{Prometheus, "Alloc", "Alloc", "Alloc"},
+		{Prometheus, "http.requests-total", "http_requests_total", "http_requests_total"},
+		{Prometheus, "5xx", "_5xx", "_5xx"},
+		{Prometheus, "ns:temp_°C", "ns:temp__C", "ns:temp__C"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+"/"+tt.in, func(t *testing.T) {
+			assert.Equal(t, tt.wantName, tt.policy.Name(tt.in))
+			assert.Equal(t, tt.wantKey, tt.policy.Key(tt.in))
+			assert.Equal(t, tt.policy.Key(tt.in), tt.policy.Key(tt.policy.Name(tt.in)))
+		})
+	}
+}
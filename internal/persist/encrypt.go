@@ -0,0 +1,127 @@
+package persist
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"gometrics/internal/signature"
+)
+
+// ErrUnknownKey is returned for encrypted data whose key ID is not configured.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// sealedMagic starts every encrypted snapshot and WAL record; sealedVersion follows it.
+var sealedMagic = []byte("GMSE")
+
+const sealedVersion = 1
+
+// keyring encrypts with AES-GCM under the active key and decrypts with any
+// configured key, picked by the key ID in the header.
+//
+// Sealed layout: magic, version, key ID length (1 byte), key ID, nonce,
+// ciphertext with tag. Everything before the nonce is authenticated as
+// additional data.
+type keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// newKeyring builds a keyring; the first key is the active one.
+func newKeyring(keys []signature.AESKey) (*keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	k := &keyring{active: keys[0].ID, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		if len(key.ID) == 0 || len(key.ID) > 255 {
+			return nil, fmt.Errorf("%w: bad key ID %q", signature.ErrInvalidAESKey, key.ID)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", signature.ErrInvalidAESKey, key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", signature.ErrInvalidAESKey, key.ID, err)
+		}
+		k.aeads[key.ID] = aead
+	}
+	return k, nil
+}
+
+// isSealed reports whether data was produced by keyring.seal.
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
+
+// seal encrypts plain under the active key.
+func (k *keyring) seal(plain []byte) ([]byte, error) {
+	aead := k.aeads[k.active]
+	header := append([]byte{}, sealedMagic...)
+	header = append(header, sealedVersion, byte(len(k.active)))
+	header = append(header, k.active...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, plain, header), nil
+}
+
+// open decrypts data sealed under any configured key.
+func (k *keyring) open(data []byte) ([]byte, error) {
+	rest := data[len(sealedMagic):]
+	if len(rest) < 2 {
+		return nil, errors.New("decrypt: truncated header")
+	}
+	if rest[0] != sealedVersion {
+		return nil, fmt.Errorf("%w: encryption version %d", ErrUnknownFormat, rest[0])
+	}
+	idLen := int(rest[1])
+	rest = rest[2:]
+	if len(rest) < idLen {
+		return nil, errors.New("decrypt: truncated header")
+	}
+	id := string(rest[:idLen])
+	rest = rest[idLen:]
+
+	if k == nil {
+		return nil, fmt.Errorf("%w %q: encryption is not configured", ErrUnknownKey, id)
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("decrypt: truncated nonce")
+	}
+	header := data[:len(data)-len(rest)]
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt with key %q: %w", id, err)
+	}
+	return plain, nil
+}
+
+// SetEncryption encrypts the snapshots and WAL records written from now on
+// with AES-GCM under the first key; the other keys are kept to read data
+// written before a rotation. No keys disable encryption. Unencrypted
+// snapshots are still read.
+func (pstorage *PersistStorage) SetEncryption(keys []signature.AESKey) error {
+	k, err := newKeyring(keys)
+	if err != nil {
+		return err
+	}
+	pstorage.mu.Lock()
+	defer pstorage.mu.Unlock()
+	pstorage.keys = k
+	if pstorage.wal != nil {
+		pstorage.wal.keys = k
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gometrics/internal/signature"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistStorage_Encryption(t *testing.T) {
+	ctx := context.Background()
+	k1 := signature.AESKey{ID: "k1", Key: bytes.Repeat([]byte{1}, 32)}
+	k2 := signature.AESKey{ID: "k2", Key: bytes.Repeat([]byte{2}, 16)}
+
+	open := func(t *testing.T, dir string, keys ...signature.AESKey) *PersistStorage {
+		t.Helper()
+		storage, err := NewPersistStorage(dir, 0)
+		require.NoError(t, err)
+		require.NoError(t, storage.SetEncryption(keys))
+		t.Cleanup(func() { storage.Close() })
+		return storage
+	}
+
+	dir := t.TempDir()
+	storage := open(t, dir, k1)
+	require.NoError(t, storage.FormattingLogs(ctx, map[string]float64{"cpu_load": 1}, nil))
+	require.NoError(t, storage.WriteSeries(ctx, nil, map[string]int{"poll_count": 2}, nil, nil))
+
+	// Neither the snapshot nor the WAL reveal the series.
+	for _, name := range []string{snapshotFileName, walFileName} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "cpu_load", name)
+		assert.NotContains(t, string(data), "poll_count", name)
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		_, err := open(t, dir).ImportLogs(ctx)
+		assert.ErrorIs(t, err, ErrUnknownKey)
+		_, err = open(t, dir, k2).ImportLogs(ctx)
+		assert.ErrorIs(t, err, ErrUnknownKey)
+
+		info, err := os.Stat(filepath.Join(dir, walFileName))
+		require.NoError(t, err)
+		assert.Positive(t, info.Size(), "the WAL is kept when its key is missing")
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		rotated := open(t, dir, k2, k1)
+		metrics, err := rotated.ImportLogs(ctx)
+		require.NoError(t, err)
+		assertPersistedMetrics(t, metrics, map[string]float64{"cpu_load": 1}, map[string]int{"poll_count": 2})
+
+		// The next snapshot is written with the new active key.
+		require.NoError(t, rotated.Flush())
+		data, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(data, append(append([]byte{}, sealedMagic...), sealedVersion, 2, 'k', '2')))
+
+		// Without the new key the restore fails instead of falling back to the
+		// older generation written with k1.
+		_, err = open(t, dir, k1).ImportLogs(ctx)
+		assert.ErrorIs(t, err, ErrUnknownKey)
+
+		// Nor when the snapshot fails authentication.
+		data[len(data)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(filepath.Join(dir, snapshotFileName), data, 0644))
+		_, err = open(t, dir, k2, k1).ImportLogs(ctx)
+		assert.ErrorContains(t, err, `decrypt with key "k2"`)
+	})
+
+	t.Run("tampered header", func(t *testing.T) {
+		keys, err := newKeyring([]signature.AESKey{k1, {ID: "k3", Key: k1.Key}})
+		require.NoError(t, err)
+		sealed, err := keys.seal([]byte("[]"))
+		require.NoError(t, err)
+
+		// Same key material under another ID: the authenticated header does not match.
+		sealed[len(sealedMagic)+3] = '3'
+		_, err = keys.open(sealed)
+		assert.ErrorContains(t, err, `decrypt with key "k3"`)
+	})
+}
@@ -0,0 +1,307 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/compress"
+	"gometrics/internal/metadata"
+)
+
+// Snapshot formats.
+const (
+	// FormatJSON is the indented JSON snapshot written by earlier versions.
+	FormatJSON = "json"
+	// FormatBinary is the compact versioned binary snapshot.
+	FormatBinary = "binary"
+)
+
+// Snapshot compressions. Only gzip is offered: it is the codec of
+// internal/compress and needs no extra dependency.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// ErrUnknownFormat is returned for unsupported snapshot formats and compressions.
+var ErrUnknownFormat = errors.New("unknown snapshot format")
+
+// binaryMagic starts every binary snapshot; binaryVersion follows it.
+var binaryMagic = []byte("GMSB")
+
+const binaryVersion = 1
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Presence flags of the optional fields of a metric in a binary snapshot.
+const (
+	flagDelta = 1 << iota
+	flagValue
+	flagTTL
+	flagTimestamp
+)
+
+// SetFormat selects the format and the compression of the snapshots written
+// from now on; the file keeps its name Metrics.json. Snapshots of any format
+// are read back.
+func (pstorage *PersistStorage) SetFormat(format, compression string) error {
+	if format != FormatJSON && format != FormatBinary {
+		return fmt.Errorf("%w %q", ErrUnknownFormat, format)
+	}
+	if compression != CompressionNone && compression != CompressionGzip {
+		return fmt.Errorf("%w: compression %q", ErrUnknownFormat, compression)
+	}
+	pstorage.mu.Lock()
+	defer pstorage.mu.Unlock()
+	pstorage.format = format
+	pstorage.compression = compression
+	return nil
+}
+
+// encodeSnapshot serializes snap in the given format and compression.
+// Empty format and compression mean JSON without compression.
+func encodeSnapshot(snap snapshot, format, compression string) ([]byte, error) {
+	var data []byte
+	if format == FormatBinary {
+		data = encodeBinary(snap)
+	} else {
+		var v any = snap.Metrics
+		if len(snap.Metadata) > 0 {
+			v = snap
+		}
+		var err error
+		if data, err = json.MarshalIndent(v, "", "  "); err != nil {
+			return nil, fmt.Errorf("failed to marshal metrics: %w", err)
+		}
+	}
+	if compression == CompressionGzip {
+		return compress.Compress(data)
+	}
+	return data, nil
+}
+
+// decodeSnapshot detects the format of data: gzip is unwrapped first, then
+// binary snapshots are recognised by their magic, and anything else is JSON,
+// either the plain metrics array or the snapshot object.
+func decodeSnapshot(data []byte) (snapshot, error) {
+	if bytes.HasPrefix(data, gzipMagic) {
+		plain, err := compress.Decompress(data)
+		if err != nil {
+			return snapshot{}, fmt.Errorf("decode metrics file: %w", err)
+		}
+		data = plain
+	}
+	if bytes.HasPrefix(data, binaryMagic) {
+		snap, err := decodeBinary(data)
+		if err != nil {
+			return snapshot{}, fmt.Errorf("decode metrics file: %w", err)
+		}
+		return snap, nil
+	}
+
+	var snap snapshot
+	var err error
+
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0:
+	case data[0] == '[':
+		err = json.Unmarshal(data, &snap.Metrics)
+	default:
+		err = json.Unmarshal(data, &snap)
+	}
+	if err != nil {
+		// Truncate output for logging safety
+		out := string(data)
+		if len(out) > 256 {
+			out = out[:256] + "..."
+		}
+		return snapshot{}, fmt.Errorf("decode metrics file: %w\npayload: %q", err, out)
+	}
+	return snap, nil
+}
+
+// encodeBinary writes snap as: magic, version, the metrics and the metadata.
+// Counts and lengths are uvarints, integers varints and gauge values the
+// little-endian IEEE 754 bits.
+func encodeBinary(snap snapshot) []byte {
+	buf := append([]byte{}, binaryMagic...)
+	buf = append(buf, binaryVersion)
+
+	buf = binary.AppendUvarint(buf, uint64(len(snap.Metrics)))
+	for _, m := range snap.Metrics {
+		buf = appendString(buf, m.ID)
+		buf = appendString(buf, m.MType)
+		var flags byte
+		if m.Delta != nil {
+			flags |= flagDelta
+		}
+		if m.Value != nil {
+			flags |= flagValue
+		}
+		if m.TTL != nil {
+			flags |= flagTTL
+		}
+		if m.Timestamp != nil {
+			flags |= flagTimestamp
+		}
+		buf = append(buf, flags)
+		if m.Delta != nil {
+			buf = binary.AppendVarint(buf, *m.Delta)
+		}
+		if m.Value != nil {
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(*m.Value))
+		}
+		if m.TTL != nil {
+			buf = binary.AppendVarint(buf, *m.TTL)
+		}
+		if m.Timestamp != nil {
+			buf = binary.AppendVarint(buf, *m.Timestamp)
+		}
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(snap.Metadata)))
+	for _, md := range snap.Metadata {
+		buf = appendString(buf, md.Name)
+		buf = appendString(buf, md.Type)
+		buf = appendString(buf, md.Unit)
+		buf = appendString(buf, md.Help)
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// decodeBinary is the inverse of encodeBinary.
+func decodeBinary(data []byte) (snapshot, error) {
+	r := &binaryReader{data: data[len(binaryMagic):]}
+	if v := r.byte(); r.err == nil && v != binaryVersion {
+		return snapshot{}, fmt.Errorf("%w: binary version %d", ErrUnknownFormat, v)
+	}
+
+	var snap snapshot
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		m := metricsdto.Metrics{ID: r.string(), MType: r.string()}
+		flags := r.byte()
+		if flags&flagDelta != 0 {
+			v := r.varint()
+			m.Delta = &v
+		}
+		if flags&flagValue != 0 {
+			v := r.float()
+			m.Value = &v
+		}
+		if flags&flagTTL != 0 {
+			v := r.varint()
+			m.TTL = &v
+		}
+		if flags&flagTimestamp != 0 {
+			v := r.varint()
+			m.Timestamp = &v
+		}
+		snap.Metrics = append(snap.Metrics, m)
+	}
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		snap.Metadata = append(snap.Metadata, metadata.Metadata{
+			Name: r.string(), Type: r.string(), Unit: r.string(), Help: r.string(),
+		})
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.err = fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+	if r.err != nil {
+		return snapshot{}, fmt.Errorf("binary snapshot: %w", r.err)
+	}
+	return snap, nil
+}
+
+// errTruncated is reported for binary snapshots that end too early.
+var errTruncated = errors.New("unexpected end of data")
+
+// binaryReader decodes the fields of a binary snapshot. After the first error
+// all reads return zero values and err keeps that error.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.fail(errTruncated)
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads a number of entries; it cannot exceed the remaining bytes.
+func (r *binaryReader) count() uint64 {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail(errTruncated)
+		return 0
+	}
+	return n
+}
+
+func (r *binaryReader) float() float64 {
+	if r.err != nil || len(r.data) < 8 {
+		r.fail(errTruncated)
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.data))
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	n := r.count()
+	if r.err != nil {
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
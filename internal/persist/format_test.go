@@ -0,0 +1,135 @@
+package persist
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/metadata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistStorage_Formats(t *testing.T) {
+	ctx := context.Background()
+	at := time.UnixMilli(1700000000123)
+	stamp := func(mtype, name string) time.Time {
+		if name == "cpu" {
+			return at
+		}
+		return time.Time{}
+	}
+	ttl := func(mtype, name string) time.Duration {
+		if name == "poll" {
+			return time.Hour
+		}
+		return 0
+	}
+	meta := metadata.Metadata{Name: "cpu", Type: metricsdto.MetricTypeGauge, Unit: "percent", Help: "CPU load"}
+
+	tests := []struct {
+		format, compression string
+		prefix              []byte
+	}{
+		{FormatJSON, CompressionNone, []byte("{")},
+		{FormatJSON, CompressionGzip, gzipMagic},
+		{FormatBinary, CompressionNone, binaryMagic},
+		{FormatBinary, CompressionGzip, gzipMagic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.compression, func(t *testing.T) {
+			dir := t.TempDir()
+			storage, err := NewPersistStorage(dir, 0)
+			require.NoError(t, err)
+			require.NoError(t, storage.SetFormat(tt.format, tt.compression))
+			require.NoError(t, storage.SaveMetadata(ctx, meta))
+			require.NoError(t, storage.FormattingLogsAt(ctx,
+				map[string]float64{"cpu": 0.25, "heap": -1e300}, map[string]int{"poll": -7}, stamp, ttl))
+			require.NoError(t, storage.Close())
+
+			data, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+			require.NoError(t, err)
+			assert.Equal(t, tt.prefix, data[:len(tt.prefix)])
+
+			// A storage configured with the default format detects the format.
+			restored, err := NewPersistStorage(dir, 0)
+			require.NoError(t, err)
+			defer restored.Close()
+			metrics, err := restored.ImportLogs(ctx)
+			require.NoError(t, err)
+			assertPersistedMetrics(t, metrics, map[string]float64{"cpu": 0.25, "heap": -1e300}, map[string]int{"poll": -7})
+			for _, m := range metrics {
+				if m.ID == "cpu" {
+					require.NotNil(t, m.Timestamp)
+					assert.Equal(t, at.UnixMilli(), *m.Timestamp)
+				} else {
+					assert.Nil(t, m.Timestamp)
+				}
+				if m.ID == "poll" {
+					require.NotNil(t, m.TTL)
+					assert.Equal(t, int64(3600), *m.TTL)
+				} else {
+					assert.Nil(t, m.TTL)
+				}
+			}
+			loaded, err := restored.LoadMetadata(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []metadata.Metadata{meta}, loaded)
+		})
+	}
+}
+
+func TestPersistStorage_SetFormat(t *testing.T) {
+	storage, err := NewPersistStorage(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	assert.ErrorIs(t, storage.SetFormat("xml", CompressionNone), ErrUnknownFormat)
+	assert.ErrorIs(t, storage.SetFormat(FormatBinary, "lz4"), ErrUnknownFormat)
+	assert.NoError(t, storage.SetFormat(FormatBinary, CompressionGzip))
+}
+
+func TestDecodeBinary_Corrupt(t *testing.T) {
+	value := 1.5
+	data := encodeBinary(snapshot{Metrics: []metricsdto.Metrics{{ID: "cpu", MType: metricsdto.MetricTypeGauge, Value: &value}}})
+
+	for cut := len(binaryMagic); cut < len(data); cut++ {
+		_, err := decodeSnapshot(data[:cut])
+		assert.Error(t, err, "cut at %d", cut)
+	}
+	_, err := decodeSnapshot(append(data, 0))
+	assert.ErrorContains(t, err, "trailing bytes")
+
+	future := append([]byte{}, data...)
+	future[len(binaryMagic)] = binaryVersion + 1
+	_, err = decodeSnapshot(future)
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
+
+func BenchmarkEncodeSnapshot(b *testing.B) {
+	var snap snapshot
+	for i := range 50000 {
+		v := float64(i)
+		snap.Metrics = append(snap.Metrics, metricsdto.Metrics{ID: fmt.Sprintf("series_%d", i), MType: metricsdto.MetricTypeGauge, Value: &v})
+	}
+	for _, format := range []string{FormatJSON, FormatBinary} {
+		for _, compression := range []string{CompressionNone, CompressionGzip} {
+			b.Run(format+"/"+compression, func(b *testing.B) {
+				var size int
+				for b.Loop() {
+					data, err := encodeSnapshot(snap, format, compression)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = len(data)
+				}
+				b.ReportMetric(float64(size), "bytes")
+			})
+		}
+	}
+}
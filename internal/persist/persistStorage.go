@@ -1,39 +1,71 @@
 // Package persist implements file-based storage for metrics persistence.
 // It supports saving metrics to a JSON file and restoring them, with support
 // for both synchronous (immediate) and buffered flushing strategies.
+//
+// Updates of single series are appended to a write-ahead log (Metrics.wal)
+// instead of rewriting the snapshot. The snapshot is rewritten, and the WAL
+// truncated, on Flush and whenever the WAL grows past its size limit; on
+// startup the snapshot is read first and the WAL replayed on top of it.
+//
+// Snapshots are replaced atomically (temp file, fsync, rename) and the last
+// few generations are kept, so that a corrupt snapshot falls back to the
+// newest readable one.
 package persist
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/metadata"
+	"gometrics/internal/metricname"
 )
 
 // PersistStorage handles reading and writing metrics to a local file.
 // It is concurrent-safe and manages file I/O operations.
 type PersistStorage struct {
-	file       *os.File
+	dir        string   // directory of the snapshot, its generations and the WAL
+	file       *os.File // current snapshot, reopened after every replacement
 	writer     *bufio.Writer
-	reader     *bufio.Reader
 	storeInter int // storeInter defines the flush interval (0 for sync writes, >0 for manual flush).
 	mu         sync.Mutex
 	pending    []byte // pending holds serialized metrics waiting to be flushed.
+
+	metrics []metricsdto.Metrics // metrics of the last snapshot, kept to re-encode it
+	meta    []metadata.Metadata  // metric metadata written along with the metrics
+	loaded  bool                 // metrics and meta reflect the file contents
+
+	wal         *wal  // write-ahead log of series updates since the snapshot
+	walMaxBytes int64 // WAL size that triggers a new snapshot
+	generations int   // snapshots kept, the latest included
+
+	format      string   // snapshot format: FormatJSON or FormatBinary
+	compression string   // snapshot compression: CompressionNone or CompressionGzip
+	keys        *keyring // encryption of snapshots and WAL records, nil = plaintext
+
+	names metricname.Policy // normalisation of series names, case-insensitive by default
+}
+
+// snapshot is the file layout used once metadata is stored. Files without
+// metadata keep the plain metrics array written by earlier versions.
+type snapshot struct {
+	Metrics  []metricsdto.Metrics `json:"metrics"`
+	Metadata []metadata.Metadata  `json:"metadata,omitempty"`
 }
 
 // NewPersistStorage initializes a new storage engine backed by a file.
 //
 // Arguments:
 //   - dirPath: The directory where "Metrics.json" will be created. If set to "agent", storage runs in no-op mode.
+//     Older snapshot generations and the WAL are kept in the same directory.
 //   - storeInter: The interval settings. If 0, every write is immediately synced to disk.
 //
 // Returns an error if the directory cannot be created or the file cannot be opened.
@@ -53,18 +85,30 @@ func NewPersistStorage(dirPath string, storeInter int) (*PersistStorage, error)
 		return nil, fmt.Errorf("failed to create storage directory: %w", err)
 	}
 
-	filePath := filepath.Join(dirPath, "Metrics.json")
+	removeTempSnapshots(dirPath)
+	filePath := filepath.Join(dirPath, snapshotFileName)
 
 	file, err := os.OpenFile(filePath, flags, mode)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open storage file: %w", err)
 	}
 
+	walLog, err := openWAL(filepath.Join(dirPath, walFileName))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
 	pstorage := &PersistStorage{
-		file:       file,
-		writer:     bufio.NewWriter(file),
-		reader:     bufio.NewReader(file),
-		storeInter: storeInter,
+		dir:         dirPath,
+		file:        file,
+		writer:      bufio.NewWriter(file),
+		storeInter:  storeInter,
+		wal:         walLog,
+		walMaxBytes: defaultWALMaxBytes,
+		generations: defaultGenerations,
+		format:      FormatJSON,
+		compression: CompressionNone,
 	}
 	return pstorage, nil
 }
@@ -75,40 +119,201 @@ func NewPersistStorage(dirPath string, storeInter int) (*PersistStorage, error)
 // If storeInter is 0, the data is flushed to disk immediately.
 // Otherwise, it is stored in the 'pending' buffer and must be explicitly flushed later.
 func (pstorage *PersistStorage) FormattingLogs(ctx context.Context, gauge map[string]float64, counter map[string]int) error {
+	return pstorage.FormattingLogsAt(ctx, gauge, counter, nil, nil)
+}
+
+// FormattingLogsAt works like FormattingLogs but also records the sample time
+// returned by at as the metric timestamp and the explicit TTL returned by ttl.
+// A nil at or a zero time records no timestamp, a nil ttl or a zero one no TTL.
+func (pstorage *PersistStorage) FormattingLogsAt(ctx context.Context, gauge map[string]float64, counter map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration) error {
+	timestamp := func(mtype, name string) *int64 {
+		if at == nil {
+			return nil
+		}
+		t := at(mtype, name)
+		if t.IsZero() {
+			return nil
+		}
+		ms := t.UnixMilli()
+		return &ms
+	}
+	seconds := ttlSeconds(ttl)
+
 	var metrics []metricsdto.Metrics
 	for gkey, gvalue := range gauge {
 		value := gvalue
 		metric := metricsdto.Metrics{
-			ID:    gkey,
-			MType: metricsdto.MetricTypeGauge,
-			Value: &value}
+			ID:        gkey,
+			MType:     metricsdto.MetricTypeGauge,
+			Value:     &value,
+			TTL:       seconds(metricsdto.MetricTypeGauge, gkey),
+			Timestamp: timestamp(metricsdto.MetricTypeGauge, gkey)}
 		metrics = append(metrics, metric)
 	}
 	for ckey, cvalue := range counter {
 		delta := int64(cvalue)
 		metric := metricsdto.Metrics{
-			ID:    ckey,
-			MType: metricsdto.MetricTypeCounter,
-			Delta: &delta}
+			ID:        ckey,
+			MType:     metricsdto.MetricTypeCounter,
+			Delta:     &delta,
+			TTL:       seconds(metricsdto.MetricTypeCounter, ckey),
+			Timestamp: timestamp(metricsdto.MetricTypeCounter, ckey)}
 		metrics = append(metrics, metric)
 	}
 
-	metricsByte, err := json.MarshalIndent(metrics, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal metrics: %w", err)
-	}
-
 	pstorage.mu.Lock()
 	defer pstorage.mu.Unlock()
 
-	pstorage.pending = metricsByte
+	// Keep the metadata already in the file, even if it was never restored.
+	if !pstorage.loaded && pstorage.file != nil {
+		if _, err := pstorage.readSnapshotLocked(); err != nil {
+			log.Printf("WARN: read snapshot before overwrite: %v", err)
+		}
+	}
+	pstorage.metrics = metrics
+	pstorage.loaded = true
 
 	// If interval is 0, we treat it as "sync mode" -> write immediately
 	if pstorage.storeInter != 0 {
 		return nil
 	}
 
-	return pstorage.writeSnapshotLocked()
+	return pstorage.checkpointLocked()
+}
+
+// WriteSeries merges the given series into the snapshot, keeping the other
+// series. Series are matched by type and the key of the name policy. The series
+// are appended to the WAL, which is fsynced when storeInter is 0; the
+// snapshot itself is only rewritten once the WAL outgrows its limit.
+// In agent mode it does nothing.
+func (pstorage *PersistStorage) WriteSeries(ctx context.Context, gauge map[string]float64, counter map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration) error {
+	if pstorage.file == nil {
+		return nil
+	}
+	timestamp := func(mtype, name string) *int64 {
+		if at == nil {
+			return nil
+		}
+		if t := at(mtype, name); !t.IsZero() {
+			ms := t.UnixMilli()
+			return &ms
+		}
+		return nil
+	}
+	seconds := ttlSeconds(ttl)
+
+	pstorage.mu.Lock()
+	defer pstorage.mu.Unlock()
+
+	if !pstorage.loaded {
+		if _, err := pstorage.readSnapshotLocked(); err != nil {
+			log.Printf("WARN: read snapshot before merge: %v", err)
+		}
+	}
+	updates := make([]metricsdto.Metrics, 0, len(gauge)+len(counter))
+	for name, v := range gauge {
+		value := v
+		updates = append(updates, metricsdto.Metrics{ID: name, MType: metricsdto.MetricTypeGauge, Value: &value,
+			TTL: seconds(metricsdto.MetricTypeGauge, name), Timestamp: timestamp(metricsdto.MetricTypeGauge, name)})
+	}
+	for name, v := range counter {
+		delta := int64(v)
+		updates = append(updates, metricsdto.Metrics{ID: name, MType: metricsdto.MetricTypeCounter, Delta: &delta,
+			TTL: seconds(metricsdto.MetricTypeCounter, name), Timestamp: timestamp(metricsdto.MetricTypeCounter, name)})
+	}
+
+	err := pstorage.wal.appendRecords(updates, pstorage.storeInter == 0)
+	if err != nil && !pstorage.wal.broken {
+		return err
+	}
+	pstorage.metrics = mergeMetrics(pstorage.metrics, updates, pstorage.names)
+	pstorage.loaded = true
+	if err != nil {
+		// The torn record cannot be cut off: the snapshot takes the updates
+		// and the checkpoint empties the WAL.
+		log.Printf("WARN: %v, writing snapshot", err)
+		return pstorage.checkpointLocked()
+	}
+	if pstorage.wal.size < pstorage.walMaxBytes {
+		return nil
+	}
+	return pstorage.checkpointLocked()
+}
+
+// DeleteMetrics removes the given series, matched by type and the key of the
+// name policy, and rewrites the snapshot, so that records of the series left
+// in the WAL cannot bring them back. In agent mode it does nothing.
+func (pstorage *PersistStorage) DeleteMetrics(_ context.Context, metrics []metricsdto.Metrics) error {
+	if pstorage.file == nil {
+		return nil
+	}
+	pstorage.mu.Lock()
+	defer pstorage.mu.Unlock()
+
+	if !pstorage.loaded {
+		if _, err := pstorage.readSnapshotLocked(); err != nil {
+			return err
+		}
+	}
+	deleted := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		deleted[m.MType+"/"+pstorage.names.Key(m.ID)] = true
+	}
+	kept := pstorage.metrics[:0]
+	for _, m := range pstorage.metrics {
+		if !deleted[m.MType+"/"+pstorage.names.Key(m.ID)] {
+			kept = append(kept, m)
+		}
+	}
+	pstorage.metrics = kept
+	pstorage.loaded = true
+	return pstorage.checkpointLocked()
+}
+
+// ttlSeconds converts the TTL callback of a write into the TTL field of the
+// records, nil for none.
+func ttlSeconds(ttl func(mtype, name string) time.Duration) func(mtype, name string) *int64 {
+	return func(mtype, name string) *int64 {
+		if ttl == nil {
+			return nil
+		}
+		d := ttl(mtype, name)
+		if d <= 0 {
+			return nil
+		}
+		s := int64(d / time.Second)
+		return &s
+	}
+}
+
+// SetNamePolicy sets how series names are matched and stored. Snapshots and WAL
+// records read afterwards are migrated to it; it should be set before the
+// first read.
+func (pstorage *PersistStorage) SetNamePolicy(p metricname.Policy) {
+	pstorage.mu.Lock()
+	defer pstorage.mu.Unlock()
+	pstorage.names = p
+}
+
+// mergeMetrics replaces the series of dst that appear in updates, matched by
+// type and the key of names, and appends the others. The names of updates
+// are normalised by names.
+func mergeMetrics(dst, updates []metricsdto.Metrics, names metricname.Policy) []metricsdto.Metrics {
+	index := make(map[string]int, len(dst))
+	for i, m := range dst {
+		index[m.MType+"/"+names.Key(m.ID)] = i
+	}
+	for _, m := range updates {
+		m.ID = names.Name(m.ID)
+		key := m.MType + "/" + names.Key(m.ID)
+		if i, ok := index[key]; ok {
+			dst[i] = m
+			continue
+		}
+		index[key] = len(dst)
+		dst = append(dst, m)
+	}
+	return dst
 }
 
 // Close ensures all pending data is flushed to disk and closes the underlying file handle.
@@ -124,8 +329,12 @@ func (pstorage *PersistStorage) Close() error {
 	}
 
 	errClose := pstorage.file.Close()
-	if errFlush != nil || errClose != nil {
-		return errors.Join(errFlush, errClose)
+	var errWAL error
+	if pstorage.wal != nil {
+		errWAL = pstorage.wal.close()
+	}
+	if errFlush != nil || errClose != nil || errWAL != nil {
+		return errors.Join(errFlush, errClose, errWAL)
 	}
 
 	return nil
@@ -156,8 +365,6 @@ func (pstorage *PersistStorage) WriteLogs(logs []metricsdto.Metrics) error {
 // ImportLogs reads the entire file content and deserializes it into a slice of Metrics.
 // Used for restoring state on startup.
 func (pstorage *PersistStorage) ImportLogs(ctx context.Context) ([]metricsdto.Metrics, error) {
-	var token []metricsdto.Metrics
-
 	if pstorage.file == nil {
 		log.Printf("WARN: persist storage disabled; file not configured (agent mode)")
 		return []metricsdto.Metrics{}, nil
@@ -166,37 +373,113 @@ func (pstorage *PersistStorage) ImportLogs(ctx context.Context) ([]metricsdto.Me
 	pstorage.mu.Lock()
 	defer pstorage.mu.Unlock()
 
-	// Seek to start to read full file
-	if _, err := pstorage.file.Seek(0, io.SeekStart); err != nil {
-		return []metricsdto.Metrics{}, fmt.Errorf("seek error: %w", err)
+	snap, err := pstorage.readSnapshotLocked()
+	if err != nil {
+		return []metricsdto.Metrics{}, err
+	}
+	if len(snap.Metrics) == 0 {
+		log.Printf("INFO: persist storage is empty")
+		return []metricsdto.Metrics{}, nil
 	}
+	return snap.Metrics, nil
+}
 
-	var reader io.Reader = pstorage.file
-	if pstorage.reader != nil {
-		pstorage.reader.Reset(pstorage.file)
-		reader = pstorage.reader
+// LoadMetadata returns the metric metadata stored in the file.
+func (pstorage *PersistStorage) LoadMetadata(ctx context.Context) ([]metadata.Metadata, error) {
+	if pstorage.file == nil {
+		return nil, nil
 	}
 
-	jBytes, err := io.ReadAll(reader)
+	pstorage.mu.Lock()
+	defer pstorage.mu.Unlock()
+
+	snap, err := pstorage.readSnapshotLocked()
 	if err != nil {
-		return []metricsdto.Metrics{}, fmt.Errorf("can't read metrics file: %w", err)
+		return nil, err
 	}
+	return snap.Metadata, nil
+}
 
-	if len(bytes.TrimSpace(jBytes)) == 0 {
-		log.Printf("INFO: persist storage is empty")
-		return []metricsdto.Metrics{}, nil
+// SaveMetadata adds or replaces the metadata of m.Name in the snapshot, matching
+// names by the storage's name policy.
+// Like FormattingLogs, it is written immediately only when storeInter is 0.
+func (pstorage *PersistStorage) SaveMetadata(ctx context.Context, m metadata.Metadata) error {
+	if pstorage.file == nil {
+		return nil
+	}
+
+	pstorage.mu.Lock()
+	defer pstorage.mu.Unlock()
+
+	// Keep the metrics already in the file if none were written yet.
+	if !pstorage.loaded {
+		if _, err := pstorage.readSnapshotLocked(); err != nil {
+			return err
+		}
+	}
+
+	replaced := false
+	for i, old := range pstorage.meta {
+		if pstorage.names.Key(old.Name) == pstorage.names.Key(m.Name) {
+			pstorage.meta[i] = m
+			replaced = true
+		}
+	}
+	if !replaced {
+		pstorage.meta = append(pstorage.meta, m)
+	}
+	if pstorage.storeInter != 0 {
+		return nil
 	}
+	return pstorage.checkpointLocked()
+}
 
-	if err := json.Unmarshal(jBytes, &token); err != nil {
-		// Truncate output for logging safety
-		out := string(jBytes)
-		if len(out) > 256 {
-			out = out[:256] + "..."
+// readSnapshotLocked reads the newest readable snapshot generation and
+// replays the WAL on top of it, remembering the result for subsequent writes.
+// It must be called with pstorage.mu held.
+func (pstorage *PersistStorage) readSnapshotLocked() (snapshot, error) {
+	snap, err := pstorage.readNewestSnapshot()
+	if err != nil {
+		return snapshot{}, err
+	}
+	// Snapshots written under another name policy are migrated: names are
+	// rewritten and series that now share a name are merged, the later one
+	// winning. The next snapshot is written in the new form.
+	snap.Metrics = mergeMetrics(nil, snap.Metrics, pstorage.names)
+
+	if pstorage.wal != nil {
+		updates, err := pstorage.wal.replay()
+		if err != nil {
+			return snapshot{}, err
 		}
-		return []metricsdto.Metrics{}, fmt.Errorf("decode metrics file: %w\npayload: %q", err, out)
+		snap.Metrics = mergeMetrics(snap.Metrics, updates, pstorage.names)
+	}
+
+	if !pstorage.loaded {
+		pstorage.metrics = snap.Metrics
+		pstorage.meta = snap.Metadata
+		pstorage.loaded = true
 	}
+	return snap, nil
+}
 
-	return token, nil
+// encodeLocked serializes the metrics and metadata into pending in the
+// configured format, encrypted when keys are set.
+// It must be called with pstorage.mu held.
+func (pstorage *PersistStorage) encodeLocked() error {
+	snap := snapshot{Metrics: pstorage.metrics, Metadata: pstorage.meta}
+	data, err := encodeSnapshot(snap, pstorage.format, pstorage.compression)
+	if err != nil {
+		return err
+	}
+	if pstorage.keys != nil {
+		if data, err = pstorage.keys.seal(data); err != nil {
+			return fmt.Errorf("encrypt snapshot: %w", err)
+		}
+	}
+	pstorage.pending = data
+	pstorage.loaded = true
+	return nil
 }
 
 // Ping checks if the storage file is accessible.
@@ -226,36 +509,27 @@ func (pstorage *PersistStorage) Flush() error {
 		return nil
 	}
 
-	return pstorage.writeSnapshotLocked()
+	return pstorage.checkpointLocked()
 }
 
-// writeSnapshotLocked performs the actual file write operations (Truncate -> Seek -> Write -> Flush -> Sync).
+// checkpointLocked writes the full snapshot and then empties the WAL, whose
+// records the snapshot now contains. A crash in between only makes the next
+// start replay records that are already in the snapshot.
 // It must be called with pstorage.mu held.
-func (pstorage *PersistStorage) writeSnapshotLocked() error {
-	if pstorage.file == nil {
-		return nil
-	}
-
-	// Overwrite strategy: Truncate file and write fresh content
-	if err := pstorage.file.Truncate(0); err != nil {
-		return fmt.Errorf("truncate failed: %w", err)
+func (pstorage *PersistStorage) checkpointLocked() error {
+	if !pstorage.loaded {
+		if _, err := pstorage.readSnapshotLocked(); err != nil {
+			return err
+		}
 	}
-	if _, err := pstorage.file.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("seek failed: %w", err)
+	if err := pstorage.encodeLocked(); err != nil {
+		return err
 	}
-
-	pstorage.writer.Reset(pstorage.file)
-
-	if len(pstorage.pending) > 0 {
-		if _, err := pstorage.writer.Write(pstorage.pending); err != nil {
-			return fmt.Errorf("write pending failed: %w", err)
-		}
+	if err := pstorage.writeSnapshotLocked(); err != nil {
+		return err
 	}
-
-	if err := pstorage.writer.Flush(); err != nil {
-		return fmt.Errorf("flush writer failed: %w", err)
+	if pstorage.wal == nil {
+		return nil
 	}
-
-	// Ensure data hits the disk
-	return pstorage.file.Sync()
+	return pstorage.wal.reset()
 }
@@ -7,6 +7,8 @@ import (
 	"testing"
 
 	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/metadata"
+	"gometrics/internal/metricname"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -96,6 +98,50 @@ func TestPersistStorageFormattingAndImport(t *testing.T) {
 	}
 }
 
+// TestPersistStorage_Metadata verifies that metadata is written along with the
+// metrics and survives a restart.
+func TestPersistStorage_Metadata(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	storage, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, storage.FormattingLogs(ctx, map[string]float64{"Alloc": 1024}, map[string]int{}))
+	alloc := metadata.Metadata{Name: "Alloc", Type: metricsdto.MetricTypeGauge, Unit: "bytes"}
+	require.NoError(t, storage.SaveMetadata(ctx, alloc))
+	alloc.Help = "Bytes of allocated heap objects"
+	require.NoError(t, storage.SaveMetadata(ctx, alloc))
+	require.NoError(t, storage.Close())
+
+	reopened, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, reopened.Close())
+	})
+
+	meta, err := reopened.LoadMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []metadata.Metadata{alloc}, meta)
+
+	metrics, err := reopened.ImportLogs(ctx)
+	require.NoError(t, err)
+	assertPersistedMetrics(t, metrics, map[string]float64{"Alloc": 1024}, map[string]int{})
+
+	// Later snapshots keep the metadata.
+	require.NoError(t, reopened.FormattingLogs(ctx, map[string]float64{"Alloc": 2048}, map[string]int{}))
+	meta, err = reopened.LoadMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []metadata.Metadata{alloc}, meta)
+
+	// Names are matched by the name policy: case-sensitive names stay apart.
+	lower := metadata.Metadata{Name: "alloc", Type: metricsdto.MetricTypeGauge}
+	reopened.SetNamePolicy(metricname.CaseSensitive)
+	require.NoError(t, reopened.SaveMetadata(ctx, lower))
+	meta, err = reopened.LoadMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []metadata.Metadata{alloc, lower}, meta)
+}
+
 // TestPersistStorage_Ping verifies the Ping method functionality.
 func TestPersistStorage_Ping(t *testing.T) {
 	dir := t.TempDir()
@@ -119,6 +165,74 @@ func TestPersistStorage_Ping(t *testing.T) {
 	assert.Error(t, err, "Ping should fail after Close()")
 }
 
+// TestPersistStorage_WriteSeries verifies that WriteSeries replaces the given
+// series and keeps the rest of the snapshot.
+func TestPersistStorage_WriteSeries(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewPersistStorage(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	require.NoError(t, storage.FormattingLogs(ctx, map[string]float64{"cpu": 1, "heap": 2}, map[string]int{"poll": 3}))
+	require.NoError(t, storage.WriteSeries(ctx, map[string]float64{"cpu": 10}, map[string]int{"retries": 1}, nil, nil))
+
+	metrics, err := storage.ImportLogs(ctx)
+	require.NoError(t, err)
+	assertPersistedMetrics(t, metrics,
+		map[string]float64{"cpu": 10, "heap": 2},
+		map[string]int{"poll": 3, "retries": 1})
+}
+
+// TestPersistStorage_DeleteMetrics verifies that deleted series are gone
+// after a crash although their WAL records were never checkpointed.
+func TestPersistStorage_DeleteMetrics(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := NewPersistStorage(dir, 300)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	require.NoError(t, storage.WriteSeries(ctx, map[string]float64{"cpu": 1, "heap": 2}, map[string]int{"cpu": 3}, nil, nil))
+	require.NoError(t, storage.DeleteMetrics(ctx, []metricsdto.Metrics{{ID: "CPU", MType: metricsdto.MetricTypeGauge}}))
+
+	restarted, err := NewPersistStorage(dir, 300)
+	require.NoError(t, err)
+	defer restarted.Close()
+	metrics, err := restarted.ImportLogs(ctx)
+	require.NoError(t, err)
+	assertPersistedMetrics(t, metrics, map[string]float64{"heap": 2}, map[string]int{"cpu": 3})
+}
+
+// TestPersistStorage_NamePolicy verifies that a file written under one name
+// policy is migrated when it is read under another.
+func TestPersistStorage_NamePolicy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	open := func(p metricname.Policy) *PersistStorage {
+		storage, err := NewPersistStorage(dir, 0)
+		require.NoError(t, err)
+		storage.SetNamePolicy(p)
+		return storage
+	}
+
+	storage := open(metricname.CaseSensitive)
+	require.NoError(t, storage.FormattingLogs(ctx, map[string]float64{"Alloc": 1}, map[string]int{"http.requests": 3}))
+	require.NoError(t, storage.WriteSeries(ctx, map[string]float64{"alloc": 2}, nil, nil, nil))
+	require.NoError(t, storage.Close())
+
+	storage = open(metricname.Prometheus)
+	metrics, err := storage.ImportLogs(ctx)
+	require.NoError(t, err)
+	assertPersistedMetrics(t, metrics, map[string]float64{"Alloc": 1, "alloc": 2}, map[string]int{"http_requests": 3})
+	require.NoError(t, storage.Close())
+
+	storage = open(metricname.CaseInsensitive)
+	defer storage.Close()
+	metrics, err = storage.ImportLogs(ctx)
+	require.NoError(t, err)
+	assertPersistedMetrics(t, metrics, map[string]float64{"alloc": 2}, map[string]int{"http_requests": 3})
+}
+
 // TestPersistStorage_AgentMode verifies behavior when "agent" path is used.
 func TestPersistStorage_AgentMode(t *testing.T) {
 	storage, err := NewPersistStorage("agent", 0)
@@ -0,0 +1,196 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotFileName is the latest snapshot. Older generations are kept next to
+// it as snapshotFileName + "." + the time they were written.
+const snapshotFileName = "Metrics.json"
+
+// tempSnapshotPattern names snapshots being written; leftovers of a crash are
+// removed when the storage is opened.
+const tempSnapshotPattern = ".Metrics.json.tmp-*"
+
+// generationLayout formats the timestamp of a snapshot generation, so that
+// generations sort by name.
+const generationLayout = "20060102T150405.000000000Z"
+
+// defaultGenerations is the number of snapshots kept, the latest included.
+const defaultGenerations = 3
+
+// SetGenerations sets the number of snapshot generations kept, the latest
+// included. Values below 1 keep only the latest snapshot.
+func (pstorage *PersistStorage) SetGenerations(n int) {
+	pstorage.mu.Lock()
+	defer pstorage.mu.Unlock()
+	pstorage.generations = max(n, 1)
+}
+
+// writeSnapshotLocked replaces the snapshot atomically: pending is written to a
+// temp file, which is fsynced and renamed over Metrics.json, and then the
+// directory is fsynced. The replaced snapshot is kept as an older generation.
+// It must be called with pstorage.mu held.
+func (pstorage *PersistStorage) writeSnapshotLocked() error {
+	if pstorage.file == nil {
+		return nil
+	}
+	path := filepath.Join(pstorage.dir, snapshotFileName)
+
+	tmp, err := os.CreateTemp(pstorage.dir, tempSnapshotPattern)
+	if err != nil {
+		return fmt.Errorf("create temp snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(pstorage.pending); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp snapshot: %w", err)
+	}
+
+	pstorage.keepGenerationLocked(path)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace snapshot: %w", err)
+	}
+	if err := syncDir(pstorage.dir); err != nil {
+		return err
+	}
+	pstorage.pruneGenerationsLocked()
+
+	// The open handle still refers to the replaced file.
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("reopen snapshot: %w", err)
+	}
+	pstorage.file.Close()
+	pstorage.file = file
+	pstorage.writer.Reset(file)
+	return nil
+}
+
+// keepGenerationLocked hard-links the current snapshot under its
+// modification time before it is replaced. Empty snapshots are not kept.
+func (pstorage *PersistStorage) keepGenerationLocked(path string) {
+	if pstorage.generations <= 1 {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return
+	}
+	name := path + "." + info.ModTime().UTC().Format(generationLayout)
+	if err := os.Link(path, name); err != nil && !errors.Is(err, fs.ErrExist) {
+		log.Printf("WARN: keep snapshot generation: %v", err)
+	}
+}
+
+// pruneGenerationsLocked removes the generations beyond the configured number.
+func (pstorage *PersistStorage) pruneGenerationsLocked() {
+	older := generationPaths(pstorage.dir)
+	keep := pstorage.generations - 1
+	if keep < 0 {
+		keep = 0
+	}
+	if len(older) <= keep {
+		return
+	}
+	for _, path := range older[keep:] {
+		if err := os.Remove(path); err != nil {
+			log.Printf("WARN: remove snapshot generation: %v", err)
+		}
+	}
+}
+
+// readNewestSnapshot decodes Metrics.json or, if it is missing, torn or
+// corrupt, the newest older generation that can be read. When none can, the
+// error of Metrics.json is returned. A snapshot that cannot be decrypted is an
+// error, as in readWAL: falling back would silently drop the newer data for a
+// missing or wrong key.
+func (pstorage *PersistStorage) readNewestSnapshot() (snapshot, error) {
+	paths := append([]string{filepath.Join(pstorage.dir, snapshotFileName)}, generationPaths(pstorage.dir)...)
+
+	var latestErr error
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			err = fmt.Errorf("can't read metrics file: %w", err)
+		} else {
+			if isSealed(data) {
+				if data, err = pstorage.keys.open(data); err != nil {
+					return snapshot{}, fmt.Errorf("%s: %w", filepath.Base(path), err)
+				}
+			}
+			var snap snapshot
+			if snap, err = decodeSnapshot(data); err == nil {
+				if i > 0 {
+					log.Printf("WARN: latest snapshot is unreadable (%v); restored %s", latestErr, filepath.Base(path))
+				}
+				return snap, nil
+			}
+		}
+		if i == 0 {
+			latestErr = err
+		}
+	}
+	return snapshot{}, latestErr
+}
+
+// generationPaths returns the older snapshot generations in dir, newest first.
+func generationPaths(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	prefix := snapshotFileName + "."
+	var paths []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(generationLayout, strings.TrimPrefix(name, prefix)); err != nil {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	return paths
+}
+
+// removeTempSnapshots deletes snapshots left half-written by a crash.
+func removeTempSnapshots(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, tempSnapshotPattern))
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			log.Printf("WARN: remove temp snapshot: %v", err)
+		}
+	}
+}
+
+// syncDir fsyncs dir, making a rename in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open storage directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync storage directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package persist
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeGenerations writes one snapshot per cpu value, giving each a distinct
+// modification time, so that every replaced snapshot becomes a generation.
+func writeGenerations(t *testing.T, storage *PersistStorage, values ...float64) {
+	t.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, v := range values {
+		require.NoError(t, storage.FormattingLogs(context.Background(), map[string]float64{"cpu": v}, nil))
+		mtime := base.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(storage.dir, snapshotFileName), mtime, mtime))
+	}
+}
+
+func TestPersistStorage_SnapshotGenerations(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	defer storage.Close()
+	storage.SetGenerations(3)
+
+	writeGenerations(t, storage, 1, 2, 3, 4, 5)
+
+	older := generationPaths(dir)
+	require.Len(t, older, 2, "the latest snapshot and two older generations are kept")
+	assert.Equal(t, filepath.Join(dir, snapshotFileName+".20240101T000300.000000000Z"), older[0])
+	assert.Equal(t, filepath.Join(dir, snapshotFileName+".20240101T000200.000000000Z"), older[1])
+
+	temps, err := filepath.Glob(filepath.Join(dir, tempSnapshotPattern))
+	require.NoError(t, err)
+	assert.Empty(t, temps)
+
+	storage.SetGenerations(1)
+	writeGenerations(t, storage, 6)
+	assert.Empty(t, generationPaths(dir))
+}
+
+func TestPersistStorage_SnapshotFallback(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	defer storage.Close()
+	writeGenerations(t, storage, 1, 2, 3)
+
+	// The latest snapshot is corrupt and a crash left a temp snapshot behind.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, snapshotFileName), []byte(`{"metrics":[{"id":`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".Metrics.json.tmp-1"), []byte(`[]`), 0644))
+
+	restored, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	defer restored.Close()
+
+	metrics, err := restored.ImportLogs(ctx)
+	require.NoError(t, err)
+	assertPersistedMetrics(t, metrics, map[string]float64{"cpu": 2}, map[string]int{})
+
+	_, err = os.Stat(filepath.Join(dir, ".Metrics.json.tmp-1"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "temp snapshots are removed on open")
+
+	// Without readable generations the error of the latest snapshot is reported.
+	for _, path := range generationPaths(dir) {
+		require.NoError(t, os.WriteFile(path, []byte("garbage"), 0644))
+	}
+	broken, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	defer broken.Close()
+	_, err = broken.ImportLogs(ctx)
+	assert.ErrorContains(t, err, "decode metrics file")
+}
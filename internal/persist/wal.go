@@ -0,0 +1,215 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+)
+
+// walFileName is the write-ahead log kept next to the snapshot.
+const walFileName = "Metrics.wal"
+
+// walHeaderSize is the size of a record header: the payload length and the
+// CRC-32C of the payload, both big-endian uint32.
+const walHeaderSize = 8
+
+// maxWALRecord bounds the payload length, so that a corrupt header cannot
+// cause a huge allocation.
+const maxWALRecord = 1 << 20
+
+// defaultWALMaxBytes is the WAL size at which the snapshot is rewritten and
+// the WAL truncated.
+const defaultWALMaxBytes = 4 << 20
+
+// errCorruptRecord marks the end of the valid part of the WAL: a record cut
+// off by a crash or one whose checksum does not match.
+var errCorruptRecord = errors.New("torn or corrupt WAL record")
+
+// errWALBroken is returned by appends after a failed append could not be cut
+// off the WAL. The WAL is usable again once reset by a checkpoint.
+var errWALBroken = errors.New("WAL holds a torn record")
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walFile is the part of *os.File used by the WAL.
+type walFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// wal is an append-only log of update records. Every record holds the full
+// state of one series (gauge value or counter total), so replaying a record
+// more than once is harmless.
+type wal struct {
+	file   walFile
+	size   int64    // bytes of valid records
+	keys   *keyring // encryption of new records, nil = plaintext
+	broken bool     // a torn append is left at the end of the file
+}
+
+// openWAL opens or creates the WAL at path.
+func openWAL(path string) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open WAL: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat WAL: %w", err)
+	}
+	return &wal{file: file, size: info.Size()}, nil
+}
+
+// appendRecords writes one record per metric in a single write. With sync
+// the WAL is fsynced before returning. A failed or short write is cut off, so
+// that later records do not follow a torn one; if that fails too the WAL is
+// marked broken.
+func (w *wal) appendRecords(metrics []metricsdto.Metrics, sync bool) error {
+	if w.broken {
+		return errWALBroken
+	}
+	var buf bytes.Buffer
+	var header [walHeaderSize]byte
+	for _, m := range metrics {
+		payload, err := json.Marshal(m)
+		if err != nil {
+			return fmt.Errorf("encode WAL record: %w", err)
+		}
+		if w.keys != nil {
+			if payload, err = w.keys.seal(payload); err != nil {
+				return fmt.Errorf("encrypt WAL record: %w", err)
+			}
+		}
+		binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:], crc32.Checksum(payload, walCRCTable))
+		buf.Write(header[:])
+		buf.Write(payload)
+	}
+
+	n, err := w.file.Write(buf.Bytes())
+	if err == nil && n < buf.Len() {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		if n > 0 {
+			if errTrunc := w.file.Truncate(w.size); errTrunc != nil {
+				w.broken = true
+				return fmt.Errorf("append WAL: %w; cut off torn record: %w", err, errTrunc)
+			}
+		}
+		return fmt.Errorf("append WAL: %w", err)
+	}
+	w.size += int64(n)
+	if sync {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("sync WAL: %w", err)
+		}
+	}
+	return nil
+}
+
+// replay returns the records of the WAL in write order. The log ends at the
+// first torn or corrupt record: it is cut off together with everything after
+// it, so that new records follow the last valid one.
+func (w *wal) replay() ([]metricsdto.Metrics, error) {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek WAL: %w", err)
+	}
+	metrics, valid, err := readWAL(bufio.NewReader(w.file), w.keys)
+	if err != nil && !errors.Is(err, errCorruptRecord) {
+		return nil, fmt.Errorf("read WAL: %w", err)
+	}
+
+	info, statErr := w.file.Stat()
+	if statErr != nil {
+		return nil, fmt.Errorf("stat WAL: %w", statErr)
+	}
+	if info.Size() > valid {
+		log.Printf("WARN: WAL: dropping %d bytes after offset %d: %v", info.Size()-valid, valid, err)
+		if err := w.file.Truncate(valid); err != nil {
+			return nil, fmt.Errorf("truncate WAL: %w", err)
+		}
+		if err := w.file.Sync(); err != nil {
+			return nil, fmt.Errorf("sync WAL: %w", err)
+		}
+	}
+	w.size = valid
+	return metrics, nil
+}
+
+// reset empties the WAL once its records are part of the snapshot.
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+	w.size, w.broken = 0, false
+	return w.file.Sync()
+}
+
+// close closes the WAL file.
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// readWAL decodes records until the end of r, decrypting them with keys. It
+// returns the metrics and the offset just past the last valid record; a torn
+// or corrupt record stops the decoding with errCorruptRecord. A record that
+// cannot be decrypted is an error, so that the WAL is not cut for a missing key.
+func readWAL(r io.Reader, keys *keyring) ([]metricsdto.Metrics, int64, error) {
+	var (
+		metrics []metricsdto.Metrics
+		offset  int64
+		header  [walHeaderSize]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			switch {
+			case errors.Is(err, io.EOF):
+				return metrics, offset, nil
+			case errors.Is(err, io.ErrUnexpectedEOF):
+				return metrics, offset, errCorruptRecord
+			}
+			return metrics, offset, err
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		if size == 0 || size > maxWALRecord {
+			return metrics, offset, errCorruptRecord
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return metrics, offset, errCorruptRecord
+			}
+			return metrics, offset, err
+		}
+		if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(header[4:]) {
+			return metrics, offset, errCorruptRecord
+		}
+		if isSealed(payload) {
+			plain, err := keys.open(payload)
+			if err != nil {
+				return metrics, offset, err
+			}
+			payload = plain
+		}
+		var m metricsdto.Metrics
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return metrics, offset, errCorruptRecord
+		}
+		metrics = append(metrics, m)
+		offset += walHeaderSize + int64(size)
+	}
+}
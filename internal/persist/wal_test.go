@@ -0,0 +1,228 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// walState is the expected content of the storage after some WAL records.
+type walState struct {
+	gauges   map[string]float64
+	counters map[string]int
+}
+
+// writeWALFixture writes a snapshot and three WAL records to dir. It returns
+// the expected state after each prefix of the WAL and the WAL size after each record.
+func writeWALFixture(t *testing.T, dir string) ([]walState, []int64) {
+	t.Helper()
+	ctx := context.Background()
+	storage, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	// Without Close: the files are left as after a crash.
+
+	require.NoError(t, storage.FormattingLogs(ctx, map[string]float64{"cpu": 1}, map[string]int{"poll": 1}))
+	states := []walState{{gauges: map[string]float64{"cpu": 1}, counters: map[string]int{"poll": 1}}}
+	ends := []int64{0}
+
+	updates := []walState{
+		{gauges: map[string]float64{"cpu": 2}},
+		{counters: map[string]int{"poll": 5}},
+		{gauges: map[string]float64{"heap": 7.5}},
+	}
+	for _, u := range updates {
+		require.NoError(t, storage.WriteSeries(ctx, u.gauges, u.counters, nil, nil))
+		prev := states[len(states)-1]
+		next := walState{gauges: map[string]float64{}, counters: map[string]int{}}
+		for k, v := range prev.gauges {
+			next.gauges[k] = v
+		}
+		for k, v := range prev.counters {
+			next.counters[k] = v
+		}
+		for k, v := range u.gauges {
+			next.gauges[k] = v
+		}
+		for k, v := range u.counters {
+			next.counters[k] = v
+		}
+		states = append(states, next)
+		ends = append(ends, storage.wal.size)
+	}
+	return states, ends
+}
+
+// TestPersistStorage_WALCrashRecovery cuts the WAL at every offset and checks
+// that the snapshot plus all complete records are restored, and that new
+// records appended after the recovery are readable.
+func TestPersistStorage_WALCrashRecovery(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	states, ends := writeWALFixture(t, src)
+
+	snap, err := os.ReadFile(filepath.Join(src, "Metrics.json"))
+	require.NoError(t, err)
+	walBytes, err := os.ReadFile(filepath.Join(src, walFileName))
+	require.NoError(t, err)
+	require.Equal(t, ends[len(ends)-1], int64(len(walBytes)))
+
+	for cut := 0; cut <= len(walBytes); cut++ {
+		complete := 0
+		for complete+1 < len(ends) && ends[complete+1] <= int64(cut) {
+			complete++
+		}
+		want := states[complete]
+
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "Metrics.json"), snap, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, walFileName), walBytes[:cut], 0644))
+
+		storage, err := NewPersistStorage(dir, 0)
+		require.NoError(t, err)
+		metrics, err := storage.ImportLogs(ctx)
+		require.NoError(t, err, "cut at %d", cut)
+		assertPersistedMetrics(t, metrics, want.gauges, want.counters)
+
+		// The torn tail is dropped, so a new record is replayed after another crash.
+		require.NoError(t, storage.WriteSeries(ctx, map[string]float64{"after": 1}, nil, nil, nil))
+		reopened, err := NewPersistStorage(dir, 0)
+		require.NoError(t, err)
+		metrics, err = reopened.ImportLogs(ctx)
+		require.NoError(t, err, "cut at %d", cut)
+		gauges := map[string]float64{"after": 1}
+		for k, v := range want.gauges {
+			gauges[k] = v
+		}
+		assertPersistedMetrics(t, metrics, gauges, want.counters)
+
+		require.NoError(t, reopened.Close())
+		require.NoError(t, storage.Close())
+	}
+}
+
+// TestPersistStorage_WALCorruptRecord verifies that replay stops at a record
+// whose checksum does not match.
+func TestPersistStorage_WALCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	states, ends := writeWALFixture(t, dir)
+
+	path := filepath.Join(dir, walFileName)
+	walBytes, err := os.ReadFile(path)
+	require.NoError(t, err)
+	walBytes[ends[1]+walHeaderSize+2] ^= 0xff // inside the payload of the second record
+	require.NoError(t, os.WriteFile(path, walBytes, 0644))
+
+	storage, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	defer storage.Close()
+	metrics, err := storage.ImportLogs(context.Background())
+	require.NoError(t, err)
+	assertPersistedMetrics(t, metrics, states[1].gauges, states[1].counters)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, ends[1], info.Size(), "records after the corrupt one are cut off")
+}
+
+// TestPersistStorage_WALCheckpoint verifies that the snapshot is rewritten and
+// the WAL truncated once the WAL reaches its limit, and on Flush.
+func TestPersistStorage_WALCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	require.NoError(t, storage.WriteSeries(ctx, map[string]float64{"cpu": 1}, nil, nil, nil))
+	assert.Positive(t, storage.wal.size)
+	require.NoError(t, storage.Flush())
+	assert.Zero(t, storage.wal.size)
+
+	storage.walMaxBytes = 1
+	require.NoError(t, storage.WriteSeries(ctx, nil, map[string]int{"poll": 2}, nil, nil))
+	assert.Zero(t, storage.wal.size)
+
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	snap, err := NewPersistStorage(dir, 0)
+	require.NoError(t, err)
+	defer snap.Close()
+	metrics, err := snap.ImportLogs(ctx)
+	require.NoError(t, err)
+	assertPersistedMetrics(t, metrics, map[string]float64{"cpu": 1}, map[string]int{"poll": 2})
+}
+
+// tornFile writes half of the next write and fails it, as a full disk does,
+// and fails the next truncate with truncErr.
+type tornFile struct {
+	walFile
+	tear     bool
+	truncErr error
+}
+
+func (f *tornFile) Write(p []byte) (int, error) {
+	if !f.tear {
+		return f.walFile.Write(p)
+	}
+	f.tear = false
+	n, _ := f.walFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *tornFile) Truncate(size int64) error {
+	if err := f.truncErr; err != nil {
+		f.truncErr = nil
+		return err
+	}
+	return f.walFile.Truncate(size)
+}
+
+// TestPersistStorage_WALTornAppend checks that a partially written record is
+// not left in front of the records appended after it.
+func TestPersistStorage_WALTornAppend(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name     string
+		truncErr error
+	}{
+		{name: "torn record cut off"},
+		{name: "cut off fails", truncErr: errors.New("i/o error")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			storage, err := NewPersistStorage(dir, 0)
+			require.NoError(t, err)
+			require.NoError(t, storage.WriteSeries(ctx, map[string]float64{"cpu": 1}, nil, nil, nil))
+
+			file := &tornFile{walFile: storage.wal.file, tear: true, truncErr: tt.truncErr}
+			storage.wal.file = file
+			err = storage.WriteSeries(ctx, map[string]float64{"cpu": 2}, nil, nil, nil)
+			if tt.truncErr == nil {
+				require.Error(t, err)
+			} else {
+				// The snapshot takes the update and the WAL is emptied.
+				require.NoError(t, err)
+				assert.False(t, storage.wal.broken)
+			}
+			require.NoError(t, storage.WriteSeries(ctx, nil, map[string]int{"poll": 3}, nil, nil))
+
+			restarted, err := NewPersistStorage(dir, 0)
+			require.NoError(t, err)
+			defer restarted.Close()
+			metrics, err := restarted.ImportLogs(ctx)
+			require.NoError(t, err)
+			gauge := 1.0
+			if tt.truncErr != nil {
+				gauge = 2
+			}
+			assertPersistedMetrics(t, metrics, map[string]float64{"cpu": gauge}, map[string]int{"poll": 3})
+		})
+	}
+}
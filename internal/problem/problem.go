@@ -0,0 +1,85 @@
+// Package problem writes error responses as RFC 7807 problem details
+// (application/problem+json) with stable machine-readable codes.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ContentType is the media type of problem responses.
+const ContentType = "application/problem+json"
+
+// typePrefix makes the problem type URI of a code.
+const typePrefix = "urn:gometrics:problem:"
+
+// Stable error codes. Clients should branch on Code rather than on Detail.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeParse              = "parse_error"
+	CodeInvalidType        = "invalid_type"
+	CodeInvalidMetric      = "invalid_metric"
+	CodeInvalidBatch       = "invalid_batch"
+	CodeFutureTimestamp    = "future_timestamp"
+	CodeInvalidMetadata    = "invalid_metadata"
+	CodeTypeMismatch       = "type_mismatch"
+	CodeInvalidTenant      = "invalid_tenant"
+	CodeInvalidSignature   = "invalid_signature"
+	CodeInvalidIdempotency = "invalid_idempotency_key"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeTenantLimit        = "tenant_limit"
+	CodeNotFound           = "not_found"
+	CodeStale              = "stale"
+	CodeBodyTooLarge       = "body_too_large"
+	CodeRateLimited        = "rate_limited"
+	CodeSeriesLimit        = "series_limit"
+	CodePersistence        = "persistence_failure"
+	CodeUnavailable        = "unavailable"
+	CodeInternal           = "internal"
+)
+
+// Problem is an RFC 7807 problem details object extended with Code.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	Result   any    `json:"result,omitempty"` // per-item result of a rejected batch
+}
+
+// New returns the problem with the given status, code and human-readable detail.
+func New(status int, code, detail string) Problem {
+	return Problem{
+		Type:   typePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Write sends p. The request path becomes the problem instance; r may be nil.
+func Write(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Instance == "" && r != nil {
+		p.Instance = r.URL.Path
+	}
+	out, err := json.Marshal(p)
+	if err != nil {
+		out, _ = json.Marshal(New(http.StatusInternalServerError, CodeInternal, err.Error()))
+		p.Status = http.StatusInternalServerError
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(out)
+}
+
+// Error is the problem counterpart of http.Error.
+func Error(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	Write(w, r, New(status, code, detail))
+}
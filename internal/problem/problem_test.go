@@ -0,0 +1,40 @@
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/value/gauge/cpu", nil)
+	rec := httptest.NewRecorder()
+	Error(rec, req, http.StatusNotFound, CodeNotFound, "gauge cpu not found")
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+
+	var p Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	assert.Equal(t, Problem{
+		Type:     "urn:gometrics:problem:not_found",
+		Title:    "Not Found",
+		Status:   http.StatusNotFound,
+		Detail:   "gauge cpu not found",
+		Instance: "/value/gauge/cpu",
+		Code:     CodeNotFound,
+	}, p)
+}
+
+func ExampleNew() {
+	p := New(http.StatusBadRequest, CodeInvalidType, `invalid metric type "histogram"`)
+	out, _ := json.Marshal(p)
+	fmt.Println(string(out))
+	// Output:
+	// {"type":"urn:gometrics:problem:invalid_type","title":"Bad Request","status":400,"detail":"invalid metric type \"histogram\"","code":"invalid_type"}
+}
@@ -0,0 +1,196 @@
+// Package ratelimit implements per-client token-bucket rate limiting for the
+// update routes. Clients are identified by IP address, API token or tenant.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gometrics/internal/auth"
+	"gometrics/internal/problem"
+	"gometrics/internal/tenant"
+)
+
+// Key policies accepted by KeyFuncFor.
+const (
+	KeyIP     = "ip"
+	KeyToken  = "token"
+	KeyTenant = "tenant"
+)
+
+// KeyFunc returns the client identity a request is accounted to.
+type KeyFunc func(r *http.Request) string
+
+// ByIP identifies clients by the remote IP address.
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// ByToken identifies clients by their API token, falling back to the IP address
+// for anonymous requests.
+func ByToken(r *http.Request) string {
+	if tok, ok := auth.FromContext(r.Context()); ok {
+		return "token:" + tok.Name
+	}
+	return ByIP(r)
+}
+
+// ByTenant identifies clients by tenant, falling back to the IP address
+// for the default tenant.
+func ByTenant(r *http.Request) string {
+	if name := tenant.FromContext(r.Context()); name != tenant.Default {
+		return "tenant:" + name
+	}
+	return ByIP(r)
+}
+
+// KeyFuncFor returns the KeyFunc of a policy name ("ip", "token" or "tenant").
+func KeyFuncFor(policy string) (KeyFunc, error) {
+	switch policy {
+	case KeyIP, "":
+		return ByIP, nil
+	case KeyToken:
+		return ByToken, nil
+	case KeyTenant:
+		return ByTenant, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q", policy)
+	}
+}
+
+// bucket holds the tokens of one client at the time of its last refill.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a set of token buckets, one per client.
+// Each bucket holds up to burst tokens and refills at rate tokens per second.
+// It is safe for concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	key     KeyFunc
+	now     func() time.Time
+	buckets map[string]*bucket
+	calls   int
+}
+
+// pruneEvery is how many Allow calls pass between removals of full buckets.
+const pruneEvery = 1024
+
+// NewLimiter creates a limiter allowing rate requests per second with bursts
+// of up to burst requests per client. A burst below 1 is treated as 1.
+func NewLimiter(rate float64, burst int, key KeyFunc) *Limiter {
+	if key == nil {
+		key = ByIP
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   math.Max(1, float64(burst)),
+		key:     key,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of key. When the bucket is empty it
+// returns false and the time until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.calls++
+	if l.calls%pruneEvery == 0 {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Hour
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// prune drops buckets that have refilled completely; they are equivalent to new ones.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Middleware rejects requests of clients that exceeded their rate
+// with 429 Too Many Requests and a Retry-After header.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.Allow(l.key(r)); !ok {
+			TooManyRequests(w, r, wait, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BodyLimitRetryAfter is the Retry-After sent with requests over the body size quota.
+const BodyLimitRetryAfter = time.Minute
+
+// TooManyRequests writes a 429 response with Retry-After rounded up to whole seconds.
+func TooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration, msg string) {
+	SetRetryAfter(w, wait)
+	problem.Error(w, r, http.StatusTooManyRequests, problem.CodeRateLimited, msg)
+}
+
+// SetRetryAfter sets the Retry-After header to wait rounded up to whole seconds, at least 1.
+func SetRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
+// MaxBodySize limits request bodies to n bytes. Requests announcing a larger
+// Content-Length are rejected with 429 and a Retry-After of BodyLimitRetryAfter;
+// bodies that turn out larger fail to read with *http.MaxBytesError.
+// A non-positive n disables the limit.
+func MaxBodySize(n int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if n <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				SetRetryAfter(w, BodyLimitRetryAfter)
+				problem.Error(w, r, http.StatusTooManyRequests, problem.CodeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", n))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
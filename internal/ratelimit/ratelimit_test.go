@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gometrics/internal/auth"
+	"gometrics/internal/tenant"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(2, 3, ByIP)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok, "burst request %d", i)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other clients have their own bucket.
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	// Half a second refills one token at 2 rps.
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(1, 1, ByIP)
+	l.now = func() time.Time { return now }
+
+	l.Allow("idle")
+	now = now.Add(time.Hour)
+	for i := 0; i < pruneEvery; i++ {
+		l.Allow("busy")
+	}
+	_, ok := l.buckets["idle"]
+	assert.False(t, ok, "refilled bucket must be dropped")
+}
+
+func TestKeyFuncs(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	assert.Equal(t, "ip:10.0.0.1", ByIP(req))
+	assert.Equal(t, "ip:10.0.0.1", ByToken(req))
+	assert.Equal(t, "ip:10.0.0.1", ByTenant(req))
+
+	ctx := auth.WithToken(req.Context(), auth.Token{Name: "agent1"})
+	ctx = tenant.WithTenant(ctx, "teama")
+	req = req.WithContext(ctx)
+	assert.Equal(t, "token:agent1", ByToken(req))
+	assert.Equal(t, "tenant:teama", ByTenant(req))
+
+	_, err := KeyFuncFor("cookie")
+	assert.Error(t, err)
+	for _, p := range []string{"", KeyIP, KeyToken, KeyTenant} {
+		_, err := KeyFuncFor(p)
+		assert.NoError(t, err, p)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l := NewLimiter(0.5, 1, func(*http.Request) string { return "client" })
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+}
+
+func TestMaxBodySize(t *testing.T) {
+	h := MaxBodySize(4)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+
+	tests := []struct {
+		name           string
+		body           string
+		chunked        bool
+		wantCode       int
+		wantRetryAfter string
+	}{
+		{name: "within limit", body: "1234", wantCode: http.StatusOK},
+		{name: "content length over limit", body: "12345", wantCode: http.StatusTooManyRequests, wantRetryAfter: "60"},
+		{name: "unknown length over limit", body: "12345", chunked: true, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			require.Equal(t, tt.wantCode, rec.Code)
+			assert.Equal(t, tt.wantRetryAfter, rec.Header().Get("Retry-After"))
+		})
+	}
+}
@@ -3,6 +3,7 @@ package retry
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"os"
@@ -22,6 +23,26 @@ type Action interface {
 	Execute(args ...any) (any, error)
 }
 
+// maxRetryAfter caps the delay requested by a RetryAfterError,
+// so a misbehaving server cannot stall the caller indefinitely.
+const maxRetryAfter = time.Minute
+
+// RetryAfterError — ошибка, для которой источник (например, сервер с ответом 429)
+// сам указал, через сколько можно повторить попытку. Такие ошибки всегда
+// повторяются, а задержка берётся из Delay вместо Delays.
+type RetryAfterError struct {
+	Delay time.Duration
+	Err   error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.Err, e.Delay)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
 type RetryConfig struct {
 	Attempts    int
 	Delays      []time.Duration
@@ -66,6 +87,10 @@ func (cfg RetryConfig) Retry(ctx context.Context, rFunc func(...any) (any, error
 		}
 
 		delay := cfg.delayForAttempt(attempt)
+		var raErr *RetryAfterError
+		if errors.As(err, &raErr) && raErr.Delay > 0 {
+			delay = min(raErr.Delay, maxRetryAfter)
+		}
 		if cfg.OnRetry != nil {
 			cfg.OnRetry(err, attempt+1, delay)
 		}
@@ -98,6 +123,11 @@ func defaultShouldRetry(err error) bool {
 		return false
 	}
 
+	var raErr *RetryAfterError
+	if errors.As(err, &raErr) {
+		return true
+	}
+
 	var urlErr *url.Error
 	if errors.As(err, &urlErr) {
 		if urlErr.Timeout() {
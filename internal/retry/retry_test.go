@@ -218,3 +218,44 @@ func TestDefaultShouldRetry_NetTimeout(t *testing.T) {
 	err := timeoutError{}
 	assert.True(t, defaultShouldRetry(err))
 }
+
+func TestRetry_RetryAfterError(t *testing.T) {
+	var delays []time.Duration
+	cfg := RetryConfig{
+		Attempts:    3,
+		Delays:      []time.Duration{time.Hour},
+		ShouldRetry: defaultShouldRetry,
+		OnRetry: func(_ error, _ int, delay time.Duration) {
+			delays = append(delays, delay)
+		},
+	}
+	mockAction := NewMockAction(t)
+
+	// Сервер просит подождать 5 мс вместо настроенного часа
+	mockAction.On("Execute", mock.Anything).
+		Return(nil, &RetryAfterError{Delay: 5 * time.Millisecond, Err: errors.New("429")}).Once()
+	mockAction.On("Execute", mock.Anything).Return("ok", nil).Once()
+
+	res, err := cfg.Retry(context.Background(), mockAction.Execute)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", res)
+	assert.Equal(t, []time.Duration{5 * time.Millisecond}, delays)
+}
+
+func TestRetryAfterError_Cap(t *testing.T) {
+	var got time.Duration
+	cfg := RetryConfig{
+		Attempts: 2,
+		OnRetry:  func(_ error, _ int, delay time.Duration) { got = delay },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := cfg.Retry(ctx, func(...any) (any, error) {
+		cancel() // не ждём минуту в тесте
+		return nil, &RetryAfterError{Delay: 24 * time.Hour, Err: errors.New("429")}
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, maxRetryAfter, got)
+}
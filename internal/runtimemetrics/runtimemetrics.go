@@ -6,18 +6,23 @@ import (
 	"bytes"
 	"context"
 	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand/v2"
+	"net/http"
+	"net/url"
 	"reflect"
 	"runtime"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/shirou/gopsutil/v4/cpu"
 	"github.com/shirou/gopsutil/v4/mem"
@@ -27,10 +32,63 @@ import (
 	metricsdto "gometrics/internal/api/metricsdto"
 	"gometrics/internal/clientconfig"
 	myCompress "gometrics/internal/compress"
+	"gometrics/internal/metadata"
 	"gometrics/internal/retry"
 	"gometrics/internal/signature"
 )
 
+// ErrResponseSignature is returned when a server response carries a missing or
+// invalid HashSHA256 header while a signing key is configured.
+var ErrResponseSignature = errors.New("response signature mismatch")
+
+// idempotencyHeader carries the per-batch key the server uses to detect retried batches.
+const idempotencyHeader = "Idempotency-Key"
+
+// signatureErrorsMetric is the agent self-metric counting rejected server responses.
+const signatureErrorsMetric = "ResponseSignatureErrors"
+
+// RuntimeMetadata describes the metrics collected by the agent. It is sent to
+// the server on startup with SendMetadata.
+var RuntimeMetadata = func() []metadata.Metadata {
+	gauge := func(name, unit, help string) metadata.Metadata {
+		return metadata.Metadata{Name: name, Type: metricsdto.MetricTypeGauge, Unit: unit, Help: help}
+	}
+	return []metadata.Metadata{
+		gauge("Alloc", "bytes", "Bytes of allocated heap objects."),
+		gauge("BuckHashSys", "bytes", "Bytes of memory in profiling bucket hash tables."),
+		gauge("Frees", "objects", "Cumulative count of heap objects freed."),
+		gauge("GCCPUFraction", "ratio", "Fraction of available CPU time used by the GC since the program started."),
+		gauge("GCSys", "bytes", "Bytes of memory in garbage collection metadata."),
+		gauge("HeapAlloc", "bytes", "Bytes of allocated heap objects."),
+		gauge("HeapIdle", "bytes", "Bytes in idle (unused) heap spans."),
+		gauge("HeapInuse", "bytes", "Bytes in in-use heap spans."),
+		gauge("HeapObjects", "objects", "Number of allocated heap objects."),
+		gauge("HeapReleased", "bytes", "Bytes of physical memory returned to the OS."),
+		gauge("HeapSys", "bytes", "Bytes of heap memory obtained from the OS."),
+		gauge("LastGC", "nanoseconds", "Time the last garbage collection finished, as nanoseconds since the Unix epoch."),
+		gauge("Lookups", "operations", "Number of pointer lookups performed by the runtime."),
+		gauge("MCacheInuse", "bytes", "Bytes of allocated mcache structures."),
+		gauge("MCacheSys", "bytes", "Bytes of memory obtained from the OS for mcache structures."),
+		gauge("MSpanInuse", "bytes", "Bytes of allocated mspan structures."),
+		gauge("MSpanSys", "bytes", "Bytes of memory obtained from the OS for mspan structures."),
+		gauge("Mallocs", "objects", "Cumulative count of heap objects allocated."),
+		gauge("NextGC", "bytes", "Target heap size of the next GC cycle."),
+		gauge("NumForcedGC", "cycles", "Number of GC cycles forced by the application."),
+		gauge("NumGC", "cycles", "Number of completed GC cycles."),
+		gauge("OtherSys", "bytes", "Bytes of memory in miscellaneous off-heap runtime allocations."),
+		gauge("PauseTotalNs", "nanoseconds", "Cumulative nanoseconds in GC stop-the-world pauses."),
+		gauge("StackInuse", "bytes", "Bytes in stack spans."),
+		gauge("StackSys", "bytes", "Bytes of stack memory obtained from the OS."),
+		gauge("Sys", "bytes", "Total bytes of memory obtained from the OS."),
+		gauge("TotalAlloc", "bytes", "Cumulative bytes allocated for heap objects."),
+		gauge("RandomValue", "", "Random value refreshed on every poll."),
+		gauge("TotalMemory", "bytes", "Total amount of RAM on the host."),
+		gauge("FreeMemory", "bytes", "Free RAM on the host."),
+		gauge("CPUutilization1", "percent", "CPU utilization of the host."),
+		{Name: "PollCount", Type: metricsdto.MetricTypeCounter, Unit: "polls", Help: "Number of metric polls made by the agent."},
+	}
+}()
+
 // RuntimeUpdate manages the collection and transmission of runtime metrics.
 // It holds the state required for buffering metrics, handling rate limits,
 // and communicating with the storage service and external client.
@@ -70,10 +128,35 @@ func NewRuntimeUpdater(service Service, RateLimit int, pubKey *rsa.PublicKey) *R
 	}
 }
 
+// SetAuthToken makes every request to the server carry "Authorization: Bearer <token>".
+// An empty token leaves requests unauthenticated.
+func (ru *RuntimeUpdate) SetAuthToken(token string) {
+	if token != "" {
+		ru.client.SetAuthToken(token)
+	}
+}
+
+// SetAgentID makes every request carry the X-Agent-ID header, which the server
+// uses to tell agents apart when tracking their last-seen times.
+func (ru *RuntimeUpdate) SetAgentID(id string) {
+	if id != "" {
+		ru.client.SetHeader("X-Agent-ID", id)
+	}
+}
+
+// SetTenant makes every request to the server carry the X-Tenant-ID header.
+// An empty tenant reports to the server's default tenant.
+func (ru *RuntimeUpdate) SetTenant(tenant string) {
+	if tenant != "" {
+		ru.client.SetHeader("X-Tenant-ID", tenant)
+	}
+}
+
 // FillRepoExt collects extended metrics using gopsutil (VirtualMemory, CPU).
 // It saves the collected metrics (TotalMemory, FreeMemory, CPUUtilization) into the local service.
 //
 // Argument 'metrics' expects a slice of 3 strings naming the keys for Total, Free, and CPU respectively.
+// The names are sent as given, like those of FillRepo; the server normalises them.
 func (ru *RuntimeUpdate) FillRepoExt(ctx context.Context, metrics []string) error {
 	vmem, err := mem.VirtualMemory()
 	if err != nil {
@@ -85,15 +168,15 @@ func (ru *RuntimeUpdate) FillRepoExt(ctx context.Context, metrics []string) erro
 	}
 	ru.mu.Lock()
 	defer ru.mu.Unlock()
-	if err = ru.service.GaugeInsert(ctx, strings.ToLower(metrics[0]), float64(vmem.Total)); err != nil {
+	if err = ru.service.GaugeInsert(ctx, metrics[0], float64(vmem.Total)); err != nil {
 		return err
 	}
-	if err = ru.service.GaugeInsert(ctx, strings.ToLower(metrics[1]), float64(vmem.Free)); err != nil {
+	if err = ru.service.GaugeInsert(ctx, metrics[1], float64(vmem.Free)); err != nil {
 		return err
 	}
 	// Assuming cpuPercent returns at least one value
 	if len(cpuPercent) > 0 {
-		if err = ru.service.GaugeInsert(ctx, strings.ToLower(metrics[2]), cpuPercent[0]); err != nil {
+		if err = ru.service.GaugeInsert(ctx, metrics[2], cpuPercent[0]); err != nil {
 			return err
 		}
 	}
@@ -192,7 +275,8 @@ func (ru *RuntimeUpdate) GetMetrics(ctx context.Context, metrics []string, ext b
 // SendMetricGobCh continuously reads batches of metrics from the input channel (ChIn),
 // encodes them using Gob, optionally compresses them with gzip, signs them with HMAC (if key is present),
 // and sends them to the server URL (curl).
-
+// When a key is set, every response signature is verified; mismatches are logged and
+// counted in the ResponseSignatureErrors self-metric.
 func (ru *RuntimeUpdate) SendMetricGobCh(ctx context.Context, curl string, compress string, key string) error {
 	for metrics := range ru.ChIn {
 		var (
@@ -200,7 +284,9 @@ func (ru *RuntimeUpdate) SendMetricGobCh(ctx context.Context, curl string, compr
 			newBuffer bytes.Buffer
 		)
 
-		req := ru.client.R().SetHeader("Content-Type", "application/x-gob")
+		// The key stays the same across retries, so the server applies the batch once.
+		req := ru.client.R().SetHeader("Content-Type", "application/x-gob").
+			SetHeader(idempotencyHeader, newIdempotencyKey())
 		encoder := gob.NewEncoder(&newBuffer)
 		err := encoder.Encode(metrics)
 		newBufferBytes := newBuffer.Bytes()
@@ -236,15 +322,26 @@ func (ru *RuntimeUpdate) SendMetricGobCh(ctx context.Context, curl string, compr
 			}
 		}
 
-		ru.mu.Lock()
 		retryCfg := retry.DefaultConfig()
 		// Execute request with retry logic
 		_, err = retryCfg.Retry(ctx, func(_ ...any) (any, error) {
-			_, err := req.SetBody(bufOut).Post(curl)
-			return nil, err
+			resp, err := req.SetBody(bufOut).Post(curl)
+			if err != nil {
+				return nil, err
+			}
+			if key != "" {
+				if err := ru.VerifyResponse(resp, key); err != nil {
+					return nil, err
+				}
+			}
+			return nil, responseError(resp)
 		})
-		ru.mu.Unlock()
 
+		if errors.Is(err, ErrResponseSignature) {
+			if cErr := ru.service.CounterInsert(ctx, signatureErrorsMetric, 1); cErr != nil {
+				log.Printf("WARN: update counter %s: %v", signatureErrorsMetric, cErr)
+			}
+		}
 		if err != nil {
 			log.Printf("WARN: Failed to send metric after retries: %v", err)
 		}
@@ -252,6 +349,102 @@ func (ru *RuntimeUpdate) SendMetricGobCh(ctx context.Context, curl string, compr
 	return nil
 }
 
+// SendMetadata declares the metadata of the given metrics on the server with
+// PUT <baseURL>/api/v1/metadata/{name}, signing and encrypting each body like
+// metric batches. It returns the joined errors of the failed requests.
+// With authentication enabled, the server accepts it from a write token whose
+// prefix allows the metric, like the metric updates.
+func (ru *RuntimeUpdate) SendMetadata(ctx context.Context, baseURL string, key string, items []metadata.Metadata) error {
+	var errs []error
+	for _, m := range items {
+		body, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		req := ru.client.R().SetContext(ctx).SetHeader("Content-Type", "application/json")
+		if key != "" {
+			hash, err := ru.ComputeHash(ctx, body, key)
+			if err != nil {
+				return err
+			}
+			req.SetHeader("HashSHA256", hex.EncodeToString(hash))
+		}
+		if ru.PubKey != nil {
+			if body, err = signature.EncryptByRSA(body, ru.PubKey); err != nil {
+				return err
+			}
+		}
+
+		retryCfg := retry.DefaultConfig()
+		_, err = retryCfg.Retry(ctx, func(_ ...any) (any, error) {
+			resp, err := req.SetBody(body).Put(baseURL + "/api/v1/metadata/" + url.PathEscape(m.Name))
+			if err != nil {
+				return nil, err
+			}
+			if err := responseError(resp); err != nil {
+				return nil, err
+			}
+			if resp.IsError() {
+				return nil, fmt.Errorf("server responded %s", resp.Status())
+			}
+			return nil, nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("send metadata %s: %w", m.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newIdempotencyKey returns a random key identifying one batch.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// responseError turns throttling responses (429, 503) into a retry.RetryAfterError
+// carrying the delay from the Retry-After header. The server answers 429 for
+// the rate limit as well as for the series and body size quotas.
+func responseError(resp *resty.Response) error {
+	switch resp.StatusCode() {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return &retry.RetryAfterError{
+			Delay: parseRetryAfter(resp.Header().Get("Retry-After"), time.Now()),
+			Err:   fmt.Errorf("server responded %s", resp.Status()),
+		}
+	}
+	return nil
+}
+
+// parseRetryAfter parses a Retry-After value given in seconds or as an HTTP date.
+// It returns 0 for a missing or malformed value.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// VerifyResponse checks the HashSHA256 header of a server response against the HMAC
+// of its (already decompressed) body. A missing header is treated as a mismatch,
+// since a server sharing the key always signs its responses.
+func (ru *RuntimeUpdate) VerifyResponse(resp *resty.Response, key string) error {
+	header := resp.Header().Get("HashSHA256")
+	if header == "" {
+		return fmt.Errorf("%w: no HashSHA256 header (status %d)", ErrResponseSignature, resp.StatusCode())
+	}
+	if !signature.PayloadCheck(resp.Body(), []byte(key), header) {
+		return fmt.Errorf("%w: status %d", ErrResponseSignature, resp.StatusCode())
+	}
+	return nil
+}
+
 // Sender starts the metric sending process using configuration from ClientConfig.
 // It acts as a wrapper around SendMetricGobCh.
 func (ru *RuntimeUpdate) Sender(ctx context.Context, curl string, f clientconfig.ClientConfig) {
@@ -2,12 +2,21 @@ package runtimemetrics
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/metadata"
 	"gometrics/internal/service"
+	"gometrics/internal/signature"
 	"gometrics/internal/storage"
 
 	"github.com/stretchr/testify/assert"
@@ -237,3 +246,159 @@ func TestRuntimeUpdate_AddCounter_Error(t *testing.T) {
 	_, err := ru.AddCounter(keys, metricsMap)
 	assert.Error(t, err)
 }
+
+func TestRuntimeUpdate_SendMetricGobCh_ResponseSignature(t *testing.T) {
+	tests := []struct {
+		name       string
+		agentKey   string
+		serverKey  string
+		tamper     bool
+		wantErrors int
+	}{
+		{name: "same key", agentKey: "secret", serverKey: "secret", wantErrors: 0},
+		{name: "different server key", agentKey: "secret", serverKey: "other", wantErrors: 1},
+		{name: "tampering proxy", agentKey: "secret", serverKey: "secret", tamper: true, wantErrors: 1},
+		{name: "no agent key", agentKey: "", serverKey: "other", wantErrors: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handler http.Handler = signature.SignatureHandler(tt.serverKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("accepted"))
+			}))
+			if tt.tamper {
+				signed := handler
+				handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					rec := httptest.NewRecorder()
+					signed.ServeHTTP(rec, r)
+					w.Header().Set("HashSHA256", rec.Header().Get("HashSHA256"))
+					w.Write([]byte("forged"))
+				})
+			}
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+			ru := NewRuntimeUpdater(svc, 1, nil)
+			value := 1.5
+			ru.SendBatch(context.Background(), []metricsdto.Metrics{{ID: "g1", MType: metricsdto.MetricTypeGauge, Value: &value}})
+			ru.CloseChannel(context.Background())
+
+			require.NoError(t, ru.SendMetricGobCh(context.Background(), ts.URL, "", tt.agentKey))
+
+			got, err := svc.GetCounter(context.Background(), signatureErrorsMetric)
+			if tt.wantErrors == 0 {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantErrors, got)
+		})
+	}
+}
+
+func TestRuntimeUpdate_SendMetricGobCh_RetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	var gap time.Duration
+	var first time.Time
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if calls.Add(1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		gap = time.Since(first)
+		w.Write([]byte("accepted"))
+	}))
+	defer ts.Close()
+
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	ru := NewRuntimeUpdater(svc, 1, nil)
+	value := 1.5
+	ru.SendBatch(context.Background(), []metricsdto.Metrics{{ID: "g1", MType: metricsdto.MetricTypeGauge, Value: &value}})
+	ru.CloseChannel(context.Background())
+
+	require.NoError(t, ru.SendMetricGobCh(context.Background(), ts.URL, "", ""))
+	assert.Equal(t, int32(2), calls.Load())
+	assert.GreaterOrEqual(t, gap, 900*time.Millisecond, "agent must wait for Retry-After")
+	require.Len(t, keys, 2)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1], "a retry reuses the batch Idempotency-Key")
+}
+
+func TestRuntimeUpdate_SendMetricGobCh_CollectsWhileSending(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+		w.Write([]byte("accepted"))
+	}))
+	defer ts.Close()
+
+	svc := service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+	ru := NewRuntimeUpdater(svc, 1, nil)
+	value := 1.5
+	ru.SendBatch(context.Background(), []metricsdto.Metrics{{ID: "g1", MType: metricsdto.MetricTypeGauge, Value: &value}})
+	ru.CloseChannel(context.Background())
+
+	sent := make(chan error, 1)
+	go func() { sent <- ru.SendMetricGobCh(context.Background(), ts.URL, "", "") }()
+	<-received
+
+	// A slow server must not block the collection of metrics.
+	collected := make(chan error, 1)
+	go func() { collected <- ru.GetMetrics(context.Background(), []string{"Alloc"}, false) }()
+	select {
+	case err := <-collected:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("collection is blocked by the request in flight")
+	}
+	close(release)
+	require.NoError(t, <-sent)
+}
+
+func TestRuntimeUpdate_SendMetadata(t *testing.T) {
+	got := map[string]metadata.Metadata{}
+	var mu sync.Mutex
+	handler := signature.SignatureHandler("secret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		var m metadata.Metadata
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&m))
+		mu.Lock()
+		got[strings.TrimPrefix(r.URL.Path, "/api/v1/metadata/")] = m
+		mu.Unlock()
+	}))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	ru := NewRuntimeUpdater(service.NewService(storage.NewMemStorage(), &stubPersistStorage{}), 1, nil)
+	require.NoError(t, ru.SendMetadata(context.Background(), ts.URL, "secret", RuntimeMetadata))
+
+	assert.Len(t, got, len(RuntimeMetadata))
+	assert.Equal(t, "bytes", got["Alloc"].Unit)
+	assert.Equal(t, metricsdto.MetricTypeCounter, got["PollCount"].Type)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "3", want: 3 * time.Second},
+		{value: now.Add(10 * time.Second).Format(http.TimeFormat), want: 10 * time.Second},
+		{value: now.Add(-time.Second).Format(http.TimeFormat), want: 0},
+		{value: "", want: 0},
+		{value: "soon", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseRetryAfter(tt.value, now))
+		})
+	}
+}
@@ -21,6 +21,51 @@ type JSONConfig struct {
 	StoreFile     string `json:"store_file"`     // аналог FILE_STORAGE_PATH или -f
 	DatabaseDSN   string `json:"database_dsn"`   // аналог DATABASE_DSN или -d
 	CryptoKey     string `json:"crypto_key"`     // аналог CRYPTO_KEY или -crypto-key
+	AuthFile      string `json:"auth_file"`      // аналог AUTH_FILE или -auth-file
+	AuthDB        *bool  `json:"auth_db"`        // аналог AUTH_DB или -auth-db
+	MultiTenant   *bool  `json:"multi_tenant"`   // аналог MULTI_TENANT или -multi-tenant
+	MaxTenants    *int   `json:"max_tenants"`    // аналог MAX_TENANTS или -max-tenants
+	MaxSeries     *int   `json:"max_series"`     // аналог MAX_SERIES или -max-series
+
+	RateLimitRPS   *float64 `json:"rate_limit_rps"`   // аналог RATE_LIMIT_RPS или -rate-limit-rps
+	RateLimitBurst *int     `json:"rate_limit_burst"` // аналог RATE_LIMIT_BURST или -rate-limit-burst
+	RateLimitKey   string   `json:"rate_limit_key"`   // аналог RATE_LIMIT_KEY или -rate-limit-key
+	MaxBodySize    *int64   `json:"max_body_size"`    // аналог MAX_BODY_SIZE или -max-body-size
+
+	AuditFile string `json:"audit_file"` // аналог AUDIT_FILE или -audit-file
+	AuditURL  string `json:"audit_url"`  // аналог AUDIT_URL или -audit-url
+
+	AlertRules    string `json:"alert_rules"`    // аналог ALERT_RULES или -alert-rules
+	AlertInterval *int   `json:"alert_interval"` // аналог ALERT_INTERVAL или -alert-interval
+
+	StaleWindow *int  `json:"staleness_window"` // аналог STALENESS_WINDOW или -staleness-window
+	HideStale   *bool `json:"hide_stale"`       // аналог HIDE_STALE или -hide-stale
+
+	MetricTTL       *int `json:"metric_ttl"`       // аналог METRIC_TTL или -metric-ttl
+	JanitorInterval *int `json:"janitor_interval"` // аналог JANITOR_INTERVAL или -janitor-interval
+	MaxFutureSkew   *int `json:"max_future_skew"`  // аналог MAX_FUTURE_SKEW или -max-future-skew
+
+	IdempotencyTTL     *int  `json:"idempotency_ttl"`      // аналог IDEMPOTENCY_TTL или -idempotency-ttl
+	IdempotencyMaxKeys *int  `json:"idempotency_max_keys"` // аналог IDEMPOTENCY_MAX_KEYS или -idempotency-max-keys
+	IdempotencyDB      *bool `json:"idempotency_db"`       // аналог IDEMPOTENCY_DB или -idempotency-db
+
+	PersistMode     string `json:"persist_mode"`      // аналог PERSIST_MODE или -persist-mode
+	FlushDelayMs    *int   `json:"flush_delay_ms"`    // аналог FLUSH_DELAY_MS или -flush-delay-ms
+	FlushBatch      *int   `json:"flush_batch"`       // аналог FLUSH_BATCH или -flush-batch
+	FlushMaxPending *int   `json:"flush_max_pending"` // аналог FLUSH_MAX_PENDING или -flush-max-pending
+
+	SnapshotGenerations *int   `json:"snapshot_generations"` // аналог SNAPSHOT_GENERATIONS или -snapshot-generations
+	SnapshotFormat      string `json:"snapshot_format"`      // аналог SNAPSHOT_FORMAT или -snapshot-format
+	SnapshotCompression string `json:"snapshot_compression"` // аналог SNAPSHOT_COMPRESSION или -snapshot-compression
+	SnapshotKeyFile     string `json:"snapshot_key_file"`    // аналог SNAPSHOT_KEY_FILE или -snapshot-key-file
+
+	StorageShards    *int   `json:"storage_shards"`     // аналог STORAGE_SHARDS или -storage-shards
+	MetricNamePolicy string `json:"metric_name_policy"` // аналог METRIC_NAME_POLICY или -metric-name-policy
+	CounterMode      string `json:"counter_mode"`       // аналог COUNTER_MODE или -counter-mode
+	CounterCacheMs   *int   `json:"counter_cache_ms"`   // аналог COUNTER_CACHE_MS или -counter-cache-ms
+
+	TenantMaxSeries   map[string]int `json:"tenant_max_series"`   // лимит серий для отдельных тенантов (только JSON)
+	MetricTTLPatterns map[string]int `json:"metric_ttl_patterns"` // TTL серий по шаблону имени, секунд (только JSON)
 }
 
 // ServerConfigs содержит все настройки конфигурации сервера.
@@ -34,6 +79,52 @@ type ServerConfigs struct {
 	Key         string    `env:"KEY" envDefault:""`                              // ключ подписи (SHA256)
 	CryptoKey   string    `env:"CRYPTO_KEY" envDefault:""`                       // путь к публичному ключу
 	ConfigPath  string    `env:"CONFIG" envDefault:""`                           // путь к JSON конфигу
+	AuthFile    string    `env:"AUTH_FILE" envDefault:""`                        // JSON файл с токенами доступа
+	AuthDB      bool      `env:"AUTH_DB" envDefault:"false"`                     // загружать токены из таблицы auth_tokens
+	MultiTenant bool      `env:"MULTI_TENANT" envDefault:"false"`                // изоляция метрик по тенантам
+	MaxTenants  int       `env:"MAX_TENANTS" envDefault:"100"`                   // максимум тенантов (0 - без ограничений)
+	MaxSeries   int       `env:"MAX_SERIES" envDefault:"0"`                      // лимит серий на тенанта (0 - без ограничений)
+
+	RateLimitRPS   float64 `env:"RATE_LIMIT_RPS" envDefault:"0"`    // запросов в секунду на клиента (0 - без ограничений)
+	RateLimitBurst int     `env:"RATE_LIMIT_BURST" envDefault:"10"` // размер всплеска запросов
+	RateLimitKey   string  `env:"RATE_LIMIT_KEY" envDefault:"ip"`   // идентификация клиента: ip, token или tenant
+	MaxBodySize    int64   `env:"MAX_BODY_SIZE" envDefault:"0"`     // максимальный размер тела запроса на обновление в байтах
+
+	AuditFile string `env:"AUDIT_FILE" envDefault:""` // файл аудита (JSON lines), пусто - выключено
+	AuditURL  string `env:"AUDIT_URL" envDefault:""`  // URL для отправки событий аудита, пусто - выключено
+
+	AlertRules    string `env:"ALERT_RULES" envDefault:""`      // файл правил алертинга (YAML/JSON), пусто - выключено
+	AlertInterval int    `env:"ALERT_INTERVAL" envDefault:"15"` // период вычисления правил, секунд
+
+	StaleWindow int  `env:"STALENESS_WINDOW" envDefault:"0"` // окно устаревания серий, секунд (0 - выключено)
+	HideStale   bool `env:"HIDE_STALE" envDefault:"false"`   // скрывать устаревшие серии при чтении
+
+	MetricTTL       int `env:"METRIC_TTL" envDefault:"0"`        // время жизни серии без обновлений, секунд (0 - бессрочно)
+	JanitorInterval int `env:"JANITOR_INTERVAL" envDefault:"60"` // период удаления истёкших серий, секунд
+	MaxFutureSkew   int `env:"MAX_FUTURE_SKEW" envDefault:"300"` // допустимое опережение меток времени, секунд (0 - без проверки)
+
+	IdempotencyTTL     int  `env:"IDEMPOTENCY_TTL" envDefault:"600"`        // время хранения Idempotency-Key, секунд (0 - выключено)
+	IdempotencyMaxKeys int  `env:"IDEMPOTENCY_MAX_KEYS" envDefault:"10000"` // максимум ключей в памяти
+	IdempotencyDB      bool `env:"IDEMPOTENCY_DB" envDefault:"false"`       // хранить ключи в таблице idempotency_keys
+
+	PersistMode     string `env:"PERSIST_MODE" envDefault:"async"`       // запись в хранилище: sync - в запросе, async - фоновым писателем
+	FlushDelayMs    int    `env:"FLUSH_DELAY_MS" envDefault:"1000"`      // максимальная задержка записи изменённой серии, мс
+	FlushBatch      int    `env:"FLUSH_BATCH" envDefault:"1000"`         // число изменённых серий для немедленной записи (0 - только по таймеру)
+	FlushMaxPending int    `env:"FLUSH_MAX_PENDING" envDefault:"100000"` // очередь изменённых серий, при которой обновления ждут писателя (0 - без ограничений)
+
+	SnapshotGenerations int    `env:"SNAPSHOT_GENERATIONS" envDefault:"3"`    // число хранимых снапшотов файла метрик, включая последний
+	SnapshotFormat      string `env:"SNAPSHOT_FORMAT" envDefault:"json"`      // формат снапшота: json или binary
+	SnapshotCompression string `env:"SNAPSHOT_COMPRESSION" envDefault:"none"` // сжатие снапшота: none или gzip
+	SnapshotKeyFile     string `env:"SNAPSHOT_KEY_FILE" envDefault:""`        // файл ключей AES для шифрования снапшота ("id=key" в строке)
+	SnapshotKey         string `env:"SNAPSHOT_KEY" envDefault:""`             // ключи AES в переменной окружения, приоритетнее файла (только env)
+
+	StorageShards    int    `env:"STORAGE_SHARDS" envDefault:"0"`                    // число сегментов in-memory хранилища со своими блокировками, 0 = одна блокировка
+	MetricNamePolicy string `env:"METRIC_NAME_POLICY" envDefault:"case-insensitive"` // сравнение имён метрик: case-insensitive, case-sensitive или prometheus
+	CounterMode      string `env:"COUNTER_MODE" envDefault:"local"`                  // счётчики: local - итоги в памяти, database - приращения складываются в БД (несколько реплик)
+	CounterCacheMs   int    `env:"COUNTER_CACHE_MS" envDefault:"1000"`               // сколько итоги счётчиков из БД отдаются из кеша, мс (0 - читать БД при каждом чтении)
+
+	TenantMaxSeries   map[string]int // переопределения MaxSeries по тенантам (из JSON)
+	MetricTTLPatterns map[string]int // TTL по шаблонам имён серий, секунд (из JSON)
 }
 
 // GetPort возвращает порт в формате ":8080"
@@ -127,15 +218,7 @@ func (o *ServerConfigs) ParseFlags() {
 	envConfigPath := o.ConfigPath
 
 	// Шаг 2: Определяем флаги командной строки
-	flag.Var(&o.Addr, "a", "Host and port for connect/create")
-	flag.IntVar(&o.StoreInter, "i", o.StoreInter, "Flush metrics interval")
-	flag.StringVar(&o.FilePath, "f", o.FilePath, "Metrics store file destination")
-	flag.StringVar(&o.DatabaseDSN, "d", o.DatabaseDSN, "DB connection string")
-	flag.StringVar(&o.Key, "k", o.Key, "Cipher key")
-	flag.StringVar(&o.CryptoKey, "crypto-key", o.CryptoKey, "Public key for https")
-	flag.BoolVar(&o.Restore, "r", o.Restore, "Restore metrics from json file")
-	flag.StringVar(&o.ConfigPath, "config", o.ConfigPath, "Path to JSON config file")
-	flag.StringVar(&o.ConfigPath, "c", o.ConfigPath, "Path to JSON config file (shorthand)")
+	o.defineFlags(flag.CommandLine)
 	flag.Parse()
 
 	// Шаг 3: Определяем путь к конфигу (ENV имеет приоритет)
@@ -161,79 +244,217 @@ func (o *ServerConfigs) ParseFlags() {
 	}
 }
 
+// defineFlags регистрирует флаги командной строки в указанном FlagSet.
+// Текущие значения полей (из env или значений по умолчанию) используются как значения флагов по умолчанию.
+func (o *ServerConfigs) defineFlags(fs *flag.FlagSet) {
+	fs.Var(&o.Addr, "a", "Host and port for connect/create")
+	fs.IntVar(&o.StoreInter, "i", o.StoreInter, "Flush metrics interval")
+	fs.StringVar(&o.FilePath, "f", o.FilePath, "Metrics store file destination")
+	fs.StringVar(&o.DatabaseDSN, "d", o.DatabaseDSN, "DB connection string")
+	fs.StringVar(&o.Key, "k", o.Key, "Cipher key")
+	fs.StringVar(&o.CryptoKey, "crypto-key", o.CryptoKey, "Public key for https")
+	fs.BoolVar(&o.Restore, "r", o.Restore, "Restore metrics from json file")
+	fs.StringVar(&o.ConfigPath, "config", o.ConfigPath, "Path to JSON config file")
+	fs.StringVar(&o.ConfigPath, "c", o.ConfigPath, "Path to JSON config file (shorthand)")
+	fs.StringVar(&o.AuthFile, "auth-file", o.AuthFile, "JSON file with API tokens")
+	fs.BoolVar(&o.AuthDB, "auth-db", o.AuthDB, "Load API tokens from the auth_tokens DB table")
+	fs.BoolVar(&o.MultiTenant, "multi-tenant", o.MultiTenant, "Isolate metrics by tenant (X-Tenant-ID header or token)")
+	fs.IntVar(&o.MaxTenants, "max-tenants", o.MaxTenants, "Maximum number of tenants (0 = unlimited)")
+	fs.IntVar(&o.MaxSeries, "max-series", o.MaxSeries, "Maximum number of series per tenant (0 = unlimited)")
+	fs.Float64Var(&o.RateLimitRPS, "rate-limit-rps", o.RateLimitRPS, "Update requests per second per client (0 = unlimited)")
+	fs.IntVar(&o.RateLimitBurst, "rate-limit-burst", o.RateLimitBurst, "Burst of update requests per client")
+	fs.StringVar(&o.RateLimitKey, "rate-limit-key", o.RateLimitKey, "Client identity for rate limiting: ip, token or tenant")
+	fs.Int64Var(&o.MaxBodySize, "max-body-size", o.MaxBodySize, "Maximum update request body size in bytes (0 = unlimited)")
+	fs.StringVar(&o.AuditFile, "audit-file", o.AuditFile, "Append audit events to this file (JSON lines)")
+	fs.StringVar(&o.AuditURL, "audit-url", o.AuditURL, "POST audit events to this URL")
+	fs.StringVar(&o.AlertRules, "alert-rules", o.AlertRules, "Alerting rules file (YAML or JSON)")
+	fs.IntVar(&o.AlertInterval, "alert-interval", o.AlertInterval, "Alerting rules evaluation interval in seconds")
+	fs.IntVar(&o.StaleWindow, "staleness-window", o.StaleWindow, "Seconds without updates after which a series is stale (0 = disabled)")
+	fs.BoolVar(&o.HideStale, "hide-stale", o.HideStale, "Hide stale series from read endpoints")
+	fs.IntVar(&o.MetricTTL, "metric-ttl", o.MetricTTL, "Seconds after the last update when a series expires (0 = never)")
+	fs.IntVar(&o.JanitorInterval, "janitor-interval", o.JanitorInterval, "Expired series eviction interval in seconds")
+	fs.IntVar(&o.MaxFutureSkew, "max-future-skew", o.MaxFutureSkew, "Seconds a sample timestamp may be ahead of the server clock (0 = unchecked)")
+	fs.IntVar(&o.IdempotencyTTL, "idempotency-ttl", o.IdempotencyTTL, "Seconds processed Idempotency-Keys are remembered (0 = disabled)")
+	fs.IntVar(&o.IdempotencyMaxKeys, "idempotency-max-keys", o.IdempotencyMaxKeys, "Maximum number of Idempotency-Keys kept in memory")
+	fs.BoolVar(&o.IdempotencyDB, "idempotency-db", o.IdempotencyDB, "Keep Idempotency-Keys in the idempotency_keys table")
+	fs.StringVar(&o.PersistMode, "persist-mode", o.PersistMode, "Persistence mode: sync (in the request) or async (background writer)")
+	fs.IntVar(&o.FlushDelayMs, "flush-delay-ms", o.FlushDelayMs, "Longest delay in milliseconds before an updated series is persisted")
+	fs.IntVar(&o.FlushBatch, "flush-batch", o.FlushBatch, "Updated series that trigger an immediate write (0 = timer only)")
+	fs.IntVar(&o.FlushMaxPending, "flush-max-pending", o.FlushMaxPending, "Unwritten series at which updates wait for the writer (0 = unbounded)")
+	fs.IntVar(&o.SnapshotGenerations, "snapshot-generations", o.SnapshotGenerations, "Metrics file snapshots kept, the latest included")
+	fs.StringVar(&o.SnapshotFormat, "snapshot-format", o.SnapshotFormat, "Metrics file snapshot format: json or binary")
+	fs.StringVar(&o.SnapshotCompression, "snapshot-compression", o.SnapshotCompression, "Metrics file snapshot compression: none or gzip")
+	fs.StringVar(&o.SnapshotKeyFile, "snapshot-key-file", o.SnapshotKeyFile, "File with AES keys (id=key per line, active first) to encrypt the metrics file")
+	fs.IntVar(&o.StorageShards, "storage-shards", o.StorageShards, "Shards of the in-memory storage, each with its own lock (0 = one lock)")
+	fs.StringVar(&o.MetricNamePolicy, "metric-name-policy", o.MetricNamePolicy, "Metric name policy: case-insensitive, case-sensitive or prometheus")
+	fs.StringVar(&o.CounterMode, "counter-mode", o.CounterMode, "Counter mode: local (totals in memory) or database (increments added in the database, for several replicas)")
+	fs.IntVar(&o.CounterCacheMs, "counter-cache-ms", o.CounterCacheMs, "How long counter totals read from the database are cached in milliseconds (0 = read on every request)")
+}
+
 // applyJSONConfig применяет значения из JSON конфига.
 // Значение применяется только если флаг НЕ передан и env НЕ установлен.
 func (o *ServerConfigs) applyJSONConfig(cfg *JSONConfig) {
-	if cfg.Address != "" && !isFlagPassed("a") && os.Getenv("ADDRESS") == "" {
+	o.applyJSONConfigWith(cfg, isFlagPassed)
+}
+
+// applyJSONConfigFromSet применяет значения из JSON конфига для указанного FlagSet.
+// Используется в тестах с отдельным FlagSet.
+func (o *ServerConfigs) applyJSONConfigFromSet(cfg *JSONConfig, fs *flag.FlagSet) {
+	o.applyJSONConfigWith(cfg, func(name string) bool { return isFlagPassedInSet(fs, name) })
+}
+
+// applyJSONConfigWith применяет значения из JSON конфига, используя passed
+// для проверки, был ли флаг явно передан.
+func (o *ServerConfigs) applyJSONConfigWith(cfg *JSONConfig, passed func(name string) bool) {
+	if cfg.Address != "" && !passed("a") && os.Getenv("ADDRESS") == "" {
 		_ = o.Addr.Set(cfg.Address)
 	}
-	if cfg.StoreInterval != "" && !isFlagPassed("i") && os.Getenv("STORE_INTERVAL") == "" {
+	if cfg.StoreInterval != "" && !passed("i") && os.Getenv("STORE_INTERVAL") == "" {
 		if interval, err := parseInterval(cfg.StoreInterval); err == nil {
 			o.StoreInter = interval
 		}
 	}
-	if cfg.StoreFile != "" && !isFlagPassed("f") && os.Getenv("FILE_STORAGE_PATH") == "" {
+	if cfg.StoreFile != "" && !passed("f") && os.Getenv("FILE_STORAGE_PATH") == "" {
 		o.FilePath = cfg.StoreFile
 	}
-	if cfg.Restore != nil && !isFlagPassed("r") && os.Getenv("RESTORE") == "" {
+	if cfg.Restore != nil && !passed("r") && os.Getenv("RESTORE") == "" {
 		o.Restore = *cfg.Restore
 	}
-	if cfg.DatabaseDSN != "" && !isFlagPassed("d") && os.Getenv("DATABASE_DSN") == "" {
+	if cfg.DatabaseDSN != "" && !passed("d") && os.Getenv("DATABASE_DSN") == "" {
 		o.DatabaseDSN = cfg.DatabaseDSN
 	}
-	if cfg.CryptoKey != "" && !isFlagPassed("crypto-key") && os.Getenv("CRYPTO_KEY") == "" {
+	if cfg.CryptoKey != "" && !passed("crypto-key") && os.Getenv("CRYPTO_KEY") == "" {
 		o.CryptoKey = cfg.CryptoKey
 	}
-}
-
-// applyJSONConfigFromSet применяет значения из JSON конфига для указанного FlagSet.
-// Используется в тестах с отдельным FlagSet.
-func (o *ServerConfigs) applyJSONConfigFromSet(cfg *JSONConfig, fs *flag.FlagSet) {
-	if cfg.Address != "" && !isFlagPassedInSet(fs, "a") && os.Getenv("ADDRESS") == "" {
-		_ = o.Addr.Set(cfg.Address)
+	if cfg.AuthFile != "" && !passed("auth-file") && os.Getenv("AUTH_FILE") == "" {
+		o.AuthFile = cfg.AuthFile
 	}
-	if cfg.StoreInterval != "" && !isFlagPassedInSet(fs, "i") && os.Getenv("STORE_INTERVAL") == "" {
-		if interval, err := parseInterval(cfg.StoreInterval); err == nil {
-			o.StoreInter = interval
-		}
+	if cfg.AuthDB != nil && !passed("auth-db") && os.Getenv("AUTH_DB") == "" {
+		o.AuthDB = *cfg.AuthDB
 	}
-	if cfg.StoreFile != "" && !isFlagPassedInSet(fs, "f") && os.Getenv("FILE_STORAGE_PATH") == "" {
-		o.FilePath = cfg.StoreFile
+	if cfg.MultiTenant != nil && !passed("multi-tenant") && os.Getenv("MULTI_TENANT") == "" {
+		o.MultiTenant = *cfg.MultiTenant
 	}
-	if cfg.Restore != nil && !isFlagPassedInSet(fs, "r") && os.Getenv("RESTORE") == "" {
-		o.Restore = *cfg.Restore
+	if cfg.MaxTenants != nil && !passed("max-tenants") && os.Getenv("MAX_TENANTS") == "" {
+		o.MaxTenants = *cfg.MaxTenants
 	}
-	if cfg.DatabaseDSN != "" && !isFlagPassedInSet(fs, "d") && os.Getenv("DATABASE_DSN") == "" {
-		o.DatabaseDSN = cfg.DatabaseDSN
+	if cfg.MaxSeries != nil && !passed("max-series") && os.Getenv("MAX_SERIES") == "" {
+		o.MaxSeries = *cfg.MaxSeries
 	}
-	if cfg.CryptoKey != "" && !isFlagPassedInSet(fs, "crypto-key") && os.Getenv("CRYPTO_KEY") == "" {
-		o.CryptoKey = cfg.CryptoKey
+	if cfg.RateLimitRPS != nil && !passed("rate-limit-rps") && os.Getenv("RATE_LIMIT_RPS") == "" {
+		o.RateLimitRPS = *cfg.RateLimitRPS
+	}
+	if cfg.RateLimitBurst != nil && !passed("rate-limit-burst") && os.Getenv("RATE_LIMIT_BURST") == "" {
+		o.RateLimitBurst = *cfg.RateLimitBurst
+	}
+	if cfg.RateLimitKey != "" && !passed("rate-limit-key") && os.Getenv("RATE_LIMIT_KEY") == "" {
+		o.RateLimitKey = cfg.RateLimitKey
+	}
+	if cfg.MaxBodySize != nil && !passed("max-body-size") && os.Getenv("MAX_BODY_SIZE") == "" {
+		o.MaxBodySize = *cfg.MaxBodySize
+	}
+	if cfg.AuditFile != "" && !passed("audit-file") && os.Getenv("AUDIT_FILE") == "" {
+		o.AuditFile = cfg.AuditFile
+	}
+	if cfg.AuditURL != "" && !passed("audit-url") && os.Getenv("AUDIT_URL") == "" {
+		o.AuditURL = cfg.AuditURL
+	}
+	if cfg.AlertRules != "" && !passed("alert-rules") && os.Getenv("ALERT_RULES") == "" {
+		o.AlertRules = cfg.AlertRules
+	}
+	if cfg.AlertInterval != nil && !passed("alert-interval") && os.Getenv("ALERT_INTERVAL") == "" {
+		o.AlertInterval = *cfg.AlertInterval
+	}
+	if cfg.StaleWindow != nil && !passed("staleness-window") && os.Getenv("STALENESS_WINDOW") == "" {
+		o.StaleWindow = *cfg.StaleWindow
+	}
+	if cfg.HideStale != nil && !passed("hide-stale") && os.Getenv("HIDE_STALE") == "" {
+		o.HideStale = *cfg.HideStale
+	}
+	if cfg.MetricTTL != nil && !passed("metric-ttl") && os.Getenv("METRIC_TTL") == "" {
+		o.MetricTTL = *cfg.MetricTTL
+	}
+	if cfg.JanitorInterval != nil && !passed("janitor-interval") && os.Getenv("JANITOR_INTERVAL") == "" {
+		o.JanitorInterval = *cfg.JanitorInterval
+	}
+	if cfg.MaxFutureSkew != nil && !passed("max-future-skew") && os.Getenv("MAX_FUTURE_SKEW") == "" {
+		o.MaxFutureSkew = *cfg.MaxFutureSkew
+	}
+	if cfg.IdempotencyTTL != nil && !passed("idempotency-ttl") && os.Getenv("IDEMPOTENCY_TTL") == "" {
+		o.IdempotencyTTL = *cfg.IdempotencyTTL
+	}
+	if cfg.IdempotencyMaxKeys != nil && !passed("idempotency-max-keys") && os.Getenv("IDEMPOTENCY_MAX_KEYS") == "" {
+		o.IdempotencyMaxKeys = *cfg.IdempotencyMaxKeys
+	}
+	if cfg.IdempotencyDB != nil && !passed("idempotency-db") && os.Getenv("IDEMPOTENCY_DB") == "" {
+		o.IdempotencyDB = *cfg.IdempotencyDB
+	}
+	if cfg.PersistMode != "" && !passed("persist-mode") && os.Getenv("PERSIST_MODE") == "" {
+		o.PersistMode = cfg.PersistMode
+	}
+	if cfg.FlushDelayMs != nil && !passed("flush-delay-ms") && os.Getenv("FLUSH_DELAY_MS") == "" {
+		o.FlushDelayMs = *cfg.FlushDelayMs
+	}
+	if cfg.FlushBatch != nil && !passed("flush-batch") && os.Getenv("FLUSH_BATCH") == "" {
+		o.FlushBatch = *cfg.FlushBatch
+	}
+	if cfg.FlushMaxPending != nil && !passed("flush-max-pending") && os.Getenv("FLUSH_MAX_PENDING") == "" {
+		o.FlushMaxPending = *cfg.FlushMaxPending
+	}
+	if cfg.SnapshotGenerations != nil && !passed("snapshot-generations") && os.Getenv("SNAPSHOT_GENERATIONS") == "" {
+		o.SnapshotGenerations = *cfg.SnapshotGenerations
+	}
+	if cfg.SnapshotFormat != "" && !passed("snapshot-format") && os.Getenv("SNAPSHOT_FORMAT") == "" {
+		o.SnapshotFormat = cfg.SnapshotFormat
+	}
+	if cfg.SnapshotCompression != "" && !passed("snapshot-compression") && os.Getenv("SNAPSHOT_COMPRESSION") == "" {
+		o.SnapshotCompression = cfg.SnapshotCompression
+	}
+	if cfg.SnapshotKeyFile != "" && !passed("snapshot-key-file") && os.Getenv("SNAPSHOT_KEY_FILE") == "" {
+		o.SnapshotKeyFile = cfg.SnapshotKeyFile
+	}
+	if cfg.StorageShards != nil && !passed("storage-shards") && os.Getenv("STORAGE_SHARDS") == "" {
+		o.StorageShards = *cfg.StorageShards
+	}
+	if cfg.MetricNamePolicy != "" && !passed("metric-name-policy") && os.Getenv("METRIC_NAME_POLICY") == "" {
+		o.MetricNamePolicy = cfg.MetricNamePolicy
+	}
+	if cfg.CounterMode != "" && !passed("counter-mode") && os.Getenv("COUNTER_MODE") == "" {
+		o.CounterMode = cfg.CounterMode
+	}
+	if cfg.CounterCacheMs != nil && !passed("counter-cache-ms") && os.Getenv("COUNTER_CACHE_MS") == "" {
+		o.CounterCacheMs = *cfg.CounterCacheMs
+	}
+	if cfg.TenantMaxSeries != nil {
+		o.TenantMaxSeries = cfg.TenantMaxSeries
+	}
+	if cfg.MetricTTLPatterns != nil {
+		o.MetricTTLPatterns = cfg.MetricTTLPatterns
 	}
 }
 
 // ParseFlagsFromArgs - хелпер для тестирования с кастомными аргументами.
 // Работает аналогично ParseFlags, но использует отдельный FlagSet.
 func (o *ServerConfigs) ParseFlagsFromArgs(args []string) error {
+	_, err := o.ParseCommandArgs("test-server", args)
+	return err
+}
+
+// ParseCommandArgs разбирает настройки подкоманды name (например, "migrate")
+// так же, как ParseFlags, и возвращает оставшиеся позиционные аргументы.
+func (o *ServerConfigs) ParseCommandArgs(name string, args []string) ([]string, error) {
 	if err := env.Parse(o); err != nil {
-		return err
+		return nil, err
 	}
 
 	envKey := o.Key
 	envConfigPath := o.ConfigPath
 
-	fs := flag.NewFlagSet("test-server", flag.ContinueOnError)
-	fs.Var(&o.Addr, "a", "Host and port for connect/create")
-	fs.IntVar(&o.StoreInter, "i", o.StoreInter, "Flush metrics interval")
-	fs.StringVar(&o.FilePath, "f", o.FilePath, "Metrics store file destination")
-	fs.StringVar(&o.DatabaseDSN, "d", o.DatabaseDSN, "DB connection string")
-	fs.StringVar(&o.Key, "k", o.Key, "Cipher key")
-	fs.StringVar(&o.CryptoKey, "crypto-key", o.CryptoKey, "Public key for https")
-	fs.BoolVar(&o.Restore, "r", o.Restore, "Restore metrics from json file")
-	fs.StringVar(&o.ConfigPath, "config", o.ConfigPath, "Path to JSON config file")
-	fs.StringVar(&o.ConfigPath, "c", o.ConfigPath, "Path to JSON config file (shorthand)")
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	o.defineFlags(fs)
 
 	if err := fs.Parse(args); err != nil {
-		return err
+		return nil, err
 	}
 
 	configPath := o.ConfigPath
@@ -243,7 +464,7 @@ func (o *ServerConfigs) ParseFlagsFromArgs(args []string) error {
 
 	jsonCfg, err := loadJSONConfig(configPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if jsonCfg != nil {
@@ -254,5 +475,5 @@ func (o *ServerConfigs) ParseFlagsFromArgs(args []string) error {
 		o.Key = envKey
 	}
 
-	return nil
+	return fs.Args(), nil
 }
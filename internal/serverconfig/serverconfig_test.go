@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // createTempConfigFile создаёт временный JSON файл конфигурации для тестов.
@@ -26,6 +27,15 @@ func createTempConfigFile(t *testing.T, cfg JSONConfig) string {
 // Используется для JSON конфигурации, где nil означает "не задано".
 func boolPtr(b bool) *bool { return &b }
 
+// intPtr возвращает указатель на int значение.
+func intPtr(i int) *int { return &i }
+
+// int64Ptr возвращает указатель на int64 значение.
+func int64Ptr(i int64) *int64 { return &i }
+
+// float64Ptr возвращает указатель на float64 значение.
+func float64Ptr(f float64) *float64 { return &f }
+
 // TestServerConfigs_ParseFlagsFromArgs проверяет парсинг конфигурации с учётом приоритетов:
 //  1. Флаги командной строки (высший приоритет)
 //  2. Переменные окружения
@@ -122,6 +132,155 @@ func TestServerConfigs_ParseFlagsFromArgs(t *testing.T) {
 				CryptoKey: "/env/crypto.pem", DatabaseDSN: "postgres://json/db", Restore: true,
 			},
 		},
+		{
+			name: "Auth options: flag > JSON",
+			args: []string{"-auth-file", "/flag/tokens.json"},
+			jsonConfig: &JSONConfig{
+				AuthFile: "/json/tokens.json", AuthDB: boolPtr(true),
+			},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				AuthFile: "/flag/tokens.json", AuthDB: true,
+			},
+		},
+		{
+			name: "Tenant options: env > JSON",
+			env:  map[string]string{"MAX_SERIES": "50"},
+			jsonConfig: &JSONConfig{
+				MultiTenant: boolPtr(true), MaxTenants: intPtr(5), MaxSeries: intPtr(10),
+				TenantMaxSeries: map[string]int{"teama": 1000},
+			},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				MultiTenant: true, MaxTenants: 5, MaxSeries: 50,
+				TenantMaxSeries: map[string]int{"teama": 1000},
+			},
+		},
+		{
+			name: "Rate limit options: flag > env > JSON",
+			args: []string{"-rate-limit-rps=5"},
+			env:  map[string]string{"RATE_LIMIT_KEY": "token"},
+			jsonConfig: &JSONConfig{
+				RateLimitRPS: float64Ptr(1), RateLimitBurst: intPtr(3), RateLimitKey: "tenant",
+				MaxBodySize: int64Ptr(1 << 20),
+			},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				RateLimitRPS: 5, RateLimitBurst: 3, RateLimitKey: "token", MaxBodySize: 1 << 20,
+			},
+		},
+		{
+			name:       "Audit options: flag > JSON",
+			args:       []string{"-audit-url=http://flag/audit"},
+			jsonConfig: &JSONConfig{AuditFile: "/json/audit.log", AuditURL: "http://json/audit"},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				AuditFile: "/json/audit.log", AuditURL: "http://flag/audit",
+			},
+		},
+		{
+			name:       "Alerting options: env > JSON",
+			env:        map[string]string{"ALERT_INTERVAL": "30"},
+			jsonConfig: &JSONConfig{AlertRules: "/json/rules.yaml", AlertInterval: intPtr(5)},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				AlertRules: "/json/rules.yaml", AlertInterval: 30,
+			},
+		},
+		{
+			name:       "Staleness options: flag > JSON",
+			args:       []string{"-staleness-window=120"},
+			jsonConfig: &JSONConfig{StaleWindow: intPtr(60), HideStale: boolPtr(true)},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				StaleWindow: 120, HideStale: true,
+			},
+		},
+		{
+			name: "TTL options: env > JSON",
+			env:  map[string]string{"METRIC_TTL": "600"},
+			jsonConfig: &JSONConfig{
+				MetricTTL: intPtr(60), JanitorInterval: intPtr(10),
+				MetricTTLPatterns: map[string]int{"batch_*": 3600},
+			},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				MetricTTL: 600, JanitorInterval: 10,
+				MetricTTLPatterns: map[string]int{"batch_*": 3600},
+			},
+		},
+		{
+			name:       "Future skew: flag > JSON",
+			args:       []string{"-max-future-skew=10"},
+			jsonConfig: &JSONConfig{MaxFutureSkew: intPtr(30)},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				MaxFutureSkew: 10,
+			},
+		},
+		{
+			name:       "Future skew from JSON",
+			jsonConfig: &JSONConfig{MaxFutureSkew: intPtr(30)},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				MaxFutureSkew: 30,
+			},
+		},
+		{
+			name: "Idempotency options: env > flag > JSON",
+			env:  map[string]string{"IDEMPOTENCY_TTL": "60"},
+			args: []string{"-idempotency-max-keys=500"},
+			jsonConfig: &JSONConfig{
+				IdempotencyTTL: intPtr(30), IdempotencyMaxKeys: intPtr(100), IdempotencyDB: boolPtr(true),
+			},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				IdempotencyTTL: 60, IdempotencyMaxKeys: 500, IdempotencyDB: true,
+			},
+		},
+		{
+			name: "Flush options: env > flag > JSON",
+			env:  map[string]string{"FLUSH_DELAY_MS": "250"},
+			args: []string{"-persist-mode=sync"},
+			jsonConfig: &JSONConfig{
+				PersistMode: "async", FlushDelayMs: intPtr(5000), FlushBatch: intPtr(50), FlushMaxPending: intPtr(500),
+			},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				PersistMode: "sync", FlushDelayMs: 250, FlushBatch: 50, FlushMaxPending: 500,
+			},
+		},
+		{
+			name: "Snapshot options: flag > JSON",
+			args: []string{"-snapshot-compression=gzip"},
+			jsonConfig: &JSONConfig{
+				SnapshotGenerations: intPtr(5), SnapshotFormat: "binary", SnapshotCompression: "none",
+				SnapshotKeyFile: "/etc/gometrics/snapshot.keys",
+			},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				SnapshotGenerations: 5, SnapshotFormat: "binary", SnapshotCompression: "gzip",
+				SnapshotKeyFile: "/etc/gometrics/snapshot.keys",
+			},
+		},
+		{
+			name:       "Storage shards: env > JSON",
+			env:        map[string]string{"STORAGE_SHARDS": "64"},
+			jsonConfig: &JSONConfig{StorageShards: intPtr(4), MetricNamePolicy: "prometheus"},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				StorageShards: 64, MetricNamePolicy: "prometheus",
+			},
+		},
+		{
+			name:       "Counter mode: env > JSON",
+			env:        map[string]string{"COUNTER_CACHE_MS": "0"},
+			jsonConfig: &JSONConfig{CounterMode: "database", CounterCacheMs: intPtr(250)},
+			want: ServerConfigs{
+				StoreInter: 300, FilePath: "metrics_storage", Restore: true,
+				CounterMode: "database", CounterCacheMs: 0,
+			},
+		},
 		{
 			name:       "JSON via CONFIG env var",
 			env:        map[string]string{},
@@ -167,6 +326,61 @@ func TestServerConfigs_ParseFlagsFromArgs(t *testing.T) {
 			assert.Equal(t, tt.want.DatabaseDSN, cfg.DatabaseDSN, "DatabaseDSN")
 			assert.Equal(t, tt.want.Key, cfg.Key, "Key")
 			assert.Equal(t, tt.want.CryptoKey, cfg.CryptoKey, "CryptoKey")
+			assert.Equal(t, tt.want.AuthFile, cfg.AuthFile, "AuthFile")
+			assert.Equal(t, tt.want.AuthDB, cfg.AuthDB, "AuthDB")
+			assert.Equal(t, tt.want.MultiTenant, cfg.MultiTenant, "MultiTenant")
+			assert.Equal(t, tt.want.MaxSeries, cfg.MaxSeries, "MaxSeries")
+			assert.Equal(t, tt.want.TenantMaxSeries, cfg.TenantMaxSeries, "TenantMaxSeries")
+			assert.Equal(t, tt.want.RateLimitRPS, cfg.RateLimitRPS, "RateLimitRPS")
+			assert.Equal(t, tt.want.MaxBodySize, cfg.MaxBodySize, "MaxBodySize")
+			assert.Equal(t, tt.want.AuditFile, cfg.AuditFile, "AuditFile")
+			assert.Equal(t, tt.want.AuditURL, cfg.AuditURL, "AuditURL")
+			assert.Equal(t, tt.want.AlertRules, cfg.AlertRules, "AlertRules")
+			assert.Equal(t, tt.want.StaleWindow, cfg.StaleWindow, "StaleWindow")
+			assert.Equal(t, tt.want.HideStale, cfg.HideStale, "HideStale")
+			assert.Equal(t, tt.want.MetricTTL, cfg.MetricTTL, "MetricTTL")
+			assert.Equal(t, tt.want.MetricTTLPatterns, cfg.MetricTTLPatterns, "MetricTTLPatterns")
+			assert.Equal(t, tt.want.IdempotencyDB, cfg.IdempotencyDB, "IdempotencyDB")
+			if tt.want.IdempotencyTTL != 0 {
+				assert.Equal(t, tt.want.IdempotencyTTL, cfg.IdempotencyTTL, "IdempotencyTTL")
+				assert.Equal(t, tt.want.IdempotencyMaxKeys, cfg.IdempotencyMaxKeys, "IdempotencyMaxKeys")
+			}
+			if tt.want.PersistMode != "" {
+				assert.Equal(t, tt.want.PersistMode, cfg.PersistMode, "PersistMode")
+				assert.Equal(t, tt.want.FlushDelayMs, cfg.FlushDelayMs, "FlushDelayMs")
+				assert.Equal(t, tt.want.FlushBatch, cfg.FlushBatch, "FlushBatch")
+				assert.Equal(t, tt.want.FlushMaxPending, cfg.FlushMaxPending, "FlushMaxPending")
+			}
+			if tt.want.SnapshotGenerations != 0 {
+				assert.Equal(t, tt.want.SnapshotGenerations, cfg.SnapshotGenerations, "SnapshotGenerations")
+				assert.Equal(t, tt.want.SnapshotFormat, cfg.SnapshotFormat, "SnapshotFormat")
+				assert.Equal(t, tt.want.SnapshotCompression, cfg.SnapshotCompression, "SnapshotCompression")
+				assert.Equal(t, tt.want.SnapshotKeyFile, cfg.SnapshotKeyFile, "SnapshotKeyFile")
+			}
+			if tt.want.StorageShards != 0 {
+				assert.Equal(t, tt.want.StorageShards, cfg.StorageShards, "StorageShards")
+				assert.Equal(t, tt.want.MetricNamePolicy, cfg.MetricNamePolicy, "MetricNamePolicy")
+			}
+			if tt.want.CounterMode != "" {
+				assert.Equal(t, tt.want.CounterMode, cfg.CounterMode, "CounterMode")
+				assert.Equal(t, tt.want.CounterCacheMs, cfg.CounterCacheMs, "CounterCacheMs")
+			}
+			if tt.want.MaxFutureSkew != 0 {
+				assert.Equal(t, tt.want.MaxFutureSkew, cfg.MaxFutureSkew, "MaxFutureSkew")
+			}
+			if tt.want.JanitorInterval != 0 {
+				assert.Equal(t, tt.want.JanitorInterval, cfg.JanitorInterval, "JanitorInterval")
+			}
+			if tt.want.AlertInterval != 0 {
+				assert.Equal(t, tt.want.AlertInterval, cfg.AlertInterval, "AlertInterval")
+			}
+			if tt.want.RateLimitKey != "" {
+				assert.Equal(t, tt.want.RateLimitKey, cfg.RateLimitKey, "RateLimitKey")
+				assert.Equal(t, tt.want.RateLimitBurst, cfg.RateLimitBurst, "RateLimitBurst")
+			}
+			if tt.want.MaxTenants != 0 {
+				assert.Equal(t, tt.want.MaxTenants, cfg.MaxTenants, "MaxTenants")
+			}
 		})
 	}
 }
@@ -187,6 +401,17 @@ func TestServerConfigs_ParseFlags(t *testing.T) {
 	assert.Equal(t, true, cfg.Restore)
 }
 
+// TestServerConfigs_ParseCommandArgs проверяет разбор флагов подкоманды и её позиционных аргументов.
+func TestServerConfigs_ParseCommandArgs(t *testing.T) {
+	os.Clearenv()
+
+	cfg := InitialFlags()
+	rest, err := cfg.ParseCommandArgs("migrate", []string{"-d", "postgres://host/db", "down", "2"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"down", "2"}, rest)
+	assert.Equal(t, "postgres://host/db", cfg.DatabaseDSN)
+}
+
 // TestParseInterval проверяет парсинг строк интервала в секунды.
 func TestParseInterval(t *testing.T) {
 	tests := []struct {
@@ -0,0 +1,428 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+	memstorage "gometrics/internal/storage"
+)
+
+// ErrInvalidMetric is wrapped by item errors of malformed batch entries.
+var ErrInvalidMetric = errors.New("invalid metric")
+
+// ItemError describes why one entry of a batch was rejected.
+type ItemError struct {
+	Index int    `json:"index"` // position of the entry in the batch
+	ID    string `json:"id"`
+	MType string `json:"type"`
+	Err   error  `json:"-"`
+}
+
+// Error implements error.
+func (e ItemError) Error() string {
+	return fmt.Sprintf("[%d] %s %s: %v", e.Index, e.MType, e.ID, e.Err)
+}
+
+// Unwrap returns the cause of the rejection.
+func (e ItemError) Unwrap() error { return e.Err }
+
+// BatchError is returned when a batch fails validation. Nothing of the batch is applied.
+type BatchError struct {
+	Size   int                    // number of entries in the batch
+	Items  []ItemError            // rejected entries in batch order
+	Result metricsdto.BatchResult // status of every entry
+}
+
+// Error implements error.
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Items))
+	for i, item := range e.Items {
+		msgs[i] = item.Error()
+	}
+	return fmt.Sprintf("%d of %d metrics rejected: %s", len(e.Items), e.Size, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the item errors, so errors.Is matches their causes (e.g. ErrFutureTimestamp).
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Items))
+	for i, item := range e.Items {
+		errs[i] = item
+	}
+	return errs
+}
+
+// batchItem is a validated batch entry.
+type batchItem struct {
+	metric metricsdto.Metrics
+	update memstorage.Update
+	at     time.Time // sample time, zero = now
+}
+
+// prior is the state of a series before a batch, used to roll the batch back.
+type prior struct {
+	mtype, name string
+	exists      bool
+	value       float64 // gauge value
+	delta       int     // sum of the batch increments of a counter
+	stamp       time.Time
+	written     float64   // gauge value written by the batch
+	stamped     time.Time // sample time recorded by the batch
+	expiry      expiry    // expiry before the batch, if expires
+	expires     bool
+	refreshed   expiry // expiry set by the batch
+}
+
+// validateMetric checks the fields of a batch entry.
+func (s *Service) validateMetric(metric metricsdto.Metrics) error {
+	if metric.ID == "" {
+		return fmt.Errorf("%w: empty id", ErrInvalidMetric)
+	}
+	if err := CheckType(metric.MType); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMetric, err)
+	}
+	if metric.TTL != nil && *metric.TTL < 0 {
+		return fmt.Errorf("%w: negative ttl %d", ErrInvalidMetric, *metric.TTL)
+	}
+	return s.checkTimestamp(metric)
+}
+
+// prepareBatch validates a batch and converts it to storage updates.
+// Gauge samples older than the last accepted one are dropped (last write wins).
+// The result lists the status of every entry; entries of items are provisionally accepted.
+// It must be called with the series locks of the batch held; newSeries admits
+// the series the batch creates.
+func (s *Service) prepareBatch(metrics []metricsdto.Metrics, newSeries *newSeries) ([]batchItem, []ItemError, metricsdto.BatchResult) {
+	var rejected []ItemError
+	items := make([]batchItem, 0, len(metrics))
+	result := metricsdto.BatchResult{Items: make([]metricsdto.ItemResult, len(metrics))}
+	latest := make(map[string]time.Time) // last accepted gauge sample time in this batch
+	for i, metric := range metrics {
+		metric.ID = s.names.Name(metric.ID)
+		result.Items[i] = metricsdto.ItemResult{Index: i, ID: metric.ID, MType: metric.MType, Status: metricsdto.ItemAccepted}
+		err := s.validateMetric(metric)
+		if err == nil {
+			err = s.checkBatchSeries(metric, newSeries)
+		}
+		if err != nil {
+			rejected = append(rejected, ItemError{Index: i, ID: metric.ID, MType: metric.MType, Err: err})
+			result.Items[i].Status, result.Items[i].Error = metricsdto.ItemRejected, err.Error()
+			continue
+		}
+
+		key := s.expiryKey(metric.MType, metric.ID)
+		at := sampleTimeOf(metric)
+		item := batchItem{metric: metric, at: at, update: memstorage.Update{Key: metric.ID}}
+		if metric.MType == metricsdto.MetricTypeGauge {
+			sampled := at
+			if sampled.IsZero() {
+				sampled = time.Now()
+			}
+			last, seen := latest[key]
+			if seen && sampled.Before(last) || !seen && !s.supersedes(metric.MType, metric.ID, at) {
+				result.Items[i].Status = metricsdto.ItemDeduplicated
+				continue
+			}
+			latest[key] = sampled
+			if metric.Value != nil {
+				item.update.Value = *metric.Value
+			}
+		} else {
+			item.update.Counter = true
+			if metric.Delta != nil {
+				item.update.Delta = int(*metric.Delta)
+			}
+		}
+		items = append(items, item)
+	}
+	return items, rejected, result
+}
+
+// newSeries counts the series created by a batch. The first one locks
+// s.limitMu until release, after the batch is applied, so that checking the
+// limit and creating the series is atomic across concurrent batches.
+type newSeries struct {
+	mu   *sync.Mutex
+	keys map[string]bool
+	held bool
+}
+
+// lock locks the series limit once per batch.
+func (n *newSeries) lock() {
+	if !n.held {
+		n.mu.Lock()
+		n.held = true
+	}
+}
+
+// release unlocks the series limit. It is safe to call more than once.
+func (n *newSeries) release() {
+	if n.held {
+		n.held = false
+		n.mu.Unlock()
+	}
+}
+
+// checkBatchSeries returns ErrSeriesLimit if the entry creates a series beyond the limit,
+// counting the series already created by earlier entries of the batch.
+func (s *Service) checkBatchSeries(metric metricsdto.Metrics, newSeries *newSeries) error {
+	if s.maxSeries <= 0 {
+		return nil
+	}
+	key := s.expiryKey(metric.MType, metric.ID)
+	if newSeries.keys[key] || s.seriesExists(metric.MType, metric.ID) {
+		return nil
+	}
+	// Lock before counting: the series of other batches are created under it.
+	newSeries.lock()
+	if s.store.Len()+len(newSeries.keys) >= s.maxSeries {
+		return fmt.Errorf("%w: %d series", ErrSeriesLimit, s.maxSeries)
+	}
+	if newSeries.keys == nil {
+		newSeries.keys = make(map[string]bool)
+	}
+	newSeries.keys[key] = true
+	return nil
+}
+
+func (s *Service) seriesExists(mtype, name string) bool {
+	var err error
+	if mtype == metricsdto.MetricTypeGauge {
+		_, err = s.store.GetGauge(name)
+	} else {
+		_, err = s.store.GetCounter(name)
+	}
+	return err == nil
+}
+
+// priorState records the series touched by a batch before it is applied.
+func (s *Service) priorState(items []batchItem) []prior {
+	byKey := make(map[string]int)
+	var prev []prior
+	for _, item := range items {
+		m := item.metric
+		key := s.expiryKey(m.MType, m.ID)
+		i, ok := byKey[key]
+		if !ok {
+			p := prior{mtype: m.MType, name: m.ID}
+			p.stamp, _ = s.lastStamp(m.MType, m.ID)
+			p.expiry, p.expires = s.expiryOf(m.MType, m.ID)
+			if m.MType == metricsdto.MetricTypeGauge {
+				v, err := s.store.GetGauge(m.ID)
+				p.exists, p.value = err == nil, v
+			} else {
+				p.exists = s.seriesExists(m.MType, m.ID)
+			}
+			i = len(prev)
+			byKey[key] = i
+			prev = append(prev, p)
+		}
+		prev[i].delta += item.update.Delta
+		prev[i].written = item.update.Value
+	}
+	return prev
+}
+
+// rollback restores the series touched by a batch that could not be persisted.
+// It must be called with the series locks of prev held. Counters are decremented rather than
+// reset, keeping concurrent increments; gauges, sample times and expiries are
+// restored only if no later update has replaced the values of the batch.
+func (s *Service) rollback(prev []prior) {
+	var undo []memstorage.Update
+	for _, p := range prev {
+		if p.mtype == metricsdto.MetricTypeGauge {
+			v, err := s.store.GetGauge(p.name)
+			switch {
+			case err != nil || math.Float64bits(v) != math.Float64bits(p.written):
+				// Replaced or deleted since the batch.
+			case p.exists:
+				undo = append(undo, memstorage.Update{Key: p.name, Value: p.value})
+			default:
+				_ = s.store.DeleteGauge(p.name)
+			}
+		} else {
+			undo = append(undo, memstorage.Update{Key: p.name, Counter: true, Delta: -p.delta})
+		}
+		s.restoreExpiry(p.mtype, p.name, p.expiry, p.expires, p.refreshed)
+		if last, _ := s.lastStamp(p.mtype, p.name); !last.Equal(p.stamped) {
+			continue
+		}
+		if p.stamp.IsZero() {
+			s.forgetStamp(p.mtype, p.name)
+		} else {
+			s.stamp(p.mtype, p.name, p.stamp)
+		}
+	}
+	_ = s.store.Apply(undo)
+
+	// A counter created by the batch is dropped unless a concurrent update incremented it.
+	for _, p := range prev {
+		if p.mtype == metricsdto.MetricTypeCounter && !p.exists {
+			if v, err := s.store.GetCounter(p.name); err == nil && v == 0 {
+				_ = s.store.DeleteCounter(p.name)
+			}
+		}
+	}
+}
+
+// FromStructToStoreBatch applies a batch of metric DTOs atomically.
+// The whole batch is validated first; if any entry is invalid, a *BatchError
+// listing every rejected entry is returned and nothing is applied. Valid
+// batches are applied to memory under one lock and persisted with a single
+// write; if persisting fails, the batch is rolled back.
+func (s *Service) FromStructToStoreBatch(ctx context.Context, metrics []metricsdto.Metrics) error {
+	_, err := s.ApplyBatch(ctx, metrics, false)
+	return err
+}
+
+// ApplyBatch applies a batch like FromStructToStoreBatch and reports the
+// status of every entry together with the stored value of its series.
+// With partial set, invalid entries are rejected individually and the valid
+// rest is applied; otherwise any invalid entry rejects the whole batch.
+//
+// Validation and the update of memory are serialized per series (see
+// seriesLocks); batches of different series and the persistence of all
+// batches run concurrently.
+func (s *Service) ApplyBatch(ctx context.Context, metrics []metricsdto.Metrics, partial bool) (metricsdto.BatchResult, error) {
+	if err := s.waitCapacity(ctx); err != nil {
+		return metricsdto.BatchResult{}, err
+	}
+
+	keys := make([]string, len(metrics))
+	for i, m := range metrics {
+		keys[i] = s.names.Key(m.ID)
+	}
+	unlock := s.locks.lock(keys)
+	created := &newSeries{mu: &s.limitMu}
+	items, rejected, result := s.prepareBatch(metrics, created)
+	if len(rejected) > 0 && !partial {
+		created.release()
+		unlock()
+		for i := range result.Items {
+			if result.Items[i].Status == metricsdto.ItemAccepted {
+				result.Items[i].Status = metricsdto.ItemRejected
+				result.Items[i].Error = "not applied: batch has rejected entries"
+			}
+		}
+		countResults(&result)
+		err := &BatchError{Size: len(metrics), Items: rejected, Result: result}
+		return result, fmt.Errorf("cannot write batch: %w", err)
+	}
+	var (
+		prev []prior
+		err  error
+	)
+	if len(items) > 0 {
+		prev, err = s.applyLocked(items)
+	}
+	created.release()
+	unlock()
+	if err != nil {
+		return metricsdto.BatchResult{}, err
+	}
+
+	if len(items) > 0 {
+		if err := s.persistItems(ctx, prev); err != nil {
+			return metricsdto.BatchResult{}, err
+		}
+	}
+	for i := range result.Items {
+		if result.Items[i].Status != metricsdto.ItemRejected {
+			s.storedValue(&result.Items[i])
+		}
+	}
+	countResults(&result)
+	return result, nil
+}
+
+// applyLocked applies validated entries to memory and records their sample
+// times and TTLs. It must be called with the series locks of the entries held
+// and returns the prior state of the touched series.
+func (s *Service) applyLocked(items []batchItem) ([]prior, error) {
+	prev := s.priorState(items)
+	updates := make([]memstorage.Update, len(items))
+	keys := make([]string, len(items))
+	for i, item := range items {
+		updates[i] = item.update
+		keys[i] = s.names.Key(item.metric.ID)
+	}
+	if err := s.store.Apply(updates); err != nil {
+		return nil, fmt.Errorf("cannot write batch: %w", err)
+	}
+	s.holdIncrements(prev, 1)
+	unlockState := s.locks.lockState(keys)
+	defer unlockState()
+	for _, item := range items {
+		m := item.metric
+		if m.MType == metricsdto.MetricTypeGauge || s.supersedes(m.MType, m.ID, item.at) {
+			s.stamp(m.MType, m.ID, item.at)
+		}
+		var ttl time.Duration
+		if m.TTL != nil {
+			ttl = time.Duration(*m.TTL) * time.Second
+		}
+		s.refreshTTL(m.MType, m.ID, ttl, time.Now())
+	}
+	for i := range prev {
+		prev[i].stamped, _ = s.lastStamp(prev[i].mtype, prev[i].name)
+		prev[i].refreshed, _ = s.expiryOf(prev[i].mtype, prev[i].name)
+	}
+	return prev, nil
+}
+
+// persistItems persists applied entries with a single write, or marks them
+// dirty in asynchronous mode. If the write fails, the entries are rolled back.
+func (s *Service) persistItems(ctx context.Context, prev []prior) error {
+	refs := make([]seriesRef, len(prev))
+	for i, p := range prev {
+		refs[i] = seriesRef{p.mtype, p.name, p.delta}
+	}
+	if err := s.afterWrite(ctx, refs...); err != nil {
+		keys := make([]string, len(prev))
+		for i, p := range prev {
+			keys[i] = s.names.Key(p.name)
+		}
+		unlock := s.locks.lock(keys)
+		unlockState := s.locks.lockState(keys)
+		s.rollback(prev)
+		s.holdIncrements(prev, -1)
+		unlockState()
+		unlock()
+		return fmt.Errorf("batch rolled back: %w", err)
+	}
+	return nil
+}
+
+// storedValue fills the current value of the series of a batch entry.
+func (s *Service) storedValue(item *metricsdto.ItemResult) {
+	if item.MType == metricsdto.MetricTypeGauge {
+		if v, err := s.store.GetGauge(item.ID); err == nil {
+			item.Value = &v
+		}
+		return
+	}
+	if v, err := s.store.GetCounter(item.ID); err == nil {
+		d := int64(v)
+		item.Delta = &d
+	}
+}
+
+// countResults fills the totals of a batch result from its items.
+func countResults(result *metricsdto.BatchResult) {
+	result.Accepted, result.Rejected, result.Deduplicated = 0, 0, 0
+	for _, item := range result.Items {
+		switch item.Status {
+		case metricsdto.ItemAccepted:
+			result.Accepted++
+		case metricsdto.ItemRejected:
+			result.Rejected++
+		case metricsdto.ItemDeduplicated:
+			result.Deduplicated++
+		}
+	}
+}
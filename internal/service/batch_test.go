@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/metricname"
+	storageOrig "gometrics/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingPersistStorage counts snapshot writes and fails them on demand.
+type countingPersistStorage struct {
+	stubPersistStorage
+	writes int
+	err    error
+}
+
+func (s *countingPersistStorage) FormattingLogs(context.Context, map[string]float64, map[string]int) error {
+	s.writes++
+	return s.err
+}
+
+func TestService_FromStructToStoreBatch_Atomic(t *testing.T) {
+	ctx := context.Background()
+	gauge := func(id string, v float64) metricsdto.Metrics {
+		return metricsdto.Metrics{ID: id, MType: metricsdto.MetricTypeGauge, Value: &v}
+	}
+	counter := func(id string, d int64) metricsdto.Metrics {
+		return metricsdto.Metrics{ID: id, MType: metricsdto.MetricTypeCounter, Delta: &d}
+	}
+
+	t.Run("valid batch is persisted once", func(t *testing.T) {
+		pstore := &countingPersistStorage{}
+		s := NewService(storageOrig.NewMemStorage(), pstore)
+		require.NoError(t, s.FromStructToStoreBatch(ctx, []metricsdto.Metrics{
+			gauge("g1", 1), counter("c1", 2), gauge("g1", 3), counter("c1", 4),
+		}))
+		assert.Equal(t, 1, pstore.writes)
+		assert.Equal(t, map[string]float64{"g1": 3}, s.GetAllGauges(ctx))
+		assert.Equal(t, map[string]int{"c1": 6}, s.GetAllCounters(ctx))
+	})
+
+	t.Run("invalid entries reject the whole batch", func(t *testing.T) {
+		pstore := &countingPersistStorage{}
+		s := NewService(storageOrig.NewMemStorage(), pstore)
+		s.SetMaxFutureSkew(time.Minute)
+		future := time.Now().Add(time.Hour).UnixMilli()
+		err := s.FromStructToStoreBatch(ctx, []metricsdto.Metrics{
+			gauge("g1", 1),
+			{ID: "", MType: metricsdto.MetricTypeGauge},
+			{ID: "x", MType: "histogram"},
+			{ID: "g2", MType: metricsdto.MetricTypeGauge, Timestamp: &future},
+		})
+
+		var batchErr *BatchError
+		require.ErrorAs(t, err, &batchErr)
+		assert.Equal(t, 4, batchErr.Size)
+		require.Len(t, batchErr.Items, 3)
+		assert.Equal(t, []int{1, 2, 3}, []int{batchErr.Items[0].Index, batchErr.Items[1].Index, batchErr.Items[2].Index})
+		assert.ErrorIs(t, batchErr.Items[0], ErrInvalidMetric)
+		assert.ErrorIs(t, err, ErrFutureTimestamp)
+		assert.Empty(t, s.GetAllGauges(ctx), "valid entries are not applied either")
+		assert.Zero(t, pstore.writes)
+	})
+
+	t.Run("partial batch applies the valid entries", func(t *testing.T) {
+		s := NewService(storageOrig.NewMemStorage(), &stubPersistStorage{})
+		result, err := s.ApplyBatch(ctx, []metricsdto.Metrics{gauge("g1", 1), {ID: "", MType: metricsdto.MetricTypeGauge}, counter("c1", 2)}, true)
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.Accepted)
+		assert.Equal(t, 1, result.Rejected)
+		assert.Equal(t, metricsdto.ItemRejected, result.Items[1].Status)
+		require.NotNil(t, result.Items[2].Delta)
+		assert.Equal(t, int64(2), *result.Items[2].Delta)
+		assert.Equal(t, map[string]float64{"g1": 1}, s.GetAllGauges(ctx))
+	})
+
+	t.Run("series limit counts new series of the batch", func(t *testing.T) {
+		s := NewService(storageOrig.NewMemStorage(), &stubPersistStorage{})
+		s.SetMaxSeries(2)
+		require.NoError(t, s.GaugeInsert(ctx, "g1", 1))
+		err := s.FromStructToStoreBatch(ctx, []metricsdto.Metrics{gauge("g1", 2), gauge("g2", 1), gauge("g3", 1)})
+		assert.ErrorIs(t, err, ErrSeriesLimit)
+		assert.Equal(t, map[string]float64{"g1": 1}, s.GetAllGauges(ctx))
+	})
+
+	t.Run("failed persist rolls the batch back", func(t *testing.T) {
+		pstore := &countingPersistStorage{}
+		s := NewService(storageOrig.NewMemStorage(), pstore)
+		require.NoError(t, s.FromStructToStoreBatch(ctx, []metricsdto.Metrics{gauge("g1", 1), counter("c1", 1)}))
+
+		pstore.err = errors.New("disk full")
+		err := s.FromStructToStoreBatch(ctx, []metricsdto.Metrics{gauge("g1", 2), gauge("g2", 2), counter("c1", 5), counter("c2", 5)})
+		assert.ErrorContains(t, err, "disk full")
+		assert.Equal(t, map[string]float64{"g1": 1}, s.GetAllGauges(ctx))
+		assert.Equal(t, map[string]int{"c1": 1}, s.GetAllCounters(ctx))
+	})
+}
+
+// blockingPersistStorage fails the first series write once it is released and
+// lets the later ones through.
+type blockingPersistStorage struct {
+	stubPersistStorage
+	mu      sync.Mutex
+	writes  int
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingPersistStorage) WriteSeries(context.Context, map[string]float64, map[string]int, func(string, string) time.Time, func(string, string) time.Duration) error {
+	s.mu.Lock()
+	s.writes++
+	first := s.writes == 1
+	s.mu.Unlock()
+	if !first {
+		return nil
+	}
+	close(s.entered)
+	<-s.release
+	return errors.New("connection reset")
+}
+
+// TestService_ConcurrentPersistence verifies that persisting an update does not
+// block other updates and that rolling it back keeps their values.
+func TestService_ConcurrentPersistence(t *testing.T) {
+	ctx := context.Background()
+	for _, mtype := range []string{metricsdto.MetricTypeGauge, metricsdto.MetricTypeCounter} {
+		t.Run(mtype, func(t *testing.T) {
+			pstore := &blockingPersistStorage{entered: make(chan struct{}), release: make(chan struct{})}
+			s := NewService(storageOrig.NewMemStorage(), pstore)
+			insert := func(v int) error {
+				if mtype == metricsdto.MetricTypeGauge {
+					return s.GaugeInsert(ctx, "m", float64(v))
+				}
+				return s.CounterInsert(ctx, "m", v)
+			}
+
+			failed := make(chan error)
+			go func() { failed <- insert(1) }()
+			<-pstore.entered
+
+			done := make(chan error)
+			go func() { done <- insert(2) }()
+			select {
+			case err := <-done:
+				require.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("update waited for the persistence of another one")
+			}
+
+			close(pstore.release)
+			assert.ErrorIs(t, <-failed, ErrPersistence)
+			if mtype == metricsdto.MetricTypeGauge {
+				assert.Equal(t, map[string]float64{"m": 2}, s.GetAllGauges(ctx), "the later value is kept")
+			} else {
+				assert.Equal(t, map[string]int{"m": 2}, s.GetAllCounters(ctx), "only the failed increment is undone")
+			}
+		})
+	}
+}
+
+// seriesPersistStorage accepts the written series without keeping them, so the
+// benchmark measures the update path rather than snapshot copies.
+type seriesPersistStorage struct {
+	stubPersistStorage
+}
+
+func (*seriesPersistStorage) WriteSeries(context.Context, map[string]float64, map[string]int, func(string, string) time.Time, func(string, string) time.Duration) error {
+	return nil
+}
+
+// BenchmarkService_ConcurrentUpdates models concurrent /updates/ requests:
+// every request applies a batch of 20 series through ApplyBatch and some
+// requests read all series.
+func BenchmarkService_ConcurrentUpdates(b *testing.B) {
+	const series, batch = 10000, 20
+	keys := make([]string, series)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("series_%d", i)
+	}
+	stores := []struct {
+		name string
+		new  func() storage
+	}{
+		{"MemStorage", func() storage { return storageOrig.NewMemStorage() }},
+		{"Sharded-16", func() storage { return storageOrig.NewShardedStorage(16, metricname.CaseInsensitive) }},
+		{"Sharded-64", func() storage { return storageOrig.NewShardedStorage(64, metricname.CaseInsensitive) }},
+	}
+	ctx := context.Background()
+	for _, tt := range stores {
+		for _, readEvery := range []int{0, 100} {
+			b.Run(fmt.Sprintf("%s/read-every-%d", tt.name, readEvery), func(b *testing.B) {
+				s := NewService(tt.new(), &seriesPersistStorage{})
+				var mu sync.Mutex
+				next := 0
+				b.RunParallel(func(pb *testing.PB) {
+					mu.Lock()
+					offset := next * 7919
+					next++
+					mu.Unlock()
+
+					metrics := make([]metricsdto.Metrics, batch)
+					for n := 0; pb.Next(); n++ {
+						value, delta := float64(n), int64(1)
+						for i := range metrics {
+							m := metricsdto.Metrics{ID: keys[(offset+n*batch+i)%series], MType: metricsdto.MetricTypeGauge, Value: &value}
+							if i%2 == 0 {
+								m = metricsdto.Metrics{ID: m.ID, MType: metricsdto.MetricTypeCounter, Delta: &delta}
+							}
+							metrics[i] = m
+						}
+						if _, err := s.ApplyBatch(ctx, metrics, false); err != nil {
+							b.Fatal(err)
+						}
+						if readEvery > 0 && n%readEvery == 0 {
+							_ = s.GetAllGauges(ctx)
+						}
+					}
+				})
+			})
+		}
+	}
+}
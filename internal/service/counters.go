@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+	memstorage "gometrics/internal/storage"
+)
+
+// Counter modes.
+const (
+	// CountersLocal keeps the counter totals in memory and persists them as they are.
+	CountersLocal = "local"
+	// CountersDatabase keeps the counter totals in the database: increments are
+	// added there and reads reload the totals, so several servers sharing the
+	// database converge.
+	CountersDatabase = "database"
+)
+
+// ErrSharedCountersUnsupported is returned by EnableSharedCounters if the
+// persistent storage cannot add counter increments.
+var ErrSharedCountersUnsupported = errors.New("persistent storage does not support shared counters")
+
+// counterStore is implemented by persistent storages that keep the counter
+// totals themselves, e.g. a database shared by several servers.
+type counterStore interface {
+	// AddCounters writes the gauges, adds the counter increments to the stored
+	// totals and returns the new totals of the counters.
+	AddCounters(ctx context.Context, gauge map[string]float64, deltas map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration) (map[string]int, error)
+	// LoadCounters returns the stored totals of all counters.
+	LoadCounters(ctx context.Context) (map[string]int, error)
+}
+
+// EnableSharedCounters makes the persistent storage authoritative for counters:
+// updates send increments instead of totals and the in-memory counters become a
+// cache, reloaded on read once older than ttl (0 reloads on every read).
+// It must be called before the service receives updates.
+func (s *Service) EnableSharedCounters(ttl time.Duration) error {
+	cs, ok := s.pstore.(counterStore)
+	if !ok {
+		return ErrSharedCountersUnsupported
+	}
+	s.counters, s.counterTTL = cs, ttl
+	return nil
+}
+
+// addSeries persists the gauges with their current values and the counters
+// with their pending increments, then caches the returned counter totals.
+func (s *Service) addSeries(ctx context.Context, refs []seriesRef) error {
+	gauges := make(map[string]float64)
+	deltas := make(map[string]int)
+	for _, ref := range refs {
+		if ref.mtype == metricsdto.MetricTypeGauge {
+			if v, err := s.store.GetGauge(ref.name); err == nil {
+				gauges[ref.name] = v
+			}
+		} else {
+			deltas[ref.name] += ref.delta
+		}
+	}
+	if len(gauges) == 0 && len(deltas) == 0 {
+		return nil
+	}
+	read := s.settledWrites()
+	totals, err := s.counters.AddCounters(ctx, gauges, deltas, s.SampleTime, s.seriesTTL)
+	if err != nil {
+		return err
+	}
+	s.cacheCounters(totals, read, deltas)
+	return nil
+}
+
+// syncCounters reloads the counter totals from the persistent storage if the
+// cached ones are older than the cache TTL. On failure the cached totals are kept.
+func (s *Service) syncCounters(ctx context.Context) {
+	if s.counters == nil {
+		return
+	}
+	s.countersMu.Lock()
+	defer s.countersMu.Unlock()
+	if !s.countersRead.IsZero() && time.Since(s.countersRead) < s.counterTTL {
+		return
+	}
+	read := s.settledWrites()
+	totals, err := s.counters.LoadCounters(ctx)
+	if err != nil {
+		log.Printf("WARN: load shared counters: %v", err)
+		return
+	}
+	s.countersRead = time.Now()
+	s.cacheCounters(totals, read, nil)
+}
+
+// settledWrites returns the number of writes that added increments so far.
+func (s *Service) settledWrites() uint64 {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	return s.settled
+}
+
+// holdIncrements adds sign times the counter increments of prev to the
+// unpersisted ones: +1 once a batch is applied, -1 when it is rolled back.
+// It must be called with the series locks of prev held.
+func (s *Service) holdIncrements(prev []prior, sign int) {
+	if s.counters == nil {
+		return
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	for _, p := range prev {
+		if p.mtype == metricsdto.MetricTypeCounter {
+			s.addUnpersistedLocked(p.name, sign*p.delta)
+		}
+	}
+}
+
+// addUnpersistedLocked adds delta to the unpersisted increments of a counter.
+// It must be called with s.flushMu held.
+func (s *Service) addUnpersistedLocked(name string, delta int) {
+	key := s.expiryKey(metricsdto.MetricTypeCounter, name)
+	if n := s.unpersisted[key] + delta; n != 0 {
+		if s.unpersisted == nil {
+			s.unpersisted = make(map[string]int)
+		}
+		s.unpersisted[key] = n
+	} else {
+		delete(s.unpersisted, key)
+	}
+}
+
+// cacheCounters sets the in-memory counters to the stored totals read after
+// read writes had settled, plus the increments still waiting to be persisted.
+// added are the increments the totals were returned for, now persisted.
+// The counters are set under their series locks, so no update is applied in
+// between. If other increments were persisted since the totals were read, the
+// totals may miss them and the cache is left as it is.
+func (s *Service) cacheCounters(totals map[string]int, read uint64, added map[string]int) {
+	keys := make([]string, 0, len(totals)+len(added))
+	for name := range totals {
+		keys = append(keys, s.names.Key(name))
+	}
+	for name := range added {
+		keys = append(keys, s.names.Key(name))
+	}
+	unlock := s.locks.lock(keys)
+	defer unlock()
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	stale := s.settled != read
+	if len(added) > 0 {
+		for name, delta := range added {
+			s.addUnpersistedLocked(name, -delta)
+		}
+		s.settled++
+	}
+	if stale {
+		return
+	}
+	updates := make([]memstorage.Update, 0, len(totals))
+	for name, total := range totals {
+		pending := s.unpersisted[s.expiryKey(metricsdto.MetricTypeCounter, name)]
+		updates = append(updates, memstorage.Update{Key: name, Counter: true, Delta: total + pending, Reset: true})
+	}
+	_ = s.store.Apply(updates)
+}
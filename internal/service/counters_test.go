@@ -0,0 +1,207 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+	storageOrig "gometrics/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sharedCounterStorage imitates a database shared by several servers.
+type sharedCounterStorage struct {
+	stubPersistStorage
+	mu      sync.Mutex
+	gauge   map[string]float64
+	counter map[string]int
+	loads   int
+	err     error
+	entered chan struct{} // if set, AddCounters reports its call and waits for release
+	release chan struct{}
+}
+
+func newSharedCounterStorage() *sharedCounterStorage {
+	return &sharedCounterStorage{gauge: make(map[string]float64), counter: make(map[string]int)}
+}
+
+func (s *sharedCounterStorage) AddCounters(_ context.Context, gauge map[string]float64, deltas map[string]int, _ func(string, string) time.Time, _ func(string, string) time.Duration) (map[string]int, error) {
+	if s.entered != nil {
+		s.entered <- struct{}{}
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	for k, v := range gauge {
+		s.gauge[k] = v
+	}
+	totals := make(map[string]int, len(deltas))
+	for k, d := range deltas {
+		s.counter[k] += d
+		totals[k] = s.counter[k]
+	}
+	return totals, nil
+}
+
+func (s *sharedCounterStorage) LoadCounters(context.Context) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loads++
+	totals := make(map[string]int, len(s.counter))
+	for k, v := range s.counter {
+		totals[k] = v
+	}
+	return totals, nil
+}
+
+func (s *sharedCounterStorage) ImportLogs(context.Context) ([]metricsdto.Metrics, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var metrics []metricsdto.Metrics
+	for k, v := range s.gauge {
+		metrics = append(metrics, metricsdto.Metrics{ID: k, MType: metricsdto.MetricTypeGauge, Value: &v})
+	}
+	for k, v := range s.counter {
+		d := int64(v)
+		metrics = append(metrics, metricsdto.Metrics{ID: k, MType: metricsdto.MetricTypeCounter, Delta: &d})
+	}
+	return metrics, nil
+}
+
+func TestService_EnableSharedCounters(t *testing.T) {
+	s := NewService(storageOrig.NewMemStorage(), &stubPersistStorage{})
+	assert.ErrorIs(t, s.EnableSharedCounters(time.Second), ErrSharedCountersUnsupported)
+}
+
+func TestService_SharedCounters(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("replicas converge", func(t *testing.T) {
+		db := newSharedCounterStorage()
+		a := NewService(storageOrig.NewMemStorage(), db)
+		b := NewService(storageOrig.NewMemStorage(), db)
+		require.NoError(t, a.EnableSharedCounters(0))
+		require.NoError(t, b.EnableSharedCounters(0))
+
+		require.NoError(t, a.CounterInsert(ctx, "hits", 2))
+		require.NoError(t, b.CounterInsert(ctx, "hits", 3))
+		delta, value := int64(5), 1.5
+		require.NoError(t, b.FromStructToStoreBatch(ctx, []metricsdto.Metrics{
+			{ID: "hits", MType: metricsdto.MetricTypeCounter, Delta: &delta},
+			{ID: "temp", MType: metricsdto.MetricTypeGauge, Value: &value},
+		}))
+		assert.Equal(t, map[string]int{"hits": 10}, db.counter, "increments are added in the storage")
+		assert.Equal(t, map[string]float64{"temp": 1.5}, db.gauge)
+
+		for _, s := range []*Service{a, b} {
+			v, err := s.GetCounter(ctx, "hits")
+			require.NoError(t, err)
+			assert.Equal(t, 10, v)
+		}
+	})
+
+	t.Run("reads are cached for the ttl", func(t *testing.T) {
+		db := newSharedCounterStorage()
+		a := NewService(storageOrig.NewMemStorage(), db)
+		b := NewService(storageOrig.NewMemStorage(), db)
+		require.NoError(t, a.EnableSharedCounters(time.Hour))
+		require.NoError(t, b.EnableSharedCounters(time.Hour))
+
+		_ = b.GetAllCounters(ctx)
+		require.NoError(t, a.CounterInsert(ctx, "hits", 2))
+		assert.Empty(t, b.GetAllCounters(ctx), "cached totals are served until the ttl ends")
+		assert.Equal(t, 1, db.loads)
+
+		b.countersRead = time.Now().Add(-2 * time.Hour)
+		assert.Equal(t, map[string]int{"hits": 2}, b.GetAllCounters(ctx))
+	})
+
+	t.Run("async increments", func(t *testing.T) {
+		db := newSharedCounterStorage()
+		db.counter["hits"] = 100
+		s := NewService(storageOrig.NewMemStorage(), db)
+		require.NoError(t, s.EnableSharedCounters(0))
+		s.EnableAsyncFlush(FlushPolicy{MaxDelay: time.Hour})
+
+		require.NoError(t, s.CounterInsert(ctx, "hits", 1))
+		require.NoError(t, s.CounterInsert(ctx, "hits", 2))
+		v, err := s.GetCounter(ctx, "hits")
+		require.NoError(t, err)
+		assert.Equal(t, 103, v, "pending increments are added to the stored total")
+
+		db.err = errors.New("connection refused")
+		require.Error(t, s.flushDirty(ctx))
+		require.NoError(t, s.CounterInsert(ctx, "hits", 4))
+		db.err = nil
+		require.NoError(t, s.flushDirty(ctx))
+		assert.Equal(t, 107, db.counter["hits"], "failed increments are retried once")
+		assert.Zero(t, s.DirtySeries())
+	})
+
+	t.Run("restore loads totals", func(t *testing.T) {
+		db := newSharedCounterStorage()
+		db.counter["hits"] = 7
+		db.gauge["temp"] = 20
+		s := NewService(storageOrig.NewMemStorage(), db)
+		require.NoError(t, s.EnableSharedCounters(time.Hour))
+
+		require.NoError(t, s.PersistRestore(ctx))
+		assert.Equal(t, map[string]int{"hits": 7}, db.counter, "restored counters are not added again")
+		assert.Equal(t, map[string]int{"hits": 7}, s.GetAllCounters(ctx))
+		assert.Equal(t, map[string]float64{"temp": 20}, s.GetAllGauges(ctx))
+	})
+}
+
+func TestService_SharedCounters_InFlight(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "persisted increment", want: 101},
+		{name: "rolled back increment", err: errors.New("connection refused"), want: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newSharedCounterStorage()
+			db.counter["hits"] = 100
+			s := NewService(storageOrig.NewMemStorage(), db)
+			require.NoError(t, s.EnableSharedCounters(0))
+			require.Equal(t, map[string]int{"hits": 100}, s.GetAllCounters(ctx))
+
+			db.entered, db.release = make(chan struct{}), make(chan struct{})
+			done := make(chan error)
+			go func() { done <- s.CounterInsert(ctx, "hits", 1) }()
+			<-db.entered
+
+			// The reload misses the increment being written, which is kept in memory.
+			v, err := s.GetCounter(ctx, "hits")
+			require.NoError(t, err)
+			assert.Equal(t, 101, v, "the counter does not go backwards")
+
+			db.mu.Lock()
+			db.err = tt.err
+			db.mu.Unlock()
+			close(db.release)
+			if tt.err != nil {
+				assert.ErrorIs(t, <-done, tt.err)
+			} else {
+				assert.NoError(t, <-done)
+			}
+			db.entered = nil
+			v, err = s.GetCounter(ctx, "hits")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, v)
+			assert.Empty(t, s.unpersisted)
+		})
+	}
+}
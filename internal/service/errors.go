@@ -0,0 +1,50 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gometrics/internal/api/metricsdto"
+	memstorage "gometrics/internal/storage"
+)
+
+// Domain errors returned (wrapped) by the service. Handlers map them to
+// problem responses, so match them with errors.Is.
+var (
+	// ErrNotFound is returned for reads of series that do not exist.
+	ErrNotFound = memstorage.ErrNotFound
+	// ErrInvalidType is returned for metric types other than gauge and counter.
+	ErrInvalidType = errors.New("invalid metric type")
+	// ErrParse is returned for metric values and bodies that cannot be parsed.
+	ErrParse = errors.New("cannot parse metric")
+	// ErrPersistence is returned when an update was applied in memory but could
+	// not be written to the persistent storage (or was rolled back).
+	ErrPersistence = errors.New("persistence failure")
+)
+
+// CheckType returns ErrInvalidType unless mtype is gauge or counter.
+func CheckType(mtype string) error {
+	if mtype != metricsdto.MetricTypeGauge && mtype != metricsdto.MetricTypeCounter {
+		return fmt.Errorf("%w %q", ErrInvalidType, mtype)
+	}
+	return nil
+}
+
+// ParseGauge parses the value of a gauge given as text.
+func ParseGauge(raw string) (float64, error) {
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: gauge value %q", ErrParse, raw)
+	}
+	return v, nil
+}
+
+// ParseCounter parses the increment of a counter given as text.
+func ParseCounter(raw string) (int, error) {
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%w: counter value %q", ErrParse, raw)
+	}
+	return v, nil
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+)
+
+// Persistence modes.
+const (
+	// PersistSync writes the updated series before the update returns.
+	PersistSync = "sync"
+	// PersistAsync marks updated series dirty; a background writer persists them.
+	PersistAsync = "async"
+)
+
+// ErrBacklogFull is returned when asynchronous persistence lags so far behind
+// that an update could not be accepted before its context ended.
+var ErrBacklogFull = errors.New("persistence backlog is full")
+
+// defaultFlushDelay is used when FlushPolicy.MaxDelay is not positive.
+const defaultFlushDelay = time.Second
+
+// FlushPolicy configures asynchronous persistence, see EnableAsyncFlush.
+type FlushPolicy struct {
+	MaxDelay   time.Duration // longest time a dirty series waits to be written
+	BatchSize  int           // dirty series that trigger an immediate write, 0 = wait for MaxDelay
+	MaxPending int           // dirty series at which updates wait for the writer, 0 = unbounded
+}
+
+// seriesWriter is implemented by persistent storages that can write a subset
+// of the series and leave the others untouched, e.g. an upsert of the rows.
+type seriesWriter interface {
+	WriteSeries(ctx context.Context, gauge map[string]float64, counter map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration) error
+}
+
+// seriesRef names one series.
+type seriesRef struct {
+	mtype, name string
+	delta       int // counter increment not yet persisted, used with shared counters
+}
+
+// EnableAsyncFlush switches the service to asynchronous persistence: updates
+// only mark their series dirty and RunWriter persists the dirty set. It must be
+// called before the service receives updates.
+func (s *Service) EnableAsyncFlush(p FlushPolicy) {
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultFlushDelay
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.async = true
+	s.policy = p
+	s.dirty = make(map[string]seriesRef)
+	s.drained = make(chan struct{})
+	s.kick = make(chan struct{}, 1)
+}
+
+// DirtySeries returns the number of series waiting to be persisted.
+func (s *Service) DirtySeries() int {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	return len(s.dirty)
+}
+
+// RunWriter persists the dirty series every MaxDelay, or as soon as BatchSize
+// series are dirty, until ctx is cancelled. The remaining dirty series are
+// written before it returns ctx.Err(). Failed writes are retried on the next round.
+func (s *Service) RunWriter(ctx context.Context) error {
+	s.flushMu.Lock()
+	delay, kick := s.policy.MaxDelay, s.kick
+	s.flushMu.Unlock()
+	if kick == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(delay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.flushDirty(context.Background()); err != nil {
+				log.Printf("WARN: final write of dirty series: %v", err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		case <-kick:
+		}
+		if err := s.flushDirty(ctx); err != nil {
+			log.Printf("WARN: write dirty series: %v", err)
+		}
+	}
+}
+
+// waitCapacity blocks while the dirty set is at MaxPending (backpressure).
+// It returns ErrBacklogFull if ctx ends first.
+func (s *Service) waitCapacity(ctx context.Context) error {
+	for {
+		s.flushMu.Lock()
+		if !s.async || s.policy.MaxPending <= 0 || len(s.dirty) < s.policy.MaxPending {
+			s.flushMu.Unlock()
+			return nil
+		}
+		drained := s.drained
+		s.notifyWriterLocked()
+		s.flushMu.Unlock()
+
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrBacklogFull, ctx.Err())
+		}
+	}
+}
+
+// notifyWriterLocked wakes the writer without blocking. It must be called with s.flushMu held.
+func (s *Service) notifyWriterLocked() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// afterWrite persists updated series: it marks them dirty in asynchronous
+// mode and writes them right away otherwise.
+func (s *Service) afterWrite(ctx context.Context, refs ...seriesRef) error {
+	s.flushMu.Lock()
+	if s.async {
+		for _, ref := range refs {
+			key := s.expiryKey(ref.mtype, ref.name)
+			ref.delta += s.dirty[key].delta
+			s.dirty[key] = ref
+		}
+		if n := s.policy.BatchSize; n > 0 && len(s.dirty) >= n {
+			s.notifyWriterLocked()
+		}
+		s.flushMu.Unlock()
+		return nil
+	}
+	s.flushMu.Unlock()
+
+	if err := s.writeSeries(ctx, refs); err != nil {
+		return fmt.Errorf("%w: %w", ErrPersistence, err)
+	}
+	return nil
+}
+
+// flushDirty writes the dirty series. On failure they stay dirty.
+func (s *Service) flushDirty(ctx context.Context) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.flushMu.Lock()
+	dirty := s.dirty
+	if len(dirty) == 0 {
+		s.flushMu.Unlock()
+		return nil
+	}
+	s.dirty = make(map[string]seriesRef)
+	s.flushMu.Unlock()
+
+	refs := make([]seriesRef, 0, len(dirty))
+	for _, ref := range dirty {
+		refs = append(refs, ref)
+	}
+	err := s.writeSeries(ctx, refs)
+
+	s.flushMu.Lock()
+	if err != nil {
+		for key, ref := range dirty {
+			if cur, ok := s.dirty[key]; ok {
+				cur.delta += ref.delta
+				ref = cur
+			}
+			s.dirty[key] = ref
+		}
+	}
+	close(s.drained)
+	s.drained = make(chan struct{})
+	s.flushMu.Unlock()
+	return err
+}
+
+// writeSeries writes the current values of the series to the persistent
+// storage. Storages that cannot write a subset get a full snapshot.
+func (s *Service) writeSeries(ctx context.Context, refs []seriesRef) error {
+	if s.pstore == nil {
+		return nil
+	}
+	if s.counters != nil {
+		return s.addSeries(ctx, refs)
+	}
+	w, ok := s.pstore.(seriesWriter)
+	if !ok {
+		if s.pstore.Ping(ctx) != nil {
+			return nil
+		}
+		return s.persist(ctx)
+	}
+
+	gauges := make(map[string]float64)
+	counters := make(map[string]int)
+	for _, ref := range refs {
+		if ref.mtype == metricsdto.MetricTypeGauge {
+			if v, err := s.store.GetGauge(ref.name); err == nil {
+				gauges[ref.name] = v
+			}
+		} else if v, err := s.store.GetCounter(ref.name); err == nil {
+			counters[ref.name] = v
+		}
+	}
+	if len(gauges) == 0 && len(counters) == 0 {
+		return nil
+	}
+	return w.WriteSeries(ctx, gauges, counters, s.SampleTime, s.seriesTTL)
+}
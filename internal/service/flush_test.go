@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	storageOrig "gometrics/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seriesWriterStorage records the series written with WriteSeries.
+type seriesWriterStorage struct {
+	stubPersistStorage
+	mu      sync.Mutex
+	writes  int
+	gauge   map[string]float64
+	counter map[string]int
+	err     error
+}
+
+func (s *seriesWriterStorage) WriteSeries(_ context.Context, gauge map[string]float64, counter map[string]int, _ func(string, string) time.Time, _ func(string, string) time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	if s.err != nil {
+		return s.err
+	}
+	s.gauge, s.counter = gauge, counter
+	return nil
+}
+
+func (s *seriesWriterStorage) written() (int, map[string]float64, map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes, s.gauge, s.counter
+}
+
+func TestService_SyncWritesSeries(t *testing.T) {
+	ctx := context.Background()
+	pstore := &seriesWriterStorage{}
+	s := NewService(storageOrig.NewMemStorage(), pstore)
+	require.NoError(t, s.GaugeInsert(ctx, "g1", 1.5))
+
+	writes, gauge, counter := pstore.written()
+	assert.Equal(t, 1, writes)
+	assert.Equal(t, map[string]float64{"g1": 1.5}, gauge)
+	assert.Empty(t, counter)
+
+	pstore.err = errors.New("disk full")
+	assert.ErrorIs(t, s.CounterInsert(ctx, "c1", 1), ErrPersistence)
+}
+
+func TestService_AsyncFlush(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("updates only mark series dirty", func(t *testing.T) {
+		pstore := &seriesWriterStorage{}
+		s := NewService(storageOrig.NewMemStorage(), pstore)
+		s.EnableAsyncFlush(FlushPolicy{MaxDelay: time.Hour})
+		require.NoError(t, s.GaugeInsert(ctx, "g1", 1))
+		require.NoError(t, s.CounterInsert(ctx, "c1", 2))
+		require.NoError(t, s.CounterInsert(ctx, "c1", 3))
+
+		writes, _, _ := pstore.written()
+		assert.Zero(t, writes)
+		assert.Equal(t, 2, s.DirtySeries())
+
+		require.NoError(t, s.flushDirty(ctx))
+		writes, gauge, counter := pstore.written()
+		assert.Equal(t, 1, writes)
+		assert.Equal(t, map[string]float64{"g1": 1}, gauge)
+		assert.Equal(t, map[string]int{"c1": 5}, counter)
+		assert.Zero(t, s.DirtySeries())
+	})
+
+	t.Run("writer persists only the dirty subset", func(t *testing.T) {
+		pstore := &seriesWriterStorage{}
+		s := NewService(storageOrig.NewMemStorage(), pstore)
+		s.EnableAsyncFlush(FlushPolicy{MaxDelay: time.Hour})
+		require.NoError(t, s.GaugeInsert(ctx, "g1", 1))
+		require.NoError(t, s.flushDirty(ctx))
+
+		s.policy.BatchSize = 1
+		wctx, cancel := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() { done <- s.RunWriter(wctx) }()
+
+		require.NoError(t, s.GaugeInsert(ctx, "g2", 2))
+		assert.Eventually(t, func() bool { n, _, _ := pstore.written(); return n == 2 }, time.Second, 5*time.Millisecond)
+		_, gauge, _ := pstore.written()
+		assert.Equal(t, map[string]float64{"g2": 2}, gauge)
+
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	})
+
+	t.Run("failed writes keep series dirty", func(t *testing.T) {
+		pstore := &seriesWriterStorage{err: errors.New("db down")}
+		s := NewService(storageOrig.NewMemStorage(), pstore)
+		s.EnableAsyncFlush(FlushPolicy{MaxDelay: time.Hour})
+		require.NoError(t, s.GaugeInsert(ctx, "g1", 1))
+
+		assert.Error(t, s.flushDirty(ctx))
+		assert.Equal(t, 1, s.DirtySeries())
+		assert.ErrorIs(t, s.PersistFlush(ctx), ErrPersistence)
+	})
+
+	t.Run("full backlog applies backpressure", func(t *testing.T) {
+		pstore := &seriesWriterStorage{}
+		s := NewService(storageOrig.NewMemStorage(), pstore)
+		s.EnableAsyncFlush(FlushPolicy{MaxDelay: time.Hour, MaxPending: 1})
+		require.NoError(t, s.GaugeInsert(ctx, "g1", 1))
+
+		tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, s.GaugeInsert(tctx, "g2", 2), ErrBacklogFull)
+
+		wctx, stop := context.WithCancel(ctx)
+		defer stop()
+		go s.RunWriter(wctx)
+		require.NoError(t, s.GaugeInsert(ctx, "g2", 2), "the writer drains the backlog")
+	})
+}
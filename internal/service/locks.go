@@ -0,0 +1,80 @@
+package service
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+	"time"
+)
+
+// seriesStripes is the number of stripes series are spread over. It is large
+// enough for the stripes of a batch of a few dozen series to rarely collide
+// with those of concurrent batches.
+const seriesStripes = 1024
+
+// seriesStripe serializes the updates of its series and keeps their sample
+// times and expiries.
+type seriesStripe struct {
+	write sync.Mutex // held while a series of the stripe is validated and updated
+
+	// The state is written with write held and read either with write held or
+	// under mu alone, e.g. by persistence while a batch holds the stripe.
+	mu     sync.RWMutex
+	stamps map[string]time.Time // last sample time by expiryKey
+	expiry map[string]expiry    // by expiryKey
+}
+
+// seriesLocks serializes the updates of each series without a global lock:
+// series are spread over striped mutexes by the hash of their key, so batches
+// touching different series validate and apply in parallel.
+type seriesLocks struct {
+	seed    maphash.Seed
+	stripes [seriesStripes]seriesStripe
+}
+
+func newSeriesLocks() *seriesLocks {
+	return &seriesLocks{seed: maphash.MakeSeed()}
+}
+
+// stripe returns the stripe of the series key.
+func (l *seriesLocks) stripe(key string) *seriesStripe {
+	return &l.stripes[maphash.String(l.seed, key)%seriesStripes]
+}
+
+// indexes returns the distinct stripe numbers of the keys in ascending order.
+func (l *seriesLocks) indexes(keys []string) []int {
+	idx := make([]int, 0, len(keys))
+	for _, k := range keys {
+		idx = append(idx, int(maphash.String(l.seed, k)%seriesStripes))
+	}
+	slices.Sort(idx)
+	return slices.Compact(idx)
+}
+
+// lock locks the stripes of the keys in index order, so that concurrent
+// callers cannot deadlock, and returns the function releasing them.
+func (l *seriesLocks) lock(keys []string) (unlock func()) {
+	idx := l.indexes(keys)
+	for _, i := range idx {
+		l.stripes[i].write.Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			l.stripes[i].write.Unlock()
+		}
+	}
+}
+
+// lockState locks the state of the stripes of the keys for writing, once for
+// a whole batch. The caller must hold their write locks.
+func (l *seriesLocks) lockState(keys []string) (unlock func()) {
+	idx := l.indexes(keys)
+	for _, i := range idx {
+		l.stripes[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			l.stripes[i].mu.Unlock()
+		}
+	}
+}
@@ -4,12 +4,17 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"sort"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gometrics/internal/api/metricsdto"
+	"gometrics/internal/metricname"
+	memstorage "gometrics/internal/storage"
 )
 
 // storage defines the interface for in-memory or database metric operations.
@@ -20,6 +25,10 @@ type storage interface {
 	GetCounter(key string) (int, error)
 	GetGaugeMap() map[string]float64
 	GetCounterMap() map[string]int
+	Len() int
+	DeleteGauge(key string) error
+	DeleteCounter(key string) error
+	Apply(updates []memstorage.Update) error
 	ClearStorage() error
 }
 
@@ -33,15 +42,57 @@ type persistStorage interface {
 	Ping(ctx context.Context) error
 }
 
+// ErrSeriesLimit is returned when an update would create a series beyond the configured limit.
+var ErrSeriesLimit = errors.New("series limit reached")
+
 // Service aggregates the main storage and persistent storage to manage application state.
 type Service struct {
-	store  storage
-	pstore persistStorage
+	store     storage
+	pstore    persistStorage
+	maxSeries int               // maximum number of distinct series, 0 = unlimited
+	names     metricname.Policy // normalisation of metric names, case-insensitive by default
+
+	ttl     atomic.Pointer[TTLPolicy]
+	maxSkew atomic.Int64 // allowed future skew of sample timestamps, time.Duration
+
+	locks   *seriesLocks // serialize updates of each series and keep their sample times and expiries
+	limitMu sync.Mutex   // held while a batch creates series, see newSeries
+
+	flushMu sync.Mutex // guards the asynchronous persistence state below
+	async   bool
+	policy  FlushPolicy
+	dirty   map[string]seriesRef // series waiting to be persisted, by expiryKey
+	drained chan struct{}        // closed after every write of the dirty set
+	kick    chan struct{}        // wakes the writer early
+	writeMu sync.Mutex           // serializes writes of the dirty set
+
+	// Shared counter increments applied in memory but not yet added to the
+	// storage, by expiryKey, and the number of writes that added some: totals
+	// read before such a write may miss its increments.
+	unpersisted map[string]int
+	settled     uint64
+
+	countersMu   sync.Mutex    // serializes reloads of the shared counters
+	counters     counterStore  // keeps the counter totals, nil = counters are local
+	counterTTL   time.Duration // how long loaded totals are served without a reload
+	countersRead time.Time     // last reload of the counters
 }
 
 // NewService creates a new Service instance with the provided storage backends.
 func NewService(inst storage, inst2 persistStorage) *Service {
-	return &Service{store: inst, pstore: inst2}
+	return &Service{store: inst, pstore: inst2, locks: newSeriesLocks()}
+}
+
+// SetNamePolicy sets how metric names are normalised. It must match the policy
+// of the storages and be set before the service is used.
+func (s *Service) SetNamePolicy(p metricname.Policy) {
+	s.names = p
+}
+
+// SetMaxSeries limits the number of distinct series the service accepts (0 disables the limit).
+// Updates of existing series are always accepted.
+func (s *Service) SetMaxSeries(n int) {
+	s.maxSeries = n
 }
 
 // Ping checks the availability of the persistent storage (e.g., database connection).
@@ -50,9 +101,9 @@ func (s *Service) Ping(ctx context.Context) error {
 }
 
 // GetGauge retrieves the value of a gauge metric by key.
-// Keys are case-insensitive.
+// Keys are matched according to the name policy.
 func (s *Service) GetGauge(ctx context.Context, key string) (float64, error) {
-	key = strings.ToLower(key)
+	key = s.names.Name(key)
 	value, err := s.store.GetGauge(key)
 	if err != nil {
 		return 0, fmt.Errorf("get gauge %s: %w", key, err)
@@ -61,9 +112,10 @@ func (s *Service) GetGauge(ctx context.Context, key string) (float64, error) {
 }
 
 // GetCounter retrieves the value of a counter metric by key.
-// Keys are case-insensitive.
+// Keys are matched according to the name policy.
 func (s *Service) GetCounter(ctx context.Context, key string) (int, error) {
-	key = strings.ToLower(key)
+	key = s.names.Name(key)
+	s.syncCounters(ctx)
 	value, err := s.store.GetCounter(key)
 	if err != nil {
 		return 0, fmt.Errorf("get counter %s: %w", key, err)
@@ -78,6 +130,7 @@ func (s *Service) GetCounter(ctx context.Context, key string) (int, error) {
 //   - result: map of all metrics formatted as strings.
 func (s *Service) GetAllMetrics(ctx context.Context) ([]string, []string, map[string]string) {
 	result := make(map[string]string)
+	s.syncCounters(ctx)
 
 	gaugeKeys := make([]string, 0, len(result)) // len(result) is 0 initially, might want predefined cap
 	counterKeys := make([]string, 0, len(result))
@@ -107,47 +160,28 @@ func (s *Service) GetAllGauges(ctx context.Context) map[string]float64 {
 
 // GetAllCounters returns a map of all counter metrics.
 func (s *Service) GetAllCounters(ctx context.Context) map[string]int {
+	s.syncCounters(ctx)
 	counterMap := s.store.GetCounterMap()
 	return counterMap
 }
 
 // GaugeInsert updates a gauge metric.
-// It also triggers persistence if the storage is available and configured for synchronous writes.
+// It goes through the same path as batches, see FromStructToStore.
 func (s *Service) GaugeInsert(ctx context.Context, key string, value float64) error {
-	if err := s.store.GaugeInsert(key, value); err != nil {
-		return fmt.Errorf("store gauge %s: %w", key, err)
-	}
-
-	// If persistence layer is active/connected, try to save immediately (synchronous backup strategy)
-	// NOTE: This might be heavy if persistence is slow (e.g. file IO on every write).
-	if s.pstore.Ping(ctx) == nil {
-		gauges := s.GetAllGauges(ctx)
-		counters := s.GetAllCounters(ctx)
-		if err := s.pstore.FormattingLogs(context.Background(), gauges, counters); err != nil {
-			return fmt.Errorf("persist gauge %s: %w", key, err)
-		}
-	}
-	return nil
+	return s.FromStructToStore(ctx, metricsdto.Metrics{ID: key, MType: metricsdto.MetricTypeGauge, Value: &value})
 }
 
-// CounterInsert updates a counter metric.
-// It also triggers persistence if the storage is available.
+// CounterInsert adds an increment to a counter metric.
+// It goes through the same path as batches, see FromStructToStore.
 func (s *Service) CounterInsert(ctx context.Context, key string, value int) error {
-	if err := s.store.CounterInsert(key, value); err != nil {
-		return fmt.Errorf("store counter %s: %w", key, err)
-	}
-	if s.pstore.Ping(context.Background()) == nil {
-		gauges := s.GetAllGauges(ctx)
-		counters := s.GetAllCounters(ctx)
-		if err := s.pstore.FormattingLogs(context.Background(), gauges, counters); err != nil {
-			return fmt.Errorf("persist counter %s: %w", key, err)
-		}
-	}
-	return nil
+	delta := int64(value)
+	return s.FromStructToStore(ctx, metricsdto.Metrics{ID: key, MType: metricsdto.MetricTypeCounter, Delta: &delta})
 }
 
 // PersistRestore loads metrics from the persistent storage into the in-memory storage.
-// Typically called on application startup.
+// Typically called on application startup. The metrics were accepted once, so
+// request validation, the series limit and the timestamp skew do not apply;
+// malformed entries are skipped and reported in the error, the rest is restored.
 func (s *Service) PersistRestore(ctx context.Context) error {
 	// Clearning storage is commented out in original code, implying additive restore or fresh start.
 	// err := s.store.ClearStorage()
@@ -155,10 +189,69 @@ func (s *Service) PersistRestore(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("import persisted metrics: %w", err)
 	}
-	for _, metric := range metrics {
-		if err = s.FromStructToStore(ctx, metric); err != nil {
-			return fmt.Errorf("restore metric %s: %w", metric.ID, err)
+	if s.counters != nil {
+		// Shared counters are loaded, not replayed as increments.
+		metrics = slices.DeleteFunc(metrics, func(m metricsdto.Metrics) bool {
+			return m.MType == metricsdto.MetricTypeCounter
+		})
+		s.syncCounters(ctx)
+	}
+	if err = s.restore(metrics); err != nil {
+		return fmt.Errorf("restore metrics: %w", err)
+	}
+	return nil
+}
+
+// restore applies persisted metrics to memory as they are, without writing
+// them back. Entries without a name or a value of their type are skipped.
+func (s *Service) restore(metrics []metricsdto.Metrics) error {
+	var skipped []error
+	restored := make([]metricsdto.Metrics, 0, len(metrics))
+	updates := make([]memstorage.Update, 0, len(metrics))
+	for i, m := range metrics {
+		m.ID = s.names.Name(m.ID)
+		switch {
+		case m.ID == "":
+			skipped = append(skipped, ItemError{Index: i, ID: m.ID, MType: m.MType, Err: fmt.Errorf("%w: empty id", ErrInvalidMetric)})
+			continue
+		case m.MType == metricsdto.MetricTypeGauge && m.Value != nil:
+			updates = append(updates, memstorage.Update{Key: m.ID, Value: *m.Value})
+		case m.MType == metricsdto.MetricTypeCounter && m.Delta != nil:
+			updates = append(updates, memstorage.Update{Key: m.ID, Counter: true, Delta: int(*m.Delta)})
+		default:
+			skipped = append(skipped, ItemError{Index: i, ID: m.ID, MType: m.MType, Err: fmt.Errorf("%w: no %q value", ErrInvalidMetric, m.MType)})
+			continue
 		}
+		restored = append(restored, m)
+	}
+
+	keys := make([]string, len(restored))
+	for i, m := range restored {
+		keys[i] = s.names.Key(m.ID)
+	}
+	unlock := s.locks.lock(keys)
+	defer unlock()
+	if err := s.store.Apply(updates); err != nil {
+		return err
+	}
+	unlockState := s.locks.lockState(keys)
+	defer unlockState()
+	for _, m := range restored {
+		// The TTL runs from the last sample, not from the restart.
+		from := sampleTimeOf(m)
+		if !from.IsZero() {
+			s.stamp(m.MType, m.ID, from)
+		} else {
+			from = time.Now()
+		}
+		var ttl time.Duration
+		if m.TTL != nil {
+			ttl = time.Duration(*m.TTL) * time.Second
+		}
+		s.refreshTTL(m.MType, m.ID, ttl, from)
+	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("%d of %d metrics skipped: %w", len(skipped), len(metrics), errors.Join(skipped...))
 	}
 	return nil
 }
@@ -170,6 +263,11 @@ func (s *Service) PersistFlush(ctx context.Context) error {
 		return nil
 	}
 
+	// Дописываем серии, ожидающие фоновой записи
+	if err := s.flushDirty(ctx); err != nil {
+		return fmt.Errorf("%w: flush dirty series: %w", ErrPersistence, err)
+	}
+
 	// Проверяем доступность хранилища
 	if err := s.pstore.Ping(ctx); err != nil {
 		// Если ping не прошёл, пробуем просто сделать flush
@@ -178,11 +276,8 @@ func (s *Service) PersistFlush(ctx context.Context) error {
 	}
 
 	// Сохраняем все метрики
-	gauges := s.GetAllGauges(ctx)
-	counters := s.GetAllCounters(ctx)
-
-	if err := s.pstore.FormattingLogs(ctx, gauges, counters); err != nil {
-		return fmt.Errorf("persist flush formatting: %w", err)
+	if err := s.persist(ctx); err != nil {
+		return fmt.Errorf("%w: flush: %w", ErrPersistence, err)
 	}
 
 	// Вызываем flush для записи на диск
@@ -194,40 +289,16 @@ func (s *Service) PersistFlush(ctx context.Context) error {
 }
 
 // FromStructToStore updates the storage with a single metric DTO.
-// Handles both Gauge and Counter types.
+// Handles both Gauge and Counter types. It is applied as a batch of one, so it
+// is validated, limited and persisted exactly like the entries of a batch.
 func (s *Service) FromStructToStore(ctx context.Context, metric metricsdto.Metrics) error {
-	switch metric.MType {
-	case metricsdto.MetricTypeGauge:
-		if metric.Value == nil {
-			value := float64(0)
-			metric.Value = &value
-		}
-		if err := s.GaugeInsert(ctx, metric.ID, *metric.Value); err != nil {
-			return fmt.Errorf("insert gauge %s: %w", metric.ID, err)
-		}
-	case metricsdto.MetricTypeCounter:
-		if metric.Delta == nil {
-			value := int64(0)
-			metric.Delta = &value
-		}
-		if err := s.CounterInsert(ctx, metric.ID, int(*metric.Delta)); err != nil {
-			return fmt.Errorf("insert counter %s: %w", metric.ID, err)
-		}
-	default:
-		return fmt.Errorf("invalid action type")
+	_, err := s.ApplyBatch(ctx, []metricsdto.Metrics{metric}, false)
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) && len(batchErr.Items) == 1 {
+		item := batchErr.Items[0]
+		return fmt.Errorf("%s %s: %w", item.MType, item.ID, item.Err)
 	}
-	return nil
-}
-
-// FromStructToStoreBatch updates the storage with a batch of metric DTOs.
-func (s *Service) FromStructToStoreBatch(ctx context.Context, metrics []metricsdto.Metrics) error {
-	for _, metric := range metrics {
-		err := s.FromStructToStore(ctx, metric)
-		if err != nil {
-			return fmt.Errorf("cannot write batch %s: %w", metric.ID, err)
-		}
-	}
-	return nil
+	return err
 }
 
 // StorageCloser closes the persistent storage connection.
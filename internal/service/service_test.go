@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/metricname"
 	storageOrig "gometrics/internal/storage"
 
 	"github.com/stretchr/testify/assert"
@@ -181,6 +184,103 @@ func TestService_PersistRestore(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+// snapshotPersistStorage returns a fixed snapshot from ImportLogs.
+type snapshotPersistStorage struct {
+	stubPersistStorage
+	metrics []metricsdto.Metrics
+}
+
+func (s *snapshotPersistStorage) ImportLogs(context.Context) ([]metricsdto.Metrics, error) {
+	return s.metrics, nil
+}
+
+// TestService_PersistRestore_BypassesValidation verifies that restore keeps
+// series beyond a lowered limit or the skew and skips only malformed entries.
+func TestService_PersistRestore_BypassesValidation(t *testing.T) {
+	ctx := context.Background()
+	v, d := 1.5, int64(3)
+	future := time.Now().Add(time.Hour).UnixMilli()
+	pstore := &snapshotPersistStorage{metrics: []metricsdto.Metrics{
+		{ID: "g1", MType: metricsdto.MetricTypeGauge, Value: &v},
+		{ID: "g2", MType: metricsdto.MetricTypeGauge, Value: &v, Timestamp: &future},
+		{ID: "c1", MType: metricsdto.MetricTypeCounter, Delta: &d},
+		{ID: "", MType: metricsdto.MetricTypeGauge, Value: &v},
+		{ID: "broken", MType: metricsdto.MetricTypeCounter},
+	}}
+	s := NewService(storageOrig.NewMemStorage(), pstore)
+	s.SetMaxSeries(1)
+	s.SetMaxFutureSkew(time.Minute)
+
+	err := s.PersistRestore(ctx)
+	require.ErrorIs(t, err, ErrInvalidMetric)
+	assert.ErrorContains(t, err, "2 of 5 metrics skipped")
+	assert.Equal(t, map[string]float64{"g1": 1.5, "g2": 1.5}, s.GetAllGauges(ctx))
+	assert.Equal(t, map[string]int{"c1": 3}, s.GetAllCounters(ctx))
+}
+
+func TestService_SetMaxSeries(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(storageOrig.NewMemStorage(), &stubPersistStorage{})
+	s.SetMaxSeries(2)
+
+	require.NoError(t, s.GaugeInsert(ctx, "g1", 1))
+	require.NoError(t, s.CounterInsert(ctx, "c1", 1))
+	assert.ErrorIs(t, s.GaugeInsert(ctx, "g2", 1), ErrSeriesLimit)
+	assert.ErrorIs(t, s.CounterInsert(ctx, "c2", 1), ErrSeriesLimit)
+
+	// Existing series can still be updated.
+	assert.NoError(t, s.GaugeInsert(ctx, "g1", 2))
+	assert.NoError(t, s.CounterInsert(ctx, "c1", 1))
+}
+
+// TestService_SetMaxSeries_Concurrent verifies that concurrent single updates
+// and batches do not overshoot the series limit.
+func TestService_SetMaxSeries_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(storageOrig.NewMemStorage(), &stubPersistStorage{})
+	s.SetMaxSeries(10)
+
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("series%d", i)
+			switch i % 3 {
+			case 0:
+				_ = s.GaugeInsert(ctx, name, 1)
+			case 1:
+				_ = s.CounterInsert(ctx, name, 1)
+			default:
+				value := 1.0
+				_ = s.FromStructToStoreBatch(ctx, []metricsdto.Metrics{{ID: name, MType: metricsdto.MetricTypeGauge, Value: &value}})
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 10, s.store.Len())
+}
+
+func TestService_NamePolicy(t *testing.T) {
+	ctx := context.Background()
+	pstore := &seriesWriterStorage{}
+	s := NewService(storageOrig.NewMemStorageWithPolicy(metricname.Prometheus), pstore)
+	s.SetNamePolicy(metricname.Prometheus)
+	delta := int64(2)
+
+	require.NoError(t, s.CounterInsert(ctx, "http.requests", 1))
+	require.NoError(t, s.FromStructToStoreBatch(ctx, []metricsdto.Metrics{
+		{ID: "http-requests", MType: metricsdto.MetricTypeCounter, Delta: &delta},
+	}))
+
+	_, _, counter := pstore.written()
+	assert.Equal(t, map[string]int{"http_requests": 3}, counter, "persisted under the rewritten name")
+	c, err := s.GetCounter(ctx, "http.requests")
+	require.NoError(t, err)
+	assert.Equal(t, 3, c)
+	assert.False(t, s.SampleTime(metricsdto.MetricTypeCounter, "http_requests").IsZero())
+}
+
 // ExampleService_GaugeInsert demonstrates inserting a gauge metric.
 func ExampleService_GaugeInsert() {
 	// Initialize service with memory storage and mock persistence
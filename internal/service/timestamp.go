@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+)
+
+// ErrFutureTimestamp is returned for samples timestamped further in the future
+// than the allowed clock skew.
+var ErrFutureTimestamp = errors.New("timestamp is too far in the future")
+
+// timestampStorage is implemented by persistent storages that record the sample
+// time and the explicit TTL of every series, e.g. the UpdateAt and TTL columns
+// of the database.
+type timestampStorage interface {
+	FormattingLogsAt(ctx context.Context, gauge map[string]float64, counter map[string]int, at func(mtype, name string) time.Time, ttl func(mtype, name string) time.Duration) error
+}
+
+// SetMaxFutureSkew rejects samples timestamped more than d after the server
+// clock with ErrFutureTimestamp. A non-positive d disables the check.
+func (s *Service) SetMaxFutureSkew(d time.Duration) {
+	s.maxSkew.Store(int64(d))
+}
+
+// sampleTimeOf converts the optional DTO timestamp (Unix milliseconds).
+// It returns the zero time when the metric has no timestamp.
+func sampleTimeOf(metric metricsdto.Metrics) time.Time {
+	if metric.Timestamp == nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(*metric.Timestamp)
+}
+
+// checkTimestamp returns ErrFutureTimestamp if the sample time is beyond the allowed skew.
+func (s *Service) checkTimestamp(metric metricsdto.Metrics) error {
+	at := sampleTimeOf(metric)
+	skew := time.Duration(s.maxSkew.Load())
+	if at.IsZero() || skew <= 0 {
+		return nil
+	}
+	if limit := time.Now().Add(skew); at.After(limit) {
+		return fmt.Errorf("%w: %s %s at %s, limit %s", ErrFutureTimestamp, metric.MType, metric.ID,
+			at.UTC().Format(time.RFC3339Nano), limit.UTC().Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// supersedes reports whether a sample taken at at is not older than the last
+// recorded sample of the series. Samples without a time are taken now: they
+// lose to samples stamped ahead of the server clock within the allowed skew.
+// It must be called with the series lock held.
+func (s *Service) supersedes(mtype, name string, at time.Time) bool {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	last, ok := s.lastStamp(mtype, name)
+	return !ok || !at.Before(last)
+}
+
+// lastStamp returns the sample time of a series. It must be called with the
+// series lock held, which keeps the time from changing.
+func (s *Service) lastStamp(mtype, name string) (time.Time, bool) {
+	st, key := s.series(mtype, name)
+	at, ok := st.stamps[key]
+	return at, ok
+}
+
+// stamp records the sample time of a series; the zero time means now.
+// It must be called with the series lock and its state lock held (see seriesLocks.lockState).
+func (s *Service) stamp(mtype, name string, at time.Time) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	st, key := s.series(mtype, name)
+	if st.stamps == nil {
+		st.stamps = make(map[string]time.Time)
+	}
+	st.stamps[key] = at
+}
+
+// forgetStamp drops the sample time of a deleted series.
+// It must be called with the series lock and its state lock held.
+func (s *Service) forgetStamp(mtype, name string) {
+	st, key := s.series(mtype, name)
+	delete(st.stamps, key)
+}
+
+// SampleTime returns the time of the last accepted sample of a series, or the
+// zero time if it is unknown. It does not need the series lock.
+func (s *Service) SampleTime(mtype, name string) time.Time {
+	st, key := s.series(mtype, name)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.stamps[key]
+}
+
+// persist writes all metrics to the persistent storage, with their sample
+// times when the storage records them. Shared counters are left to the
+// storage, which keeps their totals.
+func (s *Service) persist(ctx context.Context) error {
+	gauges := s.GetAllGauges(ctx)
+	counters := map[string]int{}
+	if s.counters == nil {
+		counters = s.GetAllCounters(ctx)
+	}
+	if ts, ok := s.pstore.(timestampStorage); ok {
+		return ts.FormattingLogsAt(ctx, gauges, counters, s.SampleTime, s.seriesTTL)
+	}
+	return s.pstore.FormattingLogs(ctx, gauges, counters)
+}
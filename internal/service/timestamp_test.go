@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	storageOrig "gometrics/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// timestampPersistStorage records the sample times passed to FormattingLogsAt.
+type timestampPersistStorage struct {
+	stubPersistStorage
+	written map[string]time.Time
+}
+
+func (s *timestampPersistStorage) FormattingLogsAt(_ context.Context, gauge map[string]float64, _ map[string]int, at func(mtype, name string) time.Time, _ func(mtype, name string) time.Duration) error {
+	s.written = make(map[string]time.Time)
+	for name := range gauge {
+		s.written[name] = at(metricsdto.MetricTypeGauge, name)
+	}
+	return nil
+}
+
+func gaugeAt(id string, value float64, at time.Time) metricsdto.Metrics {
+	ts := at.UnixMilli()
+	return metricsdto.Metrics{ID: id, MType: metricsdto.MetricTypeGauge, Value: &value, Timestamp: &ts}
+}
+
+func TestService_LastWriteWins(t *testing.T) {
+	ctx := context.Background()
+	pstore := &timestampPersistStorage{}
+	s := NewService(storageOrig.NewMemStorage(), pstore)
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	require.NoError(t, s.FromStructToStore(ctx, gaugeAt("temp", 2, base.Add(time.Minute))))
+	require.NoError(t, s.FromStructToStore(ctx, gaugeAt("temp", 1, base)), "late samples are ignored, not rejected")
+
+	v, err := s.GetGauge(ctx, "temp")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, v)
+	assert.Equal(t, base.Add(time.Minute), s.SampleTime(metricsdto.MetricTypeGauge, "temp"))
+	assert.Equal(t, base.Add(time.Minute), pstore.written["temp"], "sample times reach the persistent storage")
+
+	// An update without a timestamp is taken at arrival and always applies.
+	require.NoError(t, s.GaugeInsert(ctx, "temp", 3))
+	v, _ = s.GetGauge(ctx, "temp")
+	assert.Equal(t, 3.0, v)
+	require.NoError(t, s.FromStructToStore(ctx, gaugeAt("temp", 4, base.Add(2*time.Minute))))
+	v, _ = s.GetGauge(ctx, "temp")
+	assert.Equal(t, 3.0, v)
+}
+
+func TestService_MaxFutureSkew(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(storageOrig.NewMemStorage(), &stubPersistStorage{})
+	s.SetMaxFutureSkew(time.Minute)
+
+	ahead := time.Now().Add(30 * time.Second).Truncate(time.Millisecond)
+	assert.NoError(t, s.FromStructToStore(ctx, gaugeAt("ok", 1, ahead)))
+	// Updates without a timestamp are taken now, before the accepted sample.
+	require.NoError(t, s.GaugeInsert(ctx, "ok", 2))
+	v, err := s.GetGauge(ctx, "ok")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, v)
+	assert.Equal(t, ahead, s.SampleTime(metricsdto.MetricTypeGauge, "ok"))
+	ts := ahead.UnixMilli()
+	delta := int64(1)
+	require.NoError(t, s.FromStructToStore(ctx, metricsdto.Metrics{ID: "hits", MType: metricsdto.MetricTypeCounter, Delta: &delta, Timestamp: &ts}))
+	require.NoError(t, s.CounterInsert(ctx, "hits", 1))
+	assert.Equal(t, ahead, s.SampleTime(metricsdto.MetricTypeCounter, "hits"), "the sample time does not move back")
+
+	assert.ErrorIs(t, s.FromStructToStore(ctx, gaugeAt("ahead", 1, time.Now().Add(time.Hour))), ErrFutureTimestamp)
+
+	err = s.FromStructToStoreBatch(ctx, []metricsdto.Metrics{
+		gaugeAt("first", 1, time.Now()),
+		gaugeAt("ahead", 1, time.Now().Add(time.Hour)),
+	})
+	assert.ErrorIs(t, err, ErrFutureTimestamp)
+	_, err = s.GetGauge(ctx, "first")
+	assert.Error(t, err, "a batch with a future sample is rejected as a whole")
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+)
+
+// EvictedSeriesMetric is the counter of series evicted by EvictExpired.
+const EvictedSeriesMetric = "EvictedSeries"
+
+// TTLPolicy assigns a time to live to series updated without an explicit TTL.
+type TTLPolicy struct {
+	Default  time.Duration            // TTL of series matching no pattern, 0 = never expire
+	Patterns map[string]time.Duration // path.Match patterns of series names, e.g. "batch_*"
+}
+
+// For returns the TTL of the named series; the longest matching pattern wins.
+func (p TTLPolicy) For(name string) time.Duration {
+	ttl, best := p.Default, -1
+	for pattern, d := range p.Patterns {
+		if ok, _ := path.Match(pattern, name); ok && len(pattern) > best {
+			ttl, best = d, len(pattern)
+		}
+	}
+	return ttl
+}
+
+// metricDeleter is implemented by persistent storages that keep series until
+// they are deleted explicitly: the database deletes the rows and the file
+// storage rewrites the snapshot.
+type metricDeleter interface {
+	DeleteMetrics(ctx context.Context, metrics []metricsdto.Metrics) error
+}
+
+// expiry is the expiration time of one series.
+type expiry struct {
+	mtype, name string
+	at          time.Time
+	ttl         time.Duration // TTL set explicitly by the update, 0 = from the policy
+}
+
+// expiryKey identifies a series by its type and the key of its name under the name policy.
+func (s *Service) expiryKey(mtype, name string) string {
+	return mtype + "/" + s.names.Key(name)
+}
+
+// series returns the stripe keeping the state of a series and its expiryKey.
+func (s *Service) series(mtype, name string) (*seriesStripe, string) {
+	key := s.names.Key(name)
+	return s.locks.stripe(key), mtype + "/" + key
+}
+
+// SetTTLPolicy sets the TTL of series updated without an explicit TTL.
+// It applies to subsequent updates.
+func (s *Service) SetTTLPolicy(p TTLPolicy) {
+	s.ttl.Store(&p)
+}
+
+// refreshTTL sets the expiration time of a series updated at from. A
+// non-positive ttl falls back to the policy. The EvictedSeries counter never
+// expires: it counts the evictions themselves.
+// It must be called with the series lock and its state lock held, so that
+// EvictExpired sees either the old expiry and the old value or both new ones.
+func (s *Service) refreshTTL(mtype, name string, ttl time.Duration, from time.Time) {
+	explicit := max(ttl, 0)
+	if p := s.ttl.Load(); ttl <= 0 && p != nil {
+		ttl = p.For(name)
+	}
+	st, key := s.series(mtype, name)
+	if ttl <= 0 || key == s.expiryKey(metricsdto.MetricTypeCounter, EvictedSeriesMetric) {
+		delete(st.expiry, key)
+		return
+	}
+	if st.expiry == nil {
+		st.expiry = make(map[string]expiry)
+	}
+	st.expiry[key] = expiry{mtype: mtype, name: name, at: from.Add(ttl), ttl: explicit}
+}
+
+// expiryOf returns the expiry of a series, if it has one.
+// It must be called with the series lock held.
+func (s *Service) expiryOf(mtype, name string) (expiry, bool) {
+	st, key := s.series(mtype, name)
+	e, ok := st.expiry[key]
+	return e, ok
+}
+
+// readExpiry returns the expiry of a series like expiryOf without the series lock.
+func (s *Service) readExpiry(mtype, name string) (expiry, bool) {
+	st, key := s.series(mtype, name)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	e, ok := st.expiry[key]
+	return e, ok
+}
+
+// restoreExpiry puts back the expiry e (none unless ok) of a series if its
+// current expiry is still set, the one set by a rolled back update.
+// It must be called with the series lock and its state lock held.
+func (s *Service) restoreExpiry(mtype, name string, e expiry, ok bool, set expiry) {
+	st, key := s.series(mtype, name)
+	if st.expiry[key].at != set.at {
+		return
+	}
+	if ok {
+		st.expiry[key] = e
+	} else {
+		delete(st.expiry, key)
+	}
+}
+
+// seriesTTL returns the TTL set explicitly by the last update of a series, or
+// 0 if its TTL comes from the policy. It is persisted with the series.
+func (s *Service) seriesTTL(mtype, name string) time.Duration {
+	e, _ := s.readExpiry(mtype, name)
+	return e.ttl
+}
+
+// ExpiresAt returns the expiration time of a series, if it has one.
+func (s *Service) ExpiresAt(mtype, name string) (time.Time, bool) {
+	e, ok := s.readExpiry(mtype, name)
+	return e.at, ok
+}
+
+// EvictExpired removes the series that expired before now from memory and from
+// the persistent storage, counts them in the EvictedSeries counter and returns them.
+// The expired series are deleted under their series locks, after checking
+// again that no update has extended their TTL since they were picked.
+// Shared counters are only evicted from memory: their rows are shared with
+// other servers, which may still be updating them.
+func (s *Service) EvictExpired(ctx context.Context, now time.Time) ([]metricsdto.Metrics, error) {
+	var candidates []expiry
+	for i := range s.locks.stripes {
+		st := &s.locks.stripes[i]
+		st.mu.RLock()
+		for _, e := range st.expiry {
+			if e.at.Before(now) {
+				candidates = append(candidates, e)
+			}
+		}
+		st.mu.RUnlock()
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(candidates))
+	for i, e := range candidates {
+		keys[i] = s.names.Key(e.name)
+	}
+	unlock := s.locks.lock(keys)
+	unlockState := s.locks.lockState(keys)
+	var (
+		evicted []metricsdto.Metrics
+		errs    []error
+	)
+	for _, e := range candidates {
+		if !s.expire(e, now) {
+			continue
+		}
+		var err error
+		if e.mtype == metricsdto.MetricTypeGauge {
+			err = s.store.DeleteGauge(e.name)
+		} else {
+			err = s.store.DeleteCounter(e.name)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("evict %s %s: %w", e.mtype, e.name, err))
+		}
+		s.forgetStamp(e.mtype, e.name)
+		evicted = append(evicted, metricsdto.Metrics{ID: e.name, MType: e.mtype})
+	}
+	unlockState()
+	unlock()
+	if len(evicted) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	deleted := evicted
+	if s.counters != nil {
+		deleted = slices.DeleteFunc(slices.Clone(evicted), func(m metricsdto.Metrics) bool {
+			return m.MType == metricsdto.MetricTypeCounter
+		})
+	}
+	if d, ok := s.pstore.(metricDeleter); ok {
+		if len(deleted) > 0 {
+			if err := d.DeleteMetrics(ctx, deleted); err != nil {
+				errs = append(errs, fmt.Errorf("evict from persistent storage: %w", err))
+			}
+		}
+	} else if s.pstore != nil && s.pstore.Ping(ctx) == nil {
+		if err := s.persist(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rewrite snapshot after eviction: %w", err))
+		}
+	}
+
+	if err := s.CounterInsert(ctx, EvictedSeriesMetric, len(evicted)); err != nil && !errors.Is(err, ErrSeriesLimit) {
+		errs = append(errs, fmt.Errorf("count evictions: %w", err))
+	}
+	return evicted, errors.Join(errs...)
+}
+
+// expire drops the expiry of a series picked for eviction if it is still
+// expired at now, and reports whether it was.
+// It must be called with the series lock and its state lock held.
+func (s *Service) expire(e expiry, now time.Time) bool {
+	st, key := s.series(e.mtype, e.name)
+	current, ok := st.expiry[key]
+	if !ok || !current.at.Before(now) {
+		return false
+	}
+	delete(st.expiry, key)
+	return true
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/persist"
+	storageOrig "gometrics/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deletingPersistStorage records the series deleted via DeleteMetrics.
+type deletingPersistStorage struct {
+	stubPersistStorage
+	deleted []metricsdto.Metrics
+}
+
+func (s *deletingPersistStorage) DeleteMetrics(_ context.Context, metrics []metricsdto.Metrics) error {
+	s.deleted = append(s.deleted, metrics...)
+	return nil
+}
+
+func TestTTLPolicy_For(t *testing.T) {
+	p := TTLPolicy{
+		Default: time.Minute,
+		Patterns: map[string]time.Duration{
+			"batch_*":      time.Hour,
+			"batch_daily*": 24 * time.Hour,
+		},
+	}
+
+	tests := []struct {
+		name string
+		want time.Duration
+	}{
+		{"Alloc", time.Minute},
+		{"batch_import", time.Hour},
+		{"batch_daily_report", 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, p.For(tt.name))
+		})
+	}
+	assert.Zero(t, TTLPolicy{}.For("Alloc"))
+}
+
+func TestService_EvictExpired(t *testing.T) {
+	ctx := context.Background()
+	pstore := &deletingPersistStorage{}
+	s := NewService(storageOrig.NewMemStorage(), pstore)
+	s.SetTTLPolicy(TTLPolicy{Patterns: map[string]time.Duration{"job_*": time.Minute}})
+
+	require.NoError(t, s.GaugeInsert(ctx, "job_duration", 1))
+	require.NoError(t, s.GaugeInsert(ctx, "Alloc", 1))
+	ttl := int64(3600)
+	delta := int64(1)
+	require.NoError(t, s.FromStructToStore(ctx, metricsdto.Metrics{
+		ID: "job_runs", MType: metricsdto.MetricTypeCounter, Delta: &delta, TTL: &ttl,
+	}))
+
+	_, ok := s.ExpiresAt(metricsdto.MetricTypeGauge, "Alloc")
+	assert.False(t, ok, "series without a TTL never expire")
+	at, ok := s.ExpiresAt(metricsdto.MetricTypeCounter, "job_runs")
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), at, time.Minute, "explicit TTL overrides the policy")
+
+	evicted, err := s.EvictExpired(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, evicted, "nothing expired yet")
+
+	evicted, err = s.EvictExpired(ctx, time.Now().Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []metricsdto.Metrics{{ID: "job_duration", MType: metricsdto.MetricTypeGauge}}, evicted)
+	assert.Equal(t, evicted, pstore.deleted)
+
+	_, err = s.GetGauge(ctx, "job_duration")
+	assert.Error(t, err)
+	_, err = s.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+	n, err := s.GetCounter(ctx, EvictedSeriesMetric)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// deletingSharedStorage is a sharedCounterStorage recording DeleteMetrics calls.
+type deletingSharedStorage struct {
+	*sharedCounterStorage
+	deleted []metricsdto.Metrics
+}
+
+func (s *deletingSharedStorage) DeleteMetrics(_ context.Context, metrics []metricsdto.Metrics) error {
+	s.deleted = append(s.deleted, metrics...)
+	return nil
+}
+
+func TestService_EvictExpired_SharedCounters(t *testing.T) {
+	ctx := context.Background()
+	db := &deletingSharedStorage{sharedCounterStorage: newSharedCounterStorage()}
+	s := NewService(storageOrig.NewMemStorage(), db)
+	require.NoError(t, s.EnableSharedCounters(0))
+	s.SetTTLPolicy(TTLPolicy{Patterns: map[string]time.Duration{"job_*": time.Minute}})
+
+	require.NoError(t, s.GaugeInsert(ctx, "job_duration", 1))
+	require.NoError(t, s.CounterInsert(ctx, "job_runs", 1))
+
+	evicted, err := s.EvictExpired(ctx, time.Now().Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, evicted, 2)
+	assert.Equal(t, []metricsdto.Metrics{{ID: "job_duration", MType: metricsdto.MetricTypeGauge}}, db.deleted,
+		"shared counter rows stay for the other servers")
+	assert.Equal(t, 1, db.counter["job_runs"])
+}
+
+func TestService_EvictExpired_UpdatedMeanwhile(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(storageOrig.NewMemStorage(), &deletingPersistStorage{})
+	s.SetTTLPolicy(TTLPolicy{Default: time.Minute})
+	require.NoError(t, s.GaugeInsert(ctx, "job_duration", 1))
+
+	// The eviction picks the series while an update holds its lock, and the
+	// update extends the TTL before the eviction gets the lock.
+	unlock := s.locks.lock([]string{s.names.Key("job_duration")})
+	done := make(chan []metricsdto.Metrics)
+	go func() {
+		evicted, _ := s.EvictExpired(ctx, time.Now().Add(2*time.Minute))
+		done <- evicted
+	}()
+	time.Sleep(20 * time.Millisecond)
+	unlockState := s.locks.lockState([]string{s.names.Key("job_duration")})
+	s.refreshTTL(metricsdto.MetricTypeGauge, "job_duration", time.Hour, time.Now())
+	unlockState()
+	unlock()
+
+	assert.Empty(t, <-done, "the updated series is kept")
+	_, err := s.GetGauge(ctx, "job_duration")
+	assert.NoError(t, err)
+}
+
+func TestService_EvictExpired_Restart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	policy := TTLPolicy{Default: time.Minute}
+	open := func() *Service {
+		pstore, err := persist.NewPersistStorage(dir, 300)
+		require.NoError(t, err)
+		s := NewService(storageOrig.NewMemStorage(), pstore)
+		s.SetTTLPolicy(policy)
+		return s
+	}
+
+	s := open()
+	ttl := int64(3600)
+	value := 1.0
+	require.NoError(t, s.FromStructToStore(ctx, metricsdto.Metrics{
+		ID: "job_duration", MType: metricsdto.MetricTypeGauge, Value: &value, TTL: &ttl,
+	}))
+	require.NoError(t, s.GaugeInsert(ctx, "job_queue", 2))
+	expires, ok := s.ExpiresAt(metricsdto.MetricTypeGauge, "job_duration")
+	require.True(t, ok)
+
+	evicted, err := s.EvictExpired(ctx, time.Now().Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []metricsdto.Metrics{{ID: "job_queue", MType: metricsdto.MetricTypeGauge}}, evicted)
+	_, ok = s.ExpiresAt(metricsdto.MetricTypeCounter, EvictedSeriesMetric)
+	assert.False(t, ok, "the eviction counter does not expire")
+
+	// Without a flush, as after a crash: the WAL does not bring back the evicted series.
+	restarted := open()
+	require.NoError(t, restarted.PersistRestore(ctx))
+	_, err = restarted.GetGauge(ctx, "job_queue")
+	assert.Error(t, err)
+	at, ok := restarted.ExpiresAt(metricsdto.MetricTypeGauge, "job_duration")
+	require.True(t, ok, "the explicit TTL is restored")
+	assert.WithinDuration(t, expires, at, time.Second)
+}
+
+func TestService_FromStructToStore_NegativeTTL(t *testing.T) {
+	s := NewService(storageOrig.NewMemStorage(), &stubPersistStorage{})
+	ttl := int64(-1)
+	value := 1.0
+	err := s.FromStructToStore(context.Background(), metricsdto.Metrics{
+		ID: "Alloc", MType: metricsdto.MetricTypeGauge, Value: &value, TTL: &ttl,
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package signature
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrInvalidAESKey is returned for malformed AES key entries.
+var ErrInvalidAESKey = errors.New("invalid AES key")
+
+// defaultAESKeyID names a key given without an ID.
+const defaultAESKeyID = "default"
+
+// AESKey is a named AES-128/192/256 key used to encrypt data at rest.
+// The ID is stored with the ciphertext, so that data encrypted with an older
+// key can still be decrypted after the keys are rotated.
+type AESKey struct {
+	ID  string
+	Key []byte
+}
+
+// GetAESKeys reads the AES keys from the file at path, see ParseAESKeys.
+func GetAESKeys(path string) ([]AESKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAESKeys(string(raw))
+}
+
+// ParseAESKeys parses entries "id=key" separated by commas or new lines;
+// the key is hex or base64 encoded. A single entry may omit "id=".
+// The first key is the active one, the others are only used to decrypt.
+func ParseAESKeys(s string) ([]AESKey, error) {
+	entries := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' })
+	var keys []AESKey
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, "=")
+		if !ok || isBase64Padding(entry) {
+			id, encoded = defaultAESKeyID, entry
+		}
+		id, encoded = strings.TrimSpace(id), strings.TrimSpace(encoded)
+		if id == "" || len(id) > 255 || strings.ContainsAny(id, " \t") {
+			return nil, fmt.Errorf("%w: bad key ID %q", ErrInvalidAESKey, id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("%w: duplicate key ID %q", ErrInvalidAESKey, id)
+		}
+		key, err := decodeAESKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrInvalidAESKey, id, err)
+		}
+		seen[id] = true
+		keys = append(keys, AESKey{ID: id, Key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidAESKey)
+	}
+	return keys, nil
+}
+
+// isBase64Padding reports whether the only "=" of entry is base64 padding
+// at its end, i.e. entry is a bare key.
+func isBase64Padding(entry string) bool {
+	return strings.TrimRight(entry, "=") != entry && !strings.Contains(strings.TrimRight(entry, "="), "=")
+}
+
+// decodeAESKey decodes a hex or base64 key of 16, 24 or 32 bytes.
+func decodeAESKey(encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, errors.New("key is neither hex nor base64")
+		}
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key has %d bytes, want 16, 24 or 32", len(key))
+}
@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"os"
+
+	"gometrics/internal/problem"
 )
 
 func GetRSAKey(rsa string) (*rsa.PrivateKey, error) {
@@ -61,12 +63,12 @@ func DecryptRSAHandler(keyPath string) func(http.Handler) http.Handler {
 
 			byteBody, err := io.ReadAll(r.Body)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				problem.Error(w, r, http.StatusBadRequest, problem.CodeBadRequest, "cannot read request body: "+err.Error())
 				return
 			}
 			decBody, err := DecryptByKey(byteBody, pKey)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidSignature, "cannot decrypt request body: "+err.Error())
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewReader(decBody))
@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	"gometrics/internal/problem"
 )
 
 type ResponseHashWriter struct {
@@ -42,11 +44,17 @@ func SignatureCheck(r *http.Request, secret []byte, header string) bool {
 	_ = r.Body.Close()
 	r.Body = io.NopCloser(bytes.NewReader(payload))
 
+	return PayloadCheck(payload, secret, header)
+}
+
+// PayloadCheck verifies that header holds the hex-encoded HMAC-SHA256 of payload.
+// It is shared by the server-side request check and the agent-side response check.
+func PayloadCheck(payload, secret []byte, header string) bool {
 	mac := hmac.New(sha256.New, secret)
 	mac.Write(payload)
 	expected := mac.Sum(nil)
 
-	got, err := hex.DecodeString(header)
+	got, err := hex.DecodeString(strings.TrimSpace(header))
 	return err == nil && hmac.Equal(got, expected)
 }
 
@@ -76,7 +84,7 @@ func SignatureHandler(secret string) func(http.Handler) http.Handler {
 
 			if reqHeader != "" && !strings.EqualFold(reqHeader, "none") {
 				if !SignatureCheck(r, key, reqHeader) {
-					http.Error(w, "wrong key", http.StatusBadRequest)
+					problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidSignature, "wrong key")
 					return
 				}
 			}
@@ -84,7 +92,7 @@ func SignatureHandler(secret string) func(http.Handler) http.Handler {
 			rw := NewResponseHashWriter(w, key)
 			next.ServeHTTP(rw, r)
 			if _, err := rw.Finalyze(); err != nil {
-				http.Error(w, "cannot write buffer to response", http.StatusBadRequest)
+				problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "cannot write buffer to response")
 			}
 
 		})
@@ -203,3 +203,45 @@ func TestSignatureHandler(t *testing.T) {
 		assert.Equal(t, http.StatusOK, rec.Code)
 	})
 }
+
+func TestParseAESKeys(t *testing.T) {
+	key16 := bytes.Repeat([]byte{1}, 16)
+	key32 := bytes.Repeat([]byte{2}, 32)
+	hex32 := hex.EncodeToString(key32)
+	b64 := "AQEBAQEBAQEBAQEBAQEBAQ==" // key16
+
+	tests := []struct {
+		name    string
+		input   string
+		want    []AESKey
+		wantErr bool
+	}{
+		{name: "bare hex key", input: hex32, want: []AESKey{{ID: "default", Key: key32}}},
+		{name: "bare base64 key", input: b64, want: []AESKey{{ID: "default", Key: key16}}},
+		{
+			name:  "rotation list",
+			input: "k2=" + hex32 + ", k1=" + b64,
+			want:  []AESKey{{ID: "k2", Key: key32}, {ID: "k1", Key: key16}},
+		},
+		{
+			name:  "file with comments",
+			input: "# active key first\nk2=" + hex32 + "\n\nk1=" + b64 + "\n",
+			want:  []AESKey{{ID: "k2", Key: key32}, {ID: "k1", Key: key16}},
+		},
+		{name: "wrong length", input: "k1=abcd", wantErr: true},
+		{name: "not encoded", input: "k1=not a key!", wantErr: true},
+		{name: "duplicate ID", input: "k1=" + hex32 + ",k1=" + b64, wantErr: true},
+		{name: "empty", input: " \n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAESKeys(tt.input)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidAESKey)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
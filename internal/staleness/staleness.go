@@ -0,0 +1,285 @@
+// Package staleness tracks when each series and each reporting source
+// (agent) was last updated, so that data of dead agents can be recognised.
+package staleness
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/auth"
+	"gometrics/internal/metricname"
+)
+
+// AgentHeader is the request header carrying the agent identity.
+const AgentHeader = "X-Agent-ID"
+
+// StaleHeader is set to "true" on read responses of stale series.
+const StaleHeader = "X-Metric-Stale"
+
+// DefaultMaxSources is how many sources a tracker remembers. Source IDs come
+// from clients, so beyond it the least recently seen source is forgotten.
+const DefaultMaxSources = 10000
+
+// SourceID identifies the reporting source of a request: the X-Agent-ID header,
+// else the name of the API token, else the client IP.
+func SourceID(r *http.Request) string {
+	if id := r.Header.Get(AgentHeader); id != "" {
+		return id
+	}
+	if tok, ok := auth.FromContext(r.Context()); ok {
+		return "token:" + tok.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Source describes one reporting source.
+type Source struct {
+	ID       string    `json:"id"`
+	LastSeen time.Time `json:"lastSeen"`
+	Series   int       `json:"series"` // distinct series reported by the source
+	Stale    bool      `json:"stale"`
+}
+
+type seriesKey struct {
+	tenant, mtype, name string // name is the key of the name policy
+}
+
+type sourceKey struct {
+	tenant, id string
+}
+
+type sourceState struct {
+	lastSeen time.Time
+	series   map[seriesKey]struct{}
+}
+
+// Tracker records update times. Series it has never seen are not stale;
+// use Seed for series restored from persistent storage. Series names are
+// matched by the name policy of the storage, case-insensitive by default.
+// It is safe for concurrent use.
+type Tracker struct {
+	mu         sync.RWMutex
+	window     time.Duration
+	now        func() time.Time
+	names      metricname.Policy
+	maxSources int
+	series     map[seriesKey]time.Time
+	sources    map[sourceKey]*sourceState
+}
+
+// NewTracker creates a tracker considering data older than window stale and
+// remembering up to DefaultMaxSources sources.
+func NewTracker(window time.Duration) *Tracker {
+	return &Tracker{
+		window:     window,
+		now:        time.Now,
+		maxSources: DefaultMaxSources,
+		series:     make(map[seriesKey]time.Time),
+		sources:    make(map[sourceKey]*sourceState),
+	}
+}
+
+// SetNamePolicy sets how series names are matched; it should be the policy
+// of the storages and set before the first update.
+func (t *Tracker) SetNamePolicy(p metricname.Policy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.names = p
+}
+
+// key returns the key of a series. It must be called with t.mu held.
+func (t *Tracker) key(tenant, mtype, name string) seriesKey {
+	return seriesKey{tenant, mtype, t.names.Key(name)}
+}
+
+// Window returns the staleness window.
+func (t *Tracker) Window() time.Duration {
+	return t.window
+}
+
+// Touch records that source updated the metrics of the tenant just now.
+func (t *Tracker) Touch(tenant, source string, metrics []metricsdto.Metrics) {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	src, ok := t.sources[sourceKey{tenant, source}]
+	if !ok {
+		if len(t.sources) >= t.maxSources {
+			t.evictOldestSource()
+		}
+		src = &sourceState{series: make(map[seriesKey]struct{})}
+		t.sources[sourceKey{tenant, source}] = src
+	}
+	src.lastSeen = now
+	for _, m := range metrics {
+		key := t.key(tenant, m.MType, m.ID)
+		t.series[key] = now
+		src.series[key] = struct{}{}
+	}
+}
+
+// evictOldestSource forgets the least recently seen source. It must be called
+// with t.mu held.
+func (t *Tracker) evictOldestSource() {
+	var (
+		oldest   sourceKey
+		lastSeen time.Time
+		found    bool
+	)
+	for key, src := range t.sources {
+		if !found || src.lastSeen.Before(lastSeen) {
+			oldest, lastSeen, found = key, src.lastSeen, true
+		}
+	}
+	delete(t.sources, oldest)
+}
+
+// Seed records series of the tenant without a known update time (e.g. restored
+// from a snapshot) as updated now, so they turn stale unless updated again.
+func (t *Tracker) Seed(tenant, mtype string, names []string) {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range names {
+		key := t.key(tenant, mtype, name)
+		if _, ok := t.series[key]; !ok {
+			t.series[key] = now
+		}
+	}
+}
+
+// Forget drops a series, e.g. after it was deleted from storage.
+func (t *Tracker) Forget(tenant, mtype, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := t.key(tenant, mtype, name)
+	delete(t.series, key)
+	for _, src := range t.sources {
+		delete(src.series, key)
+	}
+}
+
+// LastUpdate returns the last update time of a series.
+func (t *Tracker) LastUpdate(tenant, mtype, name string) (time.Time, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	at, ok := t.series[t.key(tenant, mtype, name)]
+	return at, ok
+}
+
+// Stale reports whether a series was last updated more than the window ago.
+func (t *Tracker) Stale(tenant, mtype, name string) bool {
+	at, ok := t.LastUpdate(tenant, mtype, name)
+	return ok && t.now().Sub(at) > t.window
+}
+
+// StaleSeries counts the stale series of the tenant.
+func (t *Tracker) StaleSeries(tenant string) int {
+	now := t.now()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := 0
+	for key, at := range t.series {
+		if key.tenant == tenant && now.Sub(at) > t.window {
+			n++
+		}
+	}
+	return n
+}
+
+// Sources lists the reporting sources of the tenant ordered by ID.
+func (t *Tracker) Sources(tenant string) []Source {
+	now := t.now()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	out := make([]Source, 0, len(t.sources))
+	for key, src := range t.sources {
+		if key.tenant != tenant {
+			continue
+		}
+		out = append(out, Source{
+			ID:       key.id,
+			LastSeen: src.lastSeen,
+			Series:   len(src.series),
+			Stale:    now.Sub(src.lastSeen) > t.window,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// StaleSources counts the stale sources of the tenant.
+func (t *Tracker) StaleSources(tenant string) int {
+	n := 0
+	for _, s := range t.Sources(tenant) {
+		if s.Stale {
+			n++
+		}
+	}
+	return n
+}
+
+// Self-metrics of the tracker. They are computed on read for one tenant rather
+// than stored, so they neither count against the series quota nor are
+// persisted. /metrics exposes them and alerting rules can read them (e.g.
+// "expr: StaleSources, threshold: 0" fires on absent agents); they shadow
+// stored series of the same name.
+const (
+	StaleSeriesMetric  = "StaleSeries"
+	StaleSourcesMetric = "StaleSources"
+)
+
+// SelfMetrics returns the self-metrics of the tenant by name.
+func (t *Tracker) SelfMetrics(tenant string) map[string]float64 {
+	return map[string]float64{
+		StaleSeriesMetric:  float64(t.StaleSeries(tenant)),
+		StaleSourcesMetric: float64(t.StaleSources(tenant)),
+	}
+}
+
+// selfMetric returns the named self-metric of the tenant, if name is one.
+func (t *Tracker) selfMetric(tenant, name string) (float64, bool) {
+	switch t.names.Key(name) {
+	case t.names.Key(StaleSeriesMetric):
+		return float64(t.StaleSeries(tenant)), true
+	case t.names.Key(StaleSourcesMetric):
+		return float64(t.StaleSources(tenant)), true
+	}
+	return 0, false
+}
+
+// MetricSource is read by alerting rules; *service.Service implements it.
+type MetricSource interface {
+	GetGauge(ctx context.Context, key string) (float64, error)
+	GetCounter(ctx context.Context, key string) (int, error)
+}
+
+// WithSelfMetrics returns src answering the self-metrics of the tenant as gauges.
+func (t *Tracker) WithSelfMetrics(tenant string, src MetricSource) MetricSource {
+	return selfSource{MetricSource: src, tracker: t, tenant: tenant}
+}
+
+type selfSource struct {
+	MetricSource
+	tracker *Tracker
+	tenant  string
+}
+
+// GetGauge returns the self-metric named key, else the gauge of the source.
+func (s selfSource) GetGauge(ctx context.Context, key string) (float64, error) {
+	if v, ok := s.tracker.selfMetric(s.tenant, key); ok {
+		return v, nil
+	}
+	return s.MetricSource.GetGauge(ctx, key)
+}
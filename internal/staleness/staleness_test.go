@@ -0,0 +1,149 @@
+package staleness
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metricsdto "gometrics/internal/api/metricsdto"
+	"gometrics/internal/auth"
+	"gometrics/internal/metricname"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	req.RemoteAddr = "10.0.0.7:1234"
+	assert.Equal(t, "10.0.0.7", SourceID(req))
+
+	req = req.WithContext(auth.WithToken(req.Context(), auth.Token{Name: "agent"}))
+	assert.Equal(t, "token:agent", SourceID(req))
+
+	req.Header.Set(AgentHeader, "host-1")
+	assert.Equal(t, "host-1", SourceID(req))
+}
+
+func TestTracker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tr := NewTracker(time.Minute)
+	tr.now = func() time.Time { return now }
+
+	gauge := func(id string) metricsdto.Metrics {
+		return metricsdto.Metrics{ID: id, MType: metricsdto.MetricTypeGauge}
+	}
+	tr.Touch("", "host-1", []metricsdto.Metrics{gauge("cpu"), gauge("mem")})
+	tr.Touch("", "host-2", []metricsdto.Metrics{gauge("cpu")})
+	tr.Touch("teama", "host-3", []metricsdto.Metrics{gauge("disk")})
+	tr.Seed("", metricsdto.MetricTypeCounter, []string{"restored"})
+	tr.Seed("", metricsdto.MetricTypeGauge, []string{"cpu"})
+
+	assert.False(t, tr.Stale("", metricsdto.MetricTypeGauge, "cpu"))
+	assert.False(t, tr.Stale("", metricsdto.MetricTypeGauge, "unknown"), "untracked series are not stale")
+
+	now = now.Add(30 * time.Second)
+	tr.Touch("", "host-2", []metricsdto.Metrics{gauge("cpu")})
+
+	now = now.Add(45 * time.Second)
+	assert.False(t, tr.Stale("", metricsdto.MetricTypeGauge, "cpu"))
+	assert.True(t, tr.Stale("", metricsdto.MetricTypeGauge, "mem"))
+	assert.True(t, tr.Stale("", metricsdto.MetricTypeCounter, "restored"))
+	assert.False(t, tr.Stale("", metricsdto.MetricTypeCounter, "cpu"), "types are tracked separately")
+	assert.Equal(t, 2, tr.StaleSeries(""))
+	assert.Equal(t, 1, tr.StaleSeries("teama"))
+
+	sources := tr.Sources("")
+	require.Len(t, sources, 2)
+	assert.Equal(t, Source{ID: "host-1", LastSeen: time.Unix(1000, 0), Series: 2, Stale: true}, sources[0])
+	assert.Equal(t, Source{ID: "host-2", LastSeen: time.Unix(1030, 0), Series: 1, Stale: false}, sources[1])
+	assert.Equal(t, 1, tr.StaleSources(""))
+
+	tr.Forget("", metricsdto.MetricTypeGauge, "mem")
+	assert.Equal(t, 1, tr.StaleSeries(""))
+	assert.Equal(t, 1, tr.Sources("")[0].Series)
+}
+
+func TestTracker_NamePolicy(t *testing.T) {
+	gauge := metricsdto.Metrics{ID: "CPU", MType: metricsdto.MetricTypeGauge}
+	for _, tt := range []struct {
+		policy metricname.Policy
+		name   string
+		want   bool
+	}{
+		{metricname.CaseInsensitive, "cpu", true},
+		{metricname.CaseSensitive, "cpu", false},
+		{metricname.CaseSensitive, "CPU", true},
+		{metricname.Prometheus, "CPU", true},
+	} {
+		t.Run(string(tt.policy)+"/"+tt.name, func(t *testing.T) {
+			tr := NewTracker(time.Minute)
+			tr.SetNamePolicy(tt.policy)
+			tr.Touch("", "host-1", []metricsdto.Metrics{gauge})
+			_, ok := tr.LastUpdate("", metricsdto.MetricTypeGauge, tt.name)
+			assert.Equal(t, tt.want, ok)
+		})
+	}
+
+	tr := NewTracker(time.Minute)
+	tr.Touch("", "host-1", []metricsdto.Metrics{gauge})
+	tr.Forget("", metricsdto.MetricTypeGauge, "cpu")
+	_, ok := tr.LastUpdate("", metricsdto.MetricTypeGauge, "CPU")
+	assert.False(t, ok, "Forget matches names by the policy")
+	assert.Zero(t, tr.Sources("")[0].Series)
+}
+
+func TestTracker_MaxSources(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tr := NewTracker(time.Minute)
+	tr.now = func() time.Time { return now }
+	tr.maxSources = 2
+
+	for _, id := range []string{"host-1", "host-2", "host-1", "host-3"} {
+		now = now.Add(time.Second)
+		tr.Touch("", id, nil)
+	}
+	sources := tr.Sources("")
+	require.Len(t, sources, 2)
+	assert.Equal(t, "host-1", sources[0].ID, "recently seen sources are kept")
+	assert.Equal(t, "host-3", sources[1].ID)
+}
+
+// gaugeSource is an alerting source with fixed gauges.
+type gaugeSource map[string]float64
+
+func (s gaugeSource) GetGauge(_ context.Context, key string) (float64, error) {
+	v, ok := s[key]
+	if !ok {
+		return 0, errors.New("not found")
+	}
+	return v, nil
+}
+
+func (s gaugeSource) GetCounter(context.Context, string) (int, error) {
+	return 0, errors.New("not found")
+}
+
+func TestTracker_SelfMetrics(t *testing.T) {
+	tr := NewTracker(time.Millisecond)
+	tr.Touch("", "host-1", []metricsdto.Metrics{{ID: "cpu", MType: metricsdto.MetricTypeGauge}})
+	tr.Touch("teama", "host-2", []metricsdto.Metrics{{ID: "cpu", MType: metricsdto.MetricTypeGauge}, {ID: "mem", MType: metricsdto.MetricTypeGauge}})
+	time.Sleep(5 * time.Millisecond)
+
+	assert.Equal(t, map[string]float64{StaleSeriesMetric: 1, StaleSourcesMetric: 1}, tr.SelfMetrics(""))
+	assert.Equal(t, map[string]float64{StaleSeriesMetric: 2, StaleSourcesMetric: 1}, tr.SelfMetrics("teama"))
+
+	src := tr.WithSelfMetrics("teama", gaugeSource{"cpu": 0.5, StaleSeriesMetric: 100})
+	ctx := context.Background()
+	v, err := src.GetGauge(ctx, "staleseries")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, v, "self-metrics are matched by the name policy and shadow stored series")
+	v, err = src.GetGauge(ctx, "cpu")
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, v)
+	_, err = src.GetCounter(ctx, StaleSourcesMetric)
+	assert.Error(t, err, "self-metrics are gauges")
+}
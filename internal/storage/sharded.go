@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"hash/maphash"
+
+	"gometrics/internal/metricname"
+)
+
+// DefaultShards is the number of shards used by NewShardedStorage for n < 1.
+const DefaultShards = 16
+
+// ShardedStorage spreads the series over N MemStorage shards by the hash of
+// the key of the name policy, so that writers of different series rarely
+// contend for the same lock. Single-series operations lock one shard; batches,
+// map copies, Len and ClearStorage lock every shard involved in index order,
+// so they observe and produce consistent snapshots like MemStorage does.
+// It is safe for concurrent use by multiple goroutines.
+type ShardedStorage struct {
+	seed   maphash.Seed
+	names  metricname.Policy
+	shards []*MemStorage
+}
+
+// Store is implemented by MemStorage and ShardedStorage.
+type Store interface {
+	GaugeInsert(key string, value float64) error
+	CounterInsert(key string, value int) error
+	GetGauge(key string) (float64, error)
+	GetCounter(key string) (int, error)
+	GetGaugeMap() map[string]float64
+	GetCounterMap() map[string]int
+	Len() int
+	DeleteGauge(key string) error
+	DeleteCounter(key string) error
+	Apply(updates []Update) error
+	ClearStorage() error
+}
+
+// New creates an empty storage that matches and stores keys according to
+// names: a MemStorage with one lock, or a ShardedStorage of shards shards if
+// shards > 0.
+func New(shards int, names metricname.Policy) Store {
+	if shards > 0 {
+		return NewShardedStorage(shards, names)
+	}
+	return NewMemStorageWithPolicy(names)
+}
+
+// NewShardedStorage creates an empty storage with n shards that matches and
+// stores keys according to names.
+func NewShardedStorage(n int, names metricname.Policy) *ShardedStorage {
+	if n < 1 {
+		n = DefaultShards
+	}
+	shards := make([]*MemStorage, n)
+	for i := range shards {
+		shards[i] = NewMemStorageWithPolicy(names)
+	}
+	return &ShardedStorage{seed: maphash.MakeSeed(), names: names, shards: shards}
+}
+
+// index returns the shard number of key.
+func (storage *ShardedStorage) index(key string) int {
+	if len(storage.shards) == 1 {
+		return 0
+	}
+	return int(maphash.String(storage.seed, storage.names.Key(key)) % uint64(len(storage.shards)))
+}
+
+// shard returns the shard holding key.
+func (storage *ShardedStorage) shard(key string) *MemStorage {
+	return storage.shards[storage.index(key)]
+}
+
+// GetGauge retrieves the value of a gauge metric by key, see MemStorage.GetGauge.
+func (storage *ShardedStorage) GetGauge(key string) (float64, error) {
+	return storage.shard(key).GetGauge(key)
+}
+
+// GetCounter retrieves the value of a counter metric by key, see MemStorage.GetCounter.
+func (storage *ShardedStorage) GetCounter(key string) (int, error) {
+	return storage.shard(key).GetCounter(key)
+}
+
+// GaugeInsert sets the value of a gauge metric, see MemStorage.GaugeInsert.
+func (storage *ShardedStorage) GaugeInsert(key string, value float64) error {
+	return storage.shard(key).GaugeInsert(key, value)
+}
+
+// CounterInsert adds value to a counter metric, see MemStorage.CounterInsert.
+func (storage *ShardedStorage) CounterInsert(key string, value int) error {
+	return storage.shard(key).CounterInsert(key, value)
+}
+
+// DeleteGauge removes a gauge metric, see MemStorage.DeleteGauge.
+func (storage *ShardedStorage) DeleteGauge(key string) error {
+	return storage.shard(key).DeleteGauge(key)
+}
+
+// DeleteCounter removes a counter metric, see MemStorage.DeleteCounter.
+func (storage *ShardedStorage) DeleteCounter(key string) error {
+	return storage.shard(key).DeleteCounter(key)
+}
+
+// GetGaugeMap returns a copy of all gauge metrics taken at a single point in time.
+func (storage *ShardedStorage) GetGaugeMap() map[string]float64 {
+	storage.rlockAll()
+	defer storage.runlockAll()
+	n := 0
+	for _, s := range storage.shards {
+		n += len(s.gauge)
+	}
+	copyMap := make(map[string]float64, n)
+	for _, s := range storage.shards {
+		s.copyGaugesLocked(copyMap)
+	}
+	return copyMap
+}
+
+// GetCounterMap returns a copy of all counter metrics taken at a single point in time.
+func (storage *ShardedStorage) GetCounterMap() map[string]int {
+	storage.rlockAll()
+	defer storage.runlockAll()
+	n := 0
+	for _, s := range storage.shards {
+		n += len(s.counter)
+	}
+	copyMap := make(map[string]int, n)
+	for _, s := range storage.shards {
+		s.copyCountersLocked(copyMap)
+	}
+	return copyMap
+}
+
+// Len returns the number of distinct series (gauges plus counters) in the storage.
+func (storage *ShardedStorage) Len() int {
+	storage.rlockAll()
+	defer storage.runlockAll()
+	n := 0
+	for _, s := range storage.shards {
+		n += len(s.gauge) + len(s.counter)
+	}
+	return n
+}
+
+// Apply applies a batch of updates atomically: the shards of all updates are
+// locked, in index order, before any update is applied, so readers observe
+// either none or all of them. Updates are applied in order.
+func (storage *ShardedStorage) Apply(updates []Update) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	idx := make([]int, len(updates))
+	used := make([]bool, len(storage.shards))
+	for i, u := range updates {
+		idx[i] = storage.index(u.Key)
+		used[idx[i]] = true
+	}
+	for i, s := range storage.shards {
+		if used[i] {
+			s.mu.Lock()
+		}
+	}
+	for i, u := range updates {
+		storage.shards[idx[i]].applyOneLocked(u)
+	}
+	for i, s := range storage.shards {
+		if used[i] {
+			s.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// ClearStorage removes all metrics from the storage.
+func (storage *ShardedStorage) ClearStorage() error {
+	for _, s := range storage.shards {
+		s.mu.Lock()
+	}
+	for _, s := range storage.shards {
+		s.clearLocked()
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// rlockAll read-locks every shard in index order.
+func (storage *ShardedStorage) rlockAll() {
+	for _, s := range storage.shards {
+		s.mu.RLock()
+	}
+}
+
+// runlockAll releases the locks taken by rlockAll.
+func (storage *ShardedStorage) runlockAll() {
+	for _, s := range storage.shards {
+		s.mu.RUnlock()
+	}
+}
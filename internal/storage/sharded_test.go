@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"gometrics/internal/metricname"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	assert.IsType(t, &MemStorage{}, New(0, metricname.CaseSensitive), "one lock unless sharding is configured")
+	sharded, ok := New(4, metricname.CaseSensitive).(*ShardedStorage)
+	require.True(t, ok)
+	assert.Len(t, sharded.shards, 4)
+}
+
+func TestShardedStorage_MatchesMemStorage(t *testing.T) {
+	stores := map[string]Store{
+		"mem":       NewMemStorage(),
+		"sharded-1": NewShardedStorage(1, metricname.CaseInsensitive),
+		"sharded-8": NewShardedStorage(8, metricname.CaseInsensitive),
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			for i := range 50 {
+				require.NoError(t, s.GaugeInsert(fmt.Sprintf("Gauge%d", i), float64(i)))
+				require.NoError(t, s.CounterInsert(fmt.Sprintf("counter%d", i), i))
+			}
+			require.NoError(t, s.CounterInsert("COUNTER1", 10))
+			require.NoError(t, s.Apply([]Update{
+				{Key: "gauge0", Value: 100},
+				{Key: "counter2", Counter: true, Delta: 5},
+				{Key: "new", Counter: true, Delta: 1},
+			}))
+
+			v, err := s.GetGauge("GAUGE0")
+			require.NoError(t, err)
+			assert.Equal(t, 100.0, v)
+			c, err := s.GetCounter("counter1")
+			require.NoError(t, err)
+			assert.Equal(t, 11, c)
+			assert.Equal(t, 101, s.Len())
+
+			gauges := s.GetGaugeMap()
+			assert.Len(t, gauges, 50)
+			assert.Equal(t, 100.0, gauges["gauge0"], "the key of the last write is kept")
+			counters := s.GetCounterMap()
+			assert.Equal(t, 11, counters["COUNTER1"])
+			assert.Equal(t, 7, counters["counter2"])
+
+			require.NoError(t, s.DeleteGauge("gauge1"))
+			assert.ErrorIs(t, s.DeleteGauge("gauge1"), ErrNotFound)
+			require.NoError(t, s.DeleteCounter("new"))
+			_, err = s.GetCounter("new")
+			assert.ErrorIs(t, err, ErrNotFound)
+			assert.Equal(t, 99, s.Len())
+
+			require.NoError(t, s.ClearStorage())
+			assert.Zero(t, s.Len())
+			assert.Empty(t, s.GetGaugeMap())
+		})
+	}
+}
+
+// TestShardedStorage_ConsistentSnapshots moves units between counters of
+// different shards in atomic batches; every snapshot must see a zero sum.
+func TestShardedStorage_ConsistentSnapshots(t *testing.T) {
+	s := NewShardedStorage(8, metricname.CaseInsensitive)
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("c%d", i)
+		require.NoError(t, s.CounterInsert(keys[i], 0))
+	}
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 2000 {
+				from, to := keys[(w+i)%len(keys)], keys[(w+i*7+1)%len(keys)]
+				s.Apply([]Update{{Key: from, Counter: true, Delta: -1}, {Key: to, Counter: true, Delta: 1}})
+			}
+		}()
+	}
+	for range 200 {
+		sum := 0
+		for _, v := range s.GetCounterMap() {
+			sum += v
+		}
+		require.Zero(t, sum)
+	}
+	wg.Wait()
+}
@@ -1,11 +1,13 @@
 // Package storage provides an in-memory storage implementation for metrics.
-// It supports concurrent access and case-insensitive keys.
+// It supports concurrent access; keys are matched according to a metricname.Policy
+// (case-insensitive by default).
 package storage
 
 import (
 	"errors"
-	"strings"
 	"sync"
+
+	"gometrics/internal/metricname"
 )
 
 // ErrNotFound is returned when a requested metric key does not exist.
@@ -15,16 +17,25 @@ var ErrNotFound = errors.New("resource was not found")
 // It is safe for concurrent use by multiple goroutines.
 type MemStorage struct {
 	mu      sync.RWMutex
+	names   metricname.Policy
 	gauge   map[string]float64
 	counter map[string]int
-	// Maps normalized (lowercase) keys to original keys for display purposes.
+	// Maps normalized keys to original keys for display purposes.
 	gaugeID map[string]string
 	countID map[string]string
 }
 
-// NewMemStorage creates and initializes a new empty MemStorage.
+// NewMemStorage creates and initializes a new empty MemStorage with
+// case-insensitive keys.
 func NewMemStorage() *MemStorage {
+	return NewMemStorageWithPolicy(metricname.CaseInsensitive)
+}
+
+// NewMemStorageWithPolicy creates an empty MemStorage that matches and stores
+// keys according to names.
+func NewMemStorageWithPolicy(names metricname.Policy) *MemStorage {
 	return &MemStorage{
+		names:   names,
 		gauge:   make(map[string]float64),
 		counter: make(map[string]int),
 		gaugeID: make(map[string]string),
@@ -33,10 +44,10 @@ func NewMemStorage() *MemStorage {
 }
 
 // GetGauge retrieves the value of a gauge metric by key.
-// The key lookup is case-insensitive.
+// The key is matched according to the name policy.
 // Returns the value and nil error if found, otherwise 0 and ErrNotFound.
 func (storage *MemStorage) GetGauge(key string) (float64, error) {
-	key = strings.ToLower(key)
+	key = storage.names.Key(key)
 	storage.mu.RLock()
 	defer storage.mu.RUnlock()
 	val, ok := storage.gauge[key]
@@ -47,10 +58,10 @@ func (storage *MemStorage) GetGauge(key string) (float64, error) {
 }
 
 // GetCounter retrieves the value of a counter metric by key.
-// The key lookup is case-insensitive.
+// The key is matched according to the name policy.
 // Returns the value and nil error if found, otherwise 0 and ErrNotFound.
 func (storage *MemStorage) GetCounter(key string) (int, error) {
-	key = strings.ToLower(key)
+	key = storage.names.Key(key)
 	storage.mu.RLock()
 	defer storage.mu.RUnlock()
 	val, ok := storage.counter[key]
@@ -62,26 +73,26 @@ func (storage *MemStorage) GetCounter(key string) (int, error) {
 
 // GaugeInsert sets the value of a gauge metric.
 // If the metric already exists, its value is overwritten.
-// The key is stored in a case-insensitive manner, but the original case is preserved for display.
+// The key is matched according to the name policy; the name of the latest write is kept for display.
 func (storage *MemStorage) GaugeInsert(key string, value float64) error {
-	normKey := strings.ToLower(key)
+	normKey := storage.names.Key(key)
 	storage.mu.Lock()
 	defer storage.mu.Unlock()
 	storage.gauge[normKey] = value
-	storage.gaugeID[normKey] = key
+	storage.gaugeID[normKey] = storage.names.Name(key)
 	return nil
 }
 
 // CounterInsert adds the provided value to an existing counter metric.
 // If the metric does not exist, it is initialized with the value.
-// The key is stored in a case-insensitive manner, but the original case is preserved for display.
+// The key is matched according to the name policy; the name of the latest write is kept for display.
 func (storage *MemStorage) CounterInsert(key string, value int) error {
-	normKey := strings.ToLower(key)
+	normKey := storage.names.Key(key)
 	storage.mu.Lock()
 	defer storage.mu.Unlock()
 
 	storage.counter[normKey] += value
-	storage.countID[normKey] = key
+	storage.countID[normKey] = storage.names.Name(key)
 	return nil
 }
 
@@ -91,14 +102,20 @@ func (storage *MemStorage) GetGaugeMap() map[string]float64 {
 	storage.mu.RLock()
 	defer storage.mu.RUnlock()
 	copyMap := make(map[string]float64, len(storage.gauge))
+	storage.copyGaugesLocked(copyMap)
+	return copyMap
+}
+
+// copyGaugesLocked copies the gauges into dst under their original keys.
+// It must be called with storage.mu held.
+func (storage *MemStorage) copyGaugesLocked(dst map[string]float64) {
 	for k, v := range storage.gauge {
 		orig := storage.gaugeID[k]
 		if orig == "" {
 			orig = k
 		}
-		copyMap[orig] = v
+		dst[orig] = v
 	}
-	return copyMap
 }
 
 // GetCounterMap returns a copy of all counter metrics.
@@ -107,23 +124,109 @@ func (storage *MemStorage) GetCounterMap() map[string]int {
 	storage.mu.RLock()
 	defer storage.mu.RUnlock()
 	copyMap := make(map[string]int, len(storage.counter))
+	storage.copyCountersLocked(copyMap)
+	return copyMap
+}
+
+// copyCountersLocked copies the counters into dst under their original keys.
+// It must be called with storage.mu held.
+func (storage *MemStorage) copyCountersLocked(dst map[string]int) {
 	for k, v := range storage.counter {
 		orig := storage.countID[k]
 		if orig == "" {
 			orig = k
 		}
-		copyMap[orig] = v
+		dst[orig] = v
+	}
+}
+
+// Len returns the number of distinct series (gauges plus counters) in the storage.
+func (storage *MemStorage) Len() int {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return len(storage.gauge) + len(storage.counter)
+}
+
+// DeleteGauge removes a gauge metric. The key is matched according to the name policy.
+// Returns ErrNotFound if the metric does not exist.
+func (storage *MemStorage) DeleteGauge(key string) error {
+	key = storage.names.Key(key)
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if _, ok := storage.gauge[key]; !ok {
+		return ErrNotFound
+	}
+	delete(storage.gauge, key)
+	delete(storage.gaugeID, key)
+	return nil
+}
+
+// DeleteCounter removes a counter metric. The key is matched according to the name policy.
+// Returns ErrNotFound if the metric does not exist.
+func (storage *MemStorage) DeleteCounter(key string) error {
+	key = storage.names.Key(key)
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if _, ok := storage.counter[key]; !ok {
+		return ErrNotFound
+	}
+	delete(storage.counter, key)
+	delete(storage.countID, key)
+	return nil
+}
+
+// Update is one entry of a batch applied by Apply.
+type Update struct {
+	Key     string
+	Counter bool    // true for a counter increment, false for a gauge value
+	Value   float64 // new gauge value
+	Delta   int     // counter increment
+	Reset   bool    // set the counter to Delta instead of adding it
+}
+
+// Apply applies a batch of updates under a single lock, so readers observe
+// either none or all of them. Updates are applied in order.
+func (storage *MemStorage) Apply(updates []Update) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.applyLocked(updates)
+	return nil
+}
+
+// applyLocked applies updates in order. It must be called with storage.mu held.
+func (storage *MemStorage) applyLocked(updates []Update) {
+	for _, u := range updates {
+		storage.applyOneLocked(u)
+	}
+}
+
+// applyOneLocked applies one update. It must be called with storage.mu held.
+func (storage *MemStorage) applyOneLocked(u Update) {
+	normKey := storage.names.Key(u.Key)
+	if u.Counter {
+		if u.Reset {
+			storage.counter[normKey] = 0
+		}
+		storage.counter[normKey] += u.Delta
+		storage.countID[normKey] = storage.names.Name(u.Key)
+	} else {
+		storage.gauge[normKey] = u.Value
+		storage.gaugeID[normKey] = storage.names.Name(u.Key)
 	}
-	return copyMap
 }
 
 // ClearStorage removes all metrics from the storage, resetting it to an empty state.
 func (storage *MemStorage) ClearStorage() error {
 	storage.mu.Lock()
 	defer storage.mu.Unlock()
+	storage.clearLocked()
+	return nil
+}
+
+// clearLocked drops all metrics. It must be called with storage.mu held.
+func (storage *MemStorage) clearLocked() {
 	storage.gauge = make(map[string]float64)
 	storage.counter = make(map[string]int)
 	storage.gaugeID = make(map[string]string)
 	storage.countID = make(map[string]string)
-	return nil
 }
@@ -6,6 +6,8 @@ import (
 	"strings"
 	"testing"
 
+	"gometrics/internal/metricname"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -124,6 +126,27 @@ func TestMemStorage_GetMap_CasePreservation(t *testing.T) {
 	assert.Equal(t, 10, valC)
 }
 
+func TestMemStorage_NamePolicy(t *testing.T) {
+	t.Run("case-sensitive", func(t *testing.T) {
+		ms := NewMemStorageWithPolicy(metricname.CaseSensitive)
+		_ = ms.GaugeInsert("Alloc", 1)
+		_ = ms.GaugeInsert("alloc", 2)
+		assert.Equal(t, map[string]float64{"Alloc": 1, "alloc": 2}, ms.GetGaugeMap())
+		_, err := ms.GetGauge("ALLOC")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("prometheus", func(t *testing.T) {
+		ms := NewMemStorageWithPolicy(metricname.Prometheus)
+		_ = ms.CounterInsert("http.requests", 1)
+		_ = ms.CounterInsert("http_requests", 2)
+		assert.Equal(t, map[string]int{"http_requests": 3}, ms.GetCounterMap())
+		v, err := ms.GetCounter("http-requests")
+		require.NoError(t, err)
+		assert.Equal(t, 3, v)
+	})
+}
+
 func TestMemStorage_ClearStorage(t *testing.T) {
 	ms := NewMemStorage()
 	_ = ms.GaugeInsert("g1", 1.0)
@@ -136,6 +159,41 @@ func TestMemStorage_ClearStorage(t *testing.T) {
 	assert.Empty(t, ms.GetCounterMap())
 }
 
+func TestMemStorage_Delete(t *testing.T) {
+	ms := NewMemStorage()
+	_ = ms.GaugeInsert("Load", 1.0)
+	_ = ms.CounterInsert("load", 1)
+
+	require.NoError(t, ms.DeleteGauge("LOAD"))
+	assert.Empty(t, ms.GetGaugeMap())
+	assert.Equal(t, map[string]int{"load": 1}, ms.GetCounterMap(), "counter with the same name is kept")
+	assert.ErrorIs(t, ms.DeleteGauge("load"), ErrNotFound)
+
+	require.NoError(t, ms.DeleteCounter("load"))
+	assert.Equal(t, 0, ms.Len())
+	assert.ErrorIs(t, ms.DeleteCounter("load"), ErrNotFound)
+}
+
+func TestMemStorage_Apply(t *testing.T) {
+	ms := NewMemStorage()
+	_ = ms.CounterInsert("hits", 1)
+
+	require.NoError(t, ms.Apply([]Update{
+		{Key: "Temp", Value: 1.5},
+		{Key: "hits", Counter: true, Delta: 2},
+		{Key: "temp", Value: 2.5},
+		{Key: "HITS", Counter: true, Delta: 3},
+	}))
+	assert.Equal(t, map[string]float64{"temp": 2.5}, ms.GetGaugeMap(), "later gauge value wins")
+	assert.Equal(t, map[string]int{"HITS": 6}, ms.GetCounterMap(), "increments add up")
+
+	require.NoError(t, ms.Apply([]Update{
+		{Key: "hits", Counter: true, Delta: 40, Reset: true},
+		{Key: "hits", Counter: true, Delta: 2},
+	}))
+	assert.Equal(t, map[string]int{"hits": 42}, ms.GetCounterMap(), "reset sets the total")
+}
+
 func TestMemStorage_ErrNotFound(t *testing.T) {
 	ms := NewMemStorage()
 
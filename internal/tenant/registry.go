@@ -0,0 +1,237 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+	"gometrics/internal/service"
+)
+
+// Limits bounds the resources consumed by tenants.
+type Limits struct {
+	MaxTenants int            // maximum number of non-default tenants, 0 = unlimited
+	MaxSeries  int            // default series limit per tenant, 0 = unlimited
+	Series     map[string]int // per-tenant overrides of MaxSeries
+}
+
+// SeriesFor returns the series limit of the tenant.
+func (l Limits) SeriesFor(name string) int {
+	if n, ok := l.Series[name]; ok {
+		return n
+	}
+	return l.MaxSeries
+}
+
+// Factory creates the service backing a new tenant, including its persistent storage.
+type Factory func(ctx context.Context, name string) (*service.Service, error)
+
+// Registry lazily creates and caches one service per tenant.
+// It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	ctx      context.Context // lifetime of the created tenants
+	factory  Factory
+	limits   Limits
+	services map[string]*service.Service
+	creating map[string]*creation // tenants being created, by name
+}
+
+// creation is a tenant being created. done is closed once svc or err is set.
+type creation struct {
+	done chan struct{}
+	svc  *service.Service
+	err  error
+}
+
+// NewRegistry creates a registry whose default tenant is served by base.
+// A nil factory disables non-default tenants.
+func NewRegistry(base *service.Service, factory Factory, limits Limits) *Registry {
+	base.SetMaxSeries(limits.SeriesFor(Default))
+	return &Registry{
+		ctx:      context.Background(),
+		factory:  factory,
+		limits:   limits,
+		services: map[string]*service.Service{Default: base},
+		creating: make(map[string]*creation),
+	}
+}
+
+// SetContext sets the context tenants are created with, e.g. the one
+// cancelled on server shutdown. It must be set before the registry is used.
+func (r *Registry) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// Default returns the service of the default tenant.
+func (r *Registry) Default() *service.Service {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.services[Default]
+}
+
+// Get returns the service of the tenant, creating it on first use.
+// Tenants are created outside the registry lock, once per name however many
+// requests ask for it, and with the context of the registry rather than ctx:
+// a cancelled request stops waiting but does not abort the creation.
+func (r *Registry) Get(ctx context.Context, name string) (*service.Service, error) {
+	name, err := Normalize(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	if svc, ok := r.services[name]; ok {
+		r.mu.Unlock()
+		return svc, nil
+	}
+	c, ok := r.creating[name]
+	if !ok {
+		if err := r.admit(); err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		c = &creation{done: make(chan struct{})}
+		r.creating[name] = c
+		go r.create(name, c)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.svc, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// admit returns an error if no more tenants may be created. The tenants being
+// created count against MaxTenants; the default tenant does not.
+// It must be called with r.mu held.
+func (r *Registry) admit() error {
+	if r.factory == nil {
+		return fmt.Errorf("%w: multi-tenancy is disabled", ErrTooManyTenants)
+	}
+	if r.limits.MaxTenants > 0 && len(r.services)-1+len(r.creating) >= r.limits.MaxTenants {
+		return ErrTooManyTenants
+	}
+	return nil
+}
+
+// create runs the factory of a tenant and publishes the result to the waiters of c.
+// A failed creation is not cached: the next Get tries again.
+func (r *Registry) create(name string, c *creation) {
+	defer close(c.done)
+	svc, err := r.factory(r.ctx, name)
+	if err != nil {
+		c.err = fmt.Errorf("create tenant %s: %w", name, err)
+	} else {
+		svc.SetMaxSeries(r.limits.SeriesFor(name))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.creating, name)
+	if err != nil {
+		return
+	}
+	if existing, ok := r.services[name]; ok {
+		svc = existing
+	} else {
+		r.services[name] = svc
+	}
+	c.svc = svc
+}
+
+// snapshot returns the services known at call time.
+func (r *Registry) snapshot() map[string]*service.Service {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]*service.Service, len(r.services))
+	for name, svc := range r.services {
+		out[name] = svc
+	}
+	return out
+}
+
+// Flush persists the metrics of every tenant.
+func (r *Registry) Flush(ctx context.Context) error {
+	var errs []error
+	for name, svc := range r.snapshot() {
+		if err := svc.PersistFlush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the persistent storage of every tenant.
+func (r *Registry) Close() error {
+	var errs []error
+	for name, svc := range r.snapshot() {
+		if err := svc.StorageCloser(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoopFlush flushes every tenant each interval until ctx is cancelled.
+// Flush errors are logged and do not stop the loop: the next tick retries.
+// It returns ctx.Err() on cancellation.
+func (r *Registry) LoopFlush(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := r.Flush(ctx); err != nil {
+				log.Printf("ERROR: flush tenants: %v", err)
+			}
+		}
+	}
+}
+
+// EvictFunc is notified of the series evicted from a tenant.
+type EvictFunc func(tenant string, evicted []metricsdto.Metrics)
+
+// Evict removes the series of every tenant that expired before now.
+// onEvict, if not nil, is called for each tenant that lost series.
+func (r *Registry) Evict(ctx context.Context, now time.Time, onEvict EvictFunc) error {
+	var errs []error
+	for name, svc := range r.snapshot() {
+		evicted, err := svc.EvictExpired(ctx, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", name, err))
+		}
+		if len(evicted) > 0 && onEvict != nil {
+			onEvict(name, evicted)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoopEvict evicts expired series of every tenant each interval until ctx is cancelled.
+// Eviction errors are logged and do not stop the loop.
+func (r *Registry) LoopEvict(ctx context.Context, interval time.Duration, onEvict EvictFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := r.Evict(ctx, now, onEvict); err != nil {
+				log.Printf("WARN: evict expired series: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Package tenant isolates the metrics of teams sharing one server.
+// Each tenant is served by its own service.Service with a separate in-memory
+// storage partition, persistent storage and series limit.
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gometrics/internal/auth"
+	"gometrics/internal/problem"
+)
+
+// Header is the request header selecting the tenant when no token binds one.
+const Header = "X-Tenant-ID"
+
+// Default is the name of the tenant used when a request does not select one.
+const Default = ""
+
+var (
+	// ErrInvalidName is returned for tenant names that are not [a-z0-9_]{1,32}.
+	ErrInvalidName = errors.New("invalid tenant name")
+	// ErrTooManyTenants is returned when creating a tenant would exceed Limits.MaxTenants.
+	ErrTooManyTenants = errors.New("tenant quota exceeded")
+)
+
+// namePattern restricts tenant names so they are safe as directory and schema names.
+var namePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// Normalize lowercases and validates a tenant name. The empty name is the default tenant.
+func Normalize(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == Default {
+		return Default, nil
+	}
+	if !namePattern.MatchString(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return name, nil
+}
+
+type ctxKey struct{}
+
+// WithTenant returns a copy of ctx carrying the tenant name.
+func WithTenant(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, name)
+}
+
+// FromContext returns the tenant of the request, or Default.
+func FromContext(ctx context.Context) string {
+	name, _ := ctx.Value(ctxKey{}).(string)
+	return name
+}
+
+// Middleware resolves the tenant of a request and stores it in the context.
+//
+// A token bound to a tenant always wins; a conflicting header is rejected with 403.
+// Without a bound token the X-Tenant-ID header selects the tenant, except for
+// authenticated non-admin tokens, which are confined to the default tenant.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header, err := Normalize(r.Header.Get(Header))
+		if err != nil {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidTenant, err.Error())
+			return
+		}
+
+		name := header
+		if tok, ok := auth.FromContext(r.Context()); ok {
+			bound, err := Normalize(tok.Tenant)
+			if err != nil {
+				problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "token is bound to an invalid tenant")
+				return
+			}
+			switch {
+			case bound != Default && header != Default && header != bound:
+				problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "token is not valid for tenant "+header)
+				return
+			case bound != Default:
+				name = bound
+			case header != Default && !tok.HasScope(auth.ScopeAdmin):
+				problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "only admin tokens may select a tenant")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), name)))
+	})
+}
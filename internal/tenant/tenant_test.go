@@ -0,0 +1,275 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gometrics/internal/api/metricsdto"
+	"gometrics/internal/auth"
+	"gometrics/internal/service"
+	"gometrics/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubPersistStorage struct{}
+
+func (s *stubPersistStorage) FormattingLogs(context.Context, map[string]float64, map[string]int) error {
+	return nil
+}
+func (s *stubPersistStorage) ImportLogs(context.Context) ([]metricsdto.Metrics, error) {
+	return nil, nil
+}
+func (s *stubPersistStorage) GetLoopTime() int           { return 0 }
+func (s *stubPersistStorage) Close() error               { return nil }
+func (s *stubPersistStorage) Flush() error               { return nil }
+func (s *stubPersistStorage) Ping(context.Context) error { return nil }
+
+func newTestService() *service.Service {
+	return service.NewService(storage.NewMemStorage(), &stubPersistStorage{})
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: Default},
+		{in: " TeamA ", want: "teama"},
+		{in: "team_1", want: "team_1"},
+		{in: "team-a", wantErr: true},
+		{in: "../etc", wantErr: true},
+		{in: "a234567890123456789012345678901234", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Normalize(tt.in)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidName)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		token      *auth.Token
+		wantCode   int
+		wantTenant string
+	}{
+		{name: "no header", wantCode: http.StatusOK, wantTenant: Default},
+		{name: "header", header: "TeamA", wantCode: http.StatusOK, wantTenant: "teama"},
+		{name: "invalid header", header: "team a", wantCode: http.StatusBadRequest},
+		{name: "bound token", token: &auth.Token{Tenant: "teamb"}, wantCode: http.StatusOK, wantTenant: "teamb"},
+		{name: "bound token, same header", header: "teamb", token: &auth.Token{Tenant: "teamb"}, wantCode: http.StatusOK, wantTenant: "teamb"},
+		{name: "bound token, other header", header: "teama", token: &auth.Token{Tenant: "teamb"}, wantCode: http.StatusForbidden},
+		{name: "unbound token, header", header: "teama", token: &auth.Token{Scopes: []auth.Scope{auth.ScopeWrite}}, wantCode: http.StatusForbidden},
+		{name: "admin token, header", header: "teama", token: &auth.Token{Scopes: []auth.Scope{auth.ScopeAdmin}}, wantCode: http.StatusOK, wantTenant: "teama"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = FromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(Header, tt.header)
+			}
+			if tt.token != nil {
+				req = req.WithContext(auth.WithToken(req.Context(), *tt.token))
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantCode, rec.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.wantTenant, got)
+			}
+		})
+	}
+}
+
+func TestRegistry_Get(t *testing.T) {
+	ctx := context.Background()
+	base := newTestService()
+	created := 0
+	r := NewRegistry(base, func(context.Context, string) (*service.Service, error) {
+		created++
+		return newTestService(), nil
+	}, Limits{MaxTenants: 2, MaxSeries: 1, Series: map[string]int{"big": 2}})
+
+	def, err := r.Get(ctx, Default)
+	require.NoError(t, err)
+	assert.Same(t, base, def)
+
+	a, err := r.Get(ctx, "a")
+	require.NoError(t, err)
+	again, err := r.Get(ctx, "A")
+	require.NoError(t, err)
+	assert.Same(t, a, again)
+	assert.Equal(t, 1, created)
+
+	// Tenants do not share metrics.
+	require.NoError(t, a.GaugeInsert(ctx, "cpu", 1))
+	_, err = def.GetGauge(ctx, "cpu")
+	assert.Error(t, err)
+
+	// Series limits: default for "a", override for "big".
+	assert.ErrorIs(t, a.GaugeInsert(ctx, "mem", 1), service.ErrSeriesLimit)
+	assert.NoError(t, a.GaugeInsert(ctx, "cpu", 2), "updating an existing series is allowed")
+	big, err := r.Get(ctx, "big")
+	require.NoError(t, err)
+	require.NoError(t, big.GaugeInsert(ctx, "cpu", 1))
+	require.NoError(t, big.CounterInsert(ctx, "hits", 1))
+	assert.ErrorIs(t, big.CounterInsert(ctx, "misses", 1), service.ErrSeriesLimit)
+
+	// MaxTenants does not count the default tenant.
+	_, err = r.Get(ctx, "c")
+	assert.ErrorIs(t, err, ErrTooManyTenants)
+
+	_, err = r.Get(ctx, "bad name")
+	assert.ErrorIs(t, err, ErrInvalidName)
+
+	require.NoError(t, r.Flush(ctx))
+	require.NoError(t, r.Close())
+}
+
+func TestRegistry_Evict(t *testing.T) {
+	ctx := context.Background()
+	r := NewRegistry(newTestService(), func(context.Context, string) (*service.Service, error) {
+		svc := newTestService()
+		svc.SetTTLPolicy(service.TTLPolicy{Default: time.Minute})
+		return svc, nil
+	}, Limits{})
+
+	a, err := r.Get(ctx, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.GaugeInsert(ctx, "cpu", 1))
+	require.NoError(t, r.Default().GaugeInsert(ctx, "cpu", 1))
+
+	got := map[string][]metricsdto.Metrics{}
+	require.NoError(t, r.Evict(ctx, time.Now().Add(time.Hour), func(name string, evicted []metricsdto.Metrics) {
+		got[name] = evicted
+	}))
+	assert.Equal(t, map[string][]metricsdto.Metrics{
+		"a": {{ID: "cpu", MType: metricsdto.MetricTypeGauge}},
+	}, got, "only the tenant with a TTL policy loses series")
+
+	_, err = a.GetGauge(ctx, "cpu")
+	assert.Error(t, err)
+	_, err = r.Default().GetGauge(ctx, "cpu")
+	assert.NoError(t, err)
+}
+
+func TestRegistry_Disabled(t *testing.T) {
+	r := NewRegistry(newTestService(), nil, Limits{})
+
+	_, err := r.Get(context.Background(), Default)
+	require.NoError(t, err)
+	_, err = r.Get(context.Background(), "teama")
+	assert.ErrorIs(t, err, ErrTooManyTenants)
+}
+
+func TestRegistry_FactoryError(t *testing.T) {
+	boom := errors.New("boom")
+	r := NewRegistry(newTestService(), func(context.Context, string) (*service.Service, error) {
+		return nil, boom
+	}, Limits{})
+
+	_, err := r.Get(context.Background(), "teama")
+	assert.ErrorIs(t, err, boom)
+}
+
+func TestRegistry_ConcurrentCreation(t *testing.T) {
+	type ctxKey struct{}
+	serverCtx := context.WithValue(context.Background(), ctxKey{}, "server")
+	var created atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	r := NewRegistry(newTestService(), func(ctx context.Context, name string) (*service.Service, error) {
+		assert.Equal(t, "server", ctx.Value(ctxKey{}), "tenants are created with the registry context")
+		created.Add(1)
+		if name == "slow" {
+			close(started)
+			<-release
+		}
+		return newTestService(), nil
+	}, Limits{MaxTenants: 2})
+	r.SetContext(serverCtx)
+
+	// A request giving up does not abort the creation.
+	reqCtx, cancel := context.WithCancel(context.Background())
+	failed := make(chan error)
+	go func() {
+		_, err := r.Get(reqCtx, "slow")
+		failed <- err
+	}()
+	<-started
+	cancel()
+	assert.ErrorIs(t, <-failed, context.Canceled)
+
+	// The registry is not locked while a tenant is created.
+	_, err := r.Get(context.Background(), Default)
+	require.NoError(t, err)
+	fast, err := r.Get(context.Background(), "fast")
+	require.NoError(t, err)
+	// The tenant being created counts against MaxTenants.
+	_, err = r.Get(context.Background(), "third")
+	assert.ErrorIs(t, err, ErrTooManyTenants)
+
+	var wg sync.WaitGroup
+	got := make([]*service.Service, 3)
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i], _ = r.Get(context.Background(), "slow")
+		}()
+	}
+	close(release)
+	wg.Wait()
+	require.NotNil(t, got[0])
+	assert.Same(t, got[0], got[1])
+	assert.Same(t, got[0], got[2])
+	assert.NotSame(t, fast, got[0])
+	assert.EqualValues(t, 2, created.Load(), "each tenant is created once")
+}
+
+// failingFlushStorage fails every flush and counts the attempts.
+type failingFlushStorage struct {
+	stubPersistStorage
+	flushes atomic.Int32
+}
+
+func (s *failingFlushStorage) Ping(context.Context) error { return errors.New("storage is down") }
+func (s *failingFlushStorage) Flush() error {
+	s.flushes.Add(1)
+	return errors.New("storage is down")
+}
+
+func TestRegistry_LoopFlushKeepsTicking(t *testing.T) {
+	pstore := &failingFlushStorage{}
+	r := NewRegistry(service.NewService(storage.NewMemStorage(), pstore), nil, Limits{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.LoopFlush(ctx, 5*time.Millisecond) }()
+	assert.Eventually(t, func() bool { return pstore.flushes.Load() >= 3 }, time.Second, 5*time.Millisecond,
+		"a failed flush is retried on the next tick")
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}